@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProvenanceAnnotation is the annotation pointing to where the provenance of
+// an image is published, e.g. its Rekor entry or bundle URL.
+const ProvenanceAnnotation = "org.opencontainers.image.provenance"
+
+// ProvenanceReferenceType is the artifact type of the referrers pushed by
+// annotate, which carry ProvenanceAnnotation for their subject image.
+const ProvenanceReferenceType = "application/vnd.slsa-framework.provenance-reference.v1+json"
+
+// emptyDescriptor references the OCI empty JSON blob, "{}", which is the
+// config and only layer of a referrer without content of its own.
+var emptyDescriptor = Descriptor{
+	MediaType: "application/vnd.oci.empty.v1+json",
+	Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+	Size:      2,
+}
+
+// artifactManifest is an OCI image manifest of an artifact other than an
+// image. The Subject of a referrer is the manifest it refers to.
+type artifactManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// referrerDescriptor is an entry of a referrers index.
+type referrerDescriptor struct {
+	Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrersIndex is the index a registry without the referrers API lists
+// the referrers of a manifest in, tagged with the manifest's digest.
+type referrersIndex struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []referrerDescriptor `json:"manifests"`
+}
+
+// annotateImage pushes a referrer of image, a repo@sha256:digest reference,
+// annotated with the provenance URL. Manifests can't be annotated in place
+// without changing the digest the provenance attests, so the annotation is
+// discovered through the referrers API, or the referrers tag of registries
+// without it.
+func annotateImage(c *registryClient, image, provenanceURL string, created time.Time) (string, error) {
+	annotations := map[string]string{
+		ProvenanceAnnotation:               provenanceURL,
+		"org.opencontainers.image.created": created.UTC().Format(time.RFC3339),
+	}
+	return pushReferrer(c, image, ProvenanceReferenceType, emptyDescriptor, []byte("{}"), annotations)
+}
+
+// pushReferrer pushes a referrer of image, a repo@sha256:digest reference, of
+// the given artifact type and annotations, whose only layer is content,
+// described by layer. It returns the referrer as a repo@digest reference.
+func pushReferrer(c *registryClient, image, artifactType string, layer Descriptor, content []byte, annotations map[string]string) (string, error) {
+	i := strings.LastIndex(image, "@")
+	if i < 0 || !strings.HasPrefix(image[i+1:], "sha256:") {
+		return "", fmt.Errorf("image %q is not of the form <repository>@sha256:<digest>", image)
+	}
+	repo, digest := image[:i], image[i+1:]
+	mediaType, body, err := c.manifest(repo, digest)
+	if err != nil {
+		return "", err
+	}
+	if err := c.pushBlob(repo, emptyDescriptor.Digest, []byte("{}")); err != nil {
+		return "", err
+	}
+	if layer.Digest != emptyDescriptor.Digest {
+		if err := c.pushBlob(repo, layer.Digest, content); err != nil {
+			return "", err
+		}
+	}
+	referrer, err := json.Marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        emptyDescriptor,
+		Layers:        []Descriptor{layer},
+		Subject:       &Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))},
+		Annotations:   annotations,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(referrer)
+	referrerDigest := "sha256:" + hex.EncodeToString(sum[:])
+	header, err := c.putManifest(repo, referrerDigest, MediaTypeOCIManifest, referrer)
+	if err != nil {
+		return "", err
+	}
+	if header.Get("OCI-Subject") == "" {
+		desc := referrerDescriptor{
+			Descriptor:   Descriptor{MediaType: MediaTypeOCIManifest, Digest: referrerDigest, Size: int64(len(referrer)), Annotations: annotations},
+			ArtifactType: artifactType,
+		}
+		if err := addToReferrersTag(c, repo, digest, desc); err != nil {
+			return "", err
+		}
+	}
+	return repo + "@" + referrerDigest, nil
+}
+
+// addToReferrersTag adds desc to the referrers index of the manifest with
+// the given digest, tagged sha256-<hex> as the OCI distribution spec
+// prescribes for registries without the referrers API.
+func addToReferrersTag(c *registryClient, repo, digest string, desc referrerDescriptor) error {
+	tag := strings.Replace(digest, ":", "-", 1)
+	index := referrersIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	_, body, err := c.manifest(repo, tag)
+	if err == nil {
+		if err := json.Unmarshal(body, &index); err != nil {
+			return fmt.Errorf("parsing the referrers index %s:%s: %w", repo, tag, err)
+		}
+	} else if !errors.Is(err, errManifestUnknown) {
+		return err
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+	body, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	_, err = c.putManifest(repo, tag, MediaTypeOCIIndex, body)
+	return err
+}
+
+// annotateImages annotates images as annotateImage does, up to concurrency
+// at a time. Images that fail are retried, after a backoff, up to retries
+// more times. It returns the referrer of each image annotated and the last
+// error of each image that wasn't.
+func annotateImages(c *registryClient, images []string, provenanceURL string, created time.Time, concurrency, retries int) (map[string]string, map[string]error) {
+	return forEachImage(images, concurrency, retries, func(image string) (string, error) {
+		return annotateImage(c, image, provenanceURL, created)
+	})
+}
+
+// forEachImage calls push for each of images, up to concurrency at a time,
+// retrying images that fail as annotateImages does. It returns what push
+// returned for each image that succeeded and the last error of each image
+// that didn't.
+func forEachImage(images []string, concurrency, retries int, push func(image string) (string, error)) (map[string]string, map[string]error) {
+	referrers, failed := map[string]string{}, map[string]error{}
+	var mu sync.Mutex
+	pending := images
+	for attempt := 0; attempt <= retries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+		queue := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for image := range queue {
+					referrer, err := push(image)
+					mu.Lock()
+					if err != nil {
+						failed[image] = err
+					} else {
+						delete(failed, image)
+						referrers[image] = referrer
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, image := range pending {
+			queue <- image
+		}
+		close(queue)
+		wg.Wait()
+		pending = nil
+		for _, image := range images {
+			if failed[image] != nil {
+				pending = append(pending, image)
+			}
+		}
+	}
+	return referrers, failed
+}
+
+// annotateMain implements `annotate --image <repo@digest> --provenance_url
+// <url>`, making the published provenance of images discoverable from the
+// registry.
+func annotateMain(args []string) {
+	flags := flag.NewFlagSet("annotate", flag.ExitOnError)
+	images := flags.String("image", "", "Comma-separated images to annotate, as <repository>@sha256:<digest>.")
+	provenanceURL := flags.String("provenance_url", "", "Where the provenance of the images is published, e.g. its Rekor entry or bundle URL.")
+	concurrency := flags.Int("concurrency", 4, "How many images to annotate at a time.")
+	rateLimit := flags.Float64("rate_limit", 10, "The most registry requests to send per second, across all images (0: no limit).")
+	retries := flags.Int("retries", 2, "How many more times to try annotating images that failed, with exponential backoff.")
+	addOfflineFlag(flags)
+	cloudAuth := addCloudAuthFlags(flags)
+	flags.Parse(args)
+	if err := requireOnline("annotate"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *images == "" || *provenanceURL == "" {
+		fmt.Println("Both --image and --provenance_url are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if u, err := url.Parse(*provenanceURL); err != nil || !u.IsAbs() {
+		fmt.Printf("Invalid value for flag --provenance_url: %q\n", *provenanceURL)
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		fmt.Printf("Invalid value for flag --concurrency: %d\n", *concurrency)
+		os.Exit(1)
+	}
+	if *retries < 0 {
+		fmt.Printf("Invalid value for flag --retries: %d\n", *retries)
+		os.Exit(1)
+	}
+	c := newRegistryClient()
+	c.limiter = newRateLimiter(*rateLimit)
+	var list []string
+	for _, image := range parseList(*images) {
+		if !stringSet(list...)[image] {
+			list = append(list, image)
+		}
+	}
+	referrers, failed := annotateImages(c, list, *provenanceURL, time.Now(), *concurrency, *retries)
+	for _, image := range list {
+		if err := failed[image]; err != nil {
+			fmt.Printf("Failed to annotate %s: %s\n", image, err)
+		} else {
+			fmt.Printf("Annotated %s: %s\n", image, referrers[image])
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Printf("Failed to annotate %d of %d images\n", len(failed), len(list))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnnotationFinishedOn is the annotation recording when the build finished
+// a subject, which in builds of many stages can be long before the
+// buildFinishedOn of the whole build.
+const AnnotationFinishedOn = "buildFinishedOn"
+
+// SubjectAnnotationRule annotates the subjects whose names match Match, a
+// regular expression that must match the whole name, with Annotations.
+type SubjectAnnotationRule struct {
+	Match       string            `json:"match"`
+	Annotations map[string]string `json:"annotations"`
+
+	pattern *regexp.Regexp
+}
+
+// readSubjectAnnotationRules reads the JSON list of SubjectAnnotationRules
+// at path.
+func readSubjectAnnotationRules(path string) ([]SubjectAnnotationRule, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []SubjectAnnotationRule
+	if err := json.Unmarshal(contents, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range rules {
+		if rules[i].Match == "" || len(rules[i].Annotations) == 0 {
+			return nil, fmt.Errorf("rule %d of %s needs both match and annotations", i, path)
+		}
+		for key := range rules[i].Annotations {
+			if key == "" {
+				return nil, fmt.Errorf("rule %d of %s has an empty annotation key", i, path)
+			}
+		}
+		if rules[i].pattern, err = regexp.Compile("^(?:" + rules[i].Match + ")$"); err != nil {
+			return nil, fmt.Errorf("rule %d of %s: %w", i, path, err)
+		}
+	}
+	return rules, nil
+}
+
+// parseAnnotations parses a comma-separated list of key=value annotations.
+func parseAnnotations(s string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, e := range parseList(s) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", e)
+		}
+		annotations[kv[0]] = kv[1]
+	}
+	return annotations, nil
+}
+
+// annotate sets the annotations of s, replacing those with the same keys.
+func (s *Subject) annotate(annotations map[string]string) {
+	if len(annotations) == 0 {
+		return
+	}
+	if s.Annotations == nil {
+		s.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		s.Annotations[key] = value
+	}
+}
+
+// annotateSubjects adds annotations to every subject and then, in order, the
+// annotations of each of rules matching it, so that the annotations of more
+// specific rules, listed later, take precedence.
+func annotateSubjects(subjects []Subject, annotations map[string]string, rules []SubjectAnnotationRule) {
+	for i := range subjects {
+		subjects[i].annotate(annotations)
+		for _, r := range rules {
+			if r.pattern.MatchString(subjects[i].Name) {
+				subjects[i].annotate(r.Annotations)
+			}
+		}
+	}
+}
+
+// manifestPath normalizes the path of a file subject listed in a file the
+// build writes, such as --subject_timestamps, to the name it is given under
+// --artifact_path.
+func manifestPath(p string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "./")
+}
+
+// readSubjectTimestamps reads a file of `<subject> <timestamp>` lines, with
+// the path of a file subject as it is named under --artifact_path, or the
+// name of an image subject, and when the build finished it, in RFC 3339 or
+// as Unix seconds. Blank lines and lines starting with # are skipped.
+func readSubjectTimestamps(file string) (map[string]time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stamps := map[string]time.Time{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `<subject> <timestamp>`", file, line)
+		}
+		name := manifestPath(fields[0])
+		if _, ok := stamps[name]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is listed twice", file, line, name)
+		}
+		var t time.Time
+		if secs, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			t = time.Unix(secs, 0)
+		} else if t, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %q is neither an RFC 3339 timestamp nor Unix seconds", file, line, fields[1])
+		}
+		stamps[name] = t.UTC()
+	}
+	return stamps, scanner.Err()
+}
+
+// timestampSubjects annotates the subjects listed in stamps, still named by
+// path, with when the build finished them. Files are listed by their path
+// under root, the artifact path, or as a path in the working directory.
+// Every listed subject must exist, and have finished before now.
+func timestampSubjects(subjects []Subject, stamps map[string]time.Time, root string, now time.Time) error {
+	byName := map[string]int{}
+	for i, s := range subjects {
+		byName[s.Name] = i
+	}
+	for name, t := range stamps {
+		i, ok := byName[name]
+		if rel, err := filepath.Rel(root, filepath.FromSlash(name)); !ok && root != "" && err == nil {
+			i, ok = byName[manifestPath(rel)]
+		}
+		if !ok {
+			return fmt.Errorf("%s has a timestamp, but isn't a subject", name)
+		}
+		if t.After(now) {
+			return fmt.Errorf("subject %s finished at %s, which is in the future", subjects[i].Name, t.Format(time.RFC3339))
+		}
+		subjects[i].annotate(map[string]string{AnnotationFinishedOn: t.Format(time.RFC3339)})
+	}
+	return nil
+}
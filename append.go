@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// appendStatement merges the subjects and materials of stmt into the
+// statement already stored at path, for multi-job builds that share a single
+// provenance file. If path doesn't exist, stmt is returned unchanged.
+func appendStatement(path string, stmt *Statement) (*Statement, error) {
+	existing, err := readStatement(path)
+	if os.IsNotExist(err) {
+		return stmt, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading existing provenance: %w", err)
+	}
+	if err := mergeStatement(existing, stmt); err != nil {
+		return nil, fmt.Errorf("appending to %s: %w", path, err)
+	}
+	return existing, nil
+}
+
+// mergeStatement adds the subjects, materials and byproducts of src to dst. Both must
+// describe the same build, and entries with the same name (or URI) must have
+// the same digests.
+func mergeStatement(dst, src *Statement) error {
+	switch {
+	case dst.PredicateType != src.PredicateType:
+		return fmt.Errorf("predicate type %q doesn't match %q", src.PredicateType, dst.PredicateType)
+	case dst.Predicate.Builder.Id != src.Predicate.Builder.Id:
+		return fmt.Errorf("builder %q doesn't match %q", src.Predicate.Builder.Id, dst.Predicate.Builder.Id)
+	case dst.Predicate.Metadata.BuildInvocationId != src.Predicate.Metadata.BuildInvocationId:
+		return fmt.Errorf("build invocation %q doesn't match %q", src.Predicate.Metadata.BuildInvocationId, dst.Predicate.Metadata.BuildInvocationId)
+	}
+
+	subjects := map[string]int{}
+	for i, s := range dst.Subject {
+		subjects[s.Name] = i
+	}
+	for _, s := range src.Subject {
+		i, ok := subjects[s.Name]
+		if !ok {
+			subjects[s.Name] = len(dst.Subject)
+			dst.Subject = append(dst.Subject, s)
+			continue
+		}
+		if digest := dst.Subject[i].Digest; !reflect.DeepEqual(digest, s.Digest) {
+			return fmt.Errorf("subject %s has conflicting digests %v and %v", s.Name, digest, s.Digest)
+		}
+		for key, value := range s.Annotations {
+			if v, ok := dst.Subject[i].Annotations[key]; ok && v != value {
+				return fmt.Errorf("subject %s has conflicting annotations %s=%s and %s=%s", s.Name, key, v, key, value)
+			}
+		}
+		dst.Subject[i].annotate(s.Annotations)
+	}
+
+	materials := map[string]DigestSet{}
+	for _, m := range dst.Predicate.Materials {
+		materials[m.URI] = m.Digest
+	}
+	for _, m := range src.Predicate.Materials {
+		if digest, ok := materials[m.URI]; !ok {
+			materials[m.URI] = m.Digest
+			dst.Predicate.Materials = append(dst.Predicate.Materials, m)
+		} else if !reflect.DeepEqual(digest, m.Digest) {
+			return fmt.Errorf("material %s has conflicting digests %v and %v", m.URI, digest, m.Digest)
+		}
+	}
+
+	// A receipt may cover several subjects.
+	byproducts := map[string]DigestSet{}
+	for _, b := range dst.Predicate.Metadata.Byproducts {
+		byproducts[b.Name+"="+b.Subject] = b.Digest
+	}
+	for _, b := range src.Predicate.Metadata.Byproducts {
+		if digest, ok := byproducts[b.Name+"="+b.Subject]; !ok {
+			byproducts[b.Name+"="+b.Subject] = b.Digest
+			dst.Predicate.Metadata.Byproducts = append(dst.Predicate.Metadata.Byproducts, b)
+		} else if !reflect.DeepEqual(digest, b.Digest) {
+			return fmt.Errorf("byproduct %s has conflicting digests %v and %v", b.Name, digest, b.Digest)
+		}
+	}
+
+	dst.Predicate.Metadata.Completeness.Materials = dst.Predicate.Metadata.Completeness.Materials && src.Predicate.Metadata.Completeness.Materials
+
+	// RFC 3339 timestamps in UTC sort lexically.
+	if s := src.Predicate.Metadata.BuildStartedOn; s != "" && (dst.Predicate.Metadata.BuildStartedOn == "" || s < dst.Predicate.Metadata.BuildStartedOn) {
+		dst.Predicate.Metadata.BuildStartedOn = s
+	}
+	if src.Predicate.Metadata.BuildFinishedOn > dst.Predicate.Metadata.BuildFinishedOn {
+		dst.Predicate.Metadata.BuildFinishedOn = src.Predicate.Metadata.BuildFinishedOn
+	}
+	return nil
+}
+
+// skipAttested removes the subjects that the provenance at path already
+// attests, under the same name and with a matching digest, so that an
+// incremental release only attests what changed.
+func skipAttested(subjects []Subject, path string) ([]Subject, error) {
+	prior, err := readStatement(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading prior provenance: %w", err)
+	}
+	attested := map[string][]DigestSet{}
+	for _, s := range prior.Subject {
+		attested[s.Name] = append(attested[s.Name], s.Digest)
+	}
+	var kept []Subject
+	for _, s := range subjects {
+		skip := false
+		for _, d := range attested[s.Name] {
+			if matchDigest(d, s.Digest) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("all %d subjects are already attested by %s", len(subjects), path)
+	}
+	return kept, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeStatement(t *testing.T) {
+	base := func() *Statement {
+		stmt := testProvenance("app-linux", "https://builder", "git+https://github.com/o/r")
+		stmt.Subject[0].Annotations = map[string]string{"platform": "linux"}
+		stmt.Predicate.Metadata.BuildInvocationId = "42"
+		stmt.Predicate.Metadata.Completeness.Materials = true
+		stmt.Predicate.Metadata.BuildStartedOn = "2021-06-01T10:05:00Z"
+		stmt.Predicate.Metadata.BuildFinishedOn = "2021-06-01T10:10:00Z"
+		stmt.Predicate.Metadata.Byproducts = []Byproduct{{Name: "app.sig", Digest: testDigest("sig"), Kind: ByproductSigningReceipt, Subject: "app-linux"}}
+		return stmt
+	}
+	tests := []struct {
+		name    string
+		change  func(*Statement)
+		wantErr string
+	}{
+		{"another subject", func(s *Statement) { s.Subject[0] = Subject{Name: "app-mac", Digest: testDigest("mac")} }, ""},
+		{"same subject", nil, ""},
+		{"same subject, new annotation", func(s *Statement) { s.Subject[0].Annotations = map[string]string{"arch": "amd64"} }, ""},
+		{"same receipt of another subject", func(s *Statement) { s.Predicate.Metadata.Byproducts[0].Subject = "app-mac" }, ""},
+		{"other predicate type", func(s *Statement) { s.PredicateType = ProvenanceV1Type }, "predicate type"},
+		{"other builder", func(s *Statement) { s.Predicate.Builder.Id = "https://evil" }, "builder"},
+		{"other build", func(s *Statement) { s.Predicate.Metadata.BuildInvocationId = "43" }, "build invocation"},
+		{"conflicting subject digest", func(s *Statement) { s.Subject[0].Digest = testDigest("other") }, "subject app-linux has conflicting digests"},
+		{"conflicting annotation", func(s *Statement) { s.Subject[0].Annotations = map[string]string{"platform": "mac"} }, "conflicting annotations platform=linux and platform=mac"},
+		{"conflicting material digest", func(s *Statement) { s.Predicate.Materials[0].Digest = testDigest("other") }, "material git+https://github.com/o/r has conflicting digests"},
+		{"conflicting byproduct digest", func(s *Statement) { s.Predicate.Metadata.Byproducts[0].Digest = testDigest("other") }, "byproduct app.sig has conflicting digests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, src := base(), base()
+			if tt.change != nil {
+				tt.change(src)
+			}
+			err := mergeStatement(dst, src)
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("mergeStatement() = %v, want an error containing %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("mergeStatement() = %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeStatementCombines(t *testing.T) {
+	dst := testProvenance("app-linux", "https://builder", "git+https://github.com/o/r")
+	dst.Subject[0].Annotations = map[string]string{"platform": "linux"}
+	dst.Predicate.Metadata.Completeness.Materials = true
+	dst.Predicate.Metadata.BuildStartedOn = "2021-06-01T10:05:00Z"
+	dst.Predicate.Metadata.BuildFinishedOn = "2021-06-01T10:10:00Z"
+	src := testProvenance("app-mac", "https://builder", "git+https://github.com/o/r", "pkg:npm/left-pad@1.3.0")
+	src.Subject = append(src.Subject, Subject{Name: "app-linux", Digest: testDigest("app-linux"), Annotations: map[string]string{"arch": "amd64"}})
+	src.Predicate.Metadata.BuildStartedOn = "2021-06-01T10:00:00Z"
+	src.Predicate.Metadata.BuildFinishedOn = "2021-06-01T10:08:00Z"
+	if err := mergeStatement(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	wantSubjects := []Subject{
+		{Name: "app-linux", Digest: testDigest("app-linux"), Annotations: map[string]string{"platform": "linux", "arch": "amd64"}},
+		{Name: "app-mac", Digest: testDigest("app-mac")},
+	}
+	if !reflect.DeepEqual(dst.Subject, wantSubjects) {
+		t.Errorf("merged subjects %v, want %v", dst.Subject, wantSubjects)
+	}
+	if len(dst.Predicate.Materials) != 2 || dst.Predicate.Materials[1].URI != "pkg:npm/left-pad@1.3.0" {
+		t.Errorf("merged materials %v, want the left-pad material added once", dst.Predicate.Materials)
+	}
+	m := dst.Predicate.Metadata
+	if m.Completeness.Materials {
+		t.Error("merged materials are complete, but those of one build aren't")
+	}
+	if m.BuildStartedOn != "2021-06-01T10:00:00Z" || m.BuildFinishedOn != "2021-06-01T10:10:00Z" {
+		t.Errorf("merged build ran from %s to %s, want the earliest start and latest finish", m.BuildStartedOn, m.BuildFinishedOn)
+	}
+}
+
+func TestAppendStatement(t *testing.T) {
+	dir := t.TempDir()
+	stmt := testProvenance("app", "https://builder")
+	got, err := appendStatement(filepath.Join(dir, "missing.json"), stmt)
+	if err != nil || got != stmt {
+		t.Errorf("appendStatement() to a missing file = %v, %v, want the statement itself", got, err)
+	}
+
+	path := filepath.Join(dir, "provenance.json")
+	writeProvenance(t, path, testProvenance("lib", "https://builder"), nil)
+	got, err = appendStatement(path, stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Subject) != 2 || got.Subject[0].Name != "lib" || got.Subject[1].Name != "app" {
+		t.Errorf("appendStatement() subjects %v, want lib and app", got.Subject)
+	}
+
+	writeProvenance(t, path, testProvenance("app", "https://other-builder"), nil)
+	if _, err := appendStatement(path, stmt); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("appendStatement() of another builder = %v, want an error naming %s", err, path)
+	}
+}
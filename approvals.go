@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Approvals is the review evidence of a run: the reviews of the pull request
+// the commit was built from, and the deployment approvals that gated the run.
+type Approvals struct {
+	PullRequest  *PullRequestReviews   `json:"pullRequest,omitempty"`
+	Environments []EnvironmentApproval `json:"environments,omitempty"`
+}
+
+// PullRequestReviews records the reviews of a pull request, as of its head
+// commit.
+type PullRequestReviews struct {
+	URL     string `json:"url"`
+	Author  string `json:"author"`
+	BaseRef string `json:"baseRef"`
+	HeadSHA string `json:"headSha"`
+	// Approvers are the reviewers, other than the author, whose latest
+	// review approves the head commit.
+	Approvers []string `json:"approvers"`
+	// RequiredApprovals is the most approvals required by the rulesets of
+	// the base branch, and PassedRequiredReviews whether the approvers and
+	// the absence of requested changes meet it.
+	RequiredApprovals     int  `json:"requiredApprovals"`
+	PassedRequiredReviews bool `json:"passedRequiredReviews"`
+}
+
+// EnvironmentApproval is the review of a deployment to environments that
+// had to be approved before the run could proceed.
+type EnvironmentApproval struct {
+	Environments []string `json:"environments"`
+	State        string   `json:"state"`
+	Reviewer     string   `json:"reviewer"`
+	Comment      string   `json:"comment,omitempty"`
+}
+
+// recordApprovals reads the review evidence of the run described by the
+// github context from the API. Evidence that can't be read or falls short
+// of two-person review is reported as an unreviewed finding.
+func recordApprovals(gh GitHubContext, opts Options, findings *Findings) (*Approvals, error) {
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	approvals := &Approvals{}
+	repo := "/repos/" + gh.Repository
+	var deployments []struct {
+		Environments []struct {
+			Name string `json:"name"`
+		} `json:"environments"`
+		State   string `json:"state"`
+		Comment string `json:"comment"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := c.get(repo+"/actions/runs/"+gh.RunId+"/approvals", &deployments); err != nil {
+		findings.add(CodeUnreviewed, "unable to read the deployment approvals of the run: %s", err)
+	}
+	for _, d := range deployments {
+		a := EnvironmentApproval{State: d.State, Reviewer: d.User.Login, Comment: d.Comment}
+		for _, e := range d.Environments {
+			a.Environments = append(a.Environments, e.Name)
+		}
+		approvals.Environments = append(approvals.Environments, a)
+	}
+	number, err := pullRequestNumber(c, gh)
+	if err != nil {
+		findings.add(CodeUnreviewed, "unable to find the pull request of commit %s: %s", gh.SHA, err)
+		return approvals, nil
+	} else if number == 0 {
+		findings.add(CodeUnreviewed, "commit %s was not merged through a pull request", gh.SHA)
+		return approvals, nil
+	}
+	if approvals.PullRequest, err = pullRequestReviews(c, gh.Repository, number); err != nil {
+		findings.add(CodeUnreviewed, "unable to read the reviews of pull request #%d: %s", number, err)
+		return approvals, nil
+	}
+	pr := approvals.PullRequest
+	switch {
+	case len(pr.Approvers) == 0:
+		findings.add(CodeUnreviewed, "pull request #%d was not approved by a reviewer other than its author", number)
+	case !pr.PassedRequiredReviews:
+		findings.add(CodeUnreviewed, "pull request #%d did not pass its required reviews", number)
+	}
+	return approvals, nil
+}
+
+// pullRequestNumber returns the number of the pull request that triggered
+// the run or, for other events such as the push of a merge, of the pull
+// request the commit was merged by, or 0 if there is none.
+func pullRequestNumber(c *githubClient, gh GitHubContext) (int, error) {
+	var event struct {
+		PullRequest struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+	}
+	if json.Unmarshal(gh.Event, &event) == nil && event.PullRequest.Number != 0 {
+		return event.PullRequest.Number, nil
+	}
+	var pulls []struct {
+		Number         int    `json:"number"`
+		MergeCommitSHA string `json:"merge_commit_sha"`
+		MergedAt       string `json:"merged_at"`
+	}
+	if err := c.get(fmt.Sprintf("/repos/%s/commits/%s/pulls", gh.Repository, gh.SHA), &pulls); err != nil {
+		return 0, err
+	}
+	for _, p := range pulls {
+		if p.MergedAt != "" && p.MergeCommitSHA == gh.SHA {
+			return p.Number, nil
+		}
+	}
+	// Commits of rebase merges are not the merge commit of their pull
+	// request, which still lists them.
+	for _, p := range pulls {
+		if p.MergedAt != "" {
+			return p.Number, nil
+		}
+	}
+	return 0, nil
+}
+
+// pullRequestReviews reads the reviews of pull request number and the
+// approvals required by the rulesets of its base branch.
+func pullRequestReviews(c *githubClient, repository string, number int) (*PullRequestReviews, error) {
+	repo := "/repos/" + repository
+	var pull struct {
+		HTMLURL string `json:"html_url"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	}
+	if err := c.get(repo+"/pulls/"+strconv.Itoa(number), &pull); err != nil {
+		return nil, err
+	}
+	var reviews []struct {
+		State    string `json:"state"`
+		CommitId string `json:"commit_id"`
+		User     struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := c.get(repo+"/pulls/"+strconv.Itoa(number)+"/reviews?per_page=100", &reviews); err != nil {
+		return nil, err
+	}
+	// Reviews are listed oldest first; comments don't change a reviewer's
+	// verdict.
+	latest := map[string]string{}
+	for _, r := range reviews {
+		switch r.State {
+		case "APPROVED":
+			if r.CommitId != pull.Head.SHA {
+				// An approval of an earlier commit doesn't cover the head.
+				delete(latest, r.User.Login)
+				continue
+			}
+		case "CHANGES_REQUESTED", "DISMISSED":
+		default:
+			continue
+		}
+		latest[r.User.Login] = r.State
+	}
+	pr := &PullRequestReviews{URL: pull.HTMLURL, Author: pull.User.Login, BaseRef: pull.Base.Ref, HeadSHA: pull.Head.SHA, Approvers: []string{}}
+	changesRequested := false
+	for reviewer, state := range latest {
+		switch {
+		case state == "CHANGES_REQUESTED":
+			changesRequested = true
+		case state == "APPROVED" && !strings.EqualFold(reviewer, pr.Author):
+			pr.Approvers = append(pr.Approvers, reviewer)
+		}
+	}
+	sort.Strings(pr.Approvers)
+	var rules []struct {
+		Type       string `json:"type"`
+		Parameters struct {
+			RequiredApprovingReviewCount int `json:"required_approving_review_count"`
+		} `json:"parameters"`
+	}
+	if err := c.get(repo+"/rules/branches/"+url.PathEscape(pr.BaseRef), &rules); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.Type == "pull_request" && r.Parameters.RequiredApprovingReviewCount > pr.RequiredApprovals {
+			pr.RequiredApprovals = r.Parameters.RequiredApprovingReviewCount
+		}
+	}
+	pr.PassedRequiredReviews = !changesRequested && len(pr.Approvers) >= pr.RequiredApprovals
+	return pr, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathList is a flag that may be given several times, each time with a path
+// or, one per line, several, as the action passes a multi-line input.
+type pathList []string
+
+// newPathList defines a pathList flag of the command line.
+func newPathList(name, usage string) *pathList {
+	l := &pathList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *pathList) String() string {
+	return strings.Join(*l, "\n")
+}
+
+func (l *pathList) Set(s string) error {
+	*l = append(*l, splitPaths(s)...)
+	return nil
+}
+
+// splitPaths returns the paths of s, one per line, leaving out blank lines.
+func splitPaths(s string) []string {
+	var paths []string
+	for _, p := range strings.Split(s, "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// isGlob reports whether the artifact path p is a glob pattern.
+func isGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// singleArtifactPath returns the artifact path of paths if there is only one,
+// and it isn't a pattern: the path provenance and its workspace are named
+// after by default. Otherwise it returns "".
+func singleArtifactPath(paths []string) string {
+	if len(paths) != 1 || isGlob(paths[0]) {
+		return ""
+	}
+	return normalizeInputPath(paths[0])
+}
+
+// artifactRoot is a file or directory of artifacts, whose subjects are named
+// by their path under Path, as walkFiles names them, within Prefix.
+type artifactRoot struct {
+	Path   string
+	Prefix string
+}
+
+// expandArtifactPaths returns the artifact roots of paths: each path, or the
+// files and directories matched by each glob pattern. Patterns match as
+// path.Match does within each path element, and a "**" element also matches
+// any number of directories. Matches are named by their path under the
+// pattern's directory, the part before its first wildcard, so that
+// dist/py3/app.whl, matched by dist/**/*.whl, is named py3/app.whl, as it is
+// with --artifact_path dist. A pattern matching nothing is an error.
+func expandArtifactPaths(paths []string) ([]artifactRoot, error) {
+	var roots []artifactRoot
+	for _, p := range paths {
+		p = normalizeInputPath(p)
+		if !isGlob(p) {
+			roots = append(roots, artifactRoot{Path: p})
+			continue
+		}
+		matches, err := globArtifacts(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no artifacts match %s", p)
+		}
+		roots = append(roots, matches...)
+	}
+	return roots, nil
+}
+
+// globArtifacts returns the files and directories matching pattern, in
+// lexical order. Directories that match aren't searched further: their files
+// are artifacts already.
+func globArtifacts(pattern string) ([]artifactRoot, error) {
+	elems := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(elems) && !isGlob(elems[i]) {
+		i++
+	}
+	base, rest := strings.Join(elems[:i], "/"), elems[i:]
+	switch {
+	case i == 0:
+		base = "."
+	case base == "":
+		base = "/"
+	}
+	for _, e := range rest {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("invalid artifact pattern %s: %w", pattern, err)
+		}
+	}
+	var roots []artifactRoot
+	err := filepath.Walk(filepath.FromSlash(base), func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(base), p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := strings.Split(filepath.ToSlash(rel), "/")
+		if matchElems(rest, name) {
+			prefix := path.Dir(filepath.ToSlash(rel))
+			if info.IsDir() {
+				prefix = filepath.ToSlash(rel)
+			}
+			roots = append(roots, artifactRoot{Path: p, Prefix: prefix})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && !matchPrefix(rest, name) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// matchElems reports whether the path elements name match the pattern
+// elements pattern.
+func matchElems(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		return matchElems(pattern[1:], name) || len(name) > 0 && matchElems(pattern, name[1:])
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchElems(pattern[1:], name[1:])
+}
+
+// matchPrefix reports whether the path of a directory, as the path elements
+// name, may lead to paths matching the pattern elements pattern, i.e. whether
+// it is worth searching.
+func matchPrefix(pattern, name []string) bool {
+	for i, n := range name {
+		if i == len(pattern) {
+			return false
+		}
+		if pattern[i] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[i], n); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// walkArtifacts calls fn for each file of roots, as walkFiles does, naming
+// it within the prefix of its root. A file found through several roots, such
+// as a directory and a pattern matching files in it, is only walked once, and
+// different files of the same name are an error, as they can't both be
+// verified.
+func walkArtifacts(roots []artifactRoot, fn func(abspath, name string, info fs.FileInfo) error) error {
+	seen := map[string]bool{}
+	names := map[string]string{}
+	for _, r := range roots {
+		err := walkFiles(r.Path, func(p, name string, info fs.FileInfo) error {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			if seen[abs] {
+				return nil
+			}
+			seen[abs] = true
+			if r.Prefix != "" {
+				name = path.Join(r.Prefix, name)
+			}
+			if other, ok := names[name]; ok {
+				return fmt.Errorf("artifacts %s and %s are both named %s", other, p, name)
+			}
+			names[name] = p
+			return fn(p, name, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PredicateTypeAnnotation is the annotation of the referrers pushed by
+// attach naming the predicate type of the attestation they carry, as
+// BuildKit names that of its attestations.
+const PredicateTypeAnnotation = "in-toto.io/predicate-type"
+
+// imageAttestation is an attestation to attach to the images whose manifest
+// digests are among its subjects.
+type imageAttestation struct {
+	gateAttestation
+	Statement *Statement
+}
+
+// layer describes the attestation as the layer of a referrer: a DSSE
+// envelope or a bare Statement.
+func (a imageAttestation) layer() Descriptor {
+	mediaType := PayloadContentType
+	if env := (Envelope{}); json.Unmarshal(a.Contents, &env) == nil && env.PayloadType != "" {
+		mediaType = MediaTypeDSSE
+	}
+	sum := sha256.Sum256(a.Contents)
+	return Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(a.Contents))}
+}
+
+// containerPackage is a container package in the Packages API.
+type containerPackage struct {
+	Name       string `json:"name"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// discoverImages lists the container packages of repo's owner in GitHub
+// Packages that are linked to repo, and returns their versions whose
+// manifest digests are in digests, as <registry>/<owner>/<name>@<digest>
+// references. Only the newest 100 packages and versions are listed, which
+// cover those a run just pushed.
+func discoverImages(c *githubClient, repo, registry string, digests map[string]bool) ([]string, error) {
+	owner := strings.SplitN(repo, "/", 2)[0]
+	var packages []containerPackage
+	if err := getOwned(c, owner, "packages?package_type=container&per_page=100", &packages); err != nil {
+		return nil, fmt.Errorf("listing the container packages of %s: %w", owner, err)
+	}
+	var images []string
+	for _, p := range packages {
+		if p.Repository == nil || !strings.EqualFold(p.Repository.FullName, repo) {
+			continue
+		}
+		versions, err := listPackageVersions(c, owner, "container", p.Name)
+		if err != nil {
+			return nil, fmt.Errorf("listing the versions of %s: %w", p.Name, err)
+		}
+		for _, v := range versions {
+			if digests[strings.TrimPrefix(v.Name, "sha256:")] {
+				images = append(images, fmt.Sprintf("%s/%s/%s@%s", registry, strings.ToLower(owner), p.Name, v.Name))
+			}
+		}
+	}
+	return images, nil
+}
+
+// readImageAttestations reads the attestations in the comma-separated
+// provenance files, indexing them by the sha256 digests of their subjects.
+func readImageAttestations(paths string) (map[string][]imageAttestation, error) {
+	bySubject := map[string][]imageAttestation{}
+	for _, path := range parseList(paths) {
+		attestations, err := readAttestations(normalizeInputPath(path))
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attestations {
+			stmt, _, err := parseProvenance(a.Contents, a.URI)
+			if err != nil {
+				return nil, err
+			}
+			seen := map[string]bool{}
+			for _, s := range stmt.Subject {
+				if d := s.Digest["sha256"]; d != "" && !seen[d] {
+					seen[d] = true
+					bySubject[d] = append(bySubject[d], imageAttestation{a, stmt})
+				}
+			}
+		}
+	}
+	return bySubject, nil
+}
+
+// attachMain implements `attach --provenance <file> --discover`, pushing
+// the attestations of images as OCI referrers, so that they are found with
+// the image rather than alongside the release.
+func attachMain(args []string) {
+	flags := flag.NewFlagSet("attach", flag.ExitOnError)
+	provenance := flags.String("provenance", "", "Comma-separated provenance files, Statements, envelopes or JSON Lines bundles, to attach to the images they attest.")
+	images := flags.String("image", "", "Comma-separated images to attach the attestations to, as <repository>@sha256:<digest>.")
+	discover := flags.Bool("discover", false, "Attach the attestations to the images of the container packages of --repository in GitHub Packages whose digests they attest, e.g. those the run just pushed to ghcr.io. Authenticated with $GITHUB_TOKEN.")
+	repository := flags.String("repository", os.Getenv("GITHUB_REPOSITORY"), "The repository, as <owner>/<repo>, whose container packages --discover lists.")
+	concurrency := flags.Int("concurrency", 4, "How many images to attach attestations to at a time.")
+	rateLimit := flags.Float64("rate_limit", 10, "The most registry requests to send per second, across all images (0: no limit).")
+	retries := flags.Int("retries", 2, "How many more times to try images that failed, with exponential backoff.")
+	addOfflineFlag(flags)
+	cloudAuth := addCloudAuthFlags(flags)
+	flags.Parse(args)
+	if err := requireOnline("attach"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *provenance == "" || (*images == "" && !*discover) {
+		fmt.Println("--provenance and either --image or --discover are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *discover && strings.Count(*repository, "/") != 1 {
+		fmt.Printf("Invalid value for flag --repository: %q\n", *repository)
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		fmt.Printf("Invalid value for flag --concurrency: %d\n", *concurrency)
+		os.Exit(1)
+	}
+	if *retries < 0 {
+		fmt.Printf("Invalid value for flag --retries: %d\n", *retries)
+		os.Exit(1)
+	}
+	bySubject, err := readImageAttestations(*provenance)
+	if err != nil {
+		fmt.Printf("Failed to read provenance: %s\n", err)
+		os.Exit(1)
+	}
+	var list []string
+	for _, image := range parseList(*images) {
+		if i := strings.LastIndex(image, "@"); i < 0 || !strings.HasPrefix(image[i+1:], "sha256:") {
+			fmt.Printf("Invalid value for flag --image: %q is not of the form <repository>@sha256:<digest>\n", image)
+			os.Exit(1)
+		}
+		if !stringSet(list...)[image] {
+			list = append(list, image)
+		}
+	}
+	if *discover {
+		opts := Options{Getenv: os.Getenv}
+		c, err := newGitHubClient("{}", opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		digests := map[string]bool{}
+		for d := range bySubject {
+			digests[d] = true
+		}
+		registry := strings.SplitN(packageRegistry(os.Getenv("GITHUB_SERVER_URL"), "containers"), "://", 2)[1]
+		discovered, err := discoverImages(c, *repository, registry, digests)
+		if err != nil {
+			fmt.Printf("Failed to discover images: %s\n", err)
+			os.Exit(1)
+		}
+		if len(discovered) == 0 {
+			fmt.Printf("No container package of %s has a version the provenance attests\n", *repository)
+		}
+		for _, image := range discovered {
+			if !stringSet(list...)[image] {
+				list = append(list, image)
+			}
+		}
+	}
+	sort.Strings(list)
+	c := newRegistryClient()
+	c.limiter = newRateLimiter(*rateLimit)
+	// The referrers are the same on retries, which push them again, so that
+	// images get each attestation once.
+	created := time.Now().UTC().Format(time.RFC3339)
+	referrers, failed := forEachImage(list, *concurrency, *retries, func(image string) (string, error) {
+		digest := image[strings.LastIndex(image, "@")+1:]
+		attestations := bySubject[strings.TrimPrefix(digest, "sha256:")]
+		if len(attestations) == 0 {
+			return "", errors.New("no attestation has it as a subject")
+		}
+		var pushed []string
+		for _, a := range attestations {
+			annotations := map[string]string{
+				PredicateTypeAnnotation:            a.Statement.PredicateType,
+				"org.opencontainers.image.created": created,
+			}
+			referrer, err := pushReferrer(c, image, PayloadContentType, a.layer(), a.Contents, annotations)
+			if err != nil {
+				return "", fmt.Errorf("attaching %s: %w", a.URI, err)
+			}
+			pushed = append(pushed, a.URI+" as "+referrer)
+		}
+		return strings.Join(pushed, ", "), nil
+	})
+	for _, image := range list {
+		if err := failed[image]; err != nil {
+			fmt.Printf("Failed to attach to %s: %s\n", image, err)
+		} else {
+			fmt.Printf("Attached to %s: %s\n", image, referrers[image])
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Printf("Failed to attach to %d of %d images\n", len(failed), len(list))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Predicate and attestation types of witness attestation collections.
+// See https://github.com/testifysec/witness
+const (
+	CollectionPredicateType    = "https://witness.testifysec.com/attestation-collection/v0.1"
+	GitAttestationType         = "https://witness.dev/attestations/git/v0.1"
+	EnvironmentAttestationType = "https://witness.dev/attestations/environment/v0.1"
+	CommandRunAttestationType  = "https://witness.dev/attestations/command-run/v0.1"
+)
+
+// CollectionStatement is an in-toto Statement whose predicate gathers the
+// attestations of several attestors about the same subjects.
+type CollectionStatement struct {
+	Type          string     `json:"_type"`
+	Subject       []Subject  `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Collection `json:"predicate"`
+}
+type Collection struct {
+	Name         string                  `json:"name"`
+	Attestations []CollectionAttestation `json:"attestations"`
+}
+type CollectionAttestation struct {
+	Type        string      `json:"type"`
+	Attestation interface{} `json:"attestation"`
+}
+
+type GitAttestation struct {
+	CommitHash     string            `json:"commithash"`
+	Author         string            `json:"author"`
+	AuthorEmail    string            `json:"authoremail"`
+	CommitterName  string            `json:"committername"`
+	CommitterEmail string            `json:"committeremail"`
+	CommitDate     string            `json:"commitdate"`
+	CommitMessage  string            `json:"commitmessage"`
+	Status         map[string]string `json:"status,omitempty"`
+}
+
+type EnvironmentAttestation struct {
+	OS        string            `json:"os"`
+	Hostname  string            `json:"hostname,omitempty"`
+	Username  string            `json:"username,omitempty"`
+	Variables map[string]string `json:"variables"`
+}
+
+type CommandRunAttestation struct {
+	Cmd      []string `json:"cmd"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	ExitCode int      `json:"exitcode"`
+}
+
+// attestors maps the names accepted by --attestors to their types and
+// implementations.
+var attestors = map[string]struct {
+	Type   string
+	Attest func(opts Options) (interface{}, error)
+}{
+	"git":         {GitAttestationType, attestGit},
+	"environment": {EnvironmentAttestationType, attestEnvironment},
+	"command-run": {CommandRunAttestationType, attestCommandRun},
+}
+
+// collectAttestations runs the attestors named in opts.Attestors, in order,
+// and wraps their attestations in a collection about the subjects of stmt.
+func collectAttestations(stmt *Statement, opts Options) (*CollectionStatement, error) {
+	coll := CollectionStatement{
+		Type:          stmt.Type,
+		Subject:       stmt.Subject,
+		PredicateType: CollectionPredicateType,
+		Predicate:     Collection{Name: stmt.Predicate.Recipe.EntryPoint, Attestations: []CollectionAttestation{}},
+	}
+	for _, name := range opts.Attestors {
+		a, ok := attestors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown attestor %q", name)
+		}
+		attestation, err := a.Attest(opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s attestor: %w", name, err)
+		}
+		if opts.Redact != "" {
+			attestation = redactAttestation(attestation, opts.Redact)
+		}
+		coll.Predicate.Attestations = append(coll.Predicate.Attestations, CollectionAttestation{Type: a.Type, Attestation: attestation})
+	}
+	return &coll, nil
+}
+
+// bundleStatements returns the provenance Statement followed by the
+// Statements requested alongside it, or nil if none were.
+func bundleStatements(stmt *Statement, opts Options) ([]interface{}, error) {
+	bundle := []interface{}{stmt}
+	if len(opts.Attestors) > 0 {
+		coll, err := collectAttestations(stmt, opts)
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, coll)
+	}
+	if opts.FileMetadata && len(opts.ArtifactPaths) > 0 {
+		fm, err := fileMetadataStatement(stmt, opts)
+		if err != nil {
+			return nil, fmt.Errorf("reading file metadata: %w", err)
+		}
+		bundle = append(bundle, fm)
+	}
+	if len(bundle) == 1 {
+		return nil, nil
+	}
+	return bundle, nil
+}
+
+// writeBundle writes statements to path as JSON Lines, one per line. path
+// must not exist unless force is set.
+func writeBundle(path string, force bool, statements ...interface{}) error {
+	var buf bytes.Buffer
+	for _, s := range statements {
+		line, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return writeOutput(path, buf.Bytes(), force)
+}
+
+// attestGit records the checked-out commit and the state of the working
+// tree in the workspace.
+func attestGit(opts Options) (interface{}, error) {
+	if !opts.InspectHost {
+		return nil, errors.New("the git attestor must run inside the job")
+	}
+	dir := opts.Workspace
+	if dir == "" {
+		dir = "."
+	}
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], bytes.TrimSpace(exitErr.Stderr))
+		} else if err != nil {
+			return "", fmt.Errorf("git %s: %w", args[0], err)
+		}
+		return string(out), nil
+	}
+	// Fields are separated by NUL, which can't occur in commit metadata.
+	out, err := git("log", "-1", "--format=%H%x00%an%x00%ae%x00%cn%x00%ce%x00%cI%x00%B")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(out, "\x00", 7)
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("unexpected git log output: %q", out)
+	}
+	a := GitAttestation{
+		CommitHash:     fields[0],
+		Author:         fields[1],
+		AuthorEmail:    fields[2],
+		CommitterName:  fields[3],
+		CommitterEmail: fields[4],
+		CommitDate:     fields[5],
+		CommitMessage:  strings.TrimRight(fields[6], "\n"),
+	}
+	status, err := git("status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) > 3 {
+			if a.Status == nil {
+				a.Status = map[string]string{}
+			}
+			a.Status[line[3:]] = strings.TrimSpace(line[:2])
+		}
+	}
+	return a, nil
+}
+
+// sensitiveVariables matches the names of environment variables that
+// commonly hold credentials, in addition to the scrub fields.
+var sensitiveVariables = []string{"*_key", "*token*", "*secret*", "*password*", "*credential*", "*auth*"}
+
+// attestEnvironment records the environment variables of the run, redacting
+// those whose names look sensitive, and, inside the job, the host.
+func attestEnvironment(opts Options) (interface{}, error) {
+	fields := opts.ScrubFields
+	if fields == nil {
+		fields = defaultScrubFields
+	}
+	fields = append(append([]string{}, sensitiveVariables...), fields...)
+	a := EnvironmentAttestation{Variables: map[string]string{}}
+	for _, kv := range opts.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if matchesAny(parts[0], fields) {
+			a.Variables[parts[0]] = Redacted
+		} else {
+			a.Variables[parts[0]] = parts[1]
+		}
+	}
+	if opts.InspectHost {
+		a.OS = runtime.GOOS
+		a.Hostname, _ = os.Hostname()
+		if u, err := user.Current(); err == nil {
+			a.Username = u.Username
+		}
+	} else {
+		a.OS = strings.ToLower(opts.Getenv("RUNNER_OS"))
+	}
+	return a, nil
+}
+
+// attestCommandRun runs opts.AttestCommand with the shell and records its
+// output and exit status. A failing command is recorded, not an error.
+func attestCommandRun(opts Options) (interface{}, error) {
+	if opts.AttestCommand == "" {
+		return nil, errors.New("no command given with --attest_command")
+	}
+	if !opts.InspectHost {
+		return nil, errors.New("the command-run attestor must run inside the job")
+	}
+	cmd := shellCommand(opts.AttestCommand)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	return CommandRunAttestation{
+		Cmd:      cmd.Args,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}, nil
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// environFromMap lists env in the form of os.Environ, sorted by name.
+func environFromMap(env map[string]string) []string {
+	var kvs []string
+	for k, v := range env {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return kvs
+}
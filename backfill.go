@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackfillIdSuffix is the builder ID suffix of provenance that backfill
+// reconstructed, which verification policies must trust explicitly.
+const BackfillIdSuffix = "/Attestations/Backfill@v1"
+
+// Retroactive marks provenance that backfill reconstructed from the API
+// after the release, rather than that the build recorded. It is an extension
+// to the SLSA v0.1 metadata.
+type Retroactive struct {
+	// ReconstructedOn is when backfill ran.
+	ReconstructedOn string `json:"reconstructedOn"`
+	// Release is the URL of the release whose assets are the subjects.
+	Release string `json:"release"`
+	// Run is the URL of the workflow run the release was matched to, unless
+	// none was found.
+	Run      string   `json:"run,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// githubRelease is a release as the API describes it.
+type githubRelease struct {
+	Id          int64      `json:"id"`
+	TagName     string     `json:"tag_name"`
+	Draft       bool       `json:"draft"`
+	HTMLURL     string     `json:"html_url"`
+	UploadURL   string     `json:"upload_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"published_at"`
+	Assets      []struct {
+		Name               string    `json:"name"`
+		URL                string    `json:"url"`
+		BrowserDownloadURL string    `json:"browser_download_url"`
+		UpdatedAt          time.Time `json:"updated_at"`
+		// Digest is "sha256:<hex>", for assets uploaded since GitHub began
+		// recording it.
+		Digest string `json:"digest"`
+	} `json:"assets"`
+}
+
+// workflowRun is a workflow run as the API describes it.
+type workflowRun struct {
+	Id           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	HeadBranch   string    `json:"head_branch"`
+	HeadSHA      string    `json:"head_sha"`
+	Event        string    `json:"event"`
+	Conclusion   string    `json:"conclusion"`
+	RunNumber    int       `json:"run_number"`
+	RunAttempt   int       `json:"run_attempt"`
+	RunStartedAt time.Time `json:"run_started_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	HTMLURL      string    `json:"html_url"`
+	Actor        struct {
+		Login string `json:"login"`
+	} `json:"actor"`
+	TriggeringActor struct {
+		Login string `json:"login"`
+	} `json:"triggering_actor"`
+}
+
+// isAttestationAsset reports whether a release asset named name holds
+// provenance or other attestations.
+func isAttestationAsset(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range []string{".provenance", ".intoto", ".intoto.jsonl", ".dsse", ".bundle.jsonl"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillAssetName is the name of the release asset backfill uploads the
+// provenance of the release of tag as.
+func backfillAssetName(tag string) string {
+	return strings.Replace(tag, "/", "-", -1) + ".retroactive.intoto.jsonl"
+}
+
+// backfillStatement reconstructs best-effort provenance of the assets of
+// release of repo: they are downloaded and hashed, and the build is taken to
+// be the workflow run runID or, if it's 0, the one releaseRun finds.
+func backfillStatement(c *githubClient, repo string, release githubRelease, runID int64, now time.Time) (*Statement, error) {
+	var commit struct {
+		SHA string `json:"sha"`
+	}
+	if err := c.get(fmt.Sprintf("/repos/%s/commits/%s", repo, url.PathEscape(release.TagName)), &commit); err != nil {
+		return nil, fmt.Errorf("resolving tag %s: %w", release.TagName, err)
+	}
+	retro := &Retroactive{ReconstructedOn: now.UTC().Format(time.RFC3339), Release: release.HTMLURL}
+	var run *workflowRun
+	if runID != 0 {
+		run = &workflowRun{}
+		if err := c.get(fmt.Sprintf("/repos/%s/actions/runs/%d", repo, runID), run); err != nil {
+			return nil, fmt.Errorf("reading run %d: %w", runID, err)
+		}
+		if run.HeadSHA != commit.SHA {
+			return nil, fmt.Errorf("run %d built %s, not %s, which %s tags", runID, run.HeadSHA, commit.SHA, release.TagName)
+		}
+	} else {
+		var err error
+		if run, err = releaseRun(c, repo, release, commit.SHA); err != nil {
+			return nil, err
+		}
+		if run == nil {
+			retro.Warnings = append(retro.Warnings, fmt.Sprintf("no successful workflow run of %s started before the release assets were uploaded, so the build invocation is unknown", commit.SHA))
+		}
+	}
+
+	stmt := &Statement{PredicateType: ProvenanceV01Type, Type: StatementV01Type}
+	for _, asset := range release.Assets {
+		if isAttestationAsset(asset.Name) {
+			continue
+		}
+		resp, err := c.doAccept(asset.URL, "", "application/octet-stream")
+		if err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", asset.Name, err)
+		}
+		digest, err := digestReader(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", asset.Name, err)
+		}
+		stmt.Subject = append(stmt.Subject, Subject{Name: asset.Name, Digest: digest})
+	}
+	if len(stmt.Subject) == 0 {
+		return nil, errors.New("the release has no assets to attest")
+	}
+
+	repoURI := "https://github.com/" + repo
+	stmt.Predicate.Builder.Id = repoURI + BackfillIdSuffix
+	stmt.Predicate.Recipe.Type = TypeId
+	stmt.Predicate.Materials = []Item{{URI: "git+" + repoURI, Digest: DigestSet{"sha1": commit.SHA}}}
+	context := AnyContext{GitHubContext: GitHubContext{
+		Repository:      repo,
+		RepositoryOwner: strings.SplitN(repo, "/", 2)[0],
+		SHA:             commit.SHA,
+		Ref:             "refs/tags/" + release.TagName,
+	}}
+	finished := release.CreatedAt
+	if run != nil {
+		retro.Run = run.HTMLURL
+		ref := "refs/heads/" + run.HeadBranch
+		if run.Event == "release" || run.HeadBranch == release.TagName {
+			ref = "refs/tags/" + release.TagName
+		}
+		gh := &context.GitHubContext
+		gh.Actor, gh.TriggeringActor = run.Actor.Login, run.TriggeringActor.Login
+		gh.EventName, gh.Ref, gh.Workflow = run.Event, ref, run.Name
+		gh.RunId, gh.RunNumber, gh.RunAttempt = strconv.FormatInt(run.Id, 10), strconv.Itoa(run.RunNumber), strconv.Itoa(run.RunAttempt)
+		gh.WorkflowRef = repo + "/" + run.Path + "@" + ref
+		stmt.Predicate.Metadata.BuildInvocationId = repoURI + "/actions/runs/" + gh.RunId
+		stmt.Predicate.Recipe.EntryPoint = run.Path
+		if !run.RunStartedAt.IsZero() {
+			stmt.Predicate.Metadata.BuildStartedOn = run.RunStartedAt.UTC().Format(time.RFC3339)
+		}
+		finished = run.UpdatedAt
+	} else {
+		retro.Warnings = append(retro.Warnings, "buildFinishedOn is when the release was created")
+	}
+	stmt.Predicate.Recipe.Environment = &context
+	stmt.Predicate.Metadata.BuildFinishedOn = finished.UTC().Format(time.RFC3339)
+	retro.Warnings = append(retro.Warnings, "the subjects are the release assets as they are now, which may have been replaced since the build")
+	stmt.Predicate.Metadata.Retroactive = retro
+	return stmt, nil
+}
+
+// releaseRun finds the workflow run that most likely built release: the
+// latest successful run of sha that started before its last asset was
+// uploaded, or it was published, preferring runs for the release or its tag.
+// Runs for the release start once it is published, and upload its assets
+// after. It returns nil if there's none.
+func releaseRun(c *githubClient, repo string, release githubRelease, sha string) (*workflowRun, error) {
+	cutoff := release.CreatedAt
+	if release.PublishedAt != nil {
+		cutoff = *release.PublishedAt
+	}
+	for _, a := range release.Assets {
+		if a.UpdatedAt.After(cutoff) {
+			cutoff = a.UpdatedAt
+		}
+	}
+	var runs []workflowRun
+	for page := 1; ; page++ {
+		var list struct {
+			WorkflowRuns []workflowRun `json:"workflow_runs"`
+		}
+		if err := c.get(fmt.Sprintf("/repos/%s/actions/runs?head_sha=%s&status=success&per_page=100&page=%d", repo, sha, page), &list); err != nil {
+			return nil, fmt.Errorf("listing the runs of %s: %w", sha, err)
+		}
+		for _, r := range list.WorkflowRuns {
+			if r.HeadSHA == sha && r.Conclusion == "success" && !r.RunStartedAt.After(cutoff) {
+				runs = append(runs, r)
+			}
+		}
+		if len(list.WorkflowRuns) < 100 {
+			break
+		}
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+	forRelease := func(r workflowRun) bool {
+		return r.Event == "release" || r.HeadBranch == release.TagName
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		if forRelease(runs[i]) != forRelease(runs[j]) {
+			return forRelease(runs[i])
+		}
+		return runs[i].UpdatedAt.After(runs[j].UpdatedAt)
+	})
+	return &runs[0], nil
+}
+
+// listReleases returns the published releases of repo.
+func listReleases(c *githubClient, repo string) ([]githubRelease, error) {
+	var releases []githubRelease
+	for page := 1; ; page++ {
+		var list []githubRelease
+		if err := c.get(fmt.Sprintf("/repos/%s/releases?per_page=100&page=%d", repo, page), &list); err != nil {
+			return nil, err
+		}
+		for _, r := range list {
+			if !r.Draft {
+				releases = append(releases, r)
+			}
+		}
+		if len(list) < 100 {
+			return releases, nil
+		}
+	}
+}
+
+// backfillMain implements `backfill --repo <owner>/<repo> --release <tag>,...
+// --key <key>`, reconstructing signed provenance of the assets of releases
+// made before provenance was generated, and attaching it to each release.
+func backfillMain(args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	repo := flags.String("repo", os.Getenv("GITHUB_REPOSITORY"), "The repository, as <owner>/<repo>, whose releases to backfill.")
+	releases := flags.String("release", "", "Comma-separated tags of the releases to backfill, or 'all' for every published release without provenance assets.")
+	runID := flags.Int64("run_id", 0, "The workflow run that built the release, if only one is given (default: the latest successful run of the tagged commit before the release was published).")
+	keyPath := flags.String("key", "", "The PEM private key to sign the provenance with.")
+	outputDir := flags.String("output_dir", "", "A directory to also write the provenance of each release to, as <tag>.retroactive.intoto.jsonl, overwriting earlier copies.")
+	dryRun := flags.Bool("dry_run", false, "Reconstruct and sign the provenance without uploading it to the releases.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if err := requireOnline("backfill"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *releases == "" || *keyPath == "" {
+		fmt.Println("Both --release and --key are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if strings.Count(*repo, "/") != 1 {
+		fmt.Printf("Invalid value for flag --repo: %q\n", *repo)
+		os.Exit(1)
+	}
+	tags := parseList(*releases)
+	if *runID != 0 && (len(tags) != 1 || tags[0] == "all") {
+		fmt.Println("--run_id can only be given with a single --release")
+		os.Exit(1)
+	}
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	c, err := newGitHubClient("{}", Options{Getenv: os.Getenv})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var targets []githubRelease
+	if len(tags) == 1 && tags[0] == "all" {
+		all, err := listReleases(c, *repo)
+		if err != nil {
+			fmt.Printf("Failed to list the releases of %s: %s\n", *repo, err)
+			os.Exit(1)
+		}
+		for _, r := range all {
+			attested := false
+			for _, a := range r.Assets {
+				attested = attested || isAttestationAsset(a.Name)
+			}
+			if attested {
+				fmt.Printf("%s@%s: skipped, as it has provenance\n", *repo, r.TagName)
+				continue
+			}
+			targets = append(targets, r)
+		}
+	} else {
+		for _, tag := range tags {
+			var r githubRelease
+			if err := c.get(fmt.Sprintf("/repos/%s/releases/tags/%s", *repo, url.PathEscape(tag)), &r); err != nil {
+				fmt.Printf("Failed to read release %s@%s: %s\n", *repo, tag, err)
+				os.Exit(1)
+			}
+			targets = append(targets, r)
+		}
+	}
+	failed := 0
+	for _, r := range targets {
+		name := backfillAssetName(r.TagName)
+		exists := false
+		for _, a := range r.Assets {
+			exists = exists || a.Name == name
+		}
+		if exists {
+			fmt.Printf("%s@%s: skipped, as it has %s\n", *repo, r.TagName, name)
+			continue
+		}
+		stmt, err := backfillStatement(c, *repo, r, *runID, time.Now())
+		var line []byte
+		if err == nil {
+			line, err = signBackfill(stmt, signer)
+		}
+		if err == nil && *outputDir != "" {
+			err = writeOutput(filepath.Join(*outputDir, name), line, true)
+		}
+		if err == nil && !*dryRun {
+			err = c.upload(r.UploadURL, name, "application/jsonl", line)
+		}
+		if err != nil {
+			fmt.Printf("%s@%s: failed: %s\n", *repo, r.TagName, err)
+			failed++
+			continue
+		}
+		run := "no workflow run"
+		if stmt.Predicate.Metadata.Retroactive.Run != "" {
+			run = stmt.Predicate.Metadata.Retroactive.Run
+		}
+		action := "attached as " + name
+		if *dryRun {
+			action = "not attached (--dry_run)"
+		}
+		fmt.Printf("%s@%s: %d subjects from %s, %s\n", *repo, r.TagName, len(stmt.Subject), run, action)
+	}
+	if failed > 0 {
+		fmt.Printf("Failed to backfill %d of %d releases\n", failed, len(targets))
+		os.Exit(1)
+	}
+}
+
+// signBackfill signs stmt, returning the JSON line of its envelope.
+func signBackfill(stmt *Statement, signer Signer) ([]byte, error) {
+	payload, err := json.Marshal(stmt)
+	if err != nil {
+		return nil, err
+	}
+	env, err := signEnvelope(PayloadContentType, payload, signer)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
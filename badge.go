@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Badge statuses: whether every asset of the release has provenance that
+// verifies, some don't, or the release has no provenance at all.
+const (
+	BadgeVerified   = "verified"
+	BadgeUnverified = "unverified"
+	BadgeUnattested = "unattested"
+)
+
+// BadgeSummary is the coverage of the provenance of a repository's release,
+// published as <owner>/<repo>.json next to its badge.
+type BadgeSummary struct {
+	Repository  string `json:"repository"`
+	Release     string `json:"release"`
+	ReleaseURL  string `json:"releaseUrl"`
+	PublishedAt string `json:"publishedAt,omitempty"`
+	GeneratedAt string `json:"generatedAt"`
+	Status      string `json:"status"`
+	// SLSALevel is the SLSA build level the provenance of every asset
+	// supports, as far as it can be told from the provenance: 1 for
+	// provenance that verifies, 2 if it's also signed with --key by a builder
+	// the policy trusts, and 3 if it also records an isolated build on a
+	// GitHub-hosted runner. It is 0 unless the status is verified.
+	SLSALevel int      `json:"slsaLevel"`
+	Assets    int      `json:"assets"`
+	Attested  int      `json:"attested"`
+	Verified  int      `json:"verified"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// shieldsEndpoint is the badge as the JSON of a Shields.io endpoint badge.
+// See https://shields.io/badges/endpoint-badge
+type shieldsEndpoint struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+}
+
+// badgeColors are the hex colors of the Shields.io color names used.
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"red":         "#e05d44",
+	"lightgrey":   "#9f9f9f",
+}
+
+// badgeRelease summarizes the provenance of release of repo, as found in its
+// attestation assets and checked by gateAttestation.check.
+func badgeRelease(c *githubClient, repo string, release githubRelease, policy verifyPolicy, verifier Verifier) (*BadgeSummary, error) {
+	summary := &BadgeSummary{Repository: repo, Release: release.TagName, ReleaseURL: release.HTMLURL, Status: BadgeUnattested}
+	if release.PublishedAt != nil {
+		summary.PublishedAt = release.PublishedAt.UTC().Format(time.RFC3339)
+	}
+	attestations, err := assetAttestations(c, release)
+	if err != nil {
+		return nil, err
+	}
+	sources := gateSources{Local: attestations}
+	level := 3
+	for _, asset := range release.Assets {
+		if isAttestationAsset(asset.Name) {
+			continue
+		}
+		summary.Assets++
+		digest, err := assetDigest(c, asset.URL, asset.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", asset.Name, err)
+		}
+		artifact := gateArtifact{Name: asset.Name, Subject: Subject{Name: asset.Name, Digest: digest}}
+		verified, found, problems := sources.verify(artifact, policy, verifier)
+		if len(found) > 0 {
+			summary.Attested++
+		}
+		if verified == nil {
+			for _, p := range problems {
+				summary.Problems = append(summary.Problems, asset.Name+": "+p)
+			}
+			continue
+		}
+		summary.Verified++
+		if l := provenanceLevel(verified, verifier != nil, len(policy.TrustedBuilders) > 0); l < level {
+			level = l
+		}
+	}
+	switch {
+	case summary.Assets > 0 && summary.Verified == summary.Assets:
+		summary.Status, summary.SLSALevel = BadgeVerified, level
+	case summary.Attested > 0 || len(attestations) > 0:
+		summary.Status = BadgeUnverified
+	}
+	return summary, nil
+}
+
+// assetDigest returns the digest of the release asset at the API URL path:
+// digest, as GitHub records it for assets uploaded since it began to, or
+// else that of the asset downloaded.
+func assetDigest(c *githubClient, path, digest string) (DigestSet, error) {
+	if strings.HasPrefix(digest, "sha256:") && hexDigestPattern.MatchString(digest[len("sha256:"):]) {
+		return DigestSet{"sha256": digest[len("sha256:"):]}, nil
+	}
+	resp, err := c.doAccept(path, "", "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return digestReader(resp.Body)
+}
+
+// provenanceLevel returns the SLSA build level the verified provenance a
+// supports, where signed is set if its signature was checked and
+// trustedBuilder if its builder is one the policy trusts. The provenance
+// names its builder and describes its isolation itself, as any workflow
+// running the tool can, so neither counts unless the policy vouches for the
+// builder.
+func provenanceLevel(a *gateAttestation, signed, trustedBuilder bool) int {
+	if !signed || !trustedBuilder {
+		return 1
+	}
+	stmt, _, err := parseProvenance(a.Contents, a.URI)
+	if err != nil {
+		return 1
+	}
+	if iso := stmt.Predicate.Metadata.Isolation; iso != nil && iso.Hosting == HostingGitHub && iso.Isolated {
+		return 3
+	}
+	return 2
+}
+
+// badge returns the message and Shields.io color name of the badge of s.
+func (s *BadgeSummary) badge() (string, string) {
+	switch s.Status {
+	case BadgeVerified:
+		color := map[int]string{1: "yellowgreen", 2: "green", 3: "brightgreen"}[s.SLSALevel]
+		return fmt.Sprintf("%s L%d %s", s.Release, s.SLSALevel, s.Status), color
+	case BadgeUnverified:
+		return fmt.Sprintf("%s %d/%d verified", s.Release, s.Verified, s.Assets), "red"
+	}
+	return s.Release + " " + s.Status, "lightgrey"
+}
+
+// badgeSVG renders a flat badge of label and message in color, with text
+// widths estimated, as no font metrics are at hand.
+func badgeSVG(label, message, color string) []byte {
+	lw, mw := 10+7*len(label), 10+7*len(message)
+	w := lw + mw
+	title := html.EscapeString(label + ": " + message)
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s">`+
+		`<title>%s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%d" y="14">%s</text><text x="%d" y="14">%s</text></g></svg>`+"\n",
+		w, title, title, w, lw, lw, mw, badgeColors[color], w, lw/2, html.EscapeString(label), lw+mw/2, html.EscapeString(message)))
+}
+
+// writeBadge writes the summary s, its badge and its Shields.io endpoint to
+// dir, as <owner>/<repo>.json, .svg and .shields.json.
+func writeBadge(dir string, s *BadgeSummary) ([]string, error) {
+	base := filepath.Join(dir, filepath.FromSlash(s.Repository))
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return nil, err
+	}
+	message, color := s.badge()
+	summary, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := json.Marshal(shieldsEndpoint{1, "SLSA provenance", message, color})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{
+		base + ".json":         append(summary, '\n'),
+		base + ".svg":          badgeSVG("SLSA provenance", message, color),
+		base + ".shields.json": append(endpoint, '\n'),
+	}
+	var written []string
+	for _, name := range []string{base + ".json", base + ".svg", base + ".shields.json"} {
+		// Badges are regenerated on a schedule, so earlier ones are replaced.
+		if err := writeOutput(name, files[name], true); err != nil {
+			return written, err
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
+
+// badgeMain implements `badge --repo <owner>/<repo>,... --output_dir <dir>`,
+// summarizing the provenance of the latest release of each repository in a
+// JSON file and a badge, for publishing to GitHub Pages.
+func badgeMain(args []string) {
+	flags := flag.NewFlagSet("badge", flag.ExitOnError)
+	repos := flags.String("repo", os.Getenv("GITHUB_REPOSITORY"), "Comma-separated repositories, as <owner>/<repo>, to summarize the latest release of.")
+	tag := flags.String("release", "", "The tag of the release to summarize instead of the latest, if only one --repo is given.")
+	keyPath := flags.String("key", "", "The PEM public key the provenance must be signed with for SLSA build level 2 and up.")
+	loadPolicyFlags := addPolicyFlags(flags, "")
+	outputDir := flags.String("output_dir", "badges", "The directory to write <owner>/<repo>.json, .svg and .shields.json to.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if err := requireOnline("badge"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	list := parseList(*repos)
+	if len(list) == 0 {
+		fmt.Println("No value found for required flag: --repo")
+		flags.Usage()
+		os.Exit(1)
+	}
+	for _, repo := range list {
+		if strings.Count(repo, "/") != 1 {
+			fmt.Printf("Invalid value for flag --repo: %q\n", repo)
+			os.Exit(1)
+		}
+	}
+	if *tag != "" && len(list) != 1 {
+		fmt.Println("--release can only be given with a single --repo")
+		os.Exit(1)
+	}
+	policy, _ := loadPolicyFlags()
+	var verifier Verifier
+	if *keyPath != "" {
+		v, err := loadVerifier(*keyPath)
+		if err != nil {
+			fmt.Printf("Failed to load key: %s\n", err)
+			os.Exit(1)
+		}
+		verifier = v
+	}
+	c, err := newGitHubClient("{}", Options{Getenv: os.Getenv})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	failed := 0
+	for _, repo := range list {
+		path := fmt.Sprintf("/repos/%s/releases/latest", repo)
+		if *tag != "" {
+			path = fmt.Sprintf("/repos/%s/releases/tags/%s", repo, *tag)
+		}
+		var release githubRelease
+		err := c.get(path, &release)
+		var s *BadgeSummary
+		if err == nil {
+			s, err = badgeRelease(c, repo, release, policy, verifier)
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", repo, err)
+			failed++
+			continue
+		}
+		s.GeneratedAt = now
+		written, err := writeBadge(*outputDir, s)
+		if err != nil {
+			fmt.Printf("Failed to write the badge of %s: %s\n", repo, err)
+			os.Exit(1)
+		}
+		message, _ := s.badge()
+		fmt.Printf("%s: %s (%s)\n", repo, message, strings.Join(written, ", "))
+		for _, p := range s.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// BuildxMetadata is the part of the `docker buildx build --metadata-file`
+// output describing a built image.
+type BuildxMetadata struct {
+	ImageName  string          `json:"image.name"`
+	Digest     string          `json:"containerimage.digest"`
+	Descriptor *Descriptor     `json:"containerimage.descriptor"`
+	Provenance json.RawMessage `json:"buildx.build.provenance"`
+}
+
+// readBuildxMetadata parses a metadata file written by `docker buildx build`,
+// or by `docker buildx bake`, which keys one such document per target.
+func readBuildxMetadata(path string) ([]BuildxMetadata, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	single := BuildxMetadata{}
+	if err := json.Unmarshal(contents, &single); err != nil {
+		return nil, fmt.Errorf("parsing buildx metadata: %w", err)
+	}
+	if single.Digest != "" {
+		return []BuildxMetadata{single}, nil
+	}
+	targets := map[string]BuildxMetadata{}
+	if err := json.Unmarshal(contents, &targets); err != nil {
+		return nil, fmt.Errorf("parsing buildx metadata: %w", err)
+	}
+	var names []string
+	for name, m := range targets {
+		if m.Digest != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("buildx metadata contains no containerimage.digest")
+	}
+	sort.Strings(names)
+	var all []BuildxMetadata
+	for _, name := range names {
+		all = append(all, targets[name])
+	}
+	return all, nil
+}
+
+// subjects returns one subject per image repository the image was pushed or
+// tagged as, named without the tag.
+func (m BuildxMetadata) subjects() ([]Subject, error) {
+	if m.ImageName == "" {
+		return nil, fmt.Errorf("image %s has no image.name; tag or push it to attest it", m.Digest)
+	}
+	digest, err := parseDigest(m.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var s []Subject
+	seen := map[string]bool{}
+	for _, ref := range strings.Split(m.ImageName, ",") {
+		repo := imageRepository(strings.TrimSpace(ref))
+		if repo != "" && !seen[repo] {
+			seen[repo] = true
+			s = append(s, Subject{Name: repo, Digest: digest})
+		}
+	}
+	return s, nil
+}
+
+// platformSubjects resolves a multi-arch image index from the registry and
+// returns a subject for each per-platform manifest, because some deploy
+// systems verify the platform manifest rather than the index. Subjects are
+// named "<repository>?platform=<os>/<arch>[/<variant>]". Images that aren't
+// an index yield no subjects.
+func (m BuildxMetadata) platformSubjects(c *registryClient, images []Subject) ([]Subject, error) {
+	if len(images) == 0 || (m.Descriptor != nil && m.Descriptor.MediaType != "" && !isIndex(m.Descriptor.MediaType)) {
+		return nil, nil
+	}
+	mediaType, body, err := c.manifest(images[0].Name, m.Digest)
+	if err != nil {
+		return nil, err
+	}
+	index := ImageIndex{}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("parsing manifest of %s: %w", images[0].Name, err)
+	}
+	if index.MediaType != "" {
+		mediaType = index.MediaType
+	}
+	if !isIndex(mediaType) {
+		return nil, nil
+	}
+	var s []Subject
+	for _, desc := range index.Manifests {
+		// Skip the attestation manifests buildx attaches to the index.
+		if desc.Platform == nil || desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		digest, err := parseDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			s = append(s, Subject{
+				Name:        img.Name + "?platform=" + desc.Platform.String(),
+				Digest:      digest,
+				Annotations: map[string]string{"platform": desc.Platform.String()},
+			})
+		}
+	}
+	return s, nil
+}
+
+// layerSubjects resolves the image from the registry and returns a subject
+// for each of its layers, so that layers shared between images built from
+// the same base stages can be verified individually. Subjects are named
+// "<repository>?layer=<n>", counting from 0 at the base layer, or
+// "<repository>?platform=<os>/<arch>&layer=<n>" for the platforms of a
+// multi-arch image.
+func (m BuildxMetadata) layerSubjects(c *registryClient, images []Subject) ([]Subject, error) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+	repo := images[0].Name
+	mediaType, body, err := c.manifest(repo, m.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		ImageManifest
+		Manifests []Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("parsing manifest of %s: %w", repo, err)
+	}
+	if doc.MediaType != "" {
+		mediaType = doc.MediaType
+	}
+	if !isIndex(mediaType) {
+		return nameLayers(images, "", doc.Layers)
+	}
+	var s []Subject
+	for _, desc := range doc.Manifests {
+		if desc.Platform == nil || desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		_, body, err := c.manifest(repo, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifest := ImageManifest{}
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return nil, fmt.Errorf("parsing manifest of %s@%s: %w", repo, desc.Digest, err)
+		}
+		layers, err := nameLayers(images, "platform="+desc.Platform.String()+"&", manifest.Layers)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, layers...)
+	}
+	return s, nil
+}
+
+// nameLayers names the layers of a manifest after each of images, with
+// query prefixing the layer parameter.
+func nameLayers(images []Subject, query string, layers []Descriptor) ([]Subject, error) {
+	var s []Subject
+	for i, layer := range layers {
+		digest, err := parseDigest(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			s = append(s, Subject{Name: fmt.Sprintf("%s?%slayer=%d", img.Name, query, i), Digest: digest})
+		}
+	}
+	return s, nil
+}
+
+// buildArgs returns the "build-arg:" parameters recorded in the provenance
+// buildx attaches to its metadata, in either the SLSA v0.2 or v1 layout.
+func (m BuildxMetadata) buildArgs() (map[string]string, error) {
+	if len(m.Provenance) == 0 {
+		return nil, nil
+	}
+	var prov struct {
+		Invocation struct {
+			Parameters struct {
+				Args map[string]string `json:"args"`
+			} `json:"parameters"`
+		} `json:"invocation"`
+		BuildDefinition struct {
+			ExternalParameters struct {
+				Request struct {
+					Args map[string]string `json:"args"`
+				} `json:"request"`
+			} `json:"externalParameters"`
+		} `json:"buildDefinition"`
+	}
+	if err := json.Unmarshal(m.Provenance, &prov); err != nil {
+		return nil, fmt.Errorf("parsing buildx provenance: %w", err)
+	}
+	args := map[string]string{}
+	for _, all := range []map[string]string{prov.Invocation.Parameters.Args, prov.BuildDefinition.ExternalParameters.Request.Args} {
+		for k, v := range all {
+			if strings.HasPrefix(k, "build-arg:") {
+				args[k] = v
+			}
+		}
+	}
+	return args, nil
+}
+
+// parseDigest converts an "algorithm:hex" digest to a DigestSet.
+func parseDigest(d string) (DigestSet, error) {
+	kv := strings.SplitN(d, ":", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return nil, fmt.Errorf("malformed digest %q", d)
+	}
+	return DigestSet{kv[0]: kv[1]}, nil
+}
+
+// imageRepository strips the tag and digest from an image reference.
+func imageRepository(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// mergeArguments adds extra parameters to the workflow inputs recorded as
+// the recipe arguments. Input IDs can't contain ':', so prefixed keys such as
+// "build-arg:FOO" never collide with them.
+func mergeArguments(inputs json.RawMessage, extra map[string]string) (json.RawMessage, error) {
+	if len(extra) == 0 {
+		return inputs, nil
+	}
+	args := map[string]interface{}{}
+	if len(inputs) > 0 && string(inputs) != "null" {
+		if err := json.Unmarshal(inputs, &args); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range extra {
+		args[k] = v
+	}
+	return json.Marshal(args)
+}
+
+// buildxSubjects returns the subjects and build arguments of every image in
+// a buildx metadata file. With expandIndex, the per-platform manifests of
+// multi-arch images are added as subjects too, and with layers, the layers
+// of every image.
+func buildxSubjects(path string, expandIndex, layers bool) ([]Subject, map[string]string, error) {
+	images, err := readBuildxMetadata(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var subjects []Subject
+	args := map[string]string{}
+	for _, img := range images {
+		s, err := img.subjects()
+		if err != nil {
+			return nil, nil, err
+		}
+		subjects = append(subjects, s...)
+		if expandIndex {
+			platforms, err := img.platformSubjects(newRegistryClient(), s)
+			if err != nil {
+				return nil, nil, err
+			}
+			subjects = append(subjects, platforms...)
+		}
+		if layers {
+			l, err := img.layerSubjects(newRegistryClient(), s)
+			if err != nil {
+				return nil, nil, err
+			}
+			subjects = append(subjects, l...)
+		}
+		imgArgs, err := img.buildArgs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range imgArgs {
+			if prev, ok := args[k]; ok && prev != v {
+				return nil, nil, fmt.Errorf("images were built with conflicting values for %s", k)
+			}
+			args[k] = v
+		}
+	}
+	return subjects, args, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CacheRestore is a cache restored during the job, e.g. by actions/cache.
+// Restored caches are inputs of the build that no material records: their
+// contents aren't hashed, but a cache key can't be overwritten, so the key
+// identifies what was restored. It is an extension to the SLSA v0.1
+// metadata.
+type CacheRestore struct {
+	// Key is the key the cache was looked up with, and MatchedKey that of
+	// the cache restored, which differs when a restore key matched.
+	Key        string `json:"key"`
+	MatchedKey string `json:"matchedKey"`
+	ExactMatch bool   `json:"exactMatch"`
+	Path       string `json:"path,omitempty"`
+}
+
+// readRestoredCaches reads the caches restored in the job from path, a
+// stream of JSON objects such as the outputs of actions/cache steps,
+// written with `echo '${{ toJSON(steps.<id>.outputs) }}' >> <path>`. The
+// keys may also be given as key, matched_key and path. Caches that were
+// looked up but not restored are skipped.
+func readRestoredCaches(path string) ([]CacheRestore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var caches []CacheRestore
+	dec := json.NewDecoder(f)
+	for {
+		var entry struct {
+			PrimaryKey string `json:"cache-primary-key"`
+			MatchedKey string `json:"cache-matched-key"`
+			Hit        string `json:"cache-hit"`
+			Key        string `json:"key"`
+			Matched    string `json:"matched_key"`
+			Path       string `json:"path"`
+		}
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		c := CacheRestore{Key: entry.PrimaryKey, MatchedKey: entry.MatchedKey, Path: entry.Path}
+		if c.Key == "" {
+			c.Key = entry.Key
+		}
+		if c.MatchedKey == "" {
+			c.MatchedKey = entry.Matched
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("%s has a cache without a key", path)
+		}
+		if c.MatchedKey == "" && entry.Hit == "true" {
+			// actions/cache before v4 only reports exact hits.
+			c.MatchedKey = c.Key
+		}
+		if c.MatchedKey == "" {
+			continue
+		}
+		c.ExactMatch = c.MatchedKey == c.Key
+		caches = append(caches, c)
+	}
+	return caches, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The local CAS stores each provenance file under its own digest, in
+// objects/sha256/<hex>, and indexes it by the sha256 digest of each of its
+// subjects, in subjects/sha256/<hex>, which lists the digests of the
+// provenance attesting that subject, one per line.
+
+// defaultCASDir returns the default location of the local CAS, e.g.
+// ~/.cache/provenance/cas on Linux.
+func defaultCASDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "provenance", "cas")
+}
+
+// casObjects is the directory of the provenance objects of the CAS at dir,
+// which can be read as a provenance store.
+func casObjects(dir string) string {
+	return filepath.Join(dir, "objects", "sha256")
+}
+
+// casAdd stores the provenance payload in the CAS at dir and indexes it by
+// the sha256 digests of its subjects.
+func casAdd(dir string, payload []byte, subjects []Subject) error {
+	sum := sha256.Sum256(payload)
+	digest := hex.EncodeToString(sum[:])
+	object := filepath.Join(casObjects(dir), digest)
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := writeCacheFile(object, payload); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	index := filepath.Join(dir, "subjects", "sha256")
+	if err := os.MkdirAll(index, 0700); err != nil {
+		return err
+	}
+	for _, s := range subjects {
+		d := s.Digest["sha256"]
+		if !hexDigestPattern.MatchString(d) {
+			continue
+		}
+		if err := casIndex(dir, d, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// casIndex adds digest, that of provenance in the CAS at dir, to the index
+// of the subject with the given sha256 digest, unless it's indexed already.
+// The index is locked, so that of jobs adding the same provenance, one
+// indexes it.
+func casIndex(dir, subject, digest string) error {
+	return addToIndex(filepath.Join(dir, "subjects", "sha256", subject), digest)
+}
+
+// addToIndex adds digest to the index file at path, a list of digests, one
+// per line, unless it's listed already.
+func addToIndex(path, digest string) (err error) {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unlock(); err == nil {
+			err = uerr
+		}
+	}()
+	existing, err := readIndex(path)
+	if err != nil {
+		return err
+	}
+	if stringSet(existing...)[digest] {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(digest + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// casLookup returns the digests of the provenance in the CAS at dir that
+// attests the subject with the given sha256 digest, oldest first.
+func casLookup(dir, digest string) ([]string, error) {
+	if !hexDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("malformed sha256 digest %q", digest)
+	}
+	return readIndex(filepath.Join(dir, "subjects", "sha256", digest))
+}
+
+// readIndex returns the digests listed in the index file at path, oldest
+// first, or none if it doesn't exist.
+func readIndex(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseIndex(contents), nil
+}
+
+// parseIndex returns the digests listed in an index file.
+func parseIndex(contents []byte) []string {
+	var digests []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); hexDigestPattern.MatchString(line) {
+			digests = append(digests, line)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudCreds holds the short-lived cloud credentials --cloud_auth exchanged
+// the workflow's OIDC token for, or is nil. Clients of cloud services prefer
+// them to the credentials of the environment.
+var cloudCreds *cloudCredentials
+
+// cloudCredentials are the credentials of one cloud provider.
+type cloudCredentials struct {
+	Provider string
+	// AWS is set for aws, and AccessToken, the OAuth 2.0 bearer token, for
+	// gcp and azure.
+	AWS         *awsCredentials
+	AccessToken string
+	Expiration  time.Time
+
+	// registries caches the registry credentials derived from them by host.
+	mu         sync.Mutex
+	registries map[string][2]string
+}
+
+// awsCredentials are AWS access keys, such as AWS STS issues.
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsEnvCredentials returns the AWS credentials of --cloud_auth, or else those
+// in $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, or
+// nil if there are none.
+func awsEnvCredentials(getenv func(string) string) *awsCredentials {
+	if cloudCreds != nil && cloudCreds.AWS != nil {
+		return cloudCreds.AWS
+	}
+	c := &awsCredentials{getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY"), getenv("AWS_SESSION_TOKEN")}
+	if c.AccessKeyId == "" || c.SecretAccessKey == "" {
+		return nil
+	}
+	return c
+}
+
+// The endpoints of GCP's token exchange, which aren't configurable.
+const (
+	gcpSTSURL         = "https://sts.googleapis.com/v1/token"
+	gcpIAMCredentials = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+)
+
+// gcpProviderPattern matches the resource name of a workload identity pool
+// provider.
+var gcpProviderPattern = regexp.MustCompile(`^projects/[0-9]+/locations/global/workloadIdentityPools/[^/]+/providers/[^/]+$`)
+
+// addCloudAuthFlags adds --cloud_auth to flags. The returned function
+// exchanges the OIDC token for the credentials it names, if any, once flags
+// are parsed.
+func addCloudAuthFlags(flags *flag.FlagSet) func() error {
+	spec := flags.String("cloud_auth", "", "Exchange the workflow's GitHub OIDC token for short-lived cloud credentials, used for registries and s3:// stores: aws:<role ARN>, gcp:<workload identity provider>[:<service account>] or azure:<tenant id>/<client id>. Needs permissions: id-token: write.")
+	return func() error {
+		if *spec == "" {
+			return nil
+		}
+		if err := requireOnline("--cloud_auth"); err != nil {
+			return err
+		}
+		c, err := exchangeCloudCredentials(*spec, newHTTPClient(30*time.Second), os.Getenv)
+		if err != nil {
+			return fmt.Errorf("--cloud_auth %s: %w", *spec, err)
+		}
+		cloudCreds = c
+		return nil
+	}
+}
+
+// exchangeCloudCredentials exchanges the OIDC token of the job for the
+// credentials of spec, as addCloudAuthFlags documents.
+func exchangeCloudCredentials(spec string, client *http.Client, getenv func(string) string) (*cloudCredentials, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("not of the form <provider>:<identity>")
+	}
+	switch parts[0] {
+	case "aws":
+		if !strings.HasPrefix(parts[1], "arn:") {
+			return nil, fmt.Errorf("%q is not a role ARN", parts[1])
+		}
+		return exchangeAWS(parts[1], client, getenv)
+	case "gcp":
+		provider, serviceAccount := parts[1], ""
+		if i := strings.Index(provider, ":"); i >= 0 {
+			provider, serviceAccount = provider[:i], provider[i+1:]
+		}
+		if !gcpProviderPattern.MatchString(provider) {
+			return nil, fmt.Errorf("%q is not a workload identity provider, projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>", provider)
+		}
+		return exchangeGCP(provider, serviceAccount, client, getenv)
+	case "azure":
+		ids := strings.Split(parts[1], "/")
+		if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form <tenant id>/<client id>", parts[1])
+		}
+		return exchangeAzure(ids[0], ids[1], client, getenv)
+	default:
+		return nil, fmt.Errorf("unknown cloud provider %q: want aws, gcp or azure", parts[0])
+	}
+}
+
+// githubIDToken requests an OIDC token for audience from the Actions runtime,
+// which provides it to jobs with the id-token: write permission.
+// See https://docs.github.com/en/actions/deployment/security-hardening-your-deployments/about-security-hardening-with-openid-connect
+func githubIDToken(audience string, client *http.Client, getenv func(string) string) (string, error) {
+	requestURL, requestToken := getenv("ACTIONS_ID_TOKEN_REQUEST_URL"), getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestURL == "" || requestToken == "" {
+		return "", errors.New("no GitHub OIDC token is available; the job needs `permissions: id-token: write`")
+	}
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing $ACTIONS_ID_TOKEN_REQUEST_URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("audience", audience)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting the GitHub OIDC token: %s", resp.Status)
+	}
+	var t struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("requesting the GitHub OIDC token: %w", err)
+	}
+	if t.Value == "" {
+		return "", errors.New("requesting the GitHub OIDC token: the response has no token")
+	}
+	return t.Value, nil
+}
+
+// awsRegion returns the region of $AWS_REGION or $AWS_DEFAULT_REGION, or
+// us-east-1.
+func awsRegion(getenv func(string) string) string {
+	if r := getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	if r := getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r
+	}
+	return "us-east-1"
+}
+
+// awsEndpoint returns the endpoint of service at host, or the one
+// $AWS_ENDPOINT_URL_<SERVICE> sets, as for the AWS SDKs.
+func awsEndpoint(service, host string, getenv func(string) string) string {
+	if e := getenv("AWS_ENDPOINT_URL_" + service); e != "" {
+		return strings.TrimSuffix(e, "/")
+	}
+	return "https://" + host
+}
+
+// exchangeAWS assumes role for an hour with AWS STS
+// AssumeRoleWithWebIdentity, which needs no credentials of its own.
+// See https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRoleWithWebIdentity.html
+func exchangeAWS(role string, client *http.Client, getenv func(string) string) (*cloudCredentials, error) {
+	token, err := githubIDToken("sts.amazonaws.com", client, getenv)
+	if err != nil {
+		return nil, err
+	}
+	session := "provenance"
+	if id := getenv("GITHUB_RUN_ID"); id != "" {
+		session += "-" + id
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {token},
+		"DurationSeconds":  {"3600"},
+	}
+	resp, err := client.PostForm(awsEndpoint("STS", "sts."+awsRegion(getenv)+".amazonaws.com", getenv)+"/", form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		if xml.Unmarshal(body, &e) == nil && e.Error.Code != "" {
+			return nil, fmt.Errorf("assuming %s: %s: %s", role, e.Error.Code, e.Error.Message)
+		}
+		return nil, fmt.Errorf("assuming %s: %s", role, resp.Status)
+	}
+	var r struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("assuming %s: %w", role, err)
+	}
+	if r.Credentials.AccessKeyId == "" {
+		return nil, fmt.Errorf("assuming %s: the response has no credentials", role)
+	}
+	c := r.Credentials
+	return &cloudCredentials{
+		Provider:   "aws",
+		AWS:        &awsCredentials{c.AccessKeyId, c.SecretAccessKey, c.SessionToken},
+		Expiration: c.Expiration,
+	}, nil
+}
+
+// exchangeGCP exchanges the OIDC token with GCP STS for a federated access
+// token of provider's workload identity pool and, if serviceAccount is set,
+// that for an access token of the service account, as
+// google-github-actions/auth does.
+// See https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+func exchangeGCP(provider, serviceAccount string, client *http.Client, getenv func(string) string) (*cloudCredentials, error) {
+	token, err := githubIDToken("https://iam.googleapis.com/"+provider, client, getenv)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{
+		"audience":           "//iam.googleapis.com/" + provider,
+		"grantType":          "urn:ietf:params:oauth:grant-type:token-exchange",
+		"requestedTokenType": "urn:ietf:params:oauth:token-type:access_token",
+		"scope":              "https://www.googleapis.com/auth/cloud-platform",
+		"subjectToken":       token,
+		"subjectTokenType":   "urn:ietf:params:oauth:token-type:jwt",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var federated struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	resp, err := client.Post(gcpSTSURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	err = decodeTokenResponse(resp, &federated)
+	if err == nil && federated.AccessToken == "" {
+		err = errors.New("the response has no token")
+	}
+	if err != nil {
+		if federated.ErrorDescription != "" {
+			err = errors.New(federated.ErrorDescription)
+		}
+		return nil, fmt.Errorf("exchanging the OIDC token with %s: %w", provider, err)
+	}
+	c := &cloudCredentials{
+		Provider:    "gcp",
+		AccessToken: federated.AccessToken,
+		Expiration:  time.Now().Add(time.Duration(federated.ExpiresIn) * time.Second).UTC(),
+	}
+	if serviceAccount == "" {
+		return c, nil
+	}
+	body, err = json.Marshal(map[string]interface{}{
+		"scope":    []string{"https://www.googleapis.com/auth/cloud-platform"},
+		"lifetime": "3600s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, gcpIAMCredentials+url.PathEscape(serviceAccount)+":generateAccessToken", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+	if resp, err = client.Do(req); err != nil {
+		return nil, err
+	}
+	var impersonated struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+		Error       struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	err = decodeTokenResponse(resp, &impersonated)
+	if err == nil && impersonated.AccessToken == "" {
+		err = errors.New("the response has no token")
+	}
+	if err != nil {
+		if impersonated.Error.Message != "" {
+			err = errors.New(impersonated.Error.Message)
+		}
+		return nil, fmt.Errorf("impersonating %s: %w", serviceAccount, err)
+	}
+	c.AccessToken, c.Expiration = impersonated.AccessToken, impersonated.ExpireTime
+	return c, nil
+}
+
+// exchangeAzure requests an Azure Resource Manager access token of the
+// Microsoft Entra application clientID, which has a federated credential
+// trusting the repository, presenting the OIDC token as its client
+// assertion. The authority is $AZURE_AUTHORITY_HOST, as for the Azure SDKs.
+// See https://learn.microsoft.com/en-us/entra/identity-platform/v2-oauth2-client-creds-grant-flow#third-case-access-token-request-with-a-federated-credential
+func exchangeAzure(tenant, clientID string, client *http.Client, getenv func(string) string) (*cloudCredentials, error) {
+	token, err := githubIDToken("api://AzureADTokenExchange", client, getenv)
+	if err != nil {
+		return nil, err
+	}
+	authority := getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+	form := url.Values{
+		"client_id":             {clientID},
+		"scope":                 {"https://management.azure.com/.default"},
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {token},
+	}
+	resp, err := client.PostForm(strings.TrimSuffix(authority, "/")+"/"+url.PathEscape(tenant)+"/oauth2/v2.0/token", form)
+	if err != nil {
+		return nil, err
+	}
+	var t struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = decodeTokenResponse(resp, &t)
+	if err == nil && t.AccessToken == "" {
+		err = errors.New("the response has no token")
+	}
+	if err != nil {
+		if t.ErrorDescription != "" {
+			err = errors.New(t.ErrorDescription)
+		}
+		return nil, fmt.Errorf("requesting a token of %s in tenant %s: %w", clientID, tenant, err)
+	}
+	return &cloudCredentials{
+		Provider:    "azure",
+		AccessToken: t.AccessToken,
+		Expiration:  time.Now().Add(time.Duration(t.ExpiresIn) * time.Second).UTC(),
+	}, nil
+}
+
+// decodeTokenResponse decodes the JSON body of resp into v, which is decoded
+// even for errors so that callers can report their descriptions, and closes
+// it.
+func decodeTokenResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return err
+}
+
+// Registries whose credentials are derived from cloud credentials.
+var (
+	ecrHostPattern = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com$`)
+	gcpHostPattern = regexp.MustCompile(`^([a-z0-9-]+\.)?gcr\.io$|^[a-z0-9-]+-docker\.pkg\.dev$`)
+	acrHostPattern = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.io$`)
+)
+
+// registryCredentials returns the username and password to log in to the
+// registry at host with, if c is for the cloud it belongs to: an Amazon ECR
+// authorization token, a Google access token, or an Azure Container Registry
+// refresh token.
+func (c *cloudCredentials) registryCredentials(host string, client *http.Client) (string, string, bool, error) {
+	if c == nil {
+		return "", "", false, nil
+	}
+	var login func() (string, string, error)
+	switch {
+	case c.Provider == "aws" && ecrHostPattern.MatchString(host):
+		login = func() (string, string, error) {
+			return ecrLogin(ecrHostPattern.FindStringSubmatch(host)[1], c.AWS, client, os.Getenv)
+		}
+	case c.Provider == "gcp" && gcpHostPattern.MatchString(host):
+		return "oauth2accesstoken", c.AccessToken, true, nil
+	case c.Provider == "azure" && acrHostPattern.MatchString(host):
+		login = func() (string, string, error) {
+			return acrLogin(host, c.AccessToken, client)
+		}
+	default:
+		return "", "", false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if login, ok := c.registries[host]; ok {
+		return login[0], login[1], true, nil
+	}
+	user, pass, err := login()
+	if err != nil {
+		return "", "", false, fmt.Errorf("logging in to %s: %w", host, err)
+	}
+	if c.registries == nil {
+		c.registries = map[string][2]string{}
+	}
+	c.registries[host] = [2]string{user, pass}
+	return user, pass, true, nil
+}
+
+// ecrLogin returns the credentials of an Amazon ECR authorization token for
+// the registries of region.
+// See https://docs.aws.amazon.com/AmazonECR/latest/APIReference/API_GetAuthorizationToken.html
+func ecrLogin(region string, creds *awsCredentials, client *http.Client, getenv func(string) string) (string, string, error) {
+	body := []byte("{}")
+	req, err := http.NewRequest(http.MethodPost, awsEndpoint("ECR", "api.ecr."+region+".amazonaws.com", getenv)+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	signAWSRequest(req, body, "ecr", region, creds, time.Now().UTC())
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	var r struct {
+		AuthorizationData []struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+		Message string `json:"message"`
+	}
+	err = decodeTokenResponse(resp, &r)
+	if err == nil && len(r.AuthorizationData) == 0 {
+		err = errors.New("the response has no authorization token")
+	}
+	if err != nil {
+		if r.Message != "" {
+			err = errors.New(r.Message)
+		}
+		return "", "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(r.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return "", "", fmt.Errorf("decoding the authorization token: %w", err)
+	}
+	kv := strings.SplitN(string(decoded), ":", 2)
+	if len(kv) != 2 {
+		return "", "", errors.New("the authorization token is not of the form <user>:<password>")
+	}
+	return kv[0], kv[1], nil
+}
+
+// acrLogin exchanges an Azure access token for a refresh token of the Azure
+// Container Registry at host, which, as `az acr login` does, is the password
+// of its null GUID user.
+// See https://github.com/Azure/acr/blob/main/docs/AAD-OAuth.md
+func acrLogin(host, accessToken string, client *http.Client) (string, string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	resp, err := client.PostForm(registryScheme(host)+"://"+host+"/oauth2/exchange", form)
+	if err != nil {
+		return "", "", err
+	}
+	var t struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = decodeTokenResponse(resp, &t)
+	if err == nil && t.RefreshToken == "" {
+		err = errors.New("the response has no refresh token")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return "00000000-0000-0000-0000-000000000000", t.RefreshToken, nil
+}
+
+// signAWSRequest signs req, whose body is payload, for service in region
+// with AWS Signature Version 4. The query of req, if any, must already be
+// in canonical order. If creds is nil, req is sent anonymously.
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv.html
+func signAWSRequest(req *http.Request, payload []byte, service, region string, creds *awsCredentials, now time.Time) {
+	if creds == nil {
+		return
+	}
+	payloadSum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+	amzDate := now.Format("20060102T150405Z")
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = req.Header.Get(name)
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	scope := now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyId, scope, signedHeaders, signature))
+}
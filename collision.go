@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// CollisionKeep keeps subjects whose names collide, reporting a
+	// CodeNameCollision finding.
+	CollisionKeep = "keep"
+	// CollisionError refuses to generate provenance when names collide.
+	CollisionError = "error"
+	// CollisionRename renames every colliding subject but the first by adding
+	// a "~N" suffix before its extension.
+	CollisionRename = "rename"
+)
+
+// foldName returns the key under which name is stored on case-insensitive,
+// normalization-insensitive file systems such as macOS's APFS and HFS+.
+func foldName(name string) string {
+	return cases.Fold().String(norm.NFC.String(name))
+}
+
+// resolveCollisions applies policy to subjects whose names differ only by
+// case or Unicode normalization, which verify against different files
+// depending on the file system the artifacts are checked out on. Subjects
+// with identical names are left alone.
+func resolveCollisions(subjects []Subject, policy string, findings *Findings) ([]Subject, error) {
+	first := map[string]string{}
+	taken := map[string]bool{}
+	for _, s := range subjects {
+		taken[foldName(s.Name)] = true
+	}
+	for i, s := range subjects {
+		key := foldName(s.Name)
+		name, ok := first[key]
+		if !ok {
+			first[key] = s.Name
+			continue
+		}
+		if name == s.Name {
+			continue
+		}
+		switch policy {
+		case CollisionError:
+			return nil, fmt.Errorf("subjects %+q and %+q differ only by case or Unicode normalization", name, s.Name)
+		case CollisionRename:
+			renamed := renameSubject(s.Name, taken)
+			findings.add(CodeNameCollision, "subject %+q collides with %+q and was renamed to %+q", s.Name, name, renamed)
+			subjects[i].Name = renamed
+		default:
+			findings.add(CodeNameCollision, "subjects %+q and %+q differ only by case or Unicode normalization", name, s.Name)
+		}
+	}
+	return subjects, nil
+}
+
+// renameSubject returns the first of name~2, name~3, ... (with the suffix
+// placed before the extension) that doesn't collide with a taken name.
+func renameSubject(name string, taken map[string]bool) string {
+	ext := path.Ext(name)
+	if strings.HasPrefix(path.Base(name), ".") && path.Base(name) == ext {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s~%d%s", stem, n, ext)
+		if key := foldName(candidate); !taken[key] {
+			taken[key] = true
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// commandsLogEntry is a line of a commands log: a build command run by a shell
+// shim, given either as its argv or as the command line it was run with.
+type commandsLogEntry struct {
+	Command    json.RawMessage `json:"command"`
+	ExitCode   int             `json:"exitCode"`
+	StartedOn  string          `json:"startedOn"`
+	FinishedOn string          `json:"finishedOn"`
+}
+
+// readCommandsLog reads the build commands run in the job from path, a stream
+// of JSON objects with the command, its exitCode and when it startedOn and
+// finishedOn, in RFC 3339. It returns them as recorded in metadata.commands,
+// whose durations are omitted if reproducible, and when the first command
+// started.
+func readCommandsLog(path string, reproducible bool) ([]CommandTrace, time.Time, error) {
+	var first time.Time
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, first, err
+	}
+	defer f.Close()
+	var commands []CommandTrace
+	dec := json.NewDecoder(f)
+	for n := 1; ; n++ {
+		var entry commandsLogEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, first, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		var c CommandTrace
+		var line string
+		if err := json.Unmarshal(entry.Command, &c.Command); err != nil {
+			if err := json.Unmarshal(entry.Command, &line); err != nil {
+				return nil, first, fmt.Errorf("command %d of %s is neither an argv nor a command line", n, path)
+			}
+			// The shell the line was run with isn't known, so the line is
+			// recorded as is.
+			c.Command = []string{line}
+		}
+		if len(c.Command) == 0 || strings.TrimSpace(c.Command[0]) == "" {
+			return nil, first, fmt.Errorf("command %d of %s is empty", n, path)
+		}
+		c.ExitCode = entry.ExitCode
+		started, err := time.Parse(time.RFC3339, entry.StartedOn)
+		if err != nil {
+			return nil, first, fmt.Errorf("command %d of %s has an invalid startedOn: %w", n, path, err)
+		}
+		finished, err := time.Parse(time.RFC3339, entry.FinishedOn)
+		if err != nil {
+			return nil, first, fmt.Errorf("command %d of %s has an invalid finishedOn: %w", n, path, err)
+		}
+		if finished.Before(started) {
+			return nil, first, fmt.Errorf("command %d of %s finished before it started", n, path)
+		}
+		if first.IsZero() || started.Before(first) {
+			first = started
+		}
+		if !reproducible {
+			c.Duration = finished.Sub(started).String()
+		}
+		commands = append(commands, c)
+	}
+	return commands, first, nil
+}
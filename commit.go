@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SourceCommit is the source-integrity evidence of the commit built: who
+// authored and committed it, and whether it, and the tag the run was started
+// for, are signed with a signature GitHub verified.
+type SourceCommit struct {
+	SHA          string           `json:"sha"`
+	URL          string           `json:"url,omitempty"`
+	Author       GitIdentity      `json:"author"`
+	Committer    GitIdentity      `json:"committer"`
+	Verification SignatureStatus  `json:"verification"`
+	Tag          *SourceCommitTag `json:"tag,omitempty"`
+}
+
+// SourceCommitTag is the tag of a run started by a tag push. Only annotated
+// tags have a tagger and can be signed.
+type SourceCommitTag struct {
+	Name         string           `json:"name"`
+	Annotated    bool             `json:"annotated"`
+	Tagger       *GitIdentity     `json:"tagger,omitempty"`
+	Verification *SignatureStatus `json:"verification,omitempty"`
+}
+
+// GitIdentity is an author, committer or tagger as git records it, with the
+// GitHub account it maps to, if any. The email is redacted if "email"
+// matches the scrub fields.
+type GitIdentity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+	Login string `json:"login,omitempty"`
+}
+
+// SignatureStatus is GitHub's verification of the signature of a commit or
+// tag. Format is "gpg", "ssh" or "x509", or empty if it's unsigned, and
+// Reason is GitHub's, e.g. "valid" or "unknown_key".
+type SignatureStatus struct {
+	Verified bool   `json:"verified"`
+	Format   string `json:"format,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type apiVerification struct {
+	Verified  bool   `json:"verified"`
+	Reason    string `json:"reason"`
+	Signature string `json:"signature"`
+}
+
+type apiGitIdentity struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+func (v apiVerification) status() SignatureStatus {
+	s := SignatureStatus{Verified: v.Verified, Reason: v.Reason}
+	switch {
+	case strings.HasPrefix(v.Signature, "-----BEGIN PGP SIGNATURE"):
+		s.Format = "gpg"
+	case strings.HasPrefix(v.Signature, "-----BEGIN SSH SIGNATURE"):
+		s.Format = "ssh"
+	case strings.HasPrefix(v.Signature, "-----BEGIN SIGNED MESSAGE"):
+		s.Format = "x509"
+	}
+	return s
+}
+
+func (i apiGitIdentity) identity(login string, opts Options) GitIdentity {
+	id := GitIdentity{Name: i.Name, Email: i.Email, Date: i.Date, Login: login}
+	if matchesAny("email", opts.ScrubFields) {
+		id.Email = Redacted
+	}
+	return id
+}
+
+// recordCommit reads the source-integrity evidence of the commit of the run
+// described by the github context from the API. A commit, or tag, that
+// isn't signed and verified is reported as an unverified-commit finding.
+func recordCommit(gh GitHubContext, opts Options, findings *Findings) (*SourceCommit, error) {
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	repo := "/repos/" + gh.Repository
+	var commit struct {
+		SHA     string `json:"sha"`
+		HTMLURL string `json:"html_url"`
+		Commit  struct {
+			Author       apiGitIdentity  `json:"author"`
+			Committer    apiGitIdentity  `json:"committer"`
+			Verification apiVerification `json:"verification"`
+		} `json:"commit"`
+		// The accounts are null if the emails map to none.
+		Author *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+		Committer *struct {
+			Login string `json:"login"`
+		} `json:"committer"`
+	}
+	if err := c.get(repo+"/commits/"+url.PathEscape(gh.SHA), &commit); err != nil {
+		return nil, fmt.Errorf("reading commit %s: %w", gh.SHA, err)
+	}
+	var author, committer string
+	if commit.Author != nil {
+		author = commit.Author.Login
+	}
+	if commit.Committer != nil {
+		committer = commit.Committer.Login
+	}
+	sc := &SourceCommit{
+		SHA:          commit.SHA,
+		URL:          commit.HTMLURL,
+		Author:       commit.Commit.Author.identity(author, opts),
+		Committer:    commit.Commit.Committer.identity(committer, opts),
+		Verification: commit.Commit.Verification.status(),
+	}
+	if !sc.Verification.Verified {
+		findings.add(CodeUnverifiedCommit, "commit %s is not signed with a verified signature (%s)", gh.SHA, sc.Verification.Reason)
+	}
+	if !strings.HasPrefix(gh.Ref, "refs/tags/") {
+		return sc, nil
+	}
+	name := strings.TrimPrefix(gh.Ref, "refs/tags/")
+	var ref struct {
+		Object struct {
+			Type string `json:"type"`
+			SHA  string `json:"sha"`
+		} `json:"object"`
+	}
+	segments := strings.Split(name, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	if err := c.get(repo+"/git/ref/tags/"+strings.Join(segments, "/"), &ref); err != nil {
+		return nil, fmt.Errorf("reading tag %s: %w", name, err)
+	}
+	sc.Tag = &SourceCommitTag{Name: name, Annotated: ref.Object.Type == "tag"}
+	if !sc.Tag.Annotated {
+		findings.add(CodeUnverifiedCommit, "tag %s is a lightweight tag, which can't be signed", name)
+		return sc, nil
+	}
+	var tag struct {
+		Tagger       apiGitIdentity  `json:"tagger"`
+		Verification apiVerification `json:"verification"`
+	}
+	if err := c.get(repo+"/git/tags/"+url.PathEscape(ref.Object.SHA), &tag); err != nil {
+		return nil, fmt.Errorf("reading tag %s: %w", name, err)
+	}
+	tagger := tag.Tagger.identity("", opts)
+	status := tag.Verification.status()
+	sc.Tag.Tagger, sc.Tag.Verification = &tagger, &status
+	if !status.Verified {
+		findings.add(CodeUnverifiedCommit, "tag %s is not signed with a verified signature (%s)", name, status.Reason)
+	}
+	return sc, nil
+}
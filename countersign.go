@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// countersign appends a signature by signer to env, which must already be
+// signed by verifier, e.g. the key of the build. The payload is left as is,
+// so the signatures already on env stay valid.
+func countersign(env *Envelope, verifier Verifier, signer Signer) error {
+	payload, err := verifyEnvelope(env, verifier)
+	if err != nil {
+		return err
+	}
+	if env.PayloadType == PayloadContentType {
+		stmt := &Statement{}
+		if err := decodeStatement(payload, stmt); err != nil {
+			return fmt.Errorf("parsing envelope payload: %w", err)
+		}
+		if stmt.Type != StatementV01Type && stmt.Type != StatementV1Type {
+			return errors.New("envelope payload is not an in-toto statement")
+		}
+	}
+	msg := pae(env.PayloadType, payload)
+	self := &keyVerifier{key: signer.Public()}
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if s.KeyId == signer.KeyId() || (err == nil && self.Verify(msg, sig) == nil) {
+			return errors.New("envelope is already signed with the countersigning key")
+		}
+	}
+	sig, err := signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	env.Signatures = append(env.Signatures, Signature{KeyId: signer.KeyId(), Sig: base64.StdEncoding.EncodeToString(sig)})
+	return nil
+}
+
+// countersignMain implements `countersign --envelope <file> --verify_key
+// <key> --key <key>`, adding a second signature, e.g. a release manager's,
+// to a signed envelope without regenerating its statement.
+func countersignMain(args []string) {
+	flags := flag.NewFlagSet("countersign", flag.ExitOnError)
+	envelopePath := flags.String("envelope", "", "The DSSE envelope to countersign.")
+	verifyKey := flags.String("verify_key", "", "The PEM public key the envelope must already be signed with.")
+	keyPath := flags.String("key", "", "The PEM private key to countersign with.")
+	outputPath := flags.String("output_path", "", "Path to write the countersigned envelope to (default: --envelope, in place).")
+	flags.Parse(args)
+	if *envelopePath == "" || *verifyKey == "" || *keyPath == "" {
+		fmt.Println("--envelope, --verify_key and --key are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *outputPath == "" {
+		*outputPath = *envelopePath
+	}
+	verifier, err := loadVerifier(*verifyKey)
+	if err != nil {
+		fmt.Printf("Failed to load verification key: %s\n", err)
+		os.Exit(1)
+	}
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	contents, err := readAttestationFile(*envelopePath)
+	if err != nil {
+		fmt.Printf("Failed to read envelope: %s\n", err)
+		os.Exit(1)
+	}
+	env := &Envelope{}
+	if err := json.Unmarshal(contents, env); err != nil || env.PayloadType == "" {
+		fmt.Printf("%s is not a DSSE envelope\n", *envelopePath)
+		os.Exit(1)
+	}
+	if err := countersign(env, verifier, signer); err != nil {
+		fmt.Printf("Failed to countersign %s: %s\n", *envelopePath, err)
+		os.Exit(1)
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*outputPath, out, 0644); err != nil {
+		fmt.Printf("Failed to write envelope: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Countersigned with key %s (%d signatures): %s\n", signer.KeyId(), len(env.Signatures), *outputPath)
+}
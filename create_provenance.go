@@ -1,36 +1,132 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 const (
-	GitHubHostedIdSuffix = "/Attestations/GitHubHostedActions@v1"
-	SelfHostedIdSuffix   = "/Attestations/SelfHostedActions@v1"
-	TypeId               = "https://github.com/Attestations/GitHubActionsWorkflow@v1"
-	PayloadContentType   = "application/vnd.in-toto+json"
+	GitHubHostedIdSuffix        = "/Attestations/GitHubHostedActions@v1"
+	SelfHostedIdSuffix          = "/Attestations/SelfHostedActions@v1"
+	SelfHostedEphemeralIdSuffix = "/Attestations/SelfHostedEphemeralActions@v1"
+	TypeId                      = "https://github.com/Attestations/GitHubActionsWorkflow@v1"
+	PayloadContentType          = "application/vnd.in-toto+json"
 )
 
+// Output formats: the in-toto Statement, or only its predicate, for tools
+// such as `cosign attest --predicate` that build the Statement themselves.
+const (
+	FormatStatement = "statement"
+	FormatPredicate = "predicate"
+)
+
+// EnvelopeDSSE wraps the Statement in a DSSE envelope, as cosign,
+// slsa-verifier and Rekor expect.
+const EnvelopeDSSE = "dsse"
+
 var (
-	artifactPath  = flag.String("artifact_path", "", "The file or dir path of the artifacts for which provenance should be generated.")
-	outputPath    = flag.String("output_path", "build.provenance", "The path to which the generated provenance should be written.")
-	githubContext = flag.String("github_context", "", "The '${github}' context value.")
-	runnerContext = flag.String("runner_context", "", "The '${runner}' context value.")
+	artifactPath        = newPathList("artifact_path", "The file or dir path, or glob pattern, of the artifacts for which provenance should be generated. May be repeated.")
+	buildxMetadata      = flag.String("buildx_metadata_file", "", "The file written by `docker buildx build --metadata-file`. The images it describes are added as subjects and their build args as recipe arguments.")
+	expandIndex         = flag.Bool("expand_image_index", false, "For multi-arch images from --buildx_metadata_file, also attest each per-platform manifest, resolved from the registry.")
+	imageLayers         = flag.Bool("image_layers", false, "For images from --buildx_metadata_file, also attest each layer, resolved from the registry, as <repository>?layer=<n>.")
+	koImageRefs         = flag.String("ko_image_refs", "", "A file of image references printed by `ko build` (or written with --image-refs), one repo@sha256:digest per line, to add as subjects.")
+	goreleaserArtifacts = flag.String("goreleaser_artifacts", "", "The dist/artifacts.json written by goreleaser. Its binaries, archives, packages and images are added as subjects.")
+	profileName         = flag.String("profile", "", "A profile of --config whose flag values apply to the flags left at their defaults, e.g. oss-release for the predicate version, signing, redaction and uploads of open source releases.")
+	configPath          = flag.String("config", DefaultConfigPath, "The JSON config file of --profile, of {\"profiles\": {<name>: {<flag>: <value>}}}.")
+	packagesConfig      = flag.String("packages_config", "", "A JSON file mapping the packages of a monorepo to artifact patterns. One provenance file is written per package, to the package's output_path.")
+	runArtifact         = flag.String("subject_from_run_artifact", "", "A workflow run artifact whose files are downloaded, hashed and added as subjects: name=<artifact>[,run_id=<id>][,repository=<owner/repo>]. The run defaults to the current one.")
+	githubPackages      = flag.String("subject_from_github_packages", "", "Comma-separated package versions published to GitHub Packages by the repository owner, resolved with the Packages API and added as subjects named by purl: <ecosystem>:<name>@<version>, where ecosystem is npm, maven (named <groupId>:<artifactId>), nuget or container.")
+	subjectManifest     = flag.String("subject_manifest", "", "A digest manifest written by `create_provenance digest` in the build job, whose subjects are attested without the artifacts.")
+	githubAPICache      = flag.String("github_api_cache", "", "A directory in which to cache GitHub API responses, so that jobs sharing it make fewer API calls. Responses are revalidated with their ETag once older than --github_api_cache_ttl.")
+	githubAPICacheTTL   = flag.Duration("github_api_cache_ttl", 10*time.Minute, "How long cached GitHub API responses are used without revalidation.")
+	concurrency         = flag.Int("concurrency", 0, "How many files to hash at once. 0 means one per CPU.")
+	digestAlgorithmList = flag.String("digest_algorithms", DefaultDigestAlgorithm, "Comma-separated algorithms to hash file subjects with: 'sha256', 'sha512', 'sha3_256' or 'blake3'. Each is recorded in the subject's digest set.")
+	subjectNaming       = flag.String("subject_naming", NamingPath, "How to name subjects: 'path' for file paths and image repositories, 'purl' for package URLs: files as subpaths of --file_purl, images as pkg:oci, or 'maven' to name the files of Maven artifacts as pkg:maven too.")
+	mavenCoordsFile     = flag.String("maven_coordinates", "", "With --subject_naming maven, a file of '<path> <groupId>:<artifactId>:<version>[:<classifier>][@<extension>]' lines giving the coordinates of files not laid out as in a Maven repository.")
+	filePurlBase        = flag.String("file_purl", "", "With --subject_naming=purl, the purl whose subpaths name file subjects, e.g. pkg:golang/github.com/org/repo@v1.2.0 (default: pkg:generic/<repository name>@<tag or commit>).")
+	materialNaming      = flag.String("material_naming", NamingURI, "How to name the source, workflow and generator materials: 'uri' for git URIs, or 'purl' for pkg:github package URLs.")
+	subjectAnnotations  = flag.String("subject_annotations", "", "Comma-separated key=value annotations of every subject, e.g. component=cli.")
+	annotationRulesPath = flag.String("subject_annotation_rules", "", "A JSON file of rules annotating the subjects they match: [{\"match\": <regexp of the whole name>, \"annotations\": {<key>: <value>}}]. Every matching rule applies, later ones taking precedence.")
+	subjectTimestamps   = flag.String("subject_timestamps", "", "A file of '<subject> <timestamp>' lines the build writes, recording when it finished each subject, in RFC 3339 or as Unix seconds, in the buildFinishedOn annotation of the subject.")
+	materialURIMap      = flag.String("material_uri_map", "", "A JSON file of rules rewriting material URIs, e.g. to the internal mirror a dependency was fetched from: [{\"match\": <regexp of the whole URI>, \"uri\": <template with ${group}>}]. The first matching rule applies.")
+	outputPath          = flag.String("output_path", "build.provenance", "The path to which the generated provenance should be written. It may be a template of the subject's {{.Name}} and {{.Digest}}, and the {{.RunID}}, {{.Attempt}} and {{.Job}}.")
+	forceOverwrite      = flag.Bool("force", false, "Overwrite the provenance, shards and bundle if they already exist, rather than failing.")
+	watchMode           = flag.Bool("watch", false, "Regenerate the provenance of --artifact_path whenever its files change, e.g. while developing build scripts. Without --github_context and --runner_context, it describes a build on this machine.")
+	watchDebounce       = flag.Duration("watch_debounce", 500*time.Millisecond, "How long the files must be unchanged, with --watch, before regenerating.")
+	predicateVersion    = flag.String("predicate_version", PredicateV01, "The version of the SLSA provenance predicate to generate: 'v0.1', or 'v1' for SLSA v1.0 buildDefinition and runDetails in an in-toto Statement v1.")
+	outputFormat        = flag.String("format", FormatStatement, "What to write to --output_path: the in-toto 'statement', or only its 'predicate', for `cosign attest --predicate` to wrap in a Statement of its own subjects.")
+	maxSubjects         = flag.Int("max_subjects", 0, "The most subjects a Statement may have, e.g. 1024 for the GitHub attestations API. Provenance with more is split into Statements written to --output_path.1, .2 and so on, and an index of them is written to --output_path. 0 means no limit.")
+	githubContext       = flag.String("github_context", "", "The '${github}' context value.")
+	runnerContext       = flag.String("runner_context", "", "The '${runner}' context value.")
+	jobContext          = flag.String("job_context", "", "The '${job}' context value, used to detect job containers.")
+	builderIdFlag       = flag.String("builder_id", "", "The builder ID to record instead of the one derived from the repository and runner tier, e.g. the identity of a hardened runner pool. Must be an https URL.")
+	builderNamespace    = flag.String("builder_namespace", "", "An https URL replacing the repository URL as the prefix of the derived builder ID, which keeps its runner tier suffix.")
+	ephemeral           = flag.Bool("ephemeral_runner", false, "Declare that the self-hosted runner is ephemeral, i.e. runs a single job and is discarded.")
+	runnerGroup         = flag.String("runner_group", "", "The runner group that executed the job, recorded in the isolation metadata.")
+	instanceProvider    = flag.String("instance_metadata", "", "Record the instance ID, image and region of the self-hosted runner VM from the metadata service of 'aws', 'gcp' or 'azure', or of whichever answers with 'auto'.")
+	runnerConfigFlag    = flag.Bool("runner_config", false, "Record the self-hosted runner's configuration, i.e. the digest and settings of its .runner file (never its .credentials) and the labels the job ran on, in the environment under runner_config.")
+	runnerDir           = flag.String("runner_dir", "", "The directory the runner is installed in, holding its .runner file (default: the ancestor of $RUNNER_TEMP holding one).")
+	toolCacheFlag       = flag.Bool("tool_cache_materials", false, "Record the runner tool cache entries on the PATH, e.g. go/1.16.15/x64 under $RUNNER_TOOL_CACHE, as materials, each with the digest of its files.")
+	hermetic            = flag.Bool("hermetic", false, "Claim a hermetic build. The claim is recorded only if no hermeticity signal contradicts it.")
+	containerImage      = flag.String("job_container_image", "", "The container image the job ran in, recorded in the hermeticity metadata.")
+	workspaceDir        = flag.String("workspace", "", "The directory all subjects must resolve within, after following symlinks. Defaults to $GITHUB_WORKSPACE, or when unset to the artifact path, if there is only one, or the working directory.")
+	strict              = flag.Bool("strict", false, "Fail on unknown or malformed context fields and on empty critical fields (sha, repository, run_id, event_name).")
+	scrubFields         = flag.String("scrub_fields", strings.Join(defaultScrubFields, ","), "Comma-separated, case-insensitive glob patterns of event keys whose values are redacted from the recorded environment. Set to '' to record the event verbatim.")
+	reproducible        = flag.Bool("reproducible", false, "Produce byte-identical output for identical inputs: sort all lists, take timestamps from SOURCE_DATE_EPOCH, or else from when the workflow run started, read from the API, and write canonical JSON.")
+	appendMode          = flag.Bool("append", false, "Merge the generated subjects and materials into the provenance already at --output_path, failing on conflicting digests.")
+	severities          = flag.String("severity", "", "Comma-separated code=severity overrides, where severity is 'ignore', 'warning' or 'error', e.g. partial-materials=error.")
+	findingsOutput      = flag.String("findings_output", "", "Also write the findings that aren't ignored, with their codes and severities, to this path as JSON, for callers to enforce policies such as no warnings.")
+	failOn              = flag.String("fail_on", SeverityError, "The lowest finding severity that fails the run: 'error' or 'warning'.")
+	onEscape            = flag.String("on_workspace_escape", EscapeError, "What to do with subjects that resolve outside the workspace: 'error' to refuse to generate provenance, 'warn' to keep them and print a warning.")
+	includeFiles        = flag.String("include", "", "Comma-separated gitignore-style patterns of the files under --artifact_path to attest, e.g. '*.tar.gz,bin/'. All files by default.")
+	excludeFiles        = flag.String("exclude", "", "Comma-separated gitignore-style patterns of the files under --artifact_path not to attest, e.g. '*.map,*.pdb,tmp/'. The provenance written to --output_path is always left out.")
+	onCollision         = flag.String("on_name_collision", CollisionKeep, "What to do with subjects whose names differ only by case or Unicode normalization: 'keep' them with a warning, 'error' to refuse to generate provenance, or 'rename' all but the first with a ~N suffix.")
+	signingReceiptList  = flag.String("signing_receipts", "", "Comma-separated receipt files of external signers, e.g. Authenticode signatures or notarization tickets, as <path> or <subject>=<path>. They are hashed and recorded as byproducts.")
+	commandsLog         = flag.String("commands_log", "", "A file of the build commands run during the job, as JSON Lines of {\"command\", \"exitCode\", \"startedOn\", \"finishedOn\"} records, recorded in metadata.commands.")
+	restoredCaches      = flag.String("restored_caches", "", "A file of the caches restored during the job, as the JSON outputs of actions/cache steps, recorded in metadata.caches as build inputs.")
+	redactMode          = flag.String("redact", "", "Redact the repository-private details of the provenance, such as actors, branches and the event payload, for publishing with public artifacts: 'strip' to remove them or 'hash' to replace them by their SHA-256 digests. The builder, source commit and digests are kept.")
+	envelopeFormat      = flag.String("envelope", "", "Wrap the statement written to --output_path, and each shard, in an envelope: 'dsse' for a DSSE envelope of payload type application/vnd.in-toto+json, signed with --signing_key or --sign=keyless if given. Defaults to the bare statement.")
+	rekorLogURL         = flag.String("rekor_url", "", "A Rekor transparency log to upload the signed provenance to, e.g. https://rekor.sigstore.dev, writing the log entry and its inclusion proof to <file>.rekor.json. Needs --sign or --signing_key.")
+	signingKey          = flag.String("signing_key", "", "The PEM private key to sign the --envelope with.")
+	signMode            = flag.String("sign", "", "How to sign the provenance: 'keyless' signs it with an ephemeral key certified by Fulcio for the workflow identity of the job's OIDC token, 'remote' with the key of --signing_service, writing its Sigstore bundle to <output_path>.sigstore.json and, without --envelope, the DSSE envelope to <output_path>.sig. Needs permissions: id-token: write.")
+	fulcioURL           = flag.String("fulcio_url", DefaultFulcioURL, "The Fulcio certificate authority of --sign=keyless.")
+	signingService      = flag.String("signing_service", "", "The https URL of the signing service of --sign=remote, which signs the digests it is sent with a key the runner never holds, authenticated with the job's OIDC token and --signing_service_cert.")
+	serviceCert         = flag.String("signing_service_cert", "", "The PEM client certificate to authenticate to --signing_service with over mutual TLS.")
+	serviceKey          = flag.String("signing_service_key", "", "The PEM private key of --signing_service_cert.")
+	validFor            = flag.Duration("valid_for", 0, "How long the provenance is valid for from when the build finished, e.g. 8760h, recorded in metadata.validity. verify rejects it outside that window (0: indefinitely).")
+	egressReport        = flag.String("egress_report", "", "The report an egress filter, such as an allowlist proxy, wrote during the job: a Squid access log, or JSON Lines of {\"destination\": \"<host>[:<port>]\", \"action\": \"allowed\"|\"blocked\"}. It is hashed and summarized as a byproduct, and is evidence of filtered egress for --hermetic.")
+	verifyPublishedList = flag.String("verify_published", "", "Comma-separated URLs the artifacts are published at, as <subject>=<url> or <url>, which is matched to the subject of the same base name. Each is downloaded and must hash to its subject's digest.")
+	recordApprovalsFlag = flag.Bool("record_approvals", false, "Record the reviews of the pull request the commit was merged by, whether they met the approvals required by the base branch's rulesets, and the deployment approvals that gated the run, read from the API into metadata.approvals.")
+	eventExtractorsPath = flag.String("event_extractors", "", "A JSON object of the event fields to record as recipe arguments, as argument names mapped to JSON pointers, keyed by event name or repository_dispatch:<event_type>, replacing the built-in extraction.")
+	recordCommitFlag    = flag.Bool("record_commit", false, "Record the author and committer of the commit, and whether it and the tag the run was started for are signed with a signature GitHub verified, read from the API into metadata.sourceCommit.")
+	skipAttestedPath    = flag.String("skip_already_attested", "", "The prior provenance of a release, whose subjects, with the same name and digest, are left out, so that an incremental update only attests what changed.")
+	attestorNames       = flag.String("attestors", "", "Comma-separated witness attestors to run: 'git', 'environment' and 'command-run'. Their attestations are written to --attestation_bundle.")
+	attestCommand       = flag.String("attest_command", "", "The shell command run and recorded by the command-run attestor.")
+	fileMetadata        = flag.Bool("file_metadata", false, "Record the size, mode, modification time and link target of each file subject in a file-metadata Statement in --attestation_bundle.")
+	patchPath           = flag.String("patch", "", "A JSON Patch (RFC 6902) file applied to the provenance just before it is written, e.g. to add organization-specific fields. It may not change the statement type or subjects.")
+	casEnabled          = flag.Bool("cas", false, "Also store the provenance in the local content-addressed store, indexed by subject digest, for `verify --cas`.")
+	casDir              = flag.String("cas_dir", "", "The directory of the local content-addressed store (default: provenance/cas in the user cache directory, e.g. ~/.cache/provenance/cas).")
+	outputTar           = flag.String("output_tar", "", "Also write a tarball of the files written, i.e. the provenance, its shards and the attestation bundle, with a SHA256SUMS file of their digests, to this path, or to stdout for '-', in which case messages are printed to stderr.")
+	bundlePath          = flag.String("attestation_bundle", "", "The JSON Lines file to which the provenance and the attestor collection are written. Defaults to --output_path with a .bundle.jsonl suffix.")
+	cloudAuth           = addCloudAuthFlags(flag.CommandLine)
 )
 
 type Envelope struct {
-	PayloadType string        `json:"payloadType"`
-	Payload     string        `json:"payload"`
-	Signatures  []interface{} `json:"signatures"`
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+type Signature struct {
+	KeyId string `json:"keyid"`
+	Sig   string `json:"sig"`
 }
 type Statement struct {
 	Type          string    `json:"_type"`
@@ -41,6 +137,9 @@ type Statement struct {
 type Subject struct {
 	Name   string    `json:"name"`
 	Digest DigestSet `json:"digest"`
+	// Annotations, as of the resource descriptors of in-toto Statement v1,
+	// let verifiers select among the subjects, e.g. by platform.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 type Predicate struct {
 	Builder   `json:"builder"`
@@ -55,8 +154,21 @@ type Metadata struct {
 	BuildInvocationId string `json:"buildInvocationId"`
 	Completeness      `json:"completeness"`
 	Reproducible      bool `json:"reproducible"`
-	// BuildStartedOn not defined as it's not available from a GitHub Action.
-	BuildFinishedOn string `json:"buildFinishedOn"`
+	// BuildStartedOn is only known when the build command is run by `run`
+	// or logged in a commands log, as it's not available from a GitHub
+	// Action.
+	BuildStartedOn  string         `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn string         `json:"buildFinishedOn"`
+	Isolation       *Isolation     `json:"isolation,omitempty"`
+	Hermeticity     *Hermeticity   `json:"hermeticity,omitempty"`
+	Command         *CommandTrace  `json:"command,omitempty"`
+	Commands        []CommandTrace `json:"commands,omitempty"`
+	Byproducts      []Byproduct    `json:"byproducts,omitempty"`
+	Approvals       *Approvals     `json:"approvals,omitempty"`
+	SourceCommit    *SourceCommit  `json:"sourceCommit,omitempty"`
+	Caches          []CacheRestore `json:"caches,omitempty"`
+	Retroactive     *Retroactive   `json:"retroactive,omitempty"`
+	Validity        *Validity      `json:"validity,omitempty"`
 }
 type Recipe struct {
 	Type              string          `json:"type"`
@@ -79,31 +191,45 @@ type Item struct {
 type AnyContext struct {
 	GitHubContext `json:"github"`
 	RunnerContext `json:"runner"`
+	// Instance identifies the cloud VM of a self-hosted runner.
+	Instance *InstanceMetadata `json:"instance,omitempty"`
+	// RunnerConfig is read from the self-hosted runner's configuration.
+	RunnerConfig *RunnerConfig `json:"runner_config,omitempty"`
 }
 type GitHubContext struct {
-	Action          string          `json:"action"`
-	ActionPath      string          `json:"action_path"`
-	Actor           string          `json:"actor"`
-	BaseRef         string          `json:"base_ref"`
-	Event           json.RawMessage `json:"event"`
-	EventName       string          `json:"event_name"`
-	EventPath       string          `json:"event_path"`
-	HeadRef         string          `json:"head_ref"`
-	Job             string          `json:"job"`
-	Ref             string          `json:"ref"`
-	Repository      string          `json:"repository"`
-	RepositoryOwner string          `json:"repository_owner"`
-	RunId           string          `json:"run_id"`
-	RunNumber       string          `json:"run_number"`
-	SHA             string          `json:"sha"`
-	Token           string          `json:"token,omitempty"`
-	Workflow        string          `json:"workflow"`
-	Workspace       string          `json:"workspace"`
+	Action            string          `json:"action"`
+	ActionPath        string          `json:"action_path"`
+	Actor             string          `json:"actor"`
+	ActorId           string          `json:"actor_id"`
+	TriggeringActor   string          `json:"triggering_actor"`
+	BaseRef           string          `json:"base_ref"`
+	Event             json.RawMessage `json:"event"`
+	EventName         string          `json:"event_name"`
+	EventPath         string          `json:"event_path"`
+	HeadRef           string          `json:"head_ref"`
+	Job               string          `json:"job"`
+	Ref               string          `json:"ref"`
+	Repository        string          `json:"repository"`
+	RepositoryId      string          `json:"repository_id"`
+	RepositoryOwner   string          `json:"repository_owner"`
+	RepositoryOwnerId string          `json:"repository_owner_id"`
+	RunId             string          `json:"run_id"`
+	RunNumber         string          `json:"run_number"`
+	RunAttempt        string          `json:"run_attempt"`
+	SHA               string          `json:"sha"`
+	Token             string          `json:"token,omitempty"`
+	Workflow          string          `json:"workflow"`
+	WorkflowRef       string          `json:"workflow_ref"`
+	WorkflowSHA       string          `json:"workflow_sha"`
+	Workspace         string          `json:"workspace"`
 }
 type RunnerContext struct {
-	OS        string `json:"os"`
-	Temp      string `json:"temp"`
-	ToolCache string `json:"tool_cache"`
+	Name        string `json:"name"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	Environment string `json:"environment"`
+	Temp        string `json:"temp"`
+	ToolCache   string `json:"tool_cache"`
 }
 
 // See https://docs.github.com/en/actions/reference/events-that-trigger-workflows
@@ -113,10 +239,94 @@ type AnyEvent struct {
 	Inputs json.RawMessage `json:"inputs"`
 }
 
-// subjects walks the file or directory at "root" and hashes all files.
-func subjects(root string) ([]Subject, error) {
+// WorkflowRef is a parsed github.workflow_ref, such as
+// "org/repo/.github/workflows/build.yml@refs/heads/main".
+type WorkflowRef struct {
+	Repository string
+	Path       string
+	Ref        string
+}
+
+func parseWorkflowRef(ref string) (WorkflowRef, bool) {
+	i := strings.Index(ref, "/.github/workflows/")
+	if i < 0 {
+		return WorkflowRef{}, false
+	}
+	rest := ref[i+1:]
+	at := strings.Index(rest, "@")
+	if at < 0 {
+		return WorkflowRef{}, false
+	}
+	return WorkflowRef{Repository: ref[:i], Path: rest[:at], Ref: rest[at+1:]}, true
+}
+
+// subjects walks the files and directories of roots and hashes all files, with
+// opts.Concurrency files hashed at once. The subjects are in walk order
+// however long each file takes to hash.
+func subjects(roots []artifactRoot, opts Options, findings *Findings) ([]Subject, error) {
+	ws, err := newWorkspace(opts.Workspace, opts.ArtifactWorkspace)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newFileFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+	t := opts.Timing
+	if t == nil {
+		t = newTiming()
+	}
 	var s []Subject
-	return s, filepath.Walk(root, func(abspath string, info fs.FileInfo, err error) error {
+	var paths []string
+	var size int64
+	done := track(&t.Walk)
+	err = walkArtifacts(roots, func(abspath, name string, info fs.FileInfo) error {
+		if !filter.keep(abspath, name) {
+			return nil
+		}
+		// Symlinks to files are hashed as files, but links to directories
+		// aren't followed, so that a link can't pull a tree in twice.
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(abspath)
+			if err != nil {
+				findings.add(CodeSkippedSymlink, "skipped symlink %s: %s", name, err)
+				return nil
+			}
+			if target.IsDir() {
+				findings.add(CodeSkippedSymlink, "skipped symlink %s to a directory", name)
+				return nil
+			}
+		}
+		if err := ws.check(abspath, opts.OnEscape, findings); err != nil {
+			return err
+		}
+		paths = append(paths, abspath)
+		size += info.Size()
+		s = append(s, Subject{Name: name})
+		return nil
+	})
+	done()
+	if err != nil {
+		return nil, err
+	}
+	done = track(&t.Hash)
+	digests, err := digestFiles(paths, opts.Concurrency, opts.DigestAlgorithms...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	for i := range s {
+		s[i].Digest = digests[i]
+	}
+	t.FilesHashed += len(s)
+	t.BytesHashed += size
+	return s, nil
+}
+
+// walkFiles calls fn for each file in the file or directory at "root", with
+// the subject name of the file.
+func walkFiles(root string, fn func(abspath, name string, info fs.FileInfo) error) error {
+	return filepath.Walk(root, func(abspath string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -131,52 +341,577 @@ func subjects(root string) ([]Subject, error) {
 		if relpath == "." {
 			relpath = filepath.Base(root)
 		}
-		contents, err := ioutil.ReadFile(abspath)
-		if err != nil {
-			return err
-		}
-		sha := sha256.Sum256(contents)
-		shaHex := hex.EncodeToString(sha[:])
-		s = append(s, Subject{Name: relpath, Digest: DigestSet{"sha256": shaHex}})
-		return nil
+		// Subject names always use forward slashes so that provenance
+		// generated on Windows verifies against the same artifacts elsewhere.
+		return fn(abspath, filepath.ToSlash(relpath), info)
 	})
 }
 
-func parseFlags() {
-	flag.Parse()
-	if *artifactPath == "" {
-		fmt.Println("No value found for required flag: --artifact_path\n")
+func parseFlags(args []string) {
+	flag.CommandLine.Parse(args)
+	if *profileName != "" {
+		if err := applyProfile(flag.CommandLine, *configPath, *profileName); err != nil {
+			fmt.Printf("Invalid value for flag --profile: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(*artifactPath) == 0 && *buildxMetadata == "" && *koImageRefs == "" && *goreleaserArtifacts == "" && *runArtifact == "" && *githubPackages == "" && *subjectManifest == "" && *packagesConfig == "" {
+		fmt.Println("No value found for required flag: --artifact_path (or --buildx_metadata_file, --ko_image_refs, --goreleaser_artifacts, --subject_from_run_artifact, --subject_from_github_packages, --subject_manifest, --packages_config)")
 		flag.Usage()
 		os.Exit(1)
 	}
 	if *outputPath == "" {
-		fmt.Println("No value found for required flag: --output_path\n")
+		fmt.Println("No value found for required flag: --output_path")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if _, err := parseOutputTemplate(*outputPath); isOutputTemplate(*outputPath) && err != nil {
+		fmt.Printf("Invalid value for flag --output_path: %s\n", err)
+		os.Exit(1)
+	}
+	if *githubContext == "" && !*watchMode {
+		fmt.Println("No value found for required flag: --github_context")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *runnerContext == "" && !*watchMode {
+		fmt.Println("No value found for required flag: --runner_context")
+		flag.Usage()
+		os.Exit(1)
+	}
+	otherSubjects := len(*artifactPath) > 0 || *buildxMetadata != "" || *koImageRefs != "" || *goreleaserArtifacts != "" || *runArtifact != "" || *githubPackages != "" || *subjectManifest != ""
+	if *watchMode && (singleArtifactPath(*artifactPath) == "" || *buildxMetadata != "" || *koImageRefs != "" || *goreleaserArtifacts != "" || *runArtifact != "" || *githubPackages != "" || *subjectManifest != "" || *packagesConfig != "") {
+		fmt.Println("Flag --watch only watches a single --artifact_path, which can't be a pattern, and can't be combined with other subject flags")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *watchMode && (*appendMode || *outputTar != "" || *attestorNames != "" || *bundlePath != "" || *casEnabled || *verifyPublishedList != "" || *recordApprovalsFlag || *recordCommitFlag) {
+		fmt.Println("Flag --watch can't be combined with --append, --output_tar, --attestors, --attestation_bundle, --cas, --verify_published, --record_approvals or --record_commit")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *outputTar == "-" {
+		redirectMessages()
+	}
+	if *packagesConfig != "" && (otherSubjects || *appendMode || *attestorNames != "" || *fileMetadata || *signingReceiptList != "" || *verifyPublishedList != "") {
+		fmt.Println("Flag --packages_config can't be combined with other subject flags, --append, --attestors, --file_metadata, --signing_receipts or --verify_published")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *predicateVersion != PredicateV01 && *predicateVersion != PredicateV1 {
+		fmt.Printf("Invalid value for flag --predicate_version: %q\n", *predicateVersion)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *outputFormat != FormatStatement && *outputFormat != FormatPredicate {
+		fmt.Printf("Invalid value for flag --format: %q\n", *outputFormat)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *outputFormat == FormatPredicate && (*appendMode || *maxSubjects > 0 || *casEnabled) {
+		fmt.Println("Flag --format=predicate can't be combined with --append, --max_subjects or --cas, which need the subjects")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *concurrency < 0 {
+		fmt.Printf("Invalid value for flag --concurrency: %d\n", *concurrency)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *maxSubjects < 0 {
+		fmt.Printf("Invalid value for flag --max_subjects: %d\n", *maxSubjects)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *failOn != SeverityError && *failOn != SeverityWarning {
+		fmt.Printf("Invalid value for flag --fail_on: %q\n", *failOn)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if _, err := parseFilePatterns(parseList(*includeFiles)); err != nil {
+		fmt.Printf("Invalid value for flag --include: %s\n", err)
+		os.Exit(1)
+	}
+	if _, err := parseFilePatterns(parseList(*excludeFiles)); err != nil {
+		fmt.Printf("Invalid value for flag --exclude: %s\n", err)
+		os.Exit(1)
+	}
+	if *onCollision != CollisionKeep && *onCollision != CollisionError && *onCollision != CollisionRename {
+		fmt.Printf("Invalid value for flag --on_name_collision: %q\n", *onCollision)
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch *instanceProvider {
+	case "", ProviderAWS, ProviderGCP, ProviderAzure, ProviderAuto:
+	default:
+		fmt.Printf("Invalid value for flag --instance_metadata: %q\n", *instanceProvider)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *onEscape != EscapeError && *onEscape != EscapeWarn {
+		fmt.Printf("Invalid value for flag --on_workspace_escape: %q\n", *onEscape)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *redactMode != "" && *redactMode != RedactStrip && *redactMode != RedactHash {
+		fmt.Printf("Invalid value for flag --redact: %q\n", *redactMode)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *envelopeFormat != "" && *envelopeFormat != EnvelopeDSSE {
+		fmt.Printf("Invalid value for flag --envelope: %q\n", *envelopeFormat)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *envelopeFormat != "" && (*outputFormat == FormatPredicate || *appendMode) {
+		fmt.Println("Flag --envelope can't be combined with --format=predicate or --append")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *signingKey != "" && (*envelopeFormat == "" || *signMode != "") {
+		fmt.Println("Flag --signing_key needs --envelope and can't be combined with --sign")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *signMode != "" && *signMode != SignKeyless && *signMode != SignRemote {
+		fmt.Printf("Invalid value for flag --sign: %q\n", *signMode)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *signMode != "" && (*watchMode || *packagesConfig != "" || *outputFormat == FormatPredicate) {
+		fmt.Println("Flag --sign can't be combined with --watch, --packages_config or --format=predicate")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *githubContext == "" {
-		fmt.Println("No value found for required flag: --github_context\n")
+	if (*signMode == SignRemote) != (*signingService != "") {
+		fmt.Println("Flag --signing_service must be set with --sign=remote, and only then")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *runnerContext == "" {
-		fmt.Println("No value found for required flag: --runner_context\n")
+	if (*serviceCert == "") != (*serviceKey == "") || (*serviceCert != "" && *signingService == "") {
+		fmt.Println("Flags --signing_service_cert and --signing_service_key must be set together, with --signing_service")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *signMode != "" {
+		if err := requireOnline("--sign=" + *signMode); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *rekorLogURL != "" && *signMode == "" && *signingKey == "" {
+		fmt.Println("Flag --rekor_url needs signed provenance, with --sign or --signing_key")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *rekorLogURL != "" && (*watchMode || *packagesConfig != "") {
+		fmt.Println("Flag --rekor_url can't be combined with --watch or --packages_config")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *rekorLogURL != "" {
+		if err := requireOnline("--rekor_url"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
 
-func main() {
-	parseFlags()
-	stmt := Statement{PredicateType: "https://slsa.dev/provenance/v0.1", Type: "https://in-toto.io/Statement/v0.1"}
-	subjects, err := subjects(*artifactPath)
-	if os.IsNotExist(err) {
-		fmt.Println(fmt.Sprintf("Resource path not found: [provided=%s]", *artifactPath))
-		os.Exit(1)
-	} else if err != nil {
-		panic(err)
+// Options holds everything needed to generate a single provenance Statement.
+type Options struct {
+	ArtifactPaths []string
+	// BuildxMetadataFile is the `docker buildx build --metadata-file` output
+	// of container images to attest.
+	BuildxMetadataFile string
+	// ExpandImageIndex adds the per-platform manifests of multi-arch images
+	// as subjects, resolving them from the registry.
+	ExpandImageIndex bool
+	// ImageLayers adds the layers of each image as subjects, resolving them
+	// from the registry.
+	ImageLayers bool
+	// KoImageRefs and GoreleaserArtifacts are the outputs of ko and
+	// goreleaser to attest.
+	KoImageRefs         string
+	GoreleaserArtifacts string
+	// RunArtifact is a workflow run artifact to attest, downloaded with the
+	// token of the github context.
+	RunArtifact string
+	// GitHubPackages are package versions published to GitHub Packages to
+	// attest, as <ecosystem>:<name>@<version>.
+	GitHubPackages string
+	// SubjectManifest is a DigestManifest of files hashed in another job.
+	SubjectManifest string
+	// SubjectNaming and MaterialNaming select NamingPurl to name subjects
+	// and materials by package URL; file subjects are then named as subpaths
+	// of FilePurl.
+	SubjectNaming  string
+	FilePurl       string
+	MaterialNaming string
+	// MavenCoordinates, with NamingMaven, is a file of the coordinates of
+	// file subjects, by path.
+	MavenCoordinates string
+	// MaterialRules rewrite material URIs once they are all recorded.
+	MaterialRules []MaterialRule
+	// SubjectAnnotations annotate every subject, and AnnotationRules those
+	// they match, once the subjects are named.
+	SubjectAnnotations map[string]string
+	AnnotationRules    []SubjectAnnotationRule
+	// SubjectTimestamps is a file of when the build finished each subject,
+	// recorded in their annotations.
+	SubjectTimestamps string
+	// DigestAlgorithms are the digestAlgorithms file subjects are hashed
+	// with. When empty, DefaultDigestAlgorithm is used.
+	DigestAlgorithms []string
+	// Concurrency is how many files are hashed at once, one per CPU when 0.
+	Concurrency int
+	// GitHubAPICache, if set, is the directory GitHub API responses are
+	// cached in for GitHubAPICacheTTL.
+	GitHubAPICache    string
+	GitHubAPICacheTTL time.Duration
+	GitHubContext     string
+	RunnerContext     string
+	// JobContext is optional.
+	JobContext string
+	// BuilderId overrides the builder ID; BuilderNamespace only replaces
+	// its repository URL prefix.
+	BuilderId        string
+	BuilderNamespace string
+	// EphemeralRunner and RunnerGroup are declared by the workflow for
+	// self-hosted runners, which can't be inspected from the job.
+	EphemeralRunner bool
+	RunnerGroup     string
+	// InstanceMetadata is the cloud provider whose metadata service
+	// identifies the runner VM, or ProviderAuto.
+	InstanceMetadata string
+	// RunnerConfig records the configuration of the runner installed in
+	// RunnerDir, or found from the environment if RunnerDir is empty.
+	RunnerConfig bool
+	RunnerDir    string
+	// ToolCacheMaterials records the tool cache entries on the PATH as
+	// materials.
+	ToolCacheMaterials bool
+	// Hermetic opts in to a hermeticity claim; ContainerImage is declared.
+	Hermetic       bool
+	ContainerImage string
+	// InspectHost allows probing the local machine (e.g. its routing
+	// table), which is only meaningful when running inside the job.
+	InspectHost bool
+	// Workspace is the directory subjects must resolve within. When empty,
+	// the artifact path itself is used, if there is only one.
+	Workspace string
+	// ArtifactWorkspace is set when Workspace defaulted to the artifact path,
+	// which is then resolved from its parent only: were it a symlink, its
+	// target would otherwise become the workspace.
+	ArtifactWorkspace bool
+	// OnEscape is EscapeError or EscapeWarn.
+	OnEscape string
+	// OnCollision is CollisionKeep, CollisionError or CollisionRename.
+	OnCollision string
+	// Include and Exclude are gitignore-style patterns of the names of the
+	// files walked under ArtifactPaths to keep and to leave out, and Outputs
+	// are the paths provenance is written to, whose files are always left
+	// out, so that provenance written among the artifacts doesn't attest the
+	// provenance of an earlier run.
+	Include []string
+	Exclude []string
+	Outputs []string
+	// Strict rejects contexts that fail validateContexts.
+	Strict bool
+	// Severities maps finding codes to a severity; missing codes use
+	// defaultSeverities. FailOn is SeverityError or SeverityWarning.
+	Severities map[string]string
+	FailOn     string
+	// Reproducible makes the output a pure function of the inputs.
+	Reproducible bool
+	// Patch is applied to the serialized provenance by marshalStatement.
+	Patch []PatchOperation
+	// Format is FormatStatement, the default, or FormatPredicate.
+	Format string
+	// PredicateVersion is PredicateV01, the default, or PredicateV1.
+	PredicateVersion string
+	// Redact, if RedactStrip or RedactHash, redacts the repository-private
+	// details of the provenance.
+	Redact string
+	// Envelope, if EnvelopeDSSE, wraps what writeStatement writes in an
+	// envelope, signed by Signer if set.
+	Envelope string
+	Signer   Signer
+	// Force allows writeStatement to overwrite existing files.
+	Force bool
+	// CASDir, if set, is the local CAS writeStatement adds the provenance to.
+	CASDir string
+	// MaxSubjects, if positive, is the subject limit above which
+	// writeStatement shards the provenance.
+	MaxSubjects int
+	// ScrubFields are the event key patterns redacted by scrubEvent. When
+	// nil, defaultScrubFields is used.
+	ScrubFields []string
+	// Attestors names the witness attestors run by collectAttestations, and
+	// AttestCommand is the command recorded by the command-run attestor.
+	Attestors     []string
+	AttestCommand string
+	// FileMetadata adds a file-metadata Statement to the bundle.
+	FileMetadata bool
+	// SigningReceipts are the receipt files of external signers, as
+	// "<path>" or "<subject>=<path>", recorded as byproducts.
+	SigningReceipts []string
+	// RestoredCaches is a file of the caches restored during the job.
+	RestoredCaches string
+	// CommandsLog is a file of the build commands run during the job.
+	CommandsLog string
+	// ValidFor, if set, is how long the provenance is valid for from when the
+	// build finished.
+	ValidFor time.Duration
+	// EgressReport is the report of the job's egress filter, recorded as a
+	// byproduct.
+	EgressReport string
+	// VerifyPublished are the URLs the subjects are published at, as
+	// "<url>" or "<subject>=<url>", checked against their digests.
+	VerifyPublished []string
+	// SkipAttested, if set, is the prior provenance whose subjects are left
+	// out.
+	SkipAttested string
+	// RecordApprovals records the review evidence of the run, read from the
+	// API, in the approvals metadata.
+	RecordApprovals bool
+	// RecordCommit records the source-integrity evidence of the commit,
+	// read from the API, in the sourceCommit metadata.
+	RecordCommit bool
+	// Getenv looks up environment variables of the run being attested, and
+	// Environ lists them all.
+	Getenv  func(string) string
+	Environ func() []string
+	// Trace is the evidence recorded by `run`, if the build was run by it.
+	Trace *Trace
+	// Timing, if set, accumulates the time spent in each phase.
+	Timing *Timing
+}
+
+// generate builds the provenance Statement for the artifacts described by opts.
+func generate(opts Options) (*Statement, Findings, error) {
+	var findings Findings
+	stmt := Statement{PredicateType: ProvenanceV01Type, Type: StatementV01Type}
+	if opts.Timing == nil {
+		opts.Timing = newTiming()
+	}
+	switch opts.PredicateVersion {
+	case "", PredicateV01:
+	case PredicateV1:
+		stmt.PredicateType, stmt.Type = ProvenanceV1Type, StatementV1Type
+	default:
+		return nil, findings, fmt.Errorf("unknown predicate version %q: must be %q or %q", opts.PredicateVersion, PredicateV01, PredicateV1)
+	}
+	if opts.BuilderId != "" && opts.BuilderNamespace != "" {
+		return nil, findings, errors.New("a builder ID and a builder namespace can't both be set")
+	}
+	for name, id := range map[string]string{"builder ID": opts.BuilderId, "builder namespace": opts.BuilderNamespace} {
+		if id == "" {
+			continue
+		}
+		if err := validateBuilderId(name, id); err != nil {
+			return nil, findings, err
+		}
+	}
+	if err := validateDigestAlgorithms(opts.DigestAlgorithms); err != nil {
+		return nil, findings, err
+	}
+	var fileBase PackageURL
+	switch opts.SubjectNaming {
+	case "", NamingPath:
+	case NamingPurl, NamingMaven:
+		var err error
+		if fileBase, err = filePurl(opts.FilePurl, opts.GitHubContext); err != nil {
+			return nil, findings, err
+		}
+	default:
+		return nil, findings, fmt.Errorf("unknown subject naming %q: must be %q, %q or %q", opts.SubjectNaming, NamingPath, NamingPurl, NamingMaven)
+	}
+	var mavenCoords map[string]mavenCoordinates
+	if opts.MavenCoordinates != "" {
+		if opts.SubjectNaming != NamingMaven {
+			return nil, findings, fmt.Errorf("maven coordinates only name subjects with subject naming %q", NamingMaven)
+		}
+		var err error
+		if mavenCoords, err = readMavenCoordinates(opts.MavenCoordinates); err != nil {
+			return nil, findings, fmt.Errorf("reading maven coordinates: %w", err)
+		}
+	}
+	if opts.MaterialNaming != "" && opts.MaterialNaming != NamingURI && opts.MaterialNaming != NamingPurl {
+		return nil, findings, fmt.Errorf("unknown material naming %q: must be %q or %q", opts.MaterialNaming, NamingURI, NamingPurl)
+	}
+	if opts.RunArtifact != "" {
+		if err := requireOnline("--subject_from_run_artifact"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if len(opts.VerifyPublished) > 0 {
+		if err := requireOnline("--verify_published"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.RecordApprovals {
+		if err := requireOnline("--record_approvals"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.RecordCommit {
+		if err := requireOnline("--record_commit"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.GitHubPackages != "" {
+		if err := requireOnline("--subject_from_github_packages"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.ExpandImageIndex {
+		if err := requireOnline("--expand_image_index"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.ImageLayers {
+		if err := requireOnline("--image_layers"); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.Strict {
+		if err := validateContexts(opts.GitHubContext, opts.RunnerContext); err != nil {
+			return nil, findings, err
+		}
+	}
+	opts.Workspace = normalizeInputPath(opts.Workspace)
+	if opts.Workspace == "" {
+		opts.Workspace = singleArtifactPath(opts.ArtifactPaths)
+		opts.ArtifactWorkspace = opts.Workspace != ""
+	}
+	// kinds records whether each subject is a file or an image, for naming
+	// them once name collisions are resolved.
+	var kinds []string
+	addSubjects := func(kind string, subjects []Subject) {
+		stmt.Subject = append(stmt.Subject, subjects...)
+		for range subjects {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(opts.ArtifactPaths) > 0 {
+		roots, err := expandArtifactPaths(opts.ArtifactPaths)
+		if err != nil {
+			return nil, findings, err
+		}
+		subjects, err := subjects(roots, opts, &findings)
+		if err != nil {
+			return nil, findings, err
+		}
+		addSubjects("file", subjects)
+	}
+	if opts.KoImageRefs != "" {
+		images, err := koSubjects(opts.KoImageRefs)
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading ko image references: %w", err)
+		}
+		addSubjects("image", images)
+	}
+	if opts.GoreleaserArtifacts != "" {
+		files, images, err := goreleaserSubjects(opts.GoreleaserArtifacts, opts, &findings)
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading goreleaser artifacts: %w", err)
+		}
+		addSubjects("file", files)
+		addSubjects("image", images)
+	}
+	if opts.RunArtifact != "" {
+		done := track(&opts.Timing.API)
+		files, err := runArtifactSubjects(opts.RunArtifact, opts)
+		done()
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading run artifact: %w", err)
+		}
+		addSubjects("file", files)
+	}
+	if opts.SubjectManifest != "" {
+		files, err := readDigestManifest(opts.SubjectManifest)
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading digest manifest: %w", err)
+		}
+		addSubjects("file", files)
+	}
+	if opts.GitHubPackages != "" {
+		done := track(&opts.Timing.API)
+		packages, err := githubPackageSubjects(opts.GitHubPackages, opts)
+		done()
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading GitHub Packages: %w", err)
+		}
+		// Packages are always named by purl.
+		addSubjects("package", packages)
+	}
+	var buildArgs map[string]string
+	if opts.BuildxMetadataFile != "" {
+		done := func() {}
+		if opts.ExpandImageIndex || opts.ImageLayers {
+			done = track(&opts.Timing.API)
+		}
+		images, args, err := buildxSubjects(opts.BuildxMetadataFile, opts.ExpandImageIndex, opts.ImageLayers)
+		done()
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading buildx metadata: %w", err)
+		}
+		addSubjects("image", images)
+		buildArgs = args
+	}
+	subjects, err := resolveCollisions(stmt.Subject, opts.OnCollision, &findings)
+	if err != nil {
+		return nil, findings, err
+	}
+	stmt.Subject = subjects
+	if opts.SubjectTimestamps != "" {
+		stamps, err := readSubjectTimestamps(opts.SubjectTimestamps)
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading subject timestamps: %w", err)
+		}
+		if err := timestampSubjects(stmt.Subject, stamps, singleArtifactPath(opts.ArtifactPaths), time.Now()); err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.SubjectNaming == NamingPurl || opts.SubjectNaming == NamingMaven {
+		for i, kind := range kinds {
+			switch {
+			case kind == "file" && opts.SubjectNaming == NamingMaven:
+				nameMavenSubjects(stmt.Subject[i:i+1], mavenCoords, fileBase)
+			case kind == "file":
+				nameFileSubjects(stmt.Subject[i:i+1], fileBase)
+			case kind == "image":
+				nameImageSubjects(stmt.Subject[i : i+1])
+			}
+		}
+	}
+	for name := range mavenCoords {
+		return nil, findings, fmt.Errorf("%s has maven coordinates, but isn't a file subject", name)
+	}
+	annotateSubjects(stmt.Subject, opts.SubjectAnnotations, opts.AnnotationRules)
+	if len(opts.VerifyPublished) > 0 {
+		done := track(&opts.Timing.API)
+		err := verifyPublished(opts.VerifyPublished, stmt.Subject)
+		done()
+		if err != nil {
+			return nil, findings, err
+		}
+	}
+	if opts.SkipAttested != "" {
+		if stmt.Subject, err = skipAttested(stmt.Subject, opts.SkipAttested); err != nil {
+			return nil, findings, err
+		}
+	}
+	finishedOn, err := buildFinishedOn(opts)
+	if err != nil {
+		return nil, findings, err
+	}
+	if opts.ValidFor < 0 {
+		return nil, findings, fmt.Errorf("the validity period %s is negative", opts.ValidFor)
+	}
+	if opts.Redact != "" && opts.Redact != RedactStrip && opts.Redact != RedactHash {
+		return nil, findings, fmt.Errorf("unknown redaction %q: must be %q or %q", opts.Redact, RedactStrip, RedactHash)
 	}
-	stmt.Subject = append(stmt.Subject, subjects...)
 	stmt.Predicate = Predicate{
 		Builder{},
 		Metadata{
@@ -186,7 +921,7 @@ func main() {
 				Materials:   false,
 			},
 			Reproducible:    false,
-			BuildFinishedOn: time.Now().UTC().Format(time.RFC3339),
+			BuildFinishedOn: finishedOn.Format(time.RFC3339),
 		},
 		Recipe{
 			Type:              TypeId,
@@ -196,40 +931,652 @@ func main() {
 	}
 
 	context := AnyContext{}
-	if err := json.Unmarshal([]byte(*githubContext), &context.GitHubContext); err != nil {
-		panic(err)
+	if err := json.Unmarshal([]byte(opts.GitHubContext), &context.GitHubContext); err != nil {
+		return nil, findings, fmt.Errorf("parsing github context: %w", err)
 	}
-	if err := json.Unmarshal([]byte(*runnerContext), &context.RunnerContext); err != nil {
-		panic(err)
+	if err := json.Unmarshal([]byte(opts.RunnerContext), &context.RunnerContext); err != nil {
+		return nil, findings, fmt.Errorf("parsing runner context: %w", err)
+	}
+	// Older runners only export the workflow ref and SHA to the environment.
+	if context.GitHubContext.WorkflowRef == "" {
+		context.GitHubContext.WorkflowRef = opts.Getenv("GITHUB_WORKFLOW_REF")
+	}
+	if context.GitHubContext.WorkflowSHA == "" {
+		context.GitHubContext.WorkflowSHA = opts.Getenv("GITHUB_WORKFLOW_SHA")
 	}
 	gh := context.GitHubContext
 	// Remove access token from the generated provenance.
 	context.GitHubContext.Token = ""
+	if opts.ScrubFields == nil {
+		opts.ScrubFields = defaultScrubFields
+	}
+	scrubbed, redacted, err := scrubEvent(context.GitHubContext.Event, opts.ScrubFields)
+	if err != nil {
+		return nil, findings, fmt.Errorf("parsing github event: %w", err)
+	}
+	if len(redacted) > 0 {
+		findings.add(CodeRedactedFields, "redacted %d event fields matching --scrub_fields: %s", len(redacted), strings.Join(redacted, ", "))
+	}
+	context.GitHubContext.Event = scrubbed
+	if opts.InstanceMetadata != "" {
+		if !opts.InspectHost {
+			return nil, findings, errors.New("instance metadata can only be read inside the job")
+		}
+		if context.Instance, err = instanceMetadata(opts.InstanceMetadata); err != nil {
+			findings.add(CodeNoInstanceMetadata, "unable to read instance metadata: %s", err)
+		}
+	}
+	if opts.RunnerConfig {
+		if !opts.InspectHost {
+			return nil, findings, errors.New("the runner configuration can only be read inside the job")
+		}
+		done := track(&opts.Timing.API)
+		context.RunnerConfig, err = runnerConfig(opts.RunnerDir, gh, context.RunnerContext, opts, &findings)
+		done()
+		if err != nil {
+			findings.add(CodeNoRunnerConfig, "unable to read the runner configuration: %s", err)
+		}
+	}
+	stmt.Predicate.Recipe.Environment = &context
+	if opts.ValidFor > 0 {
+		stmt.Predicate.Metadata.Validity = newValidity(finishedOn, opts.ValidFor)
+	}
+	if opts.RecordApprovals {
+		done := track(&opts.Timing.API)
+		approvals, err := recordApprovals(gh, opts, &findings)
+		done()
+		if err != nil {
+			return nil, findings, fmt.Errorf("recording approvals: %w", err)
+		}
+		stmt.Predicate.Metadata.Approvals = approvals
+	}
+	if opts.RecordCommit {
+		done := track(&opts.Timing.API)
+		commit, err := recordCommit(gh, opts, &findings)
+		done()
+		if err != nil {
+			return nil, findings, fmt.Errorf("recording the commit: %w", err)
+		}
+		stmt.Predicate.Metadata.SourceCommit = commit
+	}
 	// NOTE: Re-runs are not uniquely identified and can cause run ID collisions.
 	repoURI := "https://github.com/" + gh.Repository
 	stmt.Predicate.Metadata.BuildInvocationId = repoURI + "/actions/runs/" + gh.RunId
-	// NOTE: This is inexact as multiple workflows in a repo can have the same name.
+	// NOTE: The workflow name is inexact as multiple workflows in a repo can
+	// have the same name, so the path of the workflow file is preferred.
 	// See https://github.com/github/feedback/discussions/4188
 	stmt.Predicate.Recipe.EntryPoint = gh.Workflow
-	event := AnyEvent{}
-	if err := json.Unmarshal(context.GitHubContext.Event, &event); err != nil {
-		panic(err)
+	wf, hasWorkflowRef := parseWorkflowRef(gh.WorkflowRef)
+	if hasWorkflowRef {
+		stmt.Predicate.Recipe.EntryPoint = wf.Path
+	}
+	// The workflow file is only checked out with the commit it's defined at.
+	if ws := opts.Workspace; hasWorkflowRef && wf.Repository == gh.Repository && (gh.WorkflowSHA == "" || gh.WorkflowSHA == gh.SHA) {
+		if ws == "" {
+			ws = gh.Workspace
+		}
+		// workflow_ref comes from the context, so its path is kept within
+		// the workspace like subjects.
+		path := filepath.Join(ws, filepath.FromSlash(wf.Path))
+		if w, err := newWorkspace(ws, false); err == nil && w.check(path, EscapeError, &findings) == nil {
+			if unpinned, err := unpinnedActions(path); err == nil && len(unpinned) > 0 {
+				findings.add(CodeUnpinnedAction, "%s uses actions not pinned to a commit SHA: %s", wf.Path, strings.Join(unpinned, ", "))
+			}
+		}
+	}
+	args, err := extractArguments(gh.EventName, context.GitHubContext.Event)
+	if err != nil {
+		return nil, findings, fmt.Errorf("extracting the parameters of the %s event: %w", gh.EventName, err)
+	}
+	if stmt.Predicate.Recipe.Arguments, err = mergeArguments(args, buildArgs); err != nil {
+		return nil, findings, fmt.Errorf("parsing workflow inputs: %w", err)
 	}
-	stmt.Predicate.Recipe.Arguments = event.Inputs
 	stmt.Predicate.Materials = append(stmt.Predicate.Materials, Item{URI: "git+" + repoURI, Digest: DigestSet{"sha1": gh.SHA}})
-	if os.Getenv("GITHUB_ACTIONS") == "true" {
-		stmt.Predicate.Builder.Id = repoURI + GitHubHostedIdSuffix
+	// A workflow defined at another commit, e.g. a reusable workflow of
+	// another repository, is pinned by its own material.
+	if hasWorkflowRef && gh.WorkflowSHA != "" && (wf.Repository != gh.Repository || gh.WorkflowSHA != gh.SHA) {
+		stmt.Predicate.Recipe.DefinedInMaterial = len(stmt.Predicate.Materials)
+		stmt.Predicate.Materials = append(stmt.Predicate.Materials, Item{URI: "git+https://github.com/" + wf.Repository + "@" + wf.Ref, Digest: DigestSet{"sha1": gh.WorkflowSHA}})
+	}
+	if generator, err := generatorMaterial(); err != nil {
+		findings.add(CodeGeneratorUnhashed, "unable to hash the provenance generator: %s", err)
 	} else {
-		stmt.Predicate.Builder.Id = repoURI + SelfHostedIdSuffix
+		stmt.Predicate.Materials = append(stmt.Predicate.Materials, generator)
+	}
+	iso, err := classifyRunner(context.RunnerContext, opts)
+	if err != nil {
+		return nil, findings, fmt.Errorf("parsing job context: %w", err)
+	}
+	for _, w := range iso.Warnings {
+		findings.add(CodeRunnerNotIsolated, "%s", w)
+	}
+	stmt.Predicate.Metadata.Isolation = &iso
+	var egress *Byproduct
+	var egressSummary *EgressSummary
+	if opts.EgressReport != "" {
+		report, err := readEgressReport(opts.EgressReport)
+		if err != nil {
+			return nil, findings, fmt.Errorf("reading egress report: %w", err)
+		}
+		egress, egressSummary = &report, report.Egress
+	}
+	herm := detectHermeticity(context.RunnerContext, opts, egressSummary)
+	for _, w := range herm.Warnings {
+		findings.add(CodeNotHermetic, "%s", w)
+	}
+	stmt.Predicate.Metadata.Hermeticity = &herm
+	stmt.Predicate.Builder.Id = builderId(repoURI, iso, opts)
+	if opts.ToolCacheMaterials {
+		if !opts.InspectHost {
+			return nil, findings, errors.New("the tool cache can only be hashed inside the job")
+		}
+		done := track(&opts.Timing.Hash)
+		stmt.Predicate.Materials = append(stmt.Predicate.Materials, toolCacheMaterials(context.RunnerContext, opts, &findings)...)
+		done()
+	}
+	if opts.MaterialNaming == NamingPurl {
+		for i, m := range stmt.Predicate.Materials {
+			stmt.Predicate.Materials[i] = materialPurl(m)
+		}
+	}
+	if len(opts.SigningReceipts) > 0 {
+		if stmt.Predicate.Metadata.Byproducts, err = signingReceipts(opts.SigningReceipts, stmt.Subject); err != nil {
+			return nil, findings, err
+		}
+	}
+	if egress != nil {
+		stmt.Predicate.Metadata.Byproducts = append(stmt.Predicate.Metadata.Byproducts, *egress)
+	}
+	if opts.RestoredCaches != "" {
+		if stmt.Predicate.Metadata.Caches, err = readRestoredCaches(opts.RestoredCaches); err != nil {
+			return nil, findings, fmt.Errorf("reading restored caches: %w", err)
+		}
+	}
+	if opts.CommandsLog != "" {
+		md := &stmt.Predicate.Metadata
+		var first time.Time
+		if md.Commands, first, err = readCommandsLog(opts.CommandsLog, opts.Reproducible); err != nil {
+			return nil, findings, fmt.Errorf("reading commands log: %w", err)
+		}
+		switch {
+		case opts.Trace != nil || len(md.Commands) == 0:
+		case opts.Reproducible:
+			md.BuildStartedOn = md.BuildFinishedOn
+		default:
+			md.BuildStartedOn = first.UTC().Format(time.RFC3339)
+		}
+	}
+	partialMaterials := ""
+	if opts.Trace != nil {
+		partialMaterials = foldTrace(&stmt, opts)
+	}
+	if opts.Redact != "" {
+		redacted, err := redactStatement(&stmt, opts.Redact)
+		if err != nil {
+			return nil, findings, fmt.Errorf("redacting provenance: %w", err)
+		}
+		if len(redacted) > 0 {
+			findings.add(CodeRedactedFields, "redacted %d repository-private fields with --redact=%s: %s", len(redacted), opts.Redact, strings.Join(redacted, ", "))
+		}
+	}
+	mapMaterials(stmt.Predicate.Materials, opts.MaterialRules)
+	if opts.Reproducible {
+		sortStatement(&stmt)
+	}
+	if stmt.Predicate.Metadata.BuildStartedOn == "" {
+		findings.add(CodeMissingBuildStartedOn, "buildStartedOn is not recorded as the run start time isn't available from the contexts")
+	}
+	switch {
+	case opts.Trace == nil && opts.ToolCacheMaterials:
+		findings.add(CodePartialMaterials, "materials are incomplete: only the source repository, the generator and the tool cache entries on the PATH are recorded")
+	case opts.Trace == nil:
+		findings.add(CodePartialMaterials, "materials are incomplete: only the source repository and the generator are recorded")
+	case opts.Trace.Tracer == "":
+		findings.add(CodePartialMaterials, "materials are incomplete: the files read by the build command were not traced, which requires strace on Linux")
+	case partialMaterials != "":
+		findings.add(CodePartialMaterials, "materials are incomplete: %s", partialMaterials)
 	}
+	if codes := findings.failing(opts.Severities, opts.FailOn); len(codes) > 0 {
+		return nil, findings, fmt.Errorf("findings configured to fail the run: %s", strings.Join(codes, ", "))
+	}
+	return &stmt, findings, nil
+}
 
+// writeStatement serializes stmt and writes it to path or, if it has more
+// subjects than opts.MaxSubjects, writes its shards and their index. The
+// Statements written are added to the local CAS at opts.CASDir, if set.
+func writeStatement(stmt *Statement, path string, opts Options) ([]byte, error) {
 	// NOTE: At L1, writing the in-toto Statement type is sufficient but, at
 	// higher SLSA levels, the Statement must be encoded and wrapped in an
-	// Envelope to support attaching signatures.
-	payload, _ := json.MarshalIndent(stmt, "", "  ")
+	// Envelope to support attaching signatures, as opts.Envelope does.
+	switch opts.Envelope {
+	case "", EnvelopeDSSE:
+	default:
+		return nil, fmt.Errorf("unknown envelope %q: must be %q", opts.Envelope, EnvelopeDSSE)
+	}
+	switch opts.Format {
+	case "", FormatStatement:
+	case FormatPredicate:
+		if opts.MaxSubjects > 0 || opts.CASDir != "" {
+			return nil, errors.New("a predicate without its subjects can't be sharded or stored in the local CAS")
+		}
+		if opts.Envelope != "" {
+			return nil, errors.New("a predicate isn't a statement, so it can't be wrapped in an envelope")
+		}
+		return writePredicate(stmt, path, opts)
+	default:
+		return nil, fmt.Errorf("unknown format %q: must be %q or %q", opts.Format, FormatStatement, FormatPredicate)
+	}
+	if opts.MaxSubjects > 0 && len(stmt.Subject) > opts.MaxSubjects {
+		return writeShards(stmt, path, opts.MaxSubjects, opts)
+	}
+	payload, err := marshalStatement(stmt, opts)
+	if err != nil {
+		return nil, err
+	}
+	if payload, err = wrapStatement(payload, opts); err != nil {
+		return nil, err
+	}
+	if err := writeOutput(path, payload, opts.Force); err != nil {
+		return payload, err
+	}
+	if opts.CASDir != "" {
+		if err := casAdd(opts.CASDir, payload, stmt.Subject); err != nil {
+			return payload, fmt.Errorf("adding to the local CAS: %w", err)
+		}
+	}
+	return payload, nil
+}
+
+// writePredicate writes only the predicate of stmt, once patched, to path.
+func writePredicate(stmt *Statement, path string, opts Options) ([]byte, error) {
+	payload, err := marshalStatement(stmt, Options{Patch: opts.Patch})
+	if err != nil {
+		return nil, err
+	}
+	var patched struct {
+		Predicate json.RawMessage `json:"predicate"`
+	}
+	if err := json.Unmarshal(payload, &patched); err != nil {
+		return nil, err
+	}
+	if opts.Reproducible {
+		payload, err = canonicalJSON(patched.Predicate)
+	} else {
+		payload, err = json.MarshalIndent(patched.Predicate, "", "  ")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload, writeOutput(path, payload, opts.Force)
+}
+
+// marshalStatement serializes stmt as writeStatement writes it, as SLSA v1.0
+// provenance if it is of ProvenanceV1Type, applying opts.Patch.
+func marshalStatement(stmt *Statement, opts Options) ([]byte, error) {
+	var v interface{} = stmt
+	if stmt.PredicateType == ProvenanceV1Type {
+		v = provenanceV1(stmt)
+	}
+	if len(opts.Patch) > 0 {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = applyPatch(payload, opts.Patch); err != nil {
+			return nil, err
+		}
+		v = json.RawMessage(payload)
+	}
+	if opts.Reproducible {
+		return canonicalJSON(v)
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// wrapStatement wraps the serialized statement payload in the envelope of
+// opts.Envelope, if any.
+func wrapStatement(payload []byte, opts Options) ([]byte, error) {
+	if opts.Envelope == "" {
+		return payload, nil
+	}
+	env := &Envelope{PayloadType: PayloadContentType, Payload: base64.StdEncoding.EncodeToString(payload), Signatures: []Signature{}}
+	if opts.Signer != nil {
+		var err error
+		if env, err = signEnvelope(PayloadContentType, payload, opts.Signer); err != nil {
+			return nil, fmt.Errorf("signing the envelope: %w", err)
+		}
+	}
+	if opts.Reproducible {
+		return canonicalJSON(env)
+	}
+	return json.Marshal(env)
+}
+
+// commands maps subcommand names to their entry points. An invocation that
+// doesn't name a subcommand generates provenance, as the GitHub Action does.
+var commands = map[string]func(args []string){
+	"worker":      workerMain,
+	"selftest":    selftestMain,
+	"run":         runMain,
+	"tuf":         tufMain,
+	"search":      searchMain,
+	"verify":      verifyMain,
+	"revoke":      revokeMain,
+	"annotate":    annotateMain,
+	"attach":      attachMain,
+	"kit":         kitMain,
+	"prune":       pruneMain,
+	"policy":      policyMain,
+	"gate":        gateMain,
+	"digest":      digestMain,
+	"countersign": countersignMain,
+	"resign":      resignMain,
+	"protect":     protectMain,
+	"export":      exportMain,
+	"query":       queryMain,
+	"backfill":    backfillMain,
+	"summarize":   summarizeMain,
+	"badge":       badgeMain,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+	parseFlags(os.Args[1:])
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *watchMode {
+		watch(flagOptions(), *watchDebounce)
+		return
+	}
+	if *packagesConfig != "" {
+		emitPackages(*packagesConfig, flagOptions())
+		return
+	}
+	emit(flagOptions())
+}
+
+// flagOptions builds the Options given on the command line.
+func flagOptions() Options {
+	if *workspaceDir == "" {
+		*workspaceDir = os.Getenv("GITHUB_WORKSPACE")
+	}
+	sevs, err := parseSeverities(*severities)
+	if err != nil {
+		fmt.Printf("Invalid value for flag --severity: %s\n", err)
+		os.Exit(1)
+	}
+	cas := ""
+	if *casEnabled {
+		if cas = *casDir; cas == "" {
+			cas = defaultCASDir()
+		}
+		if cas == "" {
+			fmt.Println("No user cache directory found for --cas; set --cas_dir")
+			os.Exit(1)
+		}
+	}
+	var signer Signer
+	if *signingKey != "" {
+		if signer, err = loadSigner(*signingKey); err != nil {
+			fmt.Printf("Invalid value for flag --signing_key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var patch []PatchOperation
+	if *patchPath != "" {
+		if patch, err = readPatch(*patchPath); err != nil {
+			fmt.Printf("Invalid value for flag --patch: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var materialRules []MaterialRule
+	if *materialURIMap != "" {
+		if materialRules, err = readMaterialRules(*materialURIMap); err != nil {
+			fmt.Printf("Invalid value for flag --material_uri_map: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	annotations, err := parseAnnotations(*subjectAnnotations)
+	if err != nil {
+		fmt.Printf("Invalid value for flag --subject_annotations: %s\n", err)
+		os.Exit(1)
+	}
+	if *eventExtractorsPath != "" {
+		if err := readEventExtractors(*eventExtractorsPath); err != nil {
+			fmt.Printf("Invalid value for flag --event_extractors: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var annotationRules []SubjectAnnotationRule
+	if *annotationRulesPath != "" {
+		if annotationRules, err = readSubjectAnnotationRules(*annotationRulesPath); err != nil {
+			fmt.Printf("Invalid value for flag --subject_annotation_rules: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	return Options{
+		ArtifactPaths:       *artifactPath,
+		BuildxMetadataFile:  *buildxMetadata,
+		ExpandImageIndex:    *expandIndex,
+		ImageLayers:         *imageLayers,
+		KoImageRefs:         *koImageRefs,
+		GoreleaserArtifacts: *goreleaserArtifacts,
+		RunArtifact:         *runArtifact,
+		GitHubPackages:      *githubPackages,
+		SubjectManifest:     *subjectManifest,
+		SubjectNaming:       *subjectNaming,
+		FilePurl:            *filePurlBase,
+		MaterialNaming:      *materialNaming,
+		MavenCoordinates:    *mavenCoordsFile,
+		MaterialRules:       materialRules,
+		SubjectAnnotations:  annotations,
+		AnnotationRules:     annotationRules,
+		SubjectTimestamps:   *subjectTimestamps,
+		DigestAlgorithms:    parseList(*digestAlgorithmList),
+		Concurrency:         *concurrency,
+		GitHubAPICache:      *githubAPICache,
+		GitHubAPICacheTTL:   *githubAPICacheTTL,
+		GitHubContext:       *githubContext,
+		RunnerContext:       *runnerContext,
+		JobContext:          *jobContext,
+		BuilderId:           *builderIdFlag,
+		BuilderNamespace:    *builderNamespace,
+		EphemeralRunner:     *ephemeral,
+		RunnerGroup:         *runnerGroup,
+		InstanceMetadata:    *instanceProvider,
+		RunnerConfig:        *runnerConfigFlag,
+		ToolCacheMaterials:  *toolCacheFlag,
+		RunnerDir:           *runnerDir,
+		Hermetic:            *hermetic,
+		ContainerImage:      *containerImage,
+		InspectHost:         true,
+		Workspace:           *workspaceDir,
+		OnEscape:            *onEscape,
+		OnCollision:         *onCollision,
+		Include:             parseList(*includeFiles),
+		Exclude:             parseList(*excludeFiles),
+		Outputs:             outputPaths(*outputPath, *bundlePath, *outputTar),
+		Strict:              *strict,
+		ScrubFields:         parseList(*scrubFields),
+		Reproducible:        *reproducible,
+		MaxSubjects:         *maxSubjects,
+		Patch:               patch,
+		Format:              *outputFormat,
+		PredicateVersion:    *predicateVersion,
+		Envelope:            *envelopeFormat,
+		Redact:              *redactMode,
+		Signer:              signer,
+		Force:               *forceOverwrite || *appendMode,
+		CASDir:              cas,
+		Severities:          sevs,
+		FailOn:              *failOn,
+		Attestors:           parseList(*attestorNames),
+		FileMetadata:        *fileMetadata,
+		SigningReceipts:     parseList(*signingReceiptList),
+		RestoredCaches:      *restoredCaches,
+		CommandsLog:         *commandsLog,
+		EgressReport:        *egressReport,
+		ValidFor:            *validFor,
+		VerifyPublished:     parseList(*verifyPublishedList),
+		RecordApprovals:     *recordApprovalsFlag,
+		RecordCommit:        *recordCommitFlag,
+		SkipAttested:        *skipAttestedPath,
+		AttestCommand:       *attestCommand,
+		Getenv:              os.Getenv,
+		Environ:             os.Environ,
+		Timing:              newTiming(),
+	}
+}
+
+// emit generates provenance and writes it, with any attestation bundle, to
+// the paths given on the command line.
+func emit(opts Options) {
+	stmt, findings, err := generate(opts)
+	if err != nil {
+		findings.report(opts.Severities)
+	}
+	if os.IsNotExist(err) {
+		fmt.Println(fmt.Sprintf("Resource path not found: [provided=%s]", strings.Join(*artifactPath, ", ")))
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Printf("Failed to generate provenance: %s\n", err)
+		os.Exit(1)
+	}
+	path, err := expandOutputPath(*outputPath, stmt, singleArtifactPath(opts.ArtifactPaths), opts)
+	if err != nil {
+		findings.report(opts.Severities)
+		fmt.Printf("Failed to name provenance: %s\n", err)
+		os.Exit(1)
+	}
+	var certs []BundleCertificate
+	switch *signMode {
+	case SignKeyless:
+		done := track(&opts.Timing.Sign)
+		opts.Signer, certs, err = keylessSigner(*fulcioURL)
+		done()
+	case SignRemote:
+		done := track(&opts.Timing.Sign)
+		opts.Signer, err = newRemoteSigner(*signingService, *serviceCert, *serviceKey, opts.Getenv)
+		done()
+	}
+	if err != nil {
+		fmt.Printf("Failed to sign provenance: %s\n", err)
+		os.Exit(1)
+	}
+	// Jobs appending to the same provenance take turns, so that none loses
+	// the subjects of another.
+	unlock := func() error { return nil }
+	if *appendMode {
+		if unlock, err = lockFile(path); err != nil {
+			fmt.Printf("Failed to append provenance: %s\n", err)
+			os.Exit(1)
+		}
+		if stmt, err = appendStatement(path, stmt); err != nil {
+			unlock()
+			fmt.Printf("Failed to append provenance: %s\n", err)
+			os.Exit(1)
+		}
+		if opts.Reproducible {
+			sortStatement(stmt)
+		}
+	}
+	payload, err := writeStatement(stmt, path, opts)
+	if uerr := unlock(); err == nil {
+		err = uerr
+	}
 	fmt.Println("Provenance:\n" + string(payload))
-	if err := ioutil.WriteFile(*outputPath, payload, 0755); err != nil {
-		fmt.Println("Failed to write provenance: %s", err)
+	findings.report(opts.Severities)
+	if err != nil {
+		fmt.Printf("Failed to write provenance: %s\n", err)
+		os.Exit(1)
+	}
+	written := outputFiles(path, payload)
+	bundle, err := bundleStatements(stmt, opts)
+	if err != nil {
+		fmt.Printf("Failed to collect attestations: %s\n", err)
+		os.Exit(1)
+	}
+	var bundleFile string
+	if bundle != nil {
+		bundleFile = *bundlePath
+		if bundleFile == "" {
+			bundleFile = path + ".bundle.jsonl"
+		}
+		err := writeBundle(bundleFile, opts.Force, bundle...)
+		if err != nil {
+			fmt.Printf("Failed to write attestation bundle: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Attestation bundle: %s\n", bundleFile)
+		written = append(written, bundleFile)
+	}
+	var signed []string
+	if *signMode != "" {
+		signed, err = signKeyless(outputFiles(path, payload), opts.Signer, certs, opts.Force || *appendMode)
+		if err != nil {
+			fmt.Printf("Failed to sign provenance: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed provenance: %s\n", strings.Join(signed, ", "))
+		written = append(written, signed...)
+	}
+	var receipts []RekorReceipt
+	if *rekorLogURL != "" {
+		done := track(&opts.Timing.Upload)
+		var logged []string
+		receipts, logged, err = uploadProvenance(*rekorLogURL, outputFiles(path, payload), opts.Signer, signingCertificates(opts.Signer, certs), opts.Force || *appendMode)
+		done()
+		if errors.Is(err, errRekorUnavailable) {
+			// The findings were reported before uploading; report this one
+			// on its own, and write them all again.
+			unavailable := Findings{}
+			unavailable.add(CodeRekorUnavailable, "provenance is not logged in %s: %s", *rekorLogURL, err)
+			unavailable.print(opts.Severities)
+			findings = append(findings, unavailable...)
+			findings.write(opts.Severities)
+			if len(unavailable.failing(opts.Severities, opts.FailOn)) == 0 {
+				err = nil
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to upload provenance to %s: %s\n", *rekorLogURL, err)
+			os.Exit(1)
+		}
+		written = append(written, logged...)
+		for _, r := range receipts {
+			fmt.Printf("Logged provenance in %s at index %d: %s\n", r.URL, r.LogIndex, r.UUID)
+		}
+	}
+	emitTar(written, opts)
+	if err := writeStepOutputs(opts.Getenv, provenanceOutputs(stmt, path, bundleFile, signed, receipts)); err != nil {
+		fmt.Printf("Failed to write step outputs: %s\n", err)
+		os.Exit(1)
+	}
+	opts.Timing.print()
+}
+
+// emitTar writes the files written to --output_tar, if it is set.
+func emitTar(written []string, opts Options) {
+	if *outputTar == "" {
+		return
+	}
+	modTime, err := buildFinishedOn(opts)
+	if err == nil && *outputTar != "-" {
+		err = checkOverwrite(opts.Force, *outputTar)
+	}
+	if err == nil {
+		err = writeTar(*outputTar, written, modTime)
+	}
+	if err != nil {
+		fmt.Printf("Failed to write tarball: %s\n", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+	"lukechampine.com/blake3"
+)
+
+// DefaultDigestAlgorithm is the algorithm files are hashed with unless
+// others are selected, and the one every consumer of provenance supports.
+const DefaultDigestAlgorithm = "sha256"
+
+// digestAlgorithms maps the names accepted by --digest_algorithms, which are
+// the in-toto digest set keys, to their hash implementations. Adding one
+// here is all that's needed to hash subjects with it.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256":   sha256.New,
+	"sha512":   sha512.New,
+	"sha3_256": sha3.New256,
+	"blake3":   func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// hashBuffers are the buffers files are read into while hashed, much larger
+// than io.Copy's, to make fewer reads of multi-gigabyte artifacts. Only a
+// buffer per file being hashed is held, however large the file.
+var hashBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, 1<<20)
+	return &b
+}}
+
+// validateDigestAlgorithms checks that every name in algorithms is
+// registered in digestAlgorithms.
+func validateDigestAlgorithms(algorithms []string) error {
+	for _, alg := range algorithms {
+		if digestAlgorithms[alg] == nil {
+			names := make([]string, 0, len(digestAlgorithms))
+			for name := range digestAlgorithms {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown digest algorithm %q (known: %s)", alg, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// digestReader hashes the contents of r with each of algorithms, in a single
+// streaming pass, or with DefaultDigestAlgorithm if there are none. The algorithms
+// must have been validated.
+func digestReader(r io.Reader, algorithms ...string) (DigestSet, error) {
+	if len(algorithms) == 0 {
+		algorithms = []string{DefaultDigestAlgorithm}
+	}
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, alg := range algorithms {
+		hashes[i] = digestAlgorithms[alg]()
+		writers[i] = hashes[i]
+	}
+	buf := hashBuffers.Get().(*[]byte)
+	defer hashBuffers.Put(buf)
+	// CopyBuffer doesn't use the buffer if r is an io.WriterTo, as an
+	// *os.File is, which copies with a small buffer of its own instead.
+	if _, err := io.CopyBuffer(io.MultiWriter(writers...), struct{ io.Reader }{r}, *buf); err != nil {
+		return nil, err
+	}
+	digest := DigestSet{}
+	for i, alg := range algorithms {
+		digest[alg] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return digest, nil
+}
+
+// digestFile hashes the file at path with each of algorithms, or with
+// DefaultDigestAlgorithm if there are none.
+func digestFile(path string, algorithms ...string) (DigestSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return digestReader(f, algorithms...)
+}
+
+// digestFiles hashes the files at paths as digestFile does, with up to
+// concurrency files being read at once, or one per CPU if concurrency is 0.
+// The digests are in the order of paths, and the error is that of the first
+// path that failed, whatever order the files were hashed in, so that a run
+// fails the same way each time.
+func digestFiles(paths []string, concurrency int, algorithms ...string) ([]DigestSet, error) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	if concurrency > len(paths) {
+		concurrency = len(paths)
+	}
+	digests := make([]DigestSet, len(paths))
+	errs := make([]error, len(paths))
+	// Files after the first that failed aren't needed, but those before it
+	// are still hashed, in case one of them fails too.
+	var mu sync.Mutex
+	failed := len(paths)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				mu.Lock()
+				skip := i > failed
+				mu.Unlock()
+				if skip {
+					continue
+				}
+				if digests[i], errs[i] = digestFile(paths[i], algorithms...); errs[i] != nil {
+					mu.Lock()
+					if i < failed {
+						failed = i
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// knownAlgorithms returns the algorithms of digest that are registered, in
+// name order, so that a file can be hashed for comparison with it.
+func knownAlgorithms(digest DigestSet) []string {
+	var algorithms []string
+	for alg := range digest {
+		if digestAlgorithms[alg] != nil {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readSizes records the size of the buffers it is read into, and whether it
+// was copied with WriteTo, which would bypass them.
+type readSizes struct {
+	r       io.Reader
+	sizes   []int
+	writeTo bool
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func (r *readSizes) WriteTo(w io.Writer) (int64, error) {
+	r.writeTo = true
+	return io.Copy(w, r.r)
+}
+
+func TestDigestReaderUsesPooledBuffer(t *testing.T) {
+	r := &readSizes{r: bytes.NewReader(make([]byte, 3<<20))}
+	if _, err := digestReader(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.writeTo {
+		t.Fatal("digestReader copied with WriteTo instead of the pooled buffer")
+	}
+	for _, n := range r.sizes {
+		if n != 1<<20 {
+			t.Fatalf("digestReader read into buffers of %v bytes, want %d", r.sizes, 1<<20)
+		}
+	}
+}
+
+func TestDigestFileLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hashes 5 GiB")
+	}
+	// A sparse file takes no space, but is read in full like any other.
+	path := filepath.Join(t.TempDir(), "large")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(5 << 30)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := digestFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// head -c $((5<<30)) /dev/zero | sha256sum
+	const want = "7f06c62352aebd8125b2a1841e2b9e1ffcbed602f381c3dcb3200200e383d1d5"
+	if digest["sha256"] != want {
+		t.Errorf("digestFile() = %s, want sha256 %s", digest, want)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// pae is the DSSE Pre-Authentication Encoding of a payload, which is what
+// signatures in an Envelope are computed over.
+// See https://github.com/secure-systems-lab/dsse/blob/master/protocol.md
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// signEnvelope wraps payload in a DSSE Envelope signed by signer.
+func signEnvelope(payloadType string, payload []byte, signer Signer) (*Envelope, error) {
+	sig, err := signer.Sign(pae(payloadType, payload))
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []Signature{{KeyId: signer.KeyId(), Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// verifyEnvelope checks that at least one signature on env was made by
+// verifier, returning the decoded payload.
+func verifyEnvelope(env *Envelope, verifier Verifier) ([]byte, error) {
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decoding envelope payload: %w", err)
+	}
+	if len(env.Signatures) == 0 {
+		return nil, errors.New("envelope has no signatures")
+	}
+	msg := pae(env.PayloadType, payload)
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if verifier.Verify(msg, sig) == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("no envelope signature verifies with the given key")
+}
+
+// openEnvelope parses the envelope read from source, checks its payload
+// type and that it is signed by verifier, and returns its payload.
+func openEnvelope(contents []byte, source, payloadType string, verifier Verifier) ([]byte, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(contents, env); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", source, err)
+	}
+	if env.PayloadType != payloadType {
+		return nil, fmt.Errorf("%s has payload type %q, want %q", source, env.PayloadType, payloadType)
+	}
+	payload, err := verifyEnvelope(env, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPAE(t *testing.T) {
+	tests := []struct {
+		payloadType string
+		payload     string
+		want        string
+	}{
+		// The test vector of the DSSE protocol.
+		{"http://example.com/HelloWorld", "hello world", "DSSEv1 29 http://example.com/HelloWorld 11 hello world"},
+		{"", "", "DSSEv1 0  0 "},
+		{PayloadContentType, "{}", "DSSEv1 28 application/vnd.in-toto+json 2 {}"},
+		// Lengths are of bytes, not runes.
+		{"t", "é", "DSSEv1 1 t 2 é"},
+	}
+	for _, tt := range tests {
+		if got := string(pae(tt.payloadType, []byte(tt.payload))); got != tt.want {
+			t.Errorf("pae(%q, %q) = %q, want %q", tt.payloadType, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	ecdsaSigner, ecdsaVerifier := testVerifier(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := newKeySigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edVerifier := &keyVerifier{key: edSigner.Public()}
+	if edVerifier.KeyId() != edSigner.KeyId() || ecdsaVerifier.KeyId() != ecdsaSigner.KeyId() {
+		t.Error("a verifier's key id isn't that of its signer")
+	}
+	payload := []byte(`{"_type": "https://in-toto.io/Statement/v0.1"}`)
+	for _, tt := range []struct {
+		name     string
+		signer   Signer
+		verifier Verifier
+	}{
+		{"ecdsa", ecdsaSigner, ecdsaVerifier},
+		{"ed25519", edSigner, edVerifier},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := signEnvelope(PayloadContentType, payload, tt.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Signatures[0].KeyId != tt.signer.KeyId() {
+				t.Errorf("signature has key id %s, want %s", env.Signatures[0].KeyId, tt.signer.KeyId())
+			}
+			contents, err := json.Marshal(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := openEnvelope(contents, "provenance.dsse", PayloadContentType, tt.verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(payload) {
+				t.Errorf("openEnvelope() = %s, want %s", got, payload)
+			}
+		})
+	}
+}
+
+func TestVerifyEnvelope(t *testing.T) {
+	signer, verifier := testVerifier(t)
+	other, _ := testVerifier(t)
+	payload := []byte(`{"subject": []}`)
+	signed := func(change func(*Envelope)) *Envelope {
+		env, err := signEnvelope(PayloadContentType, payload, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change != nil {
+			change(env)
+		}
+		return env
+	}
+	otherSig := func() Signature {
+		env, err := signEnvelope(PayloadContentType, payload, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env.Signatures[0]
+	}
+	tests := []struct {
+		name    string
+		env     *Envelope
+		wantErr string
+	}{
+		{"signed", signed(nil), ""},
+		{"also signed by another key", signed(func(e *Envelope) { e.Signatures = append([]Signature{otherSig()}, e.Signatures...) }), ""},
+		{"after a malformed signature", signed(func(e *Envelope) { e.Signatures = append([]Signature{{Sig: "!"}}, e.Signatures...) }), ""},
+		{"unsigned", signed(func(e *Envelope) { e.Signatures = nil }), "no signatures"},
+		{"signed by another key", signed(func(e *Envelope) { e.Signatures = []Signature{otherSig()} }), "no envelope signature verifies"},
+		// The key id is only a hint: naming the verifier's key doesn't make a
+		// signature by another key verify.
+		{"claiming the key id", signed(func(e *Envelope) {
+			s := otherSig()
+			s.KeyId = verifier.KeyId()
+			e.Signatures = []Signature{s}
+		}), "no envelope signature verifies"},
+		{"tampered payload", signed(func(e *Envelope) { e.Payload = base64.StdEncoding.EncodeToString([]byte(`{"subject": [{}]}`)) }), "no envelope signature verifies"},
+		// The payload type is signed along with the payload.
+		{"changed payload type", signed(func(e *Envelope) { e.PayloadType = RevocationListPayloadType }), "no envelope signature verifies"},
+		{"malformed payload", signed(func(e *Envelope) { e.Payload = "!" }), "decoding envelope payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyEnvelope(tt.env, verifier)
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("verifyEnvelope() = %v, want an error containing %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("verifyEnvelope() = %v", err)
+			case string(got) != string(payload):
+				t.Errorf("verifyEnvelope() = %s, want %s", got, payload)
+			}
+		})
+	}
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	signer, verifier := testVerifier(t)
+	env, err := signEnvelope(RevocationListPayloadType, []byte(`{}`), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A signed envelope of one kind can't be passed off as another.
+	if _, err := openEnvelope(contents, "list.dsse", PayloadContentType, verifier); err == nil || !strings.Contains(err.Error(), "payload type") {
+		t.Errorf("openEnvelope() of another payload type = %v, want a payload type error", err)
+	}
+	if _, err := openEnvelope([]byte(`{"payload":`), "list.dsse", RevocationListPayloadType, verifier); err == nil || !strings.Contains(err.Error(), "parsing list.dsse") {
+		t.Errorf("openEnvelope() of malformed JSON = %v, want a parsing error", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ByproductEgressReport is the kind of a Byproduct recording the report of
+// an egress filter that ran during the job.
+const ByproductEgressReport = "egress-report"
+
+// Formats of egress reports.
+const (
+	EgressFormatSquid = "squid"
+	EgressFormatJSON  = "jsonl"
+)
+
+// EgressSummary summarizes an egress report: the destinations, as
+// <host>[:<port>], that connections were allowed to and blocked from.
+type EgressSummary struct {
+	Format      string   `json:"format"`
+	Connections int      `json:"connections"`
+	Allowed     []string `json:"allowed,omitempty"`
+	Blocked     []string `json:"blocked,omitempty"`
+}
+
+// egressRecord is a connection in a JSON Lines egress report.
+type egressRecord struct {
+	Destination string `json:"destination"`
+	Action      string `json:"action"`
+}
+
+// readEgressReport hashes and summarizes the report an egress filter wrote
+// during the job: a Squid access log, as allowlist proxies write, or JSON
+// Lines of {"destination": "<host>[:<port>]", "action": "allowed"|"blocked"}
+// records other filters' reports can be converted to.
+func readEgressReport(path string) (Byproduct, error) {
+	contents, err := ioutil.ReadFile(normalizeInputPath(path))
+	if err != nil {
+		return Byproduct{}, err
+	}
+	summary, err := summarizeEgress(contents)
+	if err != nil {
+		return Byproduct{}, fmt.Errorf("%s: %w", path, err)
+	}
+	digest, err := digestFile(normalizeInputPath(path))
+	if err != nil {
+		return Byproduct{}, err
+	}
+	return Byproduct{
+		Name:   filepath.ToSlash(path),
+		Digest: digest,
+		Kind:   ByproductEgressReport,
+		Egress: summary,
+	}, nil
+}
+
+// summarizeEgress parses an egress report, detecting its format.
+func summarizeEgress(contents []byte) (*EgressSummary, error) {
+	summary := &EgressSummary{Format: EgressFormatSquid}
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		summary.Format = EgressFormatJSON
+	}
+	allowed, blocked := map[string]bool{}, map[string]bool{}
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var destination string
+		var ok bool
+		var err error
+		if summary.Format == EgressFormatJSON {
+			destination, ok, err = parseEgressRecord(line)
+		} else {
+			destination, ok, err = parseSquidLine(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		summary.Connections++
+		if ok {
+			allowed[destination] = true
+		} else {
+			blocked[destination] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	summary.Allowed, summary.Blocked = sortedKeys(allowed), sortedKeys(blocked)
+	return summary, nil
+}
+
+// parseEgressRecord parses a JSON Lines egress record, returning its
+// destination and whether the connection was allowed.
+func parseEgressRecord(line string) (string, bool, error) {
+	var r egressRecord
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return "", false, err
+	}
+	if r.Destination == "" {
+		return "", false, fmt.Errorf("record has no destination")
+	}
+	switch r.Action {
+	case "allowed":
+		return r.Destination, true, nil
+	case "blocked":
+		return r.Destination, false, nil
+	default:
+		return "", false, fmt.Errorf("action of %s is %q, not allowed or blocked", r.Destination, r.Action)
+	}
+}
+
+// parseSquidLine parses a line of a Squid access log in its native format,
+// "<time> <elapsed> <client> <code>/<status> <bytes> <method> <URL> ...",
+// returning the destination of the request and whether Squid allowed it.
+// See https://wiki.squid-cache.org/Features/LogFormat
+func parseSquidLine(line string) (string, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 || !strings.Contains(fields[3], "/") {
+		return "", false, fmt.Errorf("not a Squid access log line: %q", line)
+	}
+	destination := fields[6]
+	if fields[5] != "CONNECT" {
+		u, err := url.Parse(destination)
+		if err != nil || u.Host == "" {
+			return "", false, fmt.Errorf("request URL %q has no host", destination)
+		}
+		destination = u.Host
+	}
+	return destination, !strings.Contains(fields[3], "DENIED"), nil
+}
+
+// sortedKeys returns the keys of set in order.
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
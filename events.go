@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// EventExtractor extracts the parameters of a run from the event that
+// started it into the recipe arguments: what a verifier compares with what
+// it expects, e.g. the ref pushed or the tag released.
+type EventExtractor interface {
+	Extract(event json.RawMessage) (json.RawMessage, error)
+}
+
+// FieldExtractor extracts the event fields at its values, JSON pointers
+// (RFC 6901), as the arguments named by its keys. Fields the event doesn't
+// have are left out.
+type FieldExtractor map[string]string
+
+func (f FieldExtractor) Extract(event json.RawMessage) (json.RawMessage, error) {
+	var doc interface{}
+	if err := decodeJSON(event, &doc); err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{}
+	for name, pointer := range f {
+		tokens, err := splitPointer(pointer)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", name, err)
+		}
+		if v, err := getPointer(doc, tokens); err == nil && v != nil {
+			args[name] = v
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(args)
+}
+
+// inputsExtractor extracts the inputs of a workflow_dispatch event as they
+// are.
+type inputsExtractor struct{}
+
+func (inputsExtractor) Extract(event json.RawMessage) (json.RawMessage, error) {
+	e := AnyEvent{}
+	if err := json.Unmarshal(event, &e); err != nil {
+		return nil, err
+	}
+	return e.Inputs, nil
+}
+
+// eventExtractors are the extractors of each event_name or, for
+// repository_dispatch events, of "repository_dispatch:<event_type>" before
+// "repository_dispatch". Events without one have their inputs extracted, if
+// they have any.
+var eventExtractors = map[string]EventExtractor{
+	"push": FieldExtractor{
+		"ref":    "/ref",
+		"before": "/before",
+		"after":  "/after",
+		"forced": "/forced",
+	},
+	"pull_request":        pullRequestExtractor,
+	"pull_request_target": pullRequestExtractor,
+	"release": FieldExtractor{
+		"action":           "/action",
+		"tag_name":         "/release/tag_name",
+		"target_commitish": "/release/target_commitish",
+		"prerelease":       "/release/prerelease",
+	},
+	"schedule":          FieldExtractor{"schedule": "/schedule"},
+	"workflow_dispatch": inputsExtractor{},
+	"repository_dispatch": FieldExtractor{
+		"event_type":     "/action",
+		"client_payload": "/client_payload",
+	},
+}
+
+var pullRequestExtractor = FieldExtractor{
+	"action":          "/action",
+	"number":          "/number",
+	"base_ref":        "/pull_request/base/ref",
+	"base_sha":        "/pull_request/base/sha",
+	"head_ref":        "/pull_request/head/ref",
+	"head_sha":        "/pull_request/head/sha",
+	"head_repository": "/pull_request/head/repo/full_name",
+}
+
+// registerEventExtractor registers e for events named name, replacing any
+// extractor already registered for it.
+func registerEventExtractor(name string, e EventExtractor) {
+	eventExtractors[name] = e
+}
+
+// readEventExtractors registers the FieldExtractors of the JSON object at
+// path, keyed by event name, e.g.
+// {"repository_dispatch:deploy": {"environment": "/client_payload/environment"}}.
+func readEventExtractors(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var extractors map[string]FieldExtractor
+	if err := json.Unmarshal(contents, &extractors); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make([]string, 0, len(extractors))
+	for name := range extractors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for arg, pointer := range extractors[name] {
+			if _, err := splitPointer(pointer); err != nil || arg == "" {
+				return fmt.Errorf("%s: extractor %s: invalid argument %q: %q", path, name, arg, pointer)
+			}
+		}
+		registerEventExtractor(name, extractors[name])
+	}
+	return nil
+}
+
+// eventExtractor returns the extractor of the event named name.
+func eventExtractor(name string, event json.RawMessage) EventExtractor {
+	if name == "repository_dispatch" {
+		var dispatch struct {
+			Action string `json:"action"`
+		}
+		if json.Unmarshal(event, &dispatch) == nil && dispatch.Action != "" {
+			if e, ok := eventExtractors[name+":"+dispatch.Action]; ok {
+				return e
+			}
+		}
+	}
+	if e, ok := eventExtractors[strings.TrimSpace(name)]; ok {
+		return e
+	}
+	return inputsExtractor{}
+}
+
+// extractArguments returns the recipe arguments of a run started by the
+// event named name.
+func extractArguments(name string, event json.RawMessage) (json.RawMessage, error) {
+	if len(event) == 0 {
+		return nil, nil
+	}
+	return eventExtractor(name, event).Extract(event)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Export formats: JSON Lines of the attestations, named as OpenSSF
+// Scorecard's Signed-Releases check looks for provenance among release
+// assets, the Sigstore bundle of the signed attestation, which Scorecard
+// counts as a signature and package registries feeding deps.dev accept as an
+// attestation, and the SCITT signed statement of the attestation.
+const (
+	ExportScorecard = "scorecard"
+	ExportSigstore  = "sigstore"
+	ExportSCITT     = "scitt"
+)
+
+// SigstoreBundleType is the media type of the bundles export writes.
+const SigstoreBundleType = "application/vnd.dev.sigstore.bundle+json;version=0.2"
+
+// SigstoreBundle is a Sigstore bundle of a DSSE envelope.
+// See https://github.com/sigstore/protobuf-specs/blob/main/protos/sigstore_bundle.proto
+type SigstoreBundle struct {
+	MediaType            string                     `json:"mediaType"`
+	VerificationMaterial BundleVerificationMaterial `json:"verificationMaterial"`
+	DSSEEnvelope         *Envelope                  `json:"dsseEnvelope"`
+}
+
+type BundleVerificationMaterial struct {
+	// PublicKey hints at the key that signed the envelope, or else
+	// X509CertificateChain holds the certificate.
+	PublicKey *struct {
+		Hint string `json:"hint"`
+	} `json:"publicKey,omitempty"`
+	X509CertificateChain *struct {
+		Certificates []BundleCertificate `json:"certificates"`
+	} `json:"x509CertificateChain,omitempty"`
+	TlogEntries []BundleTlogEntry `json:"tlogEntries"`
+}
+
+type BundleCertificate struct {
+	RawBytes string `json:"rawBytes"`
+}
+
+// BundleTlogEntry is a transparency log entry in the proto JSON encoding of
+// the bundle, in which 64-bit integers are strings.
+type BundleTlogEntry struct {
+	LogIndex string `json:"logIndex"`
+	LogId    struct {
+		KeyId string `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   string `json:"integratedTime"`
+	InclusionPromise *struct {
+		SignedEntryTimestamp string `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise,omitempty"`
+	InclusionProof    *BundleInclusionProof `json:"inclusionProof,omitempty"`
+	CanonicalizedBody string                `json:"canonicalizedBody"`
+}
+
+// BundleInclusionProof is a RekorInclusionProof in the proto JSON encoding,
+// in which hashes are base64.
+type BundleInclusionProof struct {
+	LogIndex   string   `json:"logIndex"`
+	RootHash   string   `json:"rootHash"`
+	TreeSize   string   `json:"treeSize"`
+	Hashes     []string `json:"hashes"`
+	Checkpoint struct {
+		Envelope string `json:"envelope"`
+	} `json:"checkpoint"`
+}
+
+// exportName is the name exported files are given, by default: the
+// provenance file's name without its usual extensions.
+func exportName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".bundle.jsonl", ".intoto.jsonl", ".dsse", ".intoto", ".provenance", ".json"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// exportJSONLines returns the attestations as JSON Lines, one compact
+// attestation per line.
+func exportJSONLines(attestations []gateAttestation) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, a := range attestations {
+		if err := json.Compact(&buf, a.Contents); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.URI, err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// findLogEntry returns the entry of the log recording env, by the digest of
+// its payload, or nil if there is none.
+func findLogEntry(c *rekorClient, env *Envelope) (*RekorEntry, error) {
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decoding envelope payload: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	digest := hex.EncodeToString(sum[:])
+	uuids, err := c.search("sha256:" + digest)
+	if err != nil || len(uuids) == 0 {
+		return nil, err
+	}
+	entries, err := c.entries(uuids)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if b, err := e.body(); err == nil && b.payloadHash() == digest {
+			return &entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// sigstoreBundle bundles env with its log entry, if set, whose certificate
+// replaces the envelope's key id as the verification material.
+func sigstoreBundle(env *Envelope, entry *RekorEntry) (*SigstoreBundle, error) {
+	if len(env.Signatures) == 0 {
+		return nil, errors.New("envelope has no signatures")
+	}
+	b := &SigstoreBundle{MediaType: SigstoreBundleType, DSSEEnvelope: env}
+	m := &b.VerificationMaterial
+	m.TlogEntries = []BundleTlogEntry{}
+	if entry != nil {
+		t, body, err := bundleTlogEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		m.TlogEntries = append(m.TlogEntries, t)
+		for _, k := range body.keys() {
+			contents, err := base64.StdEncoding.DecodeString(k)
+			if err != nil {
+				continue
+			}
+			if block, _ := pem.Decode(contents); block != nil && block.Type == "CERTIFICATE" {
+				m.X509CertificateChain = &struct {
+					Certificates []BundleCertificate `json:"certificates"`
+				}{[]BundleCertificate{{base64.StdEncoding.EncodeToString(block.Bytes)}}}
+				return b, nil
+			}
+		}
+	}
+	m.PublicKey = &struct {
+		Hint string `json:"hint"`
+	}{env.Signatures[0].KeyId}
+	return b, nil
+}
+
+// bundleTlogEntry encodes entry as a Sigstore bundle records it, and returns
+// its decoded body.
+func bundleTlogEntry(entry *RekorEntry) (BundleTlogEntry, rekorBody, error) {
+	t := BundleTlogEntry{
+		LogIndex:          strconv.FormatInt(entry.LogIndex, 10),
+		IntegratedTime:    strconv.FormatInt(entry.IntegratedTime, 10),
+		CanonicalizedBody: entry.Body,
+	}
+	body, err := entry.body()
+	if err != nil {
+		return t, body, fmt.Errorf("decoding log entry %s: %w", entry.UUID, err)
+	}
+	logId, err := hex.DecodeString(entry.LogID)
+	if err != nil {
+		return t, body, fmt.Errorf("log entry %s has malformed log id %q", entry.UUID, entry.LogID)
+	}
+	t.LogId.KeyId = base64.StdEncoding.EncodeToString(logId)
+	t.KindVersion.Kind, t.KindVersion.Version = body.Kind, body.APIVersion
+	v := entry.Verification
+	if v == nil {
+		return t, body, nil
+	}
+	if v.SignedEntryTimestamp != "" {
+		t.InclusionPromise = &struct {
+			SignedEntryTimestamp string `json:"signedEntryTimestamp"`
+		}{v.SignedEntryTimestamp}
+	}
+	if p := v.InclusionProof; p != nil {
+		proof := &BundleInclusionProof{LogIndex: strconv.FormatInt(p.LogIndex, 10), TreeSize: strconv.FormatInt(p.TreeSize, 10), Hashes: []string{}}
+		for _, h := range append([]string{p.RootHash}, p.Hashes...) {
+			raw, err := hex.DecodeString(h)
+			if err != nil {
+				return t, body, fmt.Errorf("log entry %s has a malformed inclusion proof", entry.UUID)
+			}
+			proof.Hashes = append(proof.Hashes, base64.StdEncoding.EncodeToString(raw))
+		}
+		proof.RootHash, proof.Hashes = proof.Hashes[0], proof.Hashes[1:]
+		proof.Checkpoint.Envelope = p.Checkpoint
+		t.InclusionProof = proof
+	}
+	return t, body, nil
+}
+
+// exportMain implements `export --provenance <path>`, writing the provenance
+// in the formats other ecosystem tools consume.
+func exportMain(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	provenance := flags.String("provenance", "build.provenance", "The provenance to export: a Statement, an envelope, a shard index or JSON Lines.")
+	formats := flags.String("format", ExportScorecard, "Comma-separated formats to write: 'scorecard', <name>.intoto.jsonl for release assets, 'sigstore', the <name>.sigstore.json bundle of a signed envelope, and 'scitt', the <name>.scitt.cose SCITT signed statement.")
+	outputDir := flags.String("output_dir", ".", "The directory to write the exported files to.")
+	name := flags.String("name", "", "The name of the exported files (default: that of --provenance, without its extensions).")
+	useRekor := flags.Bool("rekor", false, "Include the transparency log entry of the envelope in the Sigstore bundle.")
+	rekorURL := flags.String("rekor_url", DefaultRekorURL, "The Rekor transparency log to look the envelope up in with --rekor.")
+	keyPath := flags.String("key", "", "The PEM private key to sign the SCITT statement with.")
+	issuer := flags.String("scitt_issuer", "", "The issuer the SCITT statement names (default: the builder id).")
+	scittSubject := flags.String("scitt_subject", "", "The artifact the SCITT statement is about (default: the only subject's name, or else the source repository).")
+	scittURL := flags.String("scitt_url", "", "Register the SCITT statement with the transparency service at this URL, writing its receipt to <name>.scitt.receipt; a bearer token is read from $SCITT_TOKEN.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *name == "" {
+		*name = exportName(*provenance)
+	}
+	list := parseList(*formats)
+	for _, f := range list {
+		if f != ExportScorecard && f != ExportSigstore && f != ExportSCITT {
+			fmt.Printf("Invalid value for flag --format: %q\n", f)
+			os.Exit(1)
+		}
+		if f == ExportSCITT && *keyPath == "" {
+			fmt.Println("No value found for flag --key, required by --format=scitt")
+			os.Exit(1)
+		}
+	}
+	if *useRekor {
+		if err := requireOnline("export --rekor"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *scittURL != "" {
+		if err := requireOnline("export --scitt_url"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	attestations, err := readAttestations(*provenance)
+	if err != nil {
+		fmt.Printf("Failed to read provenance: %s\n", err)
+		os.Exit(1)
+	}
+	for _, a := range attestations {
+		if _, _, err := parseProvenance(a.Contents, a.URI); err != nil {
+			fmt.Printf("Failed to read provenance: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, f := range list {
+		var path string
+		var contents []byte
+		switch f {
+		case ExportScorecard:
+			path = filepath.Join(*outputDir, *name+".intoto.jsonl")
+			contents, err = exportJSONLines(attestations)
+		case ExportSigstore:
+			path = filepath.Join(*outputDir, *name+".sigstore.json")
+			contents, err = exportBundle(attestations, *useRekor, *rekorURL)
+		case ExportSCITT:
+			path = filepath.Join(*outputDir, *name+".scitt.cose")
+			contents, err = exportSCITT(attestations, *keyPath, *issuer, *scittSubject)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(path, contents, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to export %s: %s\n", f, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %s: %s\n", f, path)
+		if f == ExportSCITT && *scittURL != "" {
+			receipt, err := newSCITTClient(*scittURL).submit(contents)
+			path = filepath.Join(*outputDir, *name+".scitt.receipt")
+			if err == nil {
+				err = ioutil.WriteFile(path, receipt, 0644)
+			}
+			if err != nil {
+				fmt.Printf("Failed to register the SCITT statement with %s: %s\n", *scittURL, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Registered with %s: %s\n", *scittURL, path)
+		}
+	}
+}
+
+// exportSCITT returns the SCITT signed statement of the only attestation,
+// signed with the key at keyPath. The statement of an envelope is wrapped
+// on its own, the COSE signature taking the place of the envelope's.
+func exportSCITT(attestations []gateAttestation, keyPath, issuer, subject string) ([]byte, error) {
+	if len(attestations) != 1 {
+		return nil, fmt.Errorf("a SCITT statement holds a single attestation, but the provenance holds %d", len(attestations))
+	}
+	payload, contentType := attestations[0].Contents, PayloadContentType
+	env := &Envelope{}
+	if json.Unmarshal(payload, env) == nil && env.PayloadType != "" {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(env.Payload); err != nil {
+			return nil, fmt.Errorf("decoding envelope payload: %w", err)
+		}
+		contentType = env.PayloadType
+	}
+	stmt, _, err := parseProvenance(attestations[0].Contents, attestations[0].URI)
+	if err != nil {
+		return nil, err
+	}
+	if issuer == "" {
+		issuer = stmt.Predicate.Builder.Id
+	}
+	if subject == "" && len(stmt.Subject) == 1 {
+		subject = stmt.Subject[0].Name
+	} else if subject == "" {
+		subject = provenanceRepository(stmt)
+	}
+	if issuer == "" || subject == "" {
+		return nil, errors.New("the provenance names no builder or subject; set --scitt_issuer and --scitt_subject")
+	}
+	signer, err := loadSigner(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return scittStatement(payload, contentType, issuer, subject, signer)
+}
+
+// exportBundle returns the Sigstore bundle of the only attestation, which
+// must be an envelope, with its log entry if useRekor.
+func exportBundle(attestations []gateAttestation, useRekor bool, rekorURL string) ([]byte, error) {
+	if len(attestations) != 1 {
+		return nil, fmt.Errorf("a bundle holds a single envelope, but the provenance holds %d attestations", len(attestations))
+	}
+	env := &Envelope{}
+	if json.Unmarshal(attestations[0].Contents, env) != nil || env.PayloadType == "" {
+		return nil, errors.New("a bundle holds a signed envelope, but the provenance isn't signed")
+	}
+	var entry *RekorEntry
+	if useRekor {
+		var err error
+		if entry, err = findLogEntry(newRekorClient(rekorURL), env); err != nil {
+			return nil, fmt.Errorf("searching %s: %w", rekorURL, err)
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("the envelope is not in %s", rekorURL)
+		}
+	} else {
+		fmt.Println("The Sigstore bundle has no transparency log entry; most verifiers require one (see --rekor)")
+	}
+	b, err := sigstoreBundle(env, entry)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(b, "", "  ")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileMetadataPredicateType identifies the extension predicate recording the
+// file system metadata of file subjects.
+const FileMetadataPredicateType = GeneratorURI + "/file-metadata/v0.1"
+
+// FileMetadataStatement is an in-toto Statement about the same subjects as the
+// provenance, so that tampering with permissions or timestamps is detectable
+// and not just changes to content.
+type FileMetadataStatement struct {
+	Type          string                `json:"_type"`
+	Subject       []Subject             `json:"subject"`
+	PredicateType string                `json:"predicateType"`
+	Predicate     FileMetadataPredicate `json:"predicate"`
+}
+type FileMetadataPredicate struct {
+	Files []FileMetadata `json:"files"`
+}
+type FileMetadata struct {
+	// Name is that of the corresponding subject.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Mode holds the permission, setuid, setgid and sticky bits in octal.
+	Mode string `json:"mode"`
+	// MTime is the modification time in UTC, truncated to seconds.
+	MTime      string `json:"mtime"`
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// fileMetadataStatement records the metadata of the file subjects of stmt,
+// i.e. those found under opts.ArtifactPaths.
+func fileMetadataStatement(stmt *Statement, opts Options) (*FileMetadataStatement, error) {
+	fm := &FileMetadataStatement{Type: stmt.Type, PredicateType: FileMetadataPredicateType, Predicate: FileMetadataPredicate{Files: []FileMetadata{}}}
+	digests := map[string]DigestSet{}
+	for _, s := range stmt.Subject {
+		digests[s.Name] = s.Digest
+	}
+	roots, err := expandArtifactPaths(opts.ArtifactPaths)
+	if err != nil {
+		return nil, err
+	}
+	err = walkArtifacts(roots, func(abspath, name string, info fs.FileInfo) error {
+		digest, ok := digests[name]
+		if !ok {
+			return nil
+		}
+		m := FileMetadata{
+			Name:  name,
+			Size:  info.Size(),
+			Mode:  fileMode(info.Mode()),
+			MTime: info.ModTime().UTC().Truncate(time.Second).Format(time.RFC3339),
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(abspath)
+			if err != nil {
+				return err
+			}
+			m.LinkTarget = target
+			// The rest is that of the file the subject hashed.
+			if info, err = os.Stat(abspath); err != nil {
+				return err
+			}
+			m.Size, m.Mode, m.MTime = info.Size(), fileMode(info.Mode()), info.ModTime().UTC().Truncate(time.Second).Format(time.RFC3339)
+		}
+		fm.Subject = append(fm.Subject, Subject{Name: name, Digest: digest})
+		fm.Predicate.Files = append(fm.Predicate.Files, m)
+		return nil
+	})
+	return fm, err
+}
+
+// fileMode formats mode as a Unix octal mode, e.g. "4755".
+func fileMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
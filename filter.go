@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filePattern is a gitignore-style pattern of the subject names of files.
+type filePattern struct {
+	elems  []string
+	negate bool
+	// dirOnly patterns, ending in "/", only match the directories a file is
+	// in.
+	dirOnly bool
+}
+
+// parseFilePattern parses s, a pattern as in a .gitignore file: a pattern
+// with no slash, other than a trailing one, matches files and directories of
+// that name at any depth, and others match paths from the artifact path. A
+// trailing slash only matches directories, "**" matches any number of
+// directories, and a leading "!" negates the pattern.
+func parseFilePattern(s string) (filePattern, error) {
+	var p filePattern
+	orig := s
+	if strings.HasPrefix(s, "!") {
+		p.negate, s = true, s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly, s = true, strings.TrimSuffix(s, "/")
+	}
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return p, fmt.Errorf("invalid pattern %q", orig)
+	}
+	p.elems = strings.Split(s, "/")
+	if !anchored {
+		p.elems = append([]string{"**"}, p.elems...)
+	}
+	for _, e := range p.elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return p, fmt.Errorf("invalid pattern %q: %w", orig, err)
+		}
+	}
+	return p, nil
+}
+
+// match reports whether p matches name, a file, or one of the directories it
+// is in.
+func (p filePattern) match(name string) bool {
+	elems := strings.Split(name, "/")
+	for i := len(elems); i > 0; i-- {
+		if p.dirOnly && i == len(elems) {
+			continue
+		}
+		if matchElems(p.elems, elems[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPatterns reports whether name is matched by patterns, where, as in a
+// .gitignore file, the last pattern matching it decides, so that negated
+// patterns can make exceptions to earlier ones.
+func matchPatterns(patterns []filePattern, name string) bool {
+	matched := false
+	for _, p := range patterns {
+		if p.match(name) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+func parseFilePatterns(list []string) ([]filePattern, error) {
+	patterns := make([]filePattern, 0, len(list))
+	for _, s := range list {
+		p, err := parseFilePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// fileFilter selects the files walked under the artifact paths that become
+// subjects.
+type fileFilter struct {
+	include, exclude []filePattern
+	outputs          []string
+}
+
+// newFileFilter returns the filter of opts: files matching opts.Include, if
+// set, and not opts.Exclude, leaving out the files of opts.Outputs.
+func newFileFilter(opts Options) (*fileFilter, error) {
+	include, err := parseFilePatterns(opts.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	exclude, err := parseFilePatterns(opts.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	f := &fileFilter{include: include, exclude: exclude}
+	for _, o := range opts.Outputs {
+		f.outputs = append(f.outputs, absPath(o))
+	}
+	return f, nil
+}
+
+// keep reports whether the file at abspath, named name, is a subject.
+func (f *fileFilter) keep(abspath, name string) bool {
+	if len(f.include) > 0 && !matchPatterns(f.include, name) {
+		return false
+	}
+	if matchPatterns(f.exclude, name) {
+		return false
+	}
+	abs := absPath(abspath)
+	for _, o := range f.outputs {
+		if isOutputFile(abs, o) {
+			return false
+		}
+	}
+	return true
+}
+
+// outputSuffixes are those of the files written next to provenance at a path:
+// its signature, Sigstore bundle, Rekor receipt and attestation bundle.
+var outputSuffixes = []string{"", ".sig", ".sigstore.json", ".rekor.json", ".bundle.jsonl"}
+
+// isOutputFile reports whether the file at abspath is the provenance written
+// to output, or one of the files written next to it, its shards included, or
+// the hidden ones of writing them: the --append lock of output, and the
+// temporary files of writeTemp.
+func isOutputFile(abspath, output string) bool {
+	if abspath == lockPath(output) {
+		return true
+	}
+	if dir, name := filepath.Split(abspath); strings.HasPrefix(name, "."+filepath.Base(output)) {
+		if i := strings.LastIndex(name, ".tmp-"); i > 0 {
+			return isOutputFile(filepath.Join(dir, name[1:i]), output)
+		}
+	}
+	if !strings.HasPrefix(abspath, output) || filepath.Dir(abspath) != filepath.Dir(output) {
+		return false
+	}
+	suffix := abspath[len(output):]
+	for _, s := range outputSuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+	// Shards are numbered <output>.1, <output>.2, and so on.
+	return len(suffix) > 1 && suffix[0] == '.' && strings.Trim(suffix[1:], "0123456789") == ""
+}
+
+// outputPaths returns those of paths, of the files provenance is written to,
+// that are set and known before generating it: templates name files by their
+// subjects, and "-" is stdout.
+func outputPaths(paths ...string) []string {
+	var outputs []string
+	for _, p := range paths {
+		if p != "" && p != "-" && !isOutputTemplate(p) {
+			outputs = append(outputs, normalizeInputPath(p))
+		}
+	}
+	return outputs
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Finding codes.
+const (
+	CodeMissingBuildStartedOn = "missing-build-started-on"
+	CodePartialMaterials      = "partial-materials"
+	CodeWorkspaceEscape       = "workspace-escape"
+	CodeRunnerNotIsolated     = "runner-not-isolated"
+	CodeNotHermetic           = "not-hermetic"
+	CodeGeneratorUnhashed     = "generator-unhashed"
+	CodeNameCollision         = "name-collision"
+	CodeNoInstanceMetadata    = "no-instance-metadata"
+	CodeUnreviewed            = "unreviewed"
+	CodeNoRunnerConfig        = "no-runner-config"
+	CodeSkippedSymlink        = "skipped-symlink"
+	CodeRedactedFields        = "redacted-fields"
+	CodeUnpinnedAction        = "unpinned-action"
+	CodeUnverifiedCommit      = "unverified-commit"
+	CodeToolchainUnhashed     = "toolchain-unhashed"
+	CodeRekorUnavailable      = "rekor-unavailable"
+)
+
+// Severities a finding can be configured with.
+const (
+	SeverityIgnore  = "ignore"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// defaultSeverities lists every finding code with its default severity.
+var defaultSeverities = map[string]string{
+	CodeMissingBuildStartedOn: SeverityWarning,
+	CodePartialMaterials:      SeverityWarning,
+	CodeWorkspaceEscape:       SeverityWarning,
+	CodeRunnerNotIsolated:     SeverityWarning,
+	CodeNotHermetic:           SeverityWarning,
+	CodeGeneratorUnhashed:     SeverityWarning,
+	CodeNameCollision:         SeverityWarning,
+	CodeNoInstanceMetadata:    SeverityWarning,
+	CodeUnreviewed:            SeverityWarning,
+	CodeNoRunnerConfig:        SeverityWarning,
+	CodeSkippedSymlink:        SeverityWarning,
+	CodeRedactedFields:        SeverityWarning,
+	CodeUnpinnedAction:        SeverityWarning,
+	CodeUnverifiedCommit:      SeverityWarning,
+	CodeToolchainUnhashed:     SeverityWarning,
+	// Provenance that was to be logged fails closed unless configured
+	// otherwise.
+	CodeRekorUnavailable: SeverityError,
+}
+
+// Finding is a problem noticed while generating provenance that doesn't stop
+// generation by itself. Whether it fails the run is configurable, so that
+// security-sensitive pipelines can fail closed.
+type Finding struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Severity is set once the findings are resolved against the configured
+	// severities.
+	Severity string `json:"severity,omitempty"`
+}
+
+type Findings []Finding
+
+func (f *Findings) add(code, format string, args ...interface{}) {
+	*f = append(*f, Finding{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// parseSeverities parses a comma-separated list of code=severity overrides on
+// top of defaultSeverities.
+func parseSeverities(s string) (map[string]string, error) {
+	severities := map[string]string{}
+	for code, sev := range defaultSeverities {
+		severities[code] = sev
+	}
+	for _, e := range parseList(s) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected code=severity, got %q", e)
+		}
+		if _, ok := defaultSeverities[kv[0]]; !ok {
+			return nil, fmt.Errorf("unknown finding code %q", kv[0])
+		}
+		switch kv[1] {
+		case SeverityIgnore, SeverityWarning, SeverityError:
+		default:
+			return nil, fmt.Errorf("unknown severity %q for %s", kv[1], kv[0])
+		}
+		severities[kv[0]] = kv[1]
+	}
+	return severities, nil
+}
+
+func severityOf(code string, severities map[string]string) string {
+	if sev, ok := severities[code]; ok {
+		return sev
+	}
+	return defaultSeverities[code]
+}
+
+// failing returns the codes of the findings that fail the run: those of
+// severity error, and also those of severity warning when failOn is
+// SeverityWarning.
+func (f Findings) failing(severities map[string]string, failOn string) []string {
+	var codes []string
+	for _, finding := range f {
+		switch severityOf(finding.Code, severities) {
+		case SeverityError:
+			codes = append(codes, finding.Code)
+		case SeverityWarning:
+			if failOn == SeverityWarning {
+				codes = append(codes, finding.Code)
+			}
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// resolve returns the findings that aren't ignored, with their severities,
+// for callers to report or enforce, e.g. a policy of no warnings.
+func (f Findings) resolve(severities map[string]string) Findings {
+	resolved := Findings{}
+	for _, finding := range f {
+		if sev := severityOf(finding.Code, severities); sev != SeverityIgnore {
+			finding.Severity = sev
+			resolved = append(resolved, finding)
+		}
+	}
+	return resolved
+}
+
+// print writes every finding that isn't ignored to stdout, in a section of
+// its own.
+func (f Findings) print(severities map[string]string) {
+	resolved := f.resolve(severities)
+	if len(resolved) == 0 {
+		return
+	}
+	fmt.Printf("Findings (%d):\n", len(resolved))
+	for _, finding := range resolved {
+		switch finding.Severity {
+		case SeverityError:
+			fmt.Printf("  Error: %s [%s]\n", finding.Message, finding.Code)
+		case SeverityWarning:
+			fmt.Printf("  Warning: %s [%s]\n", finding.Message, finding.Code)
+		}
+	}
+}
+
+// report prints the findings and, with --findings_output, writes them there
+// as a JSON list, which is empty when there are none.
+func (f Findings) report(severities map[string]string) {
+	f.print(severities)
+	f.write(severities)
+}
+
+// write writes the findings to --findings_output, if it is set.
+func (f Findings) write(severities map[string]string) {
+	if *findingsOutput == "" {
+		return
+	}
+	out, err := json.MarshalIndent(f.resolve(severities), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(*findingsOutput, append(out, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Failed to write findings: %s\n", err)
+		os.Exit(1)
+	}
+}
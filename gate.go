@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VSAPredicateType is the predicate type of the verification summaries
+// written by gate.
+const VSAPredicateType = "https://slsa.dev/verification_summary/v0.2"
+
+// DefaultVerifierId identifies gate as the verifier in its summaries.
+const DefaultVerifierId = "https://github.com/slsa-framework/github-actions-demo/gate@v1"
+
+// VSAStatement is an in-toto Statement of a SLSA Verification Summary
+// Attestation, recording that an artifact was (or wasn't) verified.
+// See https://slsa.dev/verification_summary/v0.2
+type VSAStatement struct {
+	Type          string       `json:"_type"`
+	Subject       []Subject    `json:"subject"`
+	PredicateType string       `json:"predicateType"`
+	Predicate     VSAPredicate `json:"predicate"`
+}
+
+type VSAPredicate struct {
+	Verifier struct {
+		Id string `json:"id"`
+	} `json:"verifier"`
+	TimeVerified       string         `json:"timeVerified"`
+	ResourceUri        string         `json:"resourceUri"`
+	Policy             VSAReference   `json:"policy"`
+	InputAttestations  []VSAReference `json:"inputAttestations"`
+	VerificationResult string         `json:"verificationResult"`
+}
+
+// VSAReference references a policy or attestation by location and digest.
+type VSAReference struct {
+	URI    string    `json:"uri,omitempty"`
+	Digest DigestSet `json:"digest"`
+}
+
+// gateArtifact is an artifact to gate, a file or an image.
+type gateArtifact struct {
+	// Name is the path of the file or the repo@sha256:digest of the image.
+	Name    string
+	Subject Subject
+	Image   bool
+}
+
+// gateAttestation is a provenance located for an artifact.
+type gateAttestation struct {
+	URI string
+	// Contents is the attestation as located: a Statement or an envelope.
+	Contents []byte
+}
+
+func (a gateAttestation) reference() VSAReference {
+	sum := sha256.Sum256(a.Contents)
+	return VSAReference{URI: a.URI, Digest: DigestSet{"sha256": hex.EncodeToString(sum[:])}}
+}
+
+// check returns the problems with a as the provenance of artifact. If
+// verifier is set, a must be an envelope signed with its key. gate and
+// protect always set it; only badge checks unsigned provenance, which it
+// rates no higher than build level 1.
+func (a gateAttestation) check(artifact gateArtifact, policy verifyPolicy, verifier Verifier) []string {
+	stmt, _, err := parseProvenance(a.Contents, a.URI)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	if !matchDigest(artifact.Subject.Digest, subjectDigest(stmt, artifact.Subject.Digest["sha256"])) {
+		problems = append(problems, fmt.Sprintf("doesn't attest sha256:%s", artifact.Subject.Digest["sha256"]))
+	}
+	if verifier != nil {
+		env := &Envelope{}
+		if json.Unmarshal(a.Contents, env) != nil || env.PayloadType == "" {
+			problems = append(problems, "isn't signed")
+		} else if _, err := verifyEnvelope(env, verifier); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return append(problems, policy.check(stmt, verifiedKeyIds(verifier))...)
+}
+
+// splitAttestations splits contents, a JSON document or JSON Lines, into the
+// attestations it holds, located at uri or, if there are several, at uri#n.
+func splitAttestations(contents []byte, uri string) ([]gateAttestation, error) {
+	if err := checkAttestation(contents, uri); err != nil {
+		return nil, err
+	}
+	var docs []json.RawMessage
+	d := json.NewDecoder(bytes.NewReader(contents))
+	for {
+		var doc json.RawMessage
+		if err := d.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", uri, err)
+		}
+		docs = append(docs, doc)
+	}
+	var attestations []gateAttestation
+	for i, doc := range docs {
+		u := uri
+		if len(docs) > 1 {
+			u = fmt.Sprintf("%s#%d", uri, i+1)
+		}
+		attestations = append(attestations, gateAttestation{URI: u, Contents: doc})
+	}
+	return attestations, nil
+}
+
+// readAttestations reads the attestations in the file at path, or in the
+// shards of the shard index at path, whose digests are checked.
+func readAttestations(path string) ([]gateAttestation, error) {
+	contents, err := readAttestationFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := parseShardIndex(contents)
+	if index == nil {
+		return splitAttestations(contents, filepath.ToSlash(path))
+	}
+	var attestations []gateAttestation
+	for _, s := range index.Shards {
+		shardPath, contents, err := readShard(s, path)
+		if err != nil {
+			return nil, err
+		}
+		a, err := splitAttestations(contents, filepath.ToSlash(shardPath))
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a...)
+	}
+	return attestations, nil
+}
+
+// rekorAttestation returns the attestation stored with e, whose entry is at
+// uri, if the log stores it. The log only locates attestations, as its
+// responses aren't checked: a stored envelope is returned as it is, and a
+// stored payload in an envelope of the signatures of the entry body, so that
+// check verifies the signatures itself. Attestations whose payload the
+// body's payloadHash doesn't match aren't those of the entry, and are left
+// out.
+func rekorAttestation(e RekorEntry, uri string) (gateAttestation, bool) {
+	if e.Attestation == nil || e.Attestation.Data == "" {
+		return gateAttestation{}, false
+	}
+	contents, err := base64.StdEncoding.DecodeString(e.Attestation.Data)
+	if err != nil {
+		return gateAttestation{}, false
+	}
+	b, err := e.body()
+	if err != nil {
+		return gateAttestation{}, false
+	}
+	env := &Envelope{}
+	if json.Unmarshal(contents, env) == nil && env.PayloadType != "" {
+		payload, err := base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil || !b.recordsPayload(payload) {
+			return gateAttestation{}, false
+		}
+		return gateAttestation{URI: uri, Contents: contents}, true
+	}
+	if !b.recordsPayload(contents) {
+		return gateAttestation{}, false
+	}
+	wrapped, err := json.Marshal(b.envelope(contents))
+	if err != nil {
+		return gateAttestation{}, false
+	}
+	return gateAttestation{URI: uri, Contents: wrapped}, true
+}
+
+// gateSources are where gate locates the provenance of artifacts.
+type gateSources struct {
+	// Local are the attestations read from files, the provenance store and
+	// release assets.
+	Local []gateAttestation
+	// CASDir is the local CAS to look artifacts up in, if set.
+	CASDir string
+	// Rekor is the transparency log to search artifacts in, if set.
+	Rekor *rekorClient
+	// Registry looks up the provenance referrers of images.
+	Registry *registryClient
+}
+
+// locate returns the attestations of artifact found in sources, and the
+// problems looking them up.
+func (s gateSources) locate(artifact gateArtifact) ([]gateAttestation, []string) {
+	digest := artifact.Subject.Digest["sha256"]
+	var found []gateAttestation
+	var problems []string
+	for _, a := range s.Local {
+		if stmt, _, err := parseProvenance(a.Contents, a.URI); err == nil && subjectDigest(stmt, digest) != nil {
+			found = append(found, a)
+		}
+	}
+	if s.CASDir != "" {
+		digests, err := casLookup(s.CASDir, digest)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("reading the local CAS: %s", err))
+		}
+		for _, d := range digests {
+			a, err := readAttestations(filepath.Join(casObjects(s.CASDir), d))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("reading the local CAS: %s", err))
+			}
+			found = append(found, a...)
+		}
+	}
+	if s.Rekor != nil {
+		a, err := s.searchRekor(digest)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("searching %s: %s", s.Rekor.url, err))
+		}
+		found = append(found, a...)
+	}
+	if i := strings.LastIndex(artifact.Name, "@"); artifact.Image && s.Registry != nil {
+		a, err := s.referrers(artifact.Name[:i], artifact.Name[i+1:])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("looking up the provenance referrers of %s: %s", artifact.Name, err))
+		}
+		found = append(found, a...)
+	}
+	return found, problems
+}
+
+// verify returns the first of the attestations of artifact found in sources
+// that verifies as its provenance, as checked by check, or else nil and the
+// problems with each, and the attestations found.
+func (s gateSources) verify(artifact gateArtifact, policy verifyPolicy, verifier Verifier) (*gateAttestation, []gateAttestation, []string) {
+	attestations, problems := s.locate(artifact)
+	for i, a := range attestations {
+		p := a.check(artifact, policy, verifier)
+		if len(p) == 0 {
+			return &attestations[i], attestations, nil
+		}
+		for _, problem := range p {
+			problems = append(problems, a.URI+": "+problem)
+		}
+	}
+	if len(attestations) == 0 {
+		problems = append(problems, "no provenance found")
+	}
+	return nil, attestations, problems
+}
+
+func (s gateSources) searchRekor(digest string) ([]gateAttestation, error) {
+	uuids, err := s.Rekor.search("sha256:" + digest)
+	if err != nil || len(uuids) == 0 {
+		return nil, err
+	}
+	entries, err := s.Rekor.entries(uuids)
+	if err != nil {
+		return nil, err
+	}
+	var found []gateAttestation
+	for _, e := range entries {
+		if a, ok := rekorAttestation(e, s.Rekor.url+"/api/v1/log/entries/"+e.UUID); ok {
+			found = append(found, a)
+		}
+	}
+	return found, nil
+}
+
+// referrers fetches the provenance published where the referrers pushed by
+// annotate for the image repo@digest point: a Rekor entry or a file.
+func (s gateSources) referrers(repo, digest string) ([]gateAttestation, error) {
+	refs, _, err := s.Registry.referrers(repo, digest, ProvenanceReferenceType)
+	if err != nil {
+		return nil, err
+	}
+	var found []gateAttestation
+	for _, r := range refs {
+		u := r.Annotations[ProvenanceAnnotation]
+		if u == "" {
+			continue
+		}
+		contents, err := fetchURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(u, "/api/v1/log/entries/") {
+			var entries map[string]RekorEntry
+			if err := json.Unmarshal(contents, &entries); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", u, err)
+			}
+			for uuid, e := range entries {
+				e.UUID = uuid
+				if a, ok := rekorAttestation(e, u); ok {
+					found = append(found, a)
+				}
+			}
+			continue
+		}
+		a, err := splitAttestations(contents, u)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, a...)
+	}
+	return found, nil
+}
+
+// releaseAttestations downloads the provenance assets of release, given as
+// <owner>/<repo>@<tag>.
+func releaseAttestations(c *githubClient, release string) ([]gateAttestation, error) {
+	i := strings.LastIndex(release, "@")
+	if i < 0 || strings.Count(release[:i], "/") != 1 {
+		return nil, fmt.Errorf("release %q is not of the form <owner>/<repo>@<tag>", release)
+	}
+	var r githubRelease
+	if err := c.get(fmt.Sprintf("/repos/%s/releases/tags/%s", release[:i], release[i+1:]), &r); err != nil {
+		return nil, err
+	}
+	return assetAttestations(c, r)
+}
+
+// assetAttestations downloads the provenance assets of release r.
+func assetAttestations(c *githubClient, r githubRelease) ([]gateAttestation, error) {
+	var found []gateAttestation
+	for _, asset := range r.Assets {
+		if !isAttestationAsset(asset.Name) {
+			continue
+		}
+		contents, err := c.download(asset.URL)
+		if err != nil {
+			return nil, err
+		}
+		a, err := splitAttestations(contents, asset.BrowserDownloadURL)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, a...)
+	}
+	return found, nil
+}
+
+// gateArtifacts hashes the files at the comma-separated paths, and the files
+// in directories among them, and adds the comma-separated images.
+func gateArtifacts(paths, images string) ([]gateArtifact, error) {
+	var artifacts []gateArtifact
+	for _, root := range parseList(paths) {
+		err := walkFiles(normalizeInputPath(root), func(path, name string, info fs.FileInfo) error {
+			digest, err := digestFile(path)
+			if err != nil {
+				return err
+			}
+			artifacts = append(artifacts, gateArtifact{filepath.ToSlash(path), Subject{Name: name, Digest: digest}, false})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, image := range parseList(images) {
+		i := strings.LastIndex(image, "@")
+		if i < 0 || !strings.HasPrefix(image[i+1:], "sha256:") || !hexDigestPattern.MatchString(image[i+len("@sha256:"):]) {
+			return nil, fmt.Errorf("image %q is not of the form <repository>@sha256:<digest>", image)
+		}
+		artifacts = append(artifacts, gateArtifact{image, Subject{Name: image[:i], Digest: DigestSet{"sha256": image[i+len("@sha256:"):]}}, true})
+	}
+	return artifacts, nil
+}
+
+// gateMain implements `gate --artifact_path <paths> --image <images>`,
+// locating the provenance of each artifact, verifying its signature and
+// policy, writing a VSA per artifact and failing unless all are verified: a
+// single step for deployment workflows.
+func gateMain(args []string) {
+	flags := flag.NewFlagSet("gate", flag.ExitOnError)
+	artifactPaths := flags.String("artifact_path", "", "Comma-separated files, or directories of files, to gate.")
+	images := flags.String("image", "", "Comma-separated images to gate, as <repository>@sha256:<digest>. Their provenance is also looked up through the referrers pushed by annotate.")
+	provenance := flags.String("provenance", "", "Comma-separated provenance files, Statements, envelopes or JSON Lines bundles, to look the artifacts up in.")
+	storeDir := flags.String("provenance_store", "", "A directory of provenance files to look the artifacts up in.")
+	useCAS := flags.Bool("cas", false, "Look the artifacts up in the local content-addressed store.")
+	casDir := flags.String("cas_dir", defaultCASDir(), "The directory of the local content-addressed store.")
+	release := flags.String("release", "", "A GitHub release, as <owner>/<repo>@<tag>, whose .provenance, .intoto, .intoto.jsonl, .dsse and .bundle.jsonl assets to look the artifacts up in. Authenticated with $GITHUB_TOKEN.")
+	useRekor := flags.Bool("rekor", false, "Look the artifacts up in the transparency log.")
+	rekorURL := flags.String("rekor_url", DefaultRekorURL, "The Rekor transparency log to search with --rekor.")
+	keyPath := flags.String("key", "", "The PEM public key the provenance must be signed with (required, unless --key_target is set). Unsigned provenance is rejected.")
+	keyTarget := flags.String("key_target", "", "The TUF target of --tuf_url holding the PEM public key the provenance must be signed with, instead of --key.")
+	trust := addTrustFlags(flags)
+	loadPolicyFlags := addPolicyFlags(flags, "")
+	vsaPath := flags.String("vsa_path", "gate.vsa.jsonl", "The JSON Lines file to write a verification summary of each artifact to.")
+	vsaKey := flags.String("vsa_key", "", "The PEM private key to sign the verification summaries with, writing DSSE envelopes.")
+	verifierId := flags.String("verifier_id", DefaultVerifierId, "The verifier id recorded in the verification summaries.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *artifactPaths == "" && *images == "" {
+		fmt.Println("No value found for required flag: --artifact_path (or --image)")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *provenance == "" && *storeDir == "" && !*useCAS && *release == "" && !*useRekor && *images == "" {
+		fmt.Println("No provenance source given: --provenance, --provenance_store, --cas, --release, --rekor or --image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	// Anyone can write provenance to the sources, so only its signature
+	// makes it the builder's.
+	if *keyPath == "" && *keyTarget == "" {
+		fmt.Println("No value found for required flag: --key (or --key_target)")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *keyPath != "" && *keyTarget != "" {
+		fmt.Println("--key and --key_target are mutually exclusive")
+		os.Exit(1)
+	}
+	for feature, used := range map[string]bool{"gate --release": *release != "", "gate --rekor": *useRekor, "gate --image": *images != ""} {
+		if used {
+			if err := requireOnline(feature); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+	policy, policySource := loadPolicyFlags()
+	verifier, err := trust.verifier(*keyPath, *keyTarget)
+	if err != nil {
+		fmt.Printf("Failed to load key: %s\n", err)
+		os.Exit(1)
+	}
+	var signer Signer
+	if *vsaKey != "" {
+		var err error
+		if signer, err = loadSigner(*vsaKey); err != nil {
+			fmt.Printf("Failed to load VSA signing key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	artifacts, err := gateArtifacts(*artifactPaths, *images)
+	if err != nil {
+		fmt.Printf("Failed to hash artifacts: %s\n", err)
+		os.Exit(1)
+	}
+
+	sources := gateSources{}
+	var local []string
+	for _, p := range parseList(*provenance) {
+		local = append(local, normalizeInputPath(p))
+	}
+	if *storeDir != "" {
+		files, err := listStore(*storeDir)
+		if err != nil {
+			fmt.Printf("Failed to read provenance store: %s\n", err)
+			os.Exit(1)
+		}
+		local = append(local, files...)
+	}
+	for _, path := range local {
+		a, err := readAttestations(path)
+		if err != nil {
+			fmt.Printf("Failed to read provenance: %s\n", err)
+			os.Exit(1)
+		}
+		sources.Local = append(sources.Local, a...)
+	}
+	if *release != "" {
+		c, err := newGitHubClient("{}", Options{Getenv: os.Getenv})
+		if err == nil {
+			var a []gateAttestation
+			a, err = releaseAttestations(c, *release)
+			sources.Local = append(sources.Local, a...)
+		}
+		if err != nil {
+			fmt.Printf("Failed to download the provenance of release %s: %s\n", *release, err)
+			os.Exit(1)
+		}
+	}
+	if *useCAS {
+		sources.CASDir = *casDir
+	}
+	if *useRekor {
+		sources.Rekor = newRekorClient(*rekorURL)
+	}
+	if *images != "" {
+		sources.Registry = newRegistryClient()
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policySum := sha256.Sum256(policyJSON)
+	policyRef := VSAReference{URI: policySource, Digest: DigestSet{"sha256": hex.EncodeToString(policySum[:])}}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var out bytes.Buffer
+	failed := 0
+	for _, artifact := range artifacts {
+		verified, attestations, problems := sources.verify(artifact, policy, verifier)
+		vsa := VSAStatement{
+			Type:          StatementV01Type,
+			Subject:       []Subject{artifact.Subject},
+			PredicateType: VSAPredicateType,
+			Predicate: VSAPredicate{
+				TimeVerified:       now,
+				ResourceUri:        artifact.Name,
+				Policy:             policyRef,
+				InputAttestations:  []VSAReference{},
+				VerificationResult: "PASSED",
+			},
+		}
+		vsa.Predicate.Verifier.Id = *verifierId
+		if verified != nil {
+			fmt.Printf("PASS %s: %s\n", artifact.Name, verified.URI)
+			vsa.Predicate.InputAttestations = append(vsa.Predicate.InputAttestations, verified.reference())
+		} else {
+			failed++
+			for _, p := range problems {
+				fmt.Printf("FAIL %s: %s\n", artifact.Name, p)
+			}
+			for _, a := range attestations {
+				vsa.Predicate.InputAttestations = append(vsa.Predicate.InputAttestations, a.reference())
+			}
+			vsa.Predicate.VerificationResult = "FAILED"
+		}
+		line, err := json.Marshal(vsa)
+		if err == nil && signer != nil {
+			var env *Envelope
+			if env, err = signEnvelope(PayloadContentType, line, signer); err == nil {
+				line, err = json.Marshal(env)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to write the verification summary of %s: %s\n", artifact.Name, err)
+			os.Exit(1)
+		}
+		out.Write(append(line, '\n'))
+	}
+	if err := ioutil.WriteFile(*vsaPath, out.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write verification summaries: %s\n", err)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("Gate failed: %d of %d artifacts not verified, summaries written to %s\n", failed, len(artifacts), *vsaPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Gate passed: %d artifacts verified, summaries written to %s\n", len(artifacts), *vsaPath)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGateAttestationCheck(t *testing.T) {
+	signer, verifier := testVerifier(t)
+	other, _ := testVerifier(t)
+	artifact := gateArtifact{Name: "app", Subject: Subject{Name: "app", Digest: testDigest("app")}}
+	attestation := func(stmt *Statement, signer Signer) gateAttestation {
+		contents, err := json.Marshal(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer != nil {
+			env, err := signEnvelope(PayloadContentType, contents, signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contents, err = json.Marshal(env); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return gateAttestation{URI: "app.provenance", Contents: contents}
+	}
+	trusted := verifyPolicy{TrustedBuilders: []string{testBuilder}}
+	renamed := testProvenance("app", testBuilder)
+	renamed.Subject[0].Name = "dist/app-1.0"
+	tests := []struct {
+		name        string
+		attestation gateAttestation
+		policy      verifyPolicy
+		verifier    Verifier
+		want        []string
+	}{
+		{"signed", attestation(testProvenance("app", testBuilder), signer), trusted, verifier, nil},
+		// The artifact is matched by digest, not name.
+		{"renamed artifact", attestation(renamed, signer), trusted, verifier, nil},
+		{"unsigned", attestation(testProvenance("app", testBuilder), nil), trusted, verifier, []string{"isn't signed"}},
+		{"signed with another key", attestation(testProvenance("app", testBuilder), other), trusted, verifier, []string{"no envelope signature verifies"}},
+		{"unsigned, unchecked", attestation(testProvenance("app", testBuilder), nil), trusted, nil, nil},
+		{"another artifact", attestation(testProvenance("lib", testBuilder), signer), trusted, verifier, []string{"doesn't attest sha256:" + testDigest("app")["sha256"]}},
+		{"untrusted builder", attestation(testProvenance("app", "https://evil"), signer), trusted, verifier, []string{"is not trusted"}},
+		{"revoked key", attestation(testProvenance("app", testBuilder), signer), verifyPolicy{Revocations: &RevocationList{Keys: []string{verifier.KeyId()}}}, verifier, []string{"is revoked"}},
+		{"unsigned and untrusted", attestation(testProvenance("lib", "https://evil"), nil), trusted, verifier, []string{"doesn't attest", "isn't signed", "is not trusted"}},
+		{"not provenance", gateAttestation{URI: "app.provenance", Contents: []byte(`{"_type": "x"}`)}, trusted, verifier, []string{"is not an in-toto statement"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.attestation.check(artifact, tt.policy, tt.verifier)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("check() = %q, want %d problems", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("check() = %q, want problem %d to contain %q", problems, i, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// GeneratorURI identifies this provenance generator in the materials.
+const GeneratorURI = "https://github.com/slsa-framework/github-actions-demo"
+
+// version is the generator release, set at build time with
+// -ldflags "-X main.version=v0.1".
+var version = ""
+
+func generatorVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// generatorMaterial hashes the running create_provenance binary so that
+// attestation consumers can pin the generator versions they trust.
+func generatorMaterial() (Item, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return Item{}, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return Item{}, err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return Item{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Item{}, err
+	}
+	return Item{
+		URI:    GeneratorURI + "@" + generatorVersion(),
+		Digest: DigestSet{"sha256": hex.EncodeToString(h.Sum(nil))},
+	}, nil
+}
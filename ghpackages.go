@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// githubPackageSpec identifies a package version published to GitHub
+// Packages, e.g. "npm:app@1.2.3", "maven:com.example:app@1.2.3",
+// "nuget:App@1.2.3" or "container:app@v1.2.3". Packages belong to the owner
+// of the repository of the github context.
+type githubPackageSpec struct {
+	Ecosystem string
+	// Name is the package name, which is <groupId>:<artifactId> for maven.
+	Name    string
+	Version string
+}
+
+func parseGitHubPackageSpec(s string) (githubPackageSpec, error) {
+	i, j := strings.Index(s, ":"), strings.LastIndex(s, "@")
+	if i < 0 || j <= i+1 || j == len(s)-1 {
+		return githubPackageSpec{}, fmt.Errorf("invalid package %q: expected <ecosystem>:<name>@<version>", s)
+	}
+	spec := githubPackageSpec{Ecosystem: s[:i], Name: s[i+1 : j], Version: s[j+1:]}
+	switch spec.Ecosystem {
+	case "npm", "nuget", "container":
+	case "maven":
+		if strings.Count(spec.Name, ":") != 1 {
+			return spec, fmt.Errorf("invalid package %q: maven packages are named <groupId>:<artifactId>", s)
+		}
+	default:
+		return spec, fmt.Errorf("invalid package %q: unknown ecosystem %q", s, spec.Ecosystem)
+	}
+	return spec, nil
+}
+
+// packagesName is the name of the package in the Packages API.
+func (s githubPackageSpec) packagesName(owner string) string {
+	switch s.Ecosystem {
+	case "npm":
+		return strings.TrimPrefix(s.Name, "@"+owner+"/")
+	case "maven":
+		return strings.Replace(s.Name, ":", ".", 1)
+	}
+	return s.Name
+}
+
+// purl is the package URL naming the version, whose digest is only used for
+// container packages, which are pulled from containerRegistry.
+func (s githubPackageSpec) purl(owner, digest, containerRegistry string) string {
+	switch s.Ecosystem {
+	case "npm":
+		return PackageURL{Type: "npm", Namespace: "@" + owner, Name: s.packagesName(owner), Version: s.Version}.String()
+	case "maven":
+		parts := strings.SplitN(s.Name, ":", 2)
+		return PackageURL{Type: "maven", Namespace: parts[0], Name: parts[1], Version: s.Version}.String()
+	case "nuget":
+		return PackageURL{Type: "nuget", Name: s.Name, Version: s.Version}.String()
+	}
+	return PackageURL{Type: "oci", Name: s.Name, Version: "sha256:" + digest, Qualifiers: map[string]string{
+		"repository_url": containerRegistry + "/" + strings.ToLower(owner) + "/" + s.Name,
+		"tag":            s.Version,
+	}}.String()
+}
+
+// packageRegistry returns the URL of the ecosystem's registry of the GitHub
+// instance at serverURL, which uses subdomains on GitHub Enterprise Server.
+func packageRegistry(serverURL, ecosystem string) string {
+	u, err := url.Parse(serverURL)
+	if serverURL == "" || err != nil || u.Host == "github.com" {
+		if ecosystem == "containers" {
+			return "https://ghcr.io"
+		}
+		return "https://" + ecosystem + ".pkg.github.com"
+	}
+	return u.Scheme + "://" + ecosystem + "." + u.Host
+}
+
+var errPackageNotFound = errors.New("not found")
+
+// packageVersion is a version in the Packages API.
+type packageVersion struct {
+	Name     string `json:"name"`
+	Metadata struct {
+		Container struct {
+			Tags []string `json:"tags"`
+		} `json:"container"`
+	} `json:"metadata"`
+}
+
+// githubPackageSubjects resolves each of the comma-separated package versions
+// published to GitHub Packages, and returns them as subjects named by purl.
+func githubPackageSubjects(packages string, opts Options) ([]Subject, error) {
+	var gh struct {
+		Repository string `json:"repository"`
+		Actor      string `json:"actor"`
+		ServerURL  string `json:"server_url"`
+	}
+	if err := json.Unmarshal([]byte(opts.GitHubContext), &gh); err != nil {
+		return nil, fmt.Errorf("parsing github context: %w", err)
+	}
+	owner := strings.SplitN(gh.Repository, "/", 2)[0]
+	if owner == "" {
+		return nil, errors.New("the repository, whose owner publishes the packages, is unknown")
+	}
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	containers := strings.SplitN(packageRegistry(gh.ServerURL, "containers"), "://", 2)[1]
+	var subjects []Subject
+	for _, s := range parseList(packages) {
+		spec, err := parseGitHubPackageSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		version, err := findPackageVersion(c, owner, spec)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", s, err)
+		}
+		var digest DigestSet
+		switch spec.Ecosystem {
+		case "container":
+			// The versions of container packages are their manifest digests.
+			d := strings.TrimPrefix(version.Name, "sha256:")
+			if !hexDigestPattern.MatchString(d) {
+				return nil, fmt.Errorf("resolving %s: version %q is not a sha256 digest", s, version.Name)
+			}
+			digest = DigestSet{"sha256": d}
+		case "npm":
+			digest, err = npmPackageDigest(c, packageRegistry(gh.ServerURL, "npm"), owner, spec, opts.DigestAlgorithms)
+		case "maven":
+			parts := strings.SplitN(spec.Name, ":", 2)
+			base := fmt.Sprintf("%s/%s/%s/%s/%s/%s-%s", packageRegistry(gh.ServerURL, "maven"), gh.Repository,
+				strings.Replace(parts[0], ".", "/", -1), parts[1], spec.Version, parts[1], spec.Version)
+			// Projects with pom packaging publish no jar.
+			digest, err = downloadDigest(c, base+".jar", gh.Actor, opts.DigestAlgorithms)
+			if errors.Is(err, errPackageNotFound) {
+				digest, err = downloadDigest(c, base+".pom", gh.Actor, opts.DigestAlgorithms)
+			}
+		case "nuget":
+			id, v := strings.ToLower(spec.Name), strings.ToLower(spec.Version)
+			digest, err = downloadDigest(c, fmt.Sprintf("%s/%s/download/%s/%s/%s.%s.nupkg", packageRegistry(gh.ServerURL, "nuget"), owner, id, v, id, v), gh.Actor, opts.DigestAlgorithms)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", s, err)
+		}
+		subjects = append(subjects, Subject{Name: spec.purl(owner, digest["sha256"], containers), Digest: digest})
+	}
+	return subjects, nil
+}
+
+// getOwned reads path, relative to the organization owner in the API or, if
+// owner is a user, to the user.
+func getOwned(c *githubClient, owner, path string, v interface{}) error {
+	err := c.get(fmt.Sprintf("/orgs/%s/%s", owner, path), v)
+	if err != nil {
+		if userErr := c.get(fmt.Sprintf("/users/%s/%s", owner, path), v); userErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listPackageVersions lists the newest 100 versions of the package of the
+// organization or user.
+func listPackageVersions(c *githubClient, owner, ecosystem, name string) ([]packageVersion, error) {
+	var versions []packageVersion
+	path := fmt.Sprintf("packages/%s/%s/versions?per_page=100", ecosystem, url.PathEscape(name))
+	if err := getOwned(c, owner, path, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// findPackageVersion looks the version of spec up in the Packages API,
+// among the newest 100 versions of the package of the organization or user.
+func findPackageVersion(c *githubClient, owner string, spec githubPackageSpec) (*packageVersion, error) {
+	versions, err := listPackageVersions(c, owner, spec.Ecosystem, spec.packagesName(owner))
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range versions {
+		if v.Name == spec.Version {
+			return &versions[i], nil
+		}
+		if stringSet(v.Metadata.Container.Tags...)[spec.Version] {
+			return &versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %s of %s package %s isn't published", spec.Version, spec.Ecosystem, spec.Name)
+}
+
+// npmPackageDigest hashes the tarball of the npm package version, checking
+// it against the integrity the registry records.
+func npmPackageDigest(c *githubClient, registry, owner string, spec githubPackageSpec, algorithms []string) (DigestSet, error) {
+	var doc struct {
+		Versions map[string]struct {
+			Dist struct {
+				Tarball   string `json:"tarball"`
+				Integrity string `json:"integrity"`
+			} `json:"dist"`
+		} `json:"versions"`
+	}
+	u := registry + "/" + url.PathEscape("@"+owner+"/"+spec.packagesName(owner))
+	if err := c.get(u, &doc); err != nil {
+		return nil, err
+	}
+	v, ok := doc.Versions[spec.Version]
+	if !ok || v.Dist.Tarball == "" {
+		return nil, fmt.Errorf("%s has no tarball of version %s", u, spec.Version)
+	}
+	if len(algorithms) == 0 {
+		algorithms = []string{DefaultDigestAlgorithm}
+	}
+	digest, err := downloadDigest(c, v.Dist.Tarball, "", append([]string{"sha512"}, algorithms...))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(v.Dist.Integrity, "sha512-") {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v.Dist.Integrity, "sha512-"))
+		if err != nil || len(want) != sha512.Size {
+			return nil, fmt.Errorf("%s has malformed integrity %q", u, v.Dist.Integrity)
+		}
+		if fmt.Sprintf("%x", want) != digest["sha512"] {
+			return nil, fmt.Errorf("the tarball of %s@%s doesn't match its integrity", spec.Name, spec.Version)
+		}
+	}
+	if !stringSet(algorithms...)["sha512"] {
+		delete(digest, "sha512")
+	}
+	return digest, nil
+}
+
+// downloadDigest hashes the file at u with algorithms, authenticating as
+// user with the client's token if user is set, and with the token alone
+// otherwise.
+func downloadDigest(c *githubClient, u, user string, algorithms []string) (DigestSet, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		if user != "" {
+			req.SetBasicAuth(user, c.token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("GET %s: %w", u, errPackageNotFound)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return digestReader(resp.Body, algorithms...)
+}
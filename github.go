@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultGitHubAPIURL is the REST API of github.com.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// githubClient is a minimal client of the GitHub REST API.
+type githubClient struct {
+	apiURL string
+	token  string
+	client *http.Client
+	// cache, if set, is the directory JSON responses are cached in for
+	// cacheTTL.
+	cache    string
+	cacheTTL time.Duration
+}
+
+// newGitHubClient returns a client of the API of the run described by the
+// github context, authenticated with its token.
+func newGitHubClient(githubContext string, opts Options) (*githubClient, error) {
+	var gh struct {
+		APIURL string `json:"api_url"`
+		Token  string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(githubContext), &gh); err != nil {
+		return nil, fmt.Errorf("parsing github context: %w", err)
+	}
+	if gh.APIURL == "" {
+		gh.APIURL = opts.Getenv("GITHUB_API_URL")
+	}
+	if gh.APIURL == "" {
+		gh.APIURL = DefaultGitHubAPIURL
+	}
+	if gh.Token == "" {
+		gh.Token = opts.Getenv("GITHUB_TOKEN")
+	}
+	return &githubClient{
+		apiURL:   strings.TrimSuffix(gh.APIURL, "/"),
+		token:    gh.Token,
+		client:   newHTTPClient(5 * time.Minute),
+		cache:    opts.GitHubAPICache,
+		cacheTTL: opts.GitHubAPICacheTTL,
+	}, nil
+}
+
+// url resolves path against the API URL unless it's absolute.
+func (c *githubClient) url(path string) string {
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+		return path
+	}
+	return c.apiURL + path
+}
+
+// open sends a GET request for path, relative to the API URL unless it's
+// absolute, and returns the response body if the request succeeded.
+func (c *githubClient) open(path string) (io.ReadCloser, error) {
+	resp, err := c.do(path, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends a GET request for path, conditional on etag if it's set, and
+// returns the response if its status is 200 OK or 304 Not Modified.
+func (c *githubClient) do(path, etag string) (*http.Response, error) {
+	return c.doAccept(path, etag, "application/vnd.github+json")
+}
+
+// download returns the contents of the release asset with the API URL path.
+func (c *githubClient) download(path string) ([]byte, error) {
+	resp, err := c.doAccept(path, "", "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *githubClient) doAccept(path, etag, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	// Redirects to blob storage drop the Authorization header, as the
+	// signed URLs they point to must not receive it.
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return resp, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, e.Message)
+		}
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// post sends body as JSON in a POST request for path and, if v is set,
+// decodes the JSON response into it.
+func (c *githubClient) post(path string, body, v interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url(path), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return fmt.Errorf("POST %s: %s: %s", path, resp.Status, e.Message)
+		}
+		return fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// upload uploads contents as the release asset name, of type contentType, to
+// the upload_url of a release, which is a URI template such as
+// "https://uploads.github.com/repos/o/r/releases/1/assets{?name,label}".
+func (c *githubClient) upload(uploadURL, name, contentType string, contents []byte) error {
+	if i := strings.Index(uploadURL, "{"); i >= 0 {
+		uploadURL = uploadURL[:i]
+	}
+	req, err := http.NewRequest(http.MethodPost, uploadURL+"?name="+url.QueryEscape(name), bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", contentType)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var e struct {
+			Message string `json:"message"`
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return fmt.Errorf("uploading %s: %s: %s", name, resp.Status, e.Message)
+		}
+		return fmt.Errorf("uploading %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// get decodes the JSON response to a GET request for path into v.
+func (c *githubClient) get(path string, v interface{}) error {
+	if c.cache != "" {
+		return c.getCached(path, v)
+	}
+	body, err := c.open(path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// cachedResponse is a GitHub API response stored in the cache directory.
+type cachedResponse struct {
+	URL       string          `json:"url"`
+	ETag      string          `json:"etag,omitempty"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// getCached is get through the response cache: a response younger than the
+// cache TTL is used as is, and an older one is revalidated with its ETag,
+// which doesn't count against the rate limit if it is still current.
+func (c *githubClient) getCached(path string, v interface{}) error {
+	u := c.url(path)
+	key := sha256.Sum256([]byte(u))
+	file := filepath.Join(c.cache, hex.EncodeToString(key[:])+".json")
+	cached := cachedResponse{}
+	if contents, err := ioutil.ReadFile(file); err != nil || json.Unmarshal(contents, &cached) != nil || cached.URL != u {
+		cached = cachedResponse{URL: u}
+	} else if time.Since(cached.FetchedAt) < c.cacheTTL {
+		return json.Unmarshal(cached.Body, v)
+	}
+	resp, err := c.do(path, cached.ETag)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(body) {
+			return fmt.Errorf("GET %s: response is not JSON", path)
+		}
+		cached.ETag, cached.Body = resp.Header.Get("ETag"), body
+	}
+	cached.FetchedAt = time.Now()
+	// Failing to cache a response only costs a later request.
+	if contents, err := json.Marshal(cached); err == nil {
+		writeCacheFile(file, contents)
+	}
+	return json.Unmarshal(cached.Body, v)
+}
+
+// writeCacheFile replaces file with contents atomically, so that concurrent
+// jobs sharing the cache never read a partial response.
+func writeCacheFile(file string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
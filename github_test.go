@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitHub is a GitHub API server of canned responses, by request URI,
+// for the runs, run artifacts, releases, release assets and commits the
+// tool reads. Like the API, it answers 401 to requests without the token
+// and 404 to unknown paths, with a JSON message, and 304 to requests
+// conditional on the ETag of the response.
+type fakeGitHub struct {
+	srv   *httptest.Server
+	token string
+
+	mu        sync.Mutex // guards responses and requests
+	responses map[string]fakeResponse
+	requests  []string
+}
+
+type fakeResponse struct {
+	contentType string
+	body        []byte
+}
+
+func newFakeGitHub(t *testing.T, token string) *fakeGitHub {
+	f := &fakeGitHub{token: token, responses: map[string]fakeResponse{}}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeGitHub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	resp, ok := f.responses[r.URL.RequestURI()]
+	f.mu.Unlock()
+	message := func(status int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+	}
+	switch {
+	case r.Header.Get("Authorization") != "Bearer "+f.token:
+		message(http.StatusUnauthorized, "Bad credentials")
+		return
+	case !ok || r.Method != http.MethodGet:
+		message(http.StatusNotFound, "Not Found")
+		return
+	case resp.contentType == "application/octet-stream" && r.Header.Get("Accept") != resp.contentType:
+		// Without it, the API answers with the asset's JSON description.
+		message(http.StatusUnsupportedMediaType, "Unsupported Accept header")
+		return
+	}
+	sum := sha256.Sum256(resp.body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", resp.contentType)
+	w.Write(resp.body)
+}
+
+// handle answers GET requests for uri, a path with its query, with v in
+// JSON.
+func (f *fakeGitHub) handle(t *testing.T, uri string, v interface{}) {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serve(uri, "application/json", body)
+}
+
+// serve answers GET requests for uri with body, of type contentType.
+func (f *fakeGitHub) serve(uri, contentType string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[uri] = fakeResponse{contentType: contentType, body: body}
+}
+
+// url returns the absolute URL of uri on the server.
+func (f *fakeGitHub) url(uri string) string {
+	return f.srv.URL + uri
+}
+
+// served returns the requests served so far, as "<method> <uri>".
+func (f *fakeGitHub) served() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// githubContext returns the github context of
+// testdata/contexts/<name>.github.json, with the server as its API URL and
+// the server's token.
+func (f *fakeGitHub) githubContext(t *testing.T, name string) string {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join("testdata", "contexts", name+".github.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gh := map[string]interface{}{}
+	if err := json.Unmarshal(contents, &gh); err != nil {
+		t.Fatal(err)
+	}
+	gh["api_url"], gh["token"] = f.srv.URL, f.token
+	if contents, err = json.Marshal(gh); err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// client returns a client of the server, authenticated with its token.
+func (f *fakeGitHub) client(t *testing.T, opts Options) *githubClient {
+	t.Helper()
+	c, err := newGitHubClient(f.githubContext(t, "push"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestGitHubClientErrors(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	gh.handle(t, "/repos/octo-org/app", map[string]string{"full_name": "octo-org/app"})
+	var v map[string]string
+	if err := gh.client(t, Options{}).get("/repos/octo-org/app", &v); err != nil || v["full_name"] != "octo-org/app" {
+		t.Errorf("get() = %v, %v", v, err)
+	}
+	tests := []struct {
+		name    string
+		token   string
+		path    string
+		wantErr string
+	}{
+		{"unknown path", "ghs_fixture", "/repos/octo-org/missing", "GET /repos/octo-org/missing: 404 Not Found: Not Found"},
+		{"bad token", "ghs_other", "/repos/octo-org/app", "GET /repos/octo-org/app: 401 Unauthorized: Bad credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := gh.client(t, Options{})
+			c.token = tt.token
+			if err := c.get(tt.path, &v); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("get() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitHubClientCache(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	gh.handle(t, "/repos/octo-org/app/actions/runs/1", workflowRun{Id: 1, Name: "Release"})
+	c := gh.client(t, Options{GitHubAPICache: t.TempDir(), GitHubAPICacheTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		var run workflowRun
+		if err := c.get("/repos/octo-org/app/actions/runs/1", &run); err != nil || run.Name != "Release" {
+			t.Fatalf("get() = %+v, %v", run, err)
+		}
+	}
+	if got := len(gh.served()); got != 1 {
+		t.Errorf("cached get() sent %d requests within the TTL, want 1", got)
+	}
+	// Once stale, the response is revalidated, and still used if the server
+	// answers 304 Not Modified.
+	c.cacheTTL = 0
+	var run workflowRun
+	if err := c.get("/repos/octo-org/app/actions/runs/1", &run); err != nil || run.Name != "Release" {
+		t.Fatalf("revalidated get() = %+v, %v", run, err)
+	}
+	if got := len(gh.served()); got != 2 {
+		t.Errorf("cached get() sent %d requests after the TTL, want 2", got)
+	}
+}
+
+func TestRunStartedAt(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	started := time.Date(2021, 6, 15, 17, 20, 1, 500, time.UTC)
+	gh.handle(t, "/repos/octo-org/app/actions/runs/940146003", workflowRun{Id: 940146003, RunStartedAt: started})
+	opts := testOptions(t, "push", "hosted")
+	opts.GitHubContext = gh.githubContext(t, "push")
+	// Without SOURCE_DATE_EPOCH, the run's start time is the clock.
+	opts.Getenv, opts.Environ = testEnv(nil)
+	stmt, _, err := generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stmt.Predicate.Metadata.BuildFinishedOn, "2021-06-15T17:20:01Z"; got != want {
+		t.Errorf("buildFinishedOn = %s, want the start of the run, %s", got, want)
+	}
+
+	opts.GitHubContext = strings.Replace(opts.GitHubContext, "940146003", "940146005", -1)
+	if _, _, err := generate(opts); err == nil || !strings.Contains(err.Error(), "reading workflow run 940146005") {
+		t.Errorf("generate() of an unknown run = %v, want an error reading it", err)
+	}
+}
+
+func TestRunArtifactSubjects(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"app", "lib/app.so"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gh.serve("/artifacts/2.zip", "application/zip", archive.Bytes())
+	gh.handle(t, "/repos/octo-org/app/actions/runs/940146003/artifacts?name=dist&per_page=100", map[string]interface{}{
+		"artifacts": []map[string]interface{}{
+			{"name": "dist", "expired": true, "archive_download_url": gh.url("/artifacts/1.zip")},
+			{"name": "dist", "expired": false, "archive_download_url": gh.url("/artifacts/2.zip")},
+		},
+	})
+	gh.handle(t, "/repos/octo-org/app/actions/runs/7/artifacts?name=dist&per_page=100", map[string]interface{}{
+		"artifacts": []map[string]interface{}{{"name": "dist", "expired": true}},
+	})
+	opts := Options{GitHubContext: gh.githubContext(t, "push")}
+	got, err := runArtifactSubjects("name=dist", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []Subject
+	for _, name := range []string{"app", "lib/app.so"} {
+		sum := sha256.Sum256([]byte(name))
+		want = append(want, Subject{Name: name, Digest: DigestSet{"sha256": hex.EncodeToString(sum[:])}})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runArtifactSubjects() = %v, want %v", got, want)
+	}
+	if _, err := runArtifactSubjects("name=dist,run_id=7", opts); err == nil || !strings.Contains(err.Error(), "no unexpired artifact") {
+		t.Errorf("runArtifactSubjects() of an expired artifact = %v, want an error", err)
+	}
+}
+
+func TestReleaseAttestations(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	provenance, err := json.Marshal(testProvenance("app", testBuilder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assets []map[string]string
+	for i, name := range []string{"app", "app.intoto.jsonl"} {
+		asset := fmt.Sprintf("/repos/octo-org/app/releases/assets/%d", i+1)
+		assets = append(assets, map[string]string{
+			"name":                 name,
+			"url":                  gh.url(asset),
+			"browser_download_url": "https://github.com/octo-org/app/releases/download/v1.0/" + name,
+		})
+		gh.serve(asset, "application/octet-stream", append(append(provenance, '\n'), provenance...))
+	}
+	gh.handle(t, "/repos/octo-org/app/releases/tags/v1.0", map[string]interface{}{"id": 1, "tag_name": "v1.0", "assets": assets})
+	c := gh.client(t, Options{})
+	got, err := releaseAttestations(c, "octo-org/app@v1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the attestation asset is downloaded, and each of its lines is an
+	// attestation.
+	var uris []string
+	for _, a := range got {
+		uris = append(uris, a.URI)
+	}
+	wantURIs := []string{
+		"https://github.com/octo-org/app/releases/download/v1.0/app.intoto.jsonl#1",
+		"https://github.com/octo-org/app/releases/download/v1.0/app.intoto.jsonl#2",
+	}
+	if !reflect.DeepEqual(uris, wantURIs) {
+		t.Errorf("releaseAttestations() = %q, want %q", uris, wantURIs)
+	}
+	for _, r := range gh.served() {
+		if strings.HasSuffix(r, "/assets/1") {
+			t.Errorf("releaseAttestations() downloaded the artifact asset: %s", r)
+		}
+	}
+	if _, err := releaseAttestations(c, "octo-org/app@v2.0"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("releaseAttestations() of a missing release = %v, want a 404", err)
+	}
+}
+
+func TestRecordCommit(t *testing.T) {
+	gh := newFakeGitHub(t, "ghs_fixture")
+	sha := "86439f2a3f6e2bddb608860b1895310a9fcb06a1"
+	commit := func(verified bool, reason string) map[string]interface{} {
+		identity := map[string]string{"name": "Octo Cat", "email": "octocat@example.com", "date": "2021-06-15T17:00:00Z"}
+		return map[string]interface{}{
+			"sha":      sha,
+			"html_url": "https://github.com/octo-org/app/commit/" + sha,
+			"commit": map[string]interface{}{
+				"author":       identity,
+				"committer":    identity,
+				"verification": map[string]interface{}{"verified": verified, "reason": reason, "signature": "-----BEGIN SSH SIGNATURE-----"},
+			},
+			"author":    map[string]string{"login": "octocat"},
+			"committer": nil,
+		}
+	}
+	tests := []struct {
+		name         string
+		commit       map[string]interface{}
+		ref          string
+		wantFindings int
+	}{
+		{"verified", commit(true, "valid"), "refs/heads/main", 0},
+		{"unsigned", commit(false, "unsigned"), "refs/heads/main", 1},
+		{"lightweight tag", commit(true, "valid"), "refs/tags/v1.0", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh.handle(t, "/repos/octo-org/app/commits/"+sha, tt.commit)
+			gh.handle(t, "/repos/octo-org/app/git/ref/tags/v1.0", map[string]interface{}{"object": map[string]string{"type": "commit", "sha": sha}})
+			opts := Options{GitHubContext: gh.githubContext(t, "push"), ScrubFields: defaultScrubFields}
+			var findings Findings
+			sc, err := recordCommit(GitHubContext{Repository: "octo-org/app", SHA: sha, Ref: tt.ref}, opts, &findings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sc.Author.Login != "octocat" || sc.Committer.Login != "" || sc.Author.Email != Redacted || sc.Verification.Format != "ssh" {
+				t.Errorf("recordCommit() = %+v", sc)
+			}
+			if len(findings) != tt.wantFindings {
+				t.Errorf("recordCommit() found %v, want %d findings", findings, tt.wantFindings)
+			}
+		})
+	}
+}
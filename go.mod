@@ -1,3 +1,9 @@
 module slsa-framework/demo
 
 go 1.16
+
+require (
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/text v0.3.6
+	lukechampine.com/blake3 v1.1.7
+)
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files of testdata/golden with the output of the tests.")
+
+// testEpoch is the SOURCE_DATE_EPOCH of testOptions, the clock of
+// reproducible generation: 2021-06-15T17:24:42Z.
+const testEpoch = "1623777882"
+
+// testEnv returns a Getenv and an Environ of the variables vars only.
+func testEnv(vars map[string]string) (func(string) string, func() []string) {
+	getenv := func(key string) string { return vars[key] }
+	environ := func() []string {
+		var env []string
+		for k, v := range vars {
+			env = append(env, k+"="+v)
+		}
+		return env
+	}
+	return getenv, environ
+}
+
+// testOptions returns the options of a reproducible generation for the
+// artifacts of testdata/artifacts/dist, in a run of the github context of
+// testdata/contexts/<github>.github.json on the runner of
+// testdata/contexts/<runner>.runner.json, at testEpoch.
+func testOptions(t *testing.T, github, runner string) Options {
+	t.Helper()
+	read := func(name string) string {
+		contents, err := os.ReadFile(filepath.Join("testdata", "contexts", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	getenv, environ := testEnv(map[string]string{"SOURCE_DATE_EPOCH": testEpoch, "GITHUB_ACTIONS": "true"})
+	return Options{
+		ArtifactPaths: []string{filepath.Join("testdata", "artifacts", "dist")},
+		Workspace:     filepath.Join("testdata", "artifacts"),
+		GitHubContext: read(github + ".github.json"),
+		RunnerContext: read(runner + ".runner.json"),
+		OnEscape:      EscapeError,
+		OnCollision:   CollisionKeep,
+		FailOn:        SeverityError,
+		Reproducible:  true,
+		Getenv:        getenv,
+		Environ:       environ,
+	}
+}
+
+// testSeedSigner returns an Ed25519 signer of a fixed key, whose signatures,
+// unlike those of ECDSA keys, are the same on every run and so can be
+// compared with golden files.
+func testSeedSigner(t *testing.T) *keySigner {
+	t.Helper()
+	signer, err := newKeySigner(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// pinGenerator replaces the material of the generator, the digest of the
+// running test binary, by one that doesn't change with every build.
+func pinGenerator(stmt *Statement) {
+	for i, m := range stmt.Predicate.Materials {
+		if strings.HasPrefix(m.URI, GeneratorURI+"@") {
+			stmt.Predicate.Materials[i] = Item{URI: GeneratorURI + "@test", Digest: testDigest("generator")}
+		}
+	}
+}
+
+// checkGolden compares got with testdata/golden/<name>, or with -update
+// rewrites it.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s; run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; if the change is intended, run go test -update\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		github string
+		change func(*Options)
+	}{
+		{"push.json", "push", nil},
+		{"push-v1.json", "push", func(o *Options) { o.PredicateVersion = PredicateV1 }},
+		{"push-redacted.json", "push", func(o *Options) { o.Redact = RedactStrip }},
+		{"push-predicate.json", "push", func(o *Options) { o.Format = FormatPredicate }},
+		{"push.dsse", "push", func(o *Options) {
+			o.Envelope = EnvelopeDSSE
+			o.Signer = testSeedSigner(t)
+		}},
+		{"workflow_dispatch.json", "workflow_dispatch", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions(t, tt.github, "hosted")
+			if tt.change != nil {
+				tt.change(&opts)
+			}
+			stmt, _, err := generate(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pinGenerator(stmt)
+			got, err := writeStatement(stmt, filepath.Join(t.TempDir(), tt.name), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+}
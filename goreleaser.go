@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// GoreleaserArtifact is an entry of goreleaser's dist/artifacts.json.
+type GoreleaserArtifact struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Goos   string `json:"goos"`
+	Goarch string `json:"goarch"`
+	Goarm  string `json:"goarm"`
+	Extra  struct {
+		Digest string `json:"Digest"`
+		ID     string `json:"ID"`
+	} `json:"extra"`
+}
+
+// annotations returns the platform of a, if it has one, and its build or
+// archive id as its component.
+func (a GoreleaserArtifact) annotations() map[string]string {
+	annotations := map[string]string{}
+	if a.Goos != "" && a.Goarch != "" {
+		annotations["platform"] = a.Goos + "/" + a.Goarch
+		if a.Goarm != "" {
+			annotations["platform"] += "/v" + a.Goarm
+		}
+	}
+	if a.Extra.ID != "" {
+		annotations["component"] = a.Extra.ID
+	}
+	return annotations
+}
+
+// goreleaserFileTypes are the artifact types with file contents to attest.
+// Checksums, signatures and other metadata files are skipped.
+var goreleaserFileTypes = stringSet("Archive", "Binary", "Uploadable Binary", "Universal Binary", "Linux Package", "Source")
+
+// goreleaserImageTypes are the artifact types naming a pushed image.
+var goreleaserImageTypes = stringSet("Docker Image", "Published Docker Image", "Docker Manifest")
+
+// goreleaserSubjects returns a subject for each binary, archive, package and
+// image listed in a goreleaser artifacts.json, files first and then images.
+// Files are hashed from disk, relative to the project root that contains the
+// dist directory. Images are attested with the digests of their "Docker
+// Image" and "Docker Manifest" entries: goreleaser doesn't record one for
+// "Published Docker Image" entries, so those with no other entry of their
+// repository are resolved from the registry.
+func goreleaserSubjects(path string, opts Options, findings *Findings) (files, images []Subject, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var artifacts []GoreleaserArtifact
+	if err := json.Unmarshal(contents, &artifacts); err != nil {
+		return nil, nil, err
+	}
+	ws, err := newWorkspace(opts.Workspace, opts.ArtifactWorkspace)
+	if err != nil {
+		return nil, nil, err
+	}
+	root := filepath.Dir(filepath.Dir(path))
+	seen := map[string]bool{}
+	var published []GoreleaserArtifact
+	for _, a := range artifacts {
+		switch {
+		case goreleaserFileTypes[a.Type]:
+			file := filepath.FromSlash(a.Path)
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(root, file)
+			}
+			if err := ws.check(file, opts.OnEscape, findings); err != nil {
+				return nil, nil, err
+			}
+			digest, err := digestFile(file, opts.DigestAlgorithms...)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Binaries of every platform share a name, so use their path
+			// within dist. Release assets are downloaded by name.
+			name := a.Name
+			if a.Type == "Binary" {
+				name = filepath.ToSlash(a.Path)
+			}
+			s := Subject{Name: name, Digest: digest}
+			s.annotate(a.annotations())
+			files = append(files, s)
+		case a.Type == "Published Docker Image" && a.Extra.Digest == "":
+			published = append(published, a)
+		case goreleaserImageTypes[a.Type]:
+			if a.Extra.Digest == "" {
+				return nil, nil, fmt.Errorf("image %s has no digest; was it pushed?", a.Name)
+			}
+			digest, err := parseDigest(a.Extra.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Each tag of an image is listed separately.
+			if repo := imageRepository(a.Name); !seen[repo+"@"+a.Extra.Digest] {
+				seen[repo+"@"+a.Extra.Digest] = true
+				images = append(images, Subject{Name: repo, Digest: digest})
+			}
+		}
+	}
+	var c *registryClient
+	for _, a := range published {
+		repo := imageRepository(a.Name)
+		if subjectNamed(images, repo) {
+			continue
+		}
+		if c == nil {
+			if err := requireOnline("resolving goreleaser's published images"); err != nil {
+				return nil, nil, err
+			}
+			c = newRegistryClient()
+		}
+		tag := "latest"
+		if len(a.Name) > len(repo) {
+			tag = a.Name[len(repo)+1:]
+		}
+		_, body, err := c.manifest(repo, tag)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolving image %s: %w", a.Name, err)
+		}
+		sum := sha256.Sum256(body)
+		if d := "sha256:" + hex.EncodeToString(sum[:]); !seen[repo+"@"+d] {
+			seen[repo+"@"+d] = true
+			images = append(images, Subject{Name: repo, Digest: DigestSet{"sha256": hex.EncodeToString(sum[:])}})
+		}
+	}
+	return files, images, nil
+}
+
+// subjectNamed reports whether one of subjects is named name.
+func subjectNamed(subjects []Subject, name string) bool {
+	for _, s := range subjects {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
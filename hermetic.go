@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Values of Hermeticity.Network.
+const (
+	NetworkNone         = "none"
+	NetworkProxy        = "proxy"
+	NetworkFiltered     = "filtered"
+	NetworkUnrestricted = "unrestricted"
+	NetworkUnknown      = "unknown"
+)
+
+// Hermeticity records signals relevant to hermetic builds. It is an extension
+// to the SLSA v0.1 metadata.
+type Hermeticity struct {
+	// Hermetic is true only when the workflow opted in with --hermetic and
+	// none of the signals below contradict the claim.
+	Hermetic bool `json:"hermetic"`
+	// Network describes the egress available to the job.
+	Network string `json:"network"`
+	// ContainerImage is the job container image, when declared.
+	ContainerImage string `json:"containerImage,omitempty"`
+	// CachedToolchains lists runner tool cache entries on the PATH, e.g.
+	// "go/1.16.15/x64".
+	CachedToolchains []string `json:"cachedToolchains,omitempty"`
+	Warnings         []string `json:"warnings,omitempty"`
+}
+
+// detectHermeticity gathers hermeticity signals for the run being attested.
+// The egress report of a filter, if any, is the strongest evidence of the
+// job's network egress. A proxy variable is not: programs are free to ignore
+// it, so egress only goes through the proxy if the host has no default route
+// either.
+func detectHermeticity(runner RunnerContext, opts Options, egress *EgressSummary) Hermeticity {
+	h := Hermeticity{ContainerImage: opts.ContainerImage, Network: NetworkUnknown}
+	proxied := false
+	for _, proxy := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if opts.Getenv(proxy) != "" {
+			proxied = true
+			break
+		}
+	}
+	switch {
+	case egress != nil:
+		h.Network = NetworkFiltered
+	case opts.InspectHost:
+		h.Network = routeNetwork("/proc/net/route", "/proc/net/ipv6_route")
+		if h.Network == NetworkNone && proxied {
+			h.Network = NetworkProxy
+		}
+	case proxied:
+		h.Network = NetworkUnrestricted
+	}
+	h.CachedToolchains = cachedToolchains(opts.Getenv("PATH"), runner.ToolCache, opts.Getenv("RUNNER_TOOL_CACHE"))
+
+	if !opts.Hermetic {
+		return h
+	}
+	switch h.Network {
+	case NetworkNone, NetworkProxy, NetworkFiltered:
+	case NetworkUnrestricted:
+		h.Warnings = append(h.Warnings, "hermetic build requested, but the job has unrestricted network egress")
+	default:
+		h.Warnings = append(h.Warnings, "hermetic build requested, but the job's network egress could not be determined")
+	}
+	if len(h.CachedToolchains) > 0 {
+		h.Warnings = append(h.Warnings, "hermetic build requested, but toolchains from the runner tool cache are on the PATH")
+	}
+	h.Hermetic = len(h.Warnings) == 0
+	return h
+}
+
+// routeNetwork inspects the Linux IPv4 and IPv6 routing tables at ipv4Path
+// and ipv6Path for a default route. Without IPv6, there is no IPv6 table.
+func routeNetwork(ipv4Path, ipv6Path string) string {
+	// Iface Destination Gateway Flags ..., after a header.
+	v4, err := defaultRoute(ipv4Path, true, func(fields []string) (string, bool) {
+		if len(fields) < 4 {
+			return "", false
+		}
+		return fields[3], fields[1] == "00000000"
+	})
+	if err != nil {
+		return NetworkUnknown
+	}
+	// Destination PrefixLength Source SourcePrefixLength NextHop Metric
+	// RefCnt Use Flags Iface, with no header.
+	v6, err := defaultRoute(ipv6Path, false, func(fields []string) (string, bool) {
+		if len(fields) < 9 {
+			return "", false
+		}
+		return fields[8], fields[1] == "00" && strings.Trim(fields[0], "0") == ""
+	})
+	if os.IsNotExist(err) {
+		v6, err = false, nil
+	}
+	switch {
+	case v4 || v6:
+		return NetworkUnrestricted
+	case err != nil:
+		return NetworkUnknown
+	}
+	return NetworkNone
+}
+
+// Flags of Linux routes.
+const (
+	routeUp     = 0x0001
+	routeReject = 0x0200
+)
+
+// defaultRoute reports whether the routing table at path, after a header if
+// header is set, has a default route that is up and doesn't reject packets.
+// parse returns the hex flags of a route's fields, and whether it is a
+// default route.
+func defaultRoute(path string, header bool, parse func(fields []string) (string, bool)) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if header {
+		s.Scan()
+	}
+	for s.Scan() {
+		flags, isDefault := parse(strings.Fields(s.Text()))
+		if !isDefault {
+			continue
+		}
+		if v, err := strconv.ParseUint(flags, 16, 32); err == nil && v&routeUp != 0 && v&routeReject == 0 {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// cachedToolchains returns the tool cache entries referenced by PATH.
+func cachedToolchains(path string, toolCaches ...string) []string {
+	var found []string
+	for _, e := range toolCacheEntries(path, toolCaches...) {
+		found = append(found, e.Name)
+	}
+	return found
+}
+
+// toolCacheEntry is an entry of a runner tool cache, named relative to the
+// cache as <tool>/<version>/<arch>.
+type toolCacheEntry struct {
+	Name string
+	Dir  string
+}
+
+// toolCacheEntries returns the tool cache entries referenced by PATH, in
+// PATH order.
+func toolCacheEntries(path string, toolCaches ...string) []toolCacheEntry {
+	var found []toolCacheEntry
+	seen := map[string]bool{}
+	for _, dir := range filepath.SplitList(path) {
+		for _, cache := range toolCaches {
+			if cache == "" {
+				continue
+			}
+			rel, err := filepath.Rel(cache, dir)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			// Tool cache entries are laid out as <tool>/<version>/<arch>/...
+			parts := strings.SplitN(filepath.ToSlash(rel), "/", 4)
+			if len(parts) > 3 {
+				parts = parts[:3]
+			}
+			entry := strings.Join(parts, "/")
+			if !seen[entry] {
+				seen[entry] = true
+				found = append(found, toolCacheEntry{Name: entry, Dir: filepath.Join(cache, filepath.FromSlash(entry))})
+			}
+		}
+	}
+	return found
+}
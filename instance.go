@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cloud providers whose instance metadata can be recorded.
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderAzure = "azure"
+	ProviderAuto  = "auto"
+)
+
+// instanceMetadataURL is the link-local metadata service of all providers.
+var instanceMetadataURL = "http://169.254.169.254"
+
+// InstanceMetadata identifies the cloud VM a self-hosted runner ran on. It
+// is an extension to the recorded environment.
+type InstanceMetadata struct {
+	Provider    string `json:"provider"`
+	InstanceId  string `json:"instance_id"`
+	ImageId     string `json:"image_id"`
+	Region      string `json:"region"`
+	Zone        string `json:"zone,omitempty"`
+	MachineType string `json:"machine_type,omitempty"`
+}
+
+// instanceProviders maps provider names to the functions reading their
+// metadata service, in the order ProviderAuto tries them.
+var instanceProviders = []struct {
+	Name  string
+	Fetch func(c *http.Client) (*InstanceMetadata, error)
+}{
+	{ProviderAWS, awsInstanceMetadata},
+	{ProviderGCP, gcpInstanceMetadata},
+	{ProviderAzure, azureInstanceMetadata},
+}
+
+// instanceMetadata reads the metadata of the VM this process runs on from
+// the metadata service of provider, or of the first provider to answer for
+// ProviderAuto.
+func instanceMetadata(provider string) (*InstanceMetadata, error) {
+	if err := requireOnline("--instance_metadata"); err != nil {
+		return nil, err
+	}
+	// The metadata service is link-local, so it must not be reached through
+	// a proxy.
+	c := &http.Client{Timeout: 2 * time.Second, Transport: guardedTransport{&http.Transport{}}}
+	var errs []string
+	for _, p := range instanceProviders {
+		if provider != ProviderAuto && provider != p.Name {
+			continue
+		}
+		md, err := p.Fetch(c)
+		if err == nil {
+			md.Provider = p.Name
+			return md, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", p.Name, err))
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("unknown cloud provider %q", provider)
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// metadataRequest sends a request to the metadata service and decodes its
+// JSON response into v, or returns it as a string if v is nil.
+func metadataRequest(c *http.Client, method, path string, header map[string]string, v interface{}) (string, error) {
+	req, err := http.NewRequest(method, instanceMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, val := range header {
+		req.Header.Set(k, val)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if v != nil {
+		return "", json.Unmarshal(body, v)
+	}
+	return string(body), nil
+}
+
+// awsInstanceMetadata reads the EC2 instance identity document with an
+// IMDSv2 session token.
+func awsInstanceMetadata(c *http.Client) (*InstanceMetadata, error) {
+	token, err := metadataRequest(c, http.MethodPut, "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		InstanceId       string `json:"instanceId"`
+		ImageId          string `json:"imageId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+		InstanceType     string `json:"instanceType"`
+	}
+	if _, err := metadataRequest(c, http.MethodGet, "/latest/dynamic/instance-identity/document", map[string]string{"X-aws-ec2-metadata-token": token}, &doc); err != nil {
+		return nil, err
+	}
+	return &InstanceMetadata{InstanceId: doc.InstanceId, ImageId: doc.ImageId, Region: doc.Region, Zone: doc.AvailabilityZone, MachineType: doc.InstanceType}, nil
+}
+
+// gcpInstanceMetadata reads the Compute Engine instance metadata.
+func gcpInstanceMetadata(c *http.Client) (*InstanceMetadata, error) {
+	var doc struct {
+		Id          json.Number `json:"id"`
+		Image       string      `json:"image"`
+		Zone        string      `json:"zone"`
+		MachineType string      `json:"machineType"`
+	}
+	if _, err := metadataRequest(c, http.MethodGet, "/computeMetadata/v1/instance/?recursive=true", map[string]string{"Metadata-Flavor": "Google"}, &doc); err != nil {
+		return nil, err
+	}
+	// The zone and machine type are resource paths such as
+	// "projects/123/zones/us-central1-a".
+	zone := doc.Zone[strings.LastIndex(doc.Zone, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return &InstanceMetadata{
+		InstanceId:  doc.Id.String(),
+		ImageId:     doc.Image,
+		Region:      region,
+		Zone:        zone,
+		MachineType: doc.MachineType[strings.LastIndex(doc.MachineType, "/")+1:],
+	}, nil
+}
+
+// azureInstanceMetadata reads the compute metadata of an Azure VM.
+func azureInstanceMetadata(c *http.Client) (*InstanceMetadata, error) {
+	var doc struct {
+		VMId           string `json:"vmId"`
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+		VMSize         string `json:"vmSize"`
+		StorageProfile struct {
+			ImageReference struct {
+				Id        string `json:"id"`
+				Publisher string `json:"publisher"`
+				Offer     string `json:"offer"`
+				Sku       string `json:"sku"`
+				Version   string `json:"version"`
+			} `json:"imageReference"`
+		} `json:"storageProfile"`
+	}
+	if _, err := metadataRequest(c, http.MethodGet, "/metadata/instance/compute?api-version=2021-02-01", map[string]string{"Metadata": "true"}, &doc); err != nil {
+		return nil, err
+	}
+	image := doc.StorageProfile.ImageReference
+	imageId := image.Id
+	if imageId == "" && image.Publisher != "" {
+		// Marketplace images are identified by URN.
+		imageId = strings.Join([]string{image.Publisher, image.Offer, image.Sku, image.Version}, ":")
+	}
+	return &InstanceMetadata{InstanceId: doc.VMId, ImageId: imageId, Region: doc.Location, Zone: doc.Zone, MachineType: doc.VMSize}, nil
+}
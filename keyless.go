@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SignKeyless signs provenance with an ephemeral key certified by Fulcio for
+// the identity of the workflow run's OIDC token.
+const SignKeyless = "keyless"
+
+// DefaultFulcioURL is the public Sigstore certificate authority.
+const DefaultFulcioURL = "https://fulcio.sigstore.dev"
+
+// fulcioResponse is the response of Fulcio's signingCert API, whose chain is
+// of PEM certificates, the leaf first.
+// See https://github.com/sigstore/fulcio/blob/main/fulcio.proto
+type fulcioResponse struct {
+	EmbeddedSct *struct {
+		Chain struct {
+			Certificates []string `json:"certificates"`
+		} `json:"chain"`
+	} `json:"signedCertificateEmbeddedSct"`
+	DetachedSct *struct {
+		Chain struct {
+			Certificates []string `json:"certificates"`
+		} `json:"chain"`
+	} `json:"signedCertificateDetachedSct"`
+}
+
+// tokenSubject returns the sub claim of the JWT token, without verifying
+// it, which Fulcio does.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("the OIDC token is not a JWT")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("decoding the OIDC token: %w", err)
+	}
+	var c struct {
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(claims, &c); err != nil || c.Sub == "" {
+		return "", errors.New("the OIDC token has no sub claim")
+	}
+	return c.Sub, nil
+}
+
+// fulcioCertificate requests a certificate of signer's public key for the
+// identity of token, proving possession of the key by signing the token's
+// subject, and returns the DER certificates of its chain, the leaf first.
+func fulcioCertificate(fulcioURL, token string, signer Signer, client *http.Client) ([][]byte, error) {
+	sub, err := tokenSubject(token)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := signer.Sign([]byte(sub))
+	if err != nil {
+		return nil, err
+	}
+	public, err := marshalPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	var request struct {
+		Credentials struct {
+			OIDCIdentityToken string `json:"oidcIdentityToken"`
+		} `json:"credentials"`
+		PublicKeyRequest struct {
+			PublicKey struct {
+				Algorithm string `json:"algorithm"`
+				Content   string `json:"content"`
+			} `json:"publicKey"`
+			ProofOfPossession string `json:"proofOfPossession"`
+		} `json:"publicKeyRequest"`
+	}
+	request.Credentials.OIDCIdentityToken = token
+	request.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	request.PublicKeyRequest.PublicKey.Content = string(public)
+	request.PublicKeyRequest.ProofOfPossession = base64.StdEncoding.EncodeToString(proof)
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(strings.TrimSuffix(fulcioURL, "/")+"/api/v2/signingCert", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("requesting a Fulcio certificate: %s: %s", resp.Status, bytes.TrimSpace(contents))
+	}
+	var r fulcioResponse
+	if err := json.Unmarshal(contents, &r); err != nil {
+		return nil, fmt.Errorf("requesting a Fulcio certificate: %w", err)
+	}
+	var certs []string
+	if r.EmbeddedSct != nil {
+		certs = r.EmbeddedSct.Chain.Certificates
+	} else if r.DetachedSct != nil {
+		certs = r.DetachedSct.Chain.Certificates
+	}
+	var chain [][]byte
+	for _, c := range certs {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("requesting a Fulcio certificate: the chain holds a malformed certificate")
+		}
+		chain = append(chain, block.Bytes)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("requesting a Fulcio certificate: the response has no certificate")
+	}
+	return chain, nil
+}
+
+// keylessSigner returns an ephemeral signer certified by Fulcio for the
+// identity of the job's OIDC token, and the certificate chain, the leaf first.
+func keylessSigner(fulcioURL string) (*keySigner, []BundleCertificate, error) {
+	client := newHTTPClient(30 * time.Second)
+	token, err := githubIDToken("sigstore", client, os.Getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := generateSigner()
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := fulcioCertificate(fulcioURL, token, signer, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certs []BundleCertificate
+	for _, der := range chain {
+		certs = append(certs, BundleCertificate{base64.StdEncoding.EncodeToString(der)})
+	}
+	return signer, certs, nil
+}
+
+// keylessBundle is the Sigstore bundle of env, signed by the key certified
+// by the certificate chain certs.
+func keylessBundle(env *Envelope, certs []BundleCertificate) *SigstoreBundle {
+	b := &SigstoreBundle{MediaType: SigstoreBundleType, DSSEEnvelope: env}
+	b.VerificationMaterial.TlogEntries = []BundleTlogEntry{}
+	b.VerificationMaterial.X509CertificateChain = &struct {
+		Certificates []BundleCertificate `json:"certificates"`
+	}{certs}
+	return b
+}
+
+// signKeyless writes the keyless signatures of the written files, leaving
+// out shard indexes, by the signer certified by the certificate chain certs,
+// or the chain of a remote signer: the Sigstore bundle of each envelope, to
+// <file>.sigstore.json. Files that
+// aren't envelopes already, i.e. without --envelope, are bare statements,
+// which are signed, with their envelopes written to <file>.sig. It returns
+// the files written.
+func signKeyless(written []string, signer Signer, certs []BundleCertificate, force bool) ([]string, error) {
+	var files []string
+	for _, path := range written {
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return files, err
+		}
+		if parseShardIndex(payload) != nil {
+			continue
+		}
+		env := &Envelope{}
+		if json.Unmarshal(payload, env) != nil || env.PayloadType == "" {
+			if env, err = signEnvelope(PayloadContentType, payload, signer); err != nil {
+				return files, err
+			}
+			sig, err := json.Marshal(env)
+			if err != nil {
+				return files, err
+			}
+			if err := writeOutput(path+".sig", sig, force); err != nil {
+				return files, err
+			}
+			files = append(files, path+".sig")
+		}
+		bundle, err := json.Marshal(keylessBundle(env, signingCertificates(signer, certs)))
+		if err != nil {
+			return files, err
+		}
+		if err := writeOutput(path+".sigstore.json", bundle, force); err != nil {
+			return files, err
+		}
+		files = append(files, path+".sigstore.json")
+	}
+	return files, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// A verification kit is a tarball of everything verify needs to check an
+// artifact without the network: the signed provenance, the public key it is
+// signed with and the policy it must satisfy, with a SHA256SUMS file of their
+// digests. The kit can't vouch for itself, being anyone's to build, so it is
+// only trusted by its digest, published through a channel the consumer trusts.
+const (
+	KitProvenance = "provenance.dsse"
+	KitPublicKey  = "public_key.pem"
+	KitPolicy     = "policy.json"
+	kitSums       = "SHA256SUMS"
+	// maxKitSize bounds the kit read into memory.
+	maxKitSize = 64 << 20
+)
+
+// verificationKit is a verification kit as read by verify.
+type verificationKit struct {
+	Provenance []byte
+	Verifier   *keyVerifier
+	Policy     verifyPolicy
+}
+
+// readKit reads the verification kit at path, checking the kit against
+// sha256Digest and its files against its SHA256SUMS.
+func readKit(path, sha256Digest string) (*verificationKit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(f, maxKitSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxKitSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, maxKitSize)
+	}
+	sum := sha256.Sum256(contents)
+	if got := hex.EncodeToString(sum[:]); got != strings.TrimPrefix(sha256Digest, "sha256:") {
+		return nil, fmt.Errorf("%s has digest sha256:%s, not %s", path, got, sha256Digest)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(contents))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s: %s is not a regular file", path, hdr.Name)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			return nil, fmt.Errorf("%s: two files are named %s", path, hdr.Name)
+		}
+		if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	sums, ok := files[kitSums]
+	if !ok {
+		return nil, fmt.Errorf("%s has no %s", path, kitSums)
+	}
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: malformed %s line %q", path, kitSums, scanner.Text())
+		}
+		name, want := fields[1], fields[0]
+		file, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s lists %s, which is missing", path, kitSums, name)
+		}
+		if sum := sha256.Sum256(file); hex.EncodeToString(sum[:]) != want {
+			return nil, fmt.Errorf("%s: %s doesn't match its digest in %s", path, name, kitSums)
+		}
+		listed[name] = true
+	}
+	for _, name := range []string{KitProvenance, KitPublicKey, KitPolicy} {
+		if !listed[name] {
+			return nil, fmt.Errorf("%s has no %s listed in %s", path, name, kitSums)
+		}
+	}
+	kit := &verificationKit{Provenance: files[KitProvenance]}
+	if kit.Verifier, err = parseVerifier(files[KitPublicKey], path+"#"+KitPublicKey); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(files[KitPolicy], &kit.Policy); err != nil {
+		return nil, fmt.Errorf("parsing %s#%s: %w", path, KitPolicy, err)
+	}
+	return kit, nil
+}
+
+// kitMain implements `kit --provenance <envelope> --public_key <key>`,
+// packaging the provenance with its trust material for consumers without
+// network access to verify with `verify --kit`.
+func kitMain(args []string) {
+	flags := flag.NewFlagSet("kit", flag.ExitOnError)
+	provenance := flags.String("provenance", "", "The provenance to package, a DSSE envelope.")
+	keyPath := flags.String("public_key", "", "The PEM public key the provenance is signed with, pinned by the kit as its trust root.")
+	loadPolicyFlags := addPolicyFlags(flags, " (default: the builder of the provenance)")
+	outputPath := flags.String("output_path", "kit.tar", "Path to write the verification kit to.")
+	force := flags.Bool("force", false, "Overwrite the kit if it already exists.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *provenance == "" || *keyPath == "" {
+		fmt.Println("Both --provenance and --public_key are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	contents, err := ioutil.ReadFile(*provenance)
+	if err != nil {
+		fmt.Printf("Failed to read provenance: %s\n", err)
+		os.Exit(1)
+	}
+	stmt, _, err := parseProvenance(contents, *provenance)
+	if err != nil {
+		fmt.Printf("Failed to read provenance: %s\n", err)
+		os.Exit(1)
+	}
+	key, err := ioutil.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load key: %s\n", err)
+		os.Exit(1)
+	}
+	verifier, err := parseVerifier(key, *keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load key: %s\n", err)
+		os.Exit(1)
+	}
+	if _, err := envelopeSigner(*provenance, contents, verifier); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policy, _ := loadPolicyFlags()
+	// The minimal policy trusts the builder that built the artifact, and
+	// nothing else.
+	if len(policy.TrustedBuilders) == 0 {
+		policy.TrustedBuilders = []string{stmt.Predicate.Builder.Id}
+	}
+	if problems := policy.check(stmt, verifiedKeyIds(verifier)); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println("FAIL", p)
+		}
+		fmt.Printf("%s doesn't satisfy the policy of the kit\n", *provenance)
+		os.Exit(1)
+	}
+	policyJSON, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkOverwrite(*force, *outputPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	entries := []tarEntry{
+		{KitProvenance, contents},
+		{KitPublicKey, key},
+		{KitPolicy, append(policyJSON, '\n')},
+	}
+	// Kits of the same provenance and policy are byte-identical.
+	if err := writeTarEntries(*outputPath, entries, time.Unix(0, 0)); err != nil {
+		fmt.Printf("Failed to write the verification kit: %s\n", err)
+		os.Exit(1)
+	}
+	written, err := ioutil.ReadFile(*outputPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	sum := sha256.Sum256(written)
+	fmt.Printf("Wrote verification kit %s (sha256:%s)\n", *outputPath, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// koSubjects reads the image references ko prints on stdout (or writes with
+// --image-refs), one "repository[:tag]@sha256:digest" per line, and returns
+// a subject per image named by its repository.
+func koSubjects(path string) ([]Subject, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s []Subject
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ref := strings.TrimSpace(scanner.Text())
+		if ref == "" {
+			continue
+		}
+		i := strings.LastIndex(ref, "@")
+		if i < 0 {
+			return nil, fmt.Errorf("image reference %q has no digest", ref)
+		}
+		digest, err := parseDigest(ref[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, Subject{Name: imageRepository(ref), Digest: digest})
+	}
+	return s, scanner.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf8"
+)
+
+// Limits on the attestations verify, gate and query parse, which may come from
+// whoever can publish next to an artifact. Provenance generated here stays far
+// below them: large builds are sharded long before a statement nears the size
+// limit, and events nest a dozen levels at most.
+const (
+	MaxAttestationSize = 64 << 20
+	MaxJSONDepth       = 64
+	// MaxJSONString applies to every key and string but the payload of an
+	// envelope, which is checked itself once decoded.
+	MaxJSONString = 1 << 20
+)
+
+// readAttestationFile reads the attestations at path, failing rather than
+// reading more than MaxAttestationSize bytes.
+func readAttestationFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLimited(f, path)
+}
+
+// readLimited reads r, the attestations at what, up to MaxAttestationSize
+// bytes.
+func readLimited(r io.Reader, what string) ([]byte, error) {
+	contents, err := ioutil.ReadAll(io.LimitReader(r, MaxAttestationSize+1))
+	if err == nil && len(contents) > MaxAttestationSize {
+		err = fmt.Errorf("%s is larger than %d MiB", what, MaxAttestationSize>>20)
+	}
+	return contents, err
+}
+
+// jsonFrame is an array or object being scanned by checkAttestation. In an
+// object, keys and values alternate.
+type jsonFrame struct {
+	object bool
+	value  bool
+	key    string
+}
+
+// checkAttestation checks that contents, the attestations read from path, are
+// JSON within the limits before they're decoded: valid UTF-8, which the
+// decoder would otherwise silently replace, so that the digest of a signed
+// payload could cover other text than what is checked, nesting at most
+// MaxJSONDepth levels and with no string longer than MaxJSONString bytes.
+// contents may be a stream of JSON values, as a JSON Lines bundle is.
+func checkAttestation(contents []byte, path string) error {
+	if len(contents) > MaxAttestationSize {
+		return fmt.Errorf("%s is larger than %d MiB", path, MaxAttestationSize>>20)
+	}
+	if !utf8.Valid(contents) {
+		return fmt.Errorf("%s is not valid UTF-8", path)
+	}
+	d := json.NewDecoder(bytes.NewReader(contents))
+	d.UseNumber()
+	var stack []*jsonFrame
+	for {
+		t, err := d.Token()
+		if err == io.EOF && len(stack) > 0 {
+			// Token doesn't report values left open at the end.
+			return fmt.Errorf("parsing %s: %w", path, io.ErrUnexpectedEOF)
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if delim, ok := t.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		var top *jsonFrame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		isKey := top != nil && top.object && !top.value
+		if top != nil && top.object {
+			if isKey {
+				top.key = t.(string)
+			}
+			top.value = isKey
+		}
+		switch t := t.(type) {
+		case json.Delim:
+			if len(stack) == MaxJSONDepth {
+				return fmt.Errorf("%s nests more than %d levels deep", path, MaxJSONDepth)
+			}
+			stack = append(stack, &jsonFrame{object: t == '{'})
+		case string:
+			if len(t) > MaxJSONString && (isKey || top == nil || !top.object || top.key != "payload") {
+				return fmt.Errorf("%s has a string longer than %d KiB", path, MaxJSONString>>10)
+			}
+		}
+	}
+}
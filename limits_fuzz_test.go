@@ -0,0 +1,58 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Fuzzing needs testing.F, of Go 1.18, which go.mod doesn't require yet.
+
+func addSeeds(f *testing.F) {
+	for _, s := range []string{
+		testStatement,
+		testStatement + "\n" + testStatement,
+		testEnvelope(testStatement),
+		nested(MaxJSONDepth),
+		`{"payload":"` + strings.Repeat("a", 64) + `"}`,
+		`{"_type":"https://in-toto.io/Statement/v1","predicateType":"https://slsa.dev/provenance/v1","predicate":{"buildDefinition":{},"runDetails":{}}}`,
+	} {
+		f.Add([]byte(s))
+	}
+}
+
+func FuzzCheckAttestation(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		checkAttestation(contents, "fuzz.json")
+	})
+}
+
+func FuzzDecodeStatement(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		// decodeStatement is only given payloads within the limits.
+		if checkAttestation(payload, "fuzz.json") != nil {
+			return
+		}
+		decodeStatement(payload, &Statement{})
+	})
+}
+
+func FuzzParseProvenance(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		stmt, _, err := parseProvenance(contents, "fuzz.json")
+		if err != nil {
+			return
+		}
+		if stmt.Type != StatementV01Type && stmt.Type != StatementV1Type {
+			t.Errorf("parseProvenance() accepted a statement of type %q", stmt.Type)
+		}
+		if err := checkAttestation(contents, "fuzz.json"); err != nil {
+			t.Errorf("parseProvenance() accepted contents checkAttestation rejects: %v", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const testStatement = `{"_type":"https://in-toto.io/Statement/v0.1","subject":[{"name":"a","digest":{"sha256":"01ba4719c80b6fe911b091a7c05124b64eeece964e09c058ef8f9805daca546b"}}],"predicateType":"https://slsa.dev/provenance/v0.1","predicate":{"builder":{"id":"https://github.com/o/r/Attestations/GitHubHostedActions@v1"}}}`
+
+// nested returns a JSON document of depth nested arrays.
+func nested(depth int) string {
+	return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+}
+
+// testEnvelope wraps payload in an unsigned DSSE envelope of in-toto
+// statements.
+func testEnvelope(payload string) string {
+	return `{"payloadType":"application/vnd.in-toto+json","payload":"` + base64.StdEncoding.EncodeToString([]byte(payload)) + `","signatures":[]}`
+}
+
+func TestCheckAttestation(t *testing.T) {
+	long := strings.Repeat("a", MaxJSONString)
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"statement", testStatement, ""},
+		{"json lines", testStatement + "\n" + testStatement + "\n", ""},
+		{"max depth", nested(MaxJSONDepth), ""},
+		{"too deep", nested(MaxJSONDepth + 1), "nests more than"},
+		{"too deep in an object", `{"a":` + nested(MaxJSONDepth) + `}`, "nests more than"},
+		{"max string", `{"a":"` + long + `"}`, ""},
+		{"long string", `{"a":"` + long + `a"}`, "string longer than"},
+		{"long string in an array", `["` + long + `a"]`, "string longer than"},
+		{"long top-level string", `"` + long + `a"`, "string longer than"},
+		{"long key", `{"` + long + `a":1}`, "string longer than"},
+		{"long payload", `{"payload":"` + long + `a"}`, ""},
+		{"long key of a payload value", `{"payload":{"` + long + `a":1}}`, "string longer than"},
+		{"long value after a payload", `{"payload":"","a":"` + long + `a"}`, "string longer than"},
+		{"invalid UTF-8", "{\"a\":\"\xff\"}", "not valid UTF-8"},
+		{"invalid JSON", `{"a":`, "parsing"},
+		{"too large", strings.Repeat(" ", MaxAttestationSize+1), "larger than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAttestation([]byte(tt.contents), "test.json")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkAttestation() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("checkAttestation() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	for _, size := range []int{0, MaxAttestationSize} {
+		contents, err := readLimited(bytes.NewReader(make([]byte, size)), "test.json")
+		if err != nil || len(contents) != size {
+			t.Errorf("readLimited() of %d bytes = %d bytes, %v", size, len(contents), err)
+		}
+	}
+	if _, err := readLimited(bytes.NewReader(make([]byte, MaxAttestationSize+1)), "test.json"); err == nil {
+		t.Errorf("readLimited() of %d bytes succeeded", MaxAttestationSize+1)
+	}
+}
+
+func TestParseProvenanceLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"statement", testStatement, ""},
+		{"envelope", testEnvelope(testStatement), ""},
+		{"payload too deep", testEnvelope(`{"_type":"https://in-toto.io/Statement/v0.1","predicate":` + nested(MaxJSONDepth) + `}`), "the envelope payload of test.json nests more than"},
+		{"payload with a long string", testEnvelope(`{"_type":"` + strings.Repeat("a", MaxJSONString+1) + `"}`), "the envelope payload of test.json has a string longer than"},
+		{"payload not UTF-8", testEnvelope("{\"_type\":\"\xff\"}"), "the envelope payload of test.json is not valid UTF-8"},
+		{"invalid payload", `{"payloadType":"application/vnd.in-toto+json","payload":"!"}`, "decoding envelope payload"},
+		{"other payload type", `{"payloadType":"text/plain","payload":""}`, "has payload type"},
+		{"not a statement", `{"_type":"other"}`, "is not an in-toto statement"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseProvenance([]byte(tt.contents), "test.json")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("parseProvenance() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("parseProvenance() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
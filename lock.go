@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jobs of a matrix may share an output directory, e.g. a mounted cache, so
+// files there are written under unique temporary names and then renamed into
+// place, and read-modify-write cycles such as --append hold a lock file. Both
+// are hidden, so that peers listing the directory skip them.
+const (
+	// lockTimeout is how long to wait for a peer to release a lock.
+	lockTimeout = 5 * time.Minute
+	// lockStale is how old a lock must be to be taken as left behind by a
+	// job that was killed, and broken. It is well within lockTimeout, so
+	// that waiting peers get to break it, and holders refresh theirs every
+	// lockRefresh, so that a lock held longer isn't taken as stale.
+	lockStale   = time.Minute
+	lockRefresh = 10 * time.Second
+	lockRetry   = 50 * time.Millisecond
+)
+
+// isScratchFile reports whether name, in a shared output directory, is a
+// lock or a file being written rather than provenance to read.
+func isScratchFile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// listStore returns the paths of the regular files in the provenance store
+// at dir, in name order, skipping those peers are still writing.
+func listStore(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && !isScratchFile(f.Name()) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// errLockTaken is the error of a lock a peer took as stale while it was held.
+var errLockTaken = errors.New("a peer took it as stale")
+
+// lockPath returns the path of the lock of path.
+func lockPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock")
+}
+
+// lockFile takes the lock of path, a hidden file created exclusively next to
+// it, waiting for the peer holding it for up to lockTimeout. It returns the
+// function releasing the lock, which is refreshed until then. Releasing
+// fails if the lock couldn't be refreshed or was taken by a peer meanwhile,
+// as the peer may then have overwritten what was written under it.
+func lockFile(path string) (func() error, error) {
+	lock := lockPath(path)
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// Locks are told apart by their contents: the inode of a removed lock
+	// is soon reused.
+	host, _ := os.Hostname()
+	id := []byte(fmt.Sprintf("%s %d %x\n", host, os.Getpid(), nonce))
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(id)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lock)
+				return nil, err
+			}
+			return holdLock(lock, id), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > lockStale {
+			holder, err := ioutil.ReadFile(lock)
+			if err == nil {
+				// Another peer may have broken it, or a third retaken it,
+				// first.
+				var broken bool
+				if broken, err = removeLock(lock, holder, true); broken {
+					fmt.Printf("Broke stale lock %s\n", lock)
+				}
+			}
+			if err != nil && !os.IsNotExist(err) && !os.IsExist(err) {
+				return nil, fmt.Errorf("breaking stale lock %s: %w", lock, err)
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			holder, _ := ioutil.ReadFile(lock)
+			return nil, fmt.Errorf("timed out waiting for %s, held by %s", lock, strings.TrimSpace(string(holder)))
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+// holdLock refreshes the lock file at lock, holding id, every lockRefresh
+// until the returned function releases it.
+func holdLock(lock string, id []byte) func() error {
+	stop, done := make(chan struct{}), make(chan struct{})
+	var lost error
+	go func() {
+		defer close(done)
+		t := time.NewTicker(lockRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			// A peer restoring a lock it moved aside by mistake, in
+			// removeLock, leaves it missing for a moment.
+			var err error
+			for i := 0; i < 3; i++ {
+				if err = refreshLock(lock, id); err == nil {
+					break
+				}
+				time.Sleep(lockRetry)
+			}
+			if err != nil {
+				lost = err
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			close(stop)
+			<-done
+			// A lock that couldn't be refreshed may still be there.
+			removed, rerr := removeLock(lock, id, false)
+			if lost == nil {
+				switch {
+				case os.IsNotExist(rerr) || rerr == nil && !removed:
+					lost = errLockTaken
+				case rerr != nil:
+					err = fmt.Errorf("releasing lock %s: %w", lock, rerr)
+					return
+				}
+			}
+			if lost != nil {
+				err = fmt.Errorf("lost lock %s: %w", lock, lost)
+			}
+		})
+		return err
+	}
+}
+
+// refreshLock touches the lock file at lock if it still holds id, so that
+// peers don't take it as stale.
+func refreshLock(lock string, id []byte) error {
+	holder, err := ioutil.ReadFile(lock)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(holder, id) {
+		return errLockTaken
+	}
+	now := time.Now()
+	return os.Chtimes(lock, now, now)
+}
+
+// removeLock removes the lock file at lock if it holds id and, if stale, is
+// still stale, and reports whether it did. Peers may break and retake a lock
+// between reading and removing it, so the lock is first moved to a unique
+// name, where it can't be replaced, and moved back if it turns out to be
+// another's.
+func removeLock(lock string, id []byte, stale bool) (bool, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return false, err
+	}
+	// Named as a temporary file of the locked path, so that it's never
+	// taken for a subject.
+	moved := strings.TrimSuffix(lock, ".lock") + ".tmp-lock-" + hex.EncodeToString(nonce)
+	if err := os.Rename(lock, moved); err != nil {
+		return false, err
+	}
+	holder, err := ioutil.ReadFile(moved)
+	if err == nil && bytes.Equal(holder, id) {
+		info, err := os.Stat(moved)
+		if err == nil && (!stale || time.Since(info.ModTime()) > lockStale) {
+			return true, os.Remove(moved)
+		}
+	}
+	// Linking, unlike renaming, fails rather than replace a lock a third
+	// peer took meanwhile, which then holds it.
+	err = os.Link(moved, lock)
+	os.Remove(moved)
+	return false, err
+}
+
+// writeTemp writes payload to a hidden file with a unique name next to path,
+// returning its name.
+func writeTemp(path string, payload []byte, mode os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(payload)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ageLock makes the lock of path look left behind by a killed job.
+func ageLock(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-2 * lockStale)
+	if err := os.Chtimes(lockPath(path), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockFileBreaksStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.provenance")
+	if err := os.WriteFile(lockPath(path), []byte("host 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageLock(t, path)
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("unlock() = %v", err)
+	}
+	if _, err := os.Stat(lockPath(path)); !os.IsNotExist(err) {
+		t.Errorf("the lock is left after unlock: %v", err)
+	}
+}
+
+func TestRemoveLockKeepsAnotherLock(t *testing.T) {
+	// Two waiters see the same stale lock; the first breaks it and takes
+	// the lock, and the second must leave that one alone.
+	path := filepath.Join(t.TempDir(), "app.provenance")
+	lock := lockPath(path)
+	if err := os.WriteFile(lock, []byte("host 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageLock(t, path)
+	if broken, err := removeLock(lock, []byte("host 1\n"), true); !broken || err != nil {
+		t.Fatalf("removeLock() of the stale lock = %v, %v", broken, err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken, err := removeLock(lock, []byte("host 1\n"), true); broken || err != nil {
+		t.Errorf("removeLock() of another lock = %v, %v, want false, nil", broken, err)
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("unlock() after another waiter's removeLock = %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s is left behind", e.Name())
+	}
+}
+
+func TestUnlockReportsLostLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.provenance")
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A peer takes the lock as stale and retakes it.
+	id, err := os.ReadFile(lockPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(lockPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lockPath(path), []byte("peer 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshLock(lockPath(path), id); !errors.Is(err, errLockTaken) {
+		t.Errorf("refreshLock() of a retaken lock = %v, want %v", err, errLockTaken)
+	}
+	if err := unlock(); !errors.Is(err, errLockTaken) {
+		t.Errorf("unlock() of a retaken lock = %v, want %v", err, errLockTaken)
+	}
+	if contents, err := os.ReadFile(lockPath(path)); err != nil || string(contents) != "peer 2\n" {
+		t.Errorf("the peer's lock is %q, %v after unlock", contents, err)
+	}
+}
+
+func TestLockFileExcludes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockFile(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			held++
+			if held > 1 {
+				t.Error("two holders of the lock")
+			}
+			mu.Unlock()
+			time.Sleep(lockRetry)
+			mu.Lock()
+			held--
+			mu.Unlock()
+			if err := unlock(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
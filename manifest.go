@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// DigestManifestType is the media type of a DigestManifest.
+const DigestManifestType = "application/vnd.slsa-framework.provenance-digests+json"
+
+// DigestManifest hands the subjects hashed in the build job over to the job
+// generating their provenance, so the artifacts themselves don't have to be.
+type DigestManifest struct {
+	MediaType string    `json:"mediaType"`
+	Subjects  []Subject `json:"subjects"`
+}
+
+var lowerHexPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// readDigestManifest reads the subjects of the DigestManifest at path,
+// checking that each has a digest of a known algorithm.
+func readDigestManifest(path string) ([]Subject, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := DigestManifest{}
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if m.MediaType != DigestManifestType {
+		return nil, fmt.Errorf("%s is not a digest manifest: media type %q", path, m.MediaType)
+	}
+	if len(m.Subjects) == 0 {
+		return nil, fmt.Errorf("%s lists no subjects", path)
+	}
+	for _, s := range m.Subjects {
+		if s.Name == "" || len(s.Digest) == 0 {
+			return nil, fmt.Errorf("%s has a subject without a name or digest", path)
+		}
+		for alg, d := range s.Digest {
+			h := digestAlgorithms[alg]
+			if h == nil {
+				return nil, fmt.Errorf("subject %s of %s has a digest of unknown algorithm %q", s.Name, path, alg)
+			}
+			if len(d) != 2*h().Size() || !lowerHexPattern.MatchString(d) {
+				return nil, fmt.Errorf("subject %s of %s has malformed %s digest %q", s.Name, path, alg, d)
+			}
+		}
+	}
+	return m.Subjects, nil
+}
+
+// digestMain implements `digest --artifact_path <path>`, the first phase of
+// generating provenance in a separate job: it hashes the artifacts in the
+// build job and writes a DigestManifest for --subject_manifest.
+func digestMain(args []string) {
+	flags := flag.NewFlagSet("digest", flag.ExitOnError)
+	var artifactPath pathList
+	flags.Var(&artifactPath, "artifact_path", "The file or dir path, or glob pattern, of the artifacts to hash. May be repeated.")
+	outputPath := flags.String("output_path", "digests.json", "The path to write the digest manifest to.")
+	algorithms := flags.String("digest_algorithms", DefaultDigestAlgorithm, "Comma-separated algorithms to hash the artifacts with.")
+	workspace := flags.String("workspace", "", "The directory all artifacts must resolve within (default: $GITHUB_WORKSPACE, or the artifact path when unset).")
+	onEscape := flags.String("on_workspace_escape", EscapeError, "What to do with artifacts that resolve outside the workspace: 'error' or 'warn'.")
+	concurrency := flags.Int("concurrency", 0, "How many files to hash at once. 0 means one per CPU.")
+	include := flags.String("include", "", "Comma-separated gitignore-style patterns of the files to hash. All files by default.")
+	exclude := flags.String("exclude", "", "Comma-separated gitignore-style patterns of the files not to hash. The manifest written to --output_path is always left out.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if len(artifactPath) == 0 {
+		fmt.Println("No value found for required flag: --artifact_path")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *concurrency < 0 {
+		fmt.Printf("Invalid value for flag --concurrency: %d\n", *concurrency)
+		os.Exit(1)
+	}
+	if *onEscape != EscapeError && *onEscape != EscapeWarn {
+		fmt.Printf("Invalid value for flag --on_workspace_escape: %q\n", *onEscape)
+		os.Exit(1)
+	}
+	opts := Options{
+		ArtifactPaths:    artifactPath,
+		DigestAlgorithms: parseList(*algorithms),
+		Concurrency:      *concurrency,
+		Workspace:        normalizeInputPath(*workspace),
+		OnEscape:         *onEscape,
+		Include:          parseList(*include),
+		Exclude:          parseList(*exclude),
+		Outputs:          outputPaths(*outputPath),
+		Timing:           newTiming(),
+	}
+	if opts.Workspace == "" {
+		opts.Workspace = normalizeInputPath(os.Getenv("GITHUB_WORKSPACE"))
+	}
+	if opts.Workspace == "" {
+		opts.Workspace = singleArtifactPath(opts.ArtifactPaths)
+		opts.ArtifactWorkspace = opts.Workspace != ""
+	}
+	if err := validateDigestAlgorithms(opts.DigestAlgorithms); err != nil {
+		fmt.Printf("Invalid value for flag --digest_algorithms: %s\n", err)
+		os.Exit(1)
+	}
+	var findings Findings
+	roots, err := expandArtifactPaths(opts.ArtifactPaths)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	s, err := subjects(roots, opts, &findings)
+	findings.print(nil)
+	if err == nil && len(s) == 0 {
+		err = errors.New("no artifacts found")
+	}
+	if err != nil {
+		fmt.Printf("Failed to hash artifacts: %s\n", err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(DigestManifest{MediaType: DigestManifestType, Subjects: s}, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*outputPath, out, 0644); err != nil {
+		fmt.Printf("Failed to write digest manifest: %s\n", err)
+		os.Exit(1)
+	}
+	sum := sha256.Sum256(out)
+	fmt.Printf("Wrote digests of %d artifacts to %s (sha256:%s)\n", len(s), *outputPath, hex.EncodeToString(sum[:]))
+	opts.Timing.print()
+}
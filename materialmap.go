@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// MaterialRule rewrites the URIs of materials matching Match, a regular
+// expression that must match the whole URI, to URI, a template in which
+// ${name} (or ${1}) is replaced with what the named (or numbered) group
+// matched, e.g. to name a module fetched from an internal mirror by its
+// URL there rather than by its path in the module cache.
+type MaterialRule struct {
+	Match string `json:"match"`
+	URI   string `json:"uri"`
+
+	pattern *regexp.Regexp
+}
+
+// readMaterialRules reads the JSON list of MaterialRules at path.
+func readMaterialRules(path string) ([]MaterialRule, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []MaterialRule
+	if err := json.Unmarshal(contents, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range rules {
+		if rules[i].Match == "" || rules[i].URI == "" {
+			return nil, fmt.Errorf("rule %d of %s needs both match and uri", i, path)
+		}
+		if rules[i].pattern, err = regexp.Compile("^(?:" + rules[i].Match + ")$"); err != nil {
+			return nil, fmt.Errorf("rule %d of %s: %w", i, path, err)
+		}
+	}
+	return rules, nil
+}
+
+// mapMaterials rewrites the URI of each material with the first of rules
+// that matches it. The digests are kept: the mirror serves the same bytes.
+func mapMaterials(materials []Item, rules []MaterialRule) {
+	for i, m := range materials {
+		for _, r := range rules {
+			if r.pattern.MatchString(m.URI) {
+				materials[i].URI = r.pattern.ReplaceAllString(m.URI, r.URI)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// NamingMaven names subjects as NamingPurl does, except for the files of
+// Maven artifacts, which are named by pkg:maven purl, so that consumers of a
+// Maven repository can match their attestations by coordinates.
+const NamingMaven = "maven"
+
+// mavenCoordinates identify a file of a Maven artifact.
+type mavenCoordinates struct {
+	GroupId    string
+	ArtifactId string
+	Version    string
+	Classifier string
+	Extension  string
+}
+
+// purl returns the pkg:maven purl of c. The type qualifier is left out for
+// jars, as it defaults to jar.
+func (c mavenCoordinates) purl() PackageURL {
+	p := PackageURL{Type: "maven", Namespace: c.GroupId, Name: c.ArtifactId, Version: c.Version, Qualifiers: map[string]string{}}
+	if c.Classifier != "" {
+		p.Qualifiers["classifier"] = c.Classifier
+	}
+	if c.Extension != "jar" {
+		p.Qualifiers["type"] = c.Extension
+	}
+	return p
+}
+
+// snapshotPattern matches the version a -SNAPSHOT is deployed under, e.g.
+// 1.0-20240101.123456-1.
+var snapshotPattern = regexp.MustCompile(`^-\d{8}\.\d{6}-\d+`)
+
+// mavenLayoutCoordinates returns the coordinates of the file at the subject
+// path name if it is laid out as in a Maven repository, i.e. as
+// <group>/<artifactId>/<version>/<artifactId>-<version>[-<classifier>].<extension>,
+// where the group's dots are directories.
+func mavenLayoutCoordinates(name string) (mavenCoordinates, bool) {
+	segments := strings.Split(name, "/")
+	n := len(segments)
+	if n < 4 {
+		return mavenCoordinates{}, false
+	}
+	c := mavenCoordinates{
+		GroupId:    strings.Join(segments[:n-3], "."),
+		ArtifactId: segments[n-3],
+		Version:    segments[n-2],
+	}
+	rest := strings.TrimPrefix(segments[n-1], c.ArtifactId+"-")
+	if rest == segments[n-1] {
+		return mavenCoordinates{}, false
+	}
+	switch {
+	case strings.HasPrefix(rest, c.Version):
+		rest = rest[len(c.Version):]
+	case strings.HasSuffix(c.Version, "-SNAPSHOT") && strings.HasPrefix(rest, strings.TrimSuffix(c.Version, "-SNAPSHOT")):
+		// Snapshots are deployed under timestamped versions, which identify
+		// the file.
+		rest = rest[len(strings.TrimSuffix(c.Version, "-SNAPSHOT")):]
+		timestamp := snapshotPattern.FindString(rest)
+		if timestamp == "" {
+			return mavenCoordinates{}, false
+		}
+		c.Version = strings.TrimSuffix(c.Version, "-SNAPSHOT") + timestamp
+		rest = rest[len(timestamp):]
+	default:
+		return mavenCoordinates{}, false
+	}
+	if strings.HasPrefix(rest, "-") {
+		i := strings.Index(rest, ".")
+		if i < 2 {
+			return mavenCoordinates{}, false
+		}
+		c.Classifier, rest = rest[1:i], rest[i:]
+	}
+	if !strings.HasPrefix(rest, ".") || len(rest) < 2 {
+		return mavenCoordinates{}, false
+	}
+	c.Extension = rest[1:]
+	return c, true
+}
+
+// parseMavenCoordinates parses coordinates in Gradle's notation,
+// <groupId>:<artifactId>:<version>[:<classifier>][@<extension>], taking the
+// extension from the name of the file they identify if they have none.
+func parseMavenCoordinates(s, name string) (mavenCoordinates, error) {
+	var c mavenCoordinates
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, c.Extension = s[:i], s[i+1:]
+	} else if i := strings.LastIndex(name, "."); i >= 0 && !strings.Contains(name[i:], "/") {
+		c.Extension = name[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) == 4 {
+		c.Classifier = parts[3]
+	}
+	if len(parts) < 3 || len(parts) > 4 {
+		return c, fmt.Errorf("%q is not of the form <groupId>:<artifactId>:<version>[:<classifier>][@<extension>]", s)
+	}
+	c.GroupId, c.ArtifactId, c.Version = parts[0], parts[1], parts[2]
+	for _, v := range []string{c.GroupId, c.ArtifactId, c.Version, c.Extension} {
+		if v == "" {
+			return c, fmt.Errorf("%q is not of the form <groupId>:<artifactId>:<version>[:<classifier>][@<extension>]", s)
+		}
+	}
+	return c, nil
+}
+
+// readMavenCoordinates reads a coordinates file, whose lines are of the form
+// `<path> <coordinates>`, with the path of a file subject as it is named
+// under --artifact_path. Blank lines and lines starting with # are skipped.
+func readMavenCoordinates(file string) (map[string]mavenCoordinates, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	coords := map[string]mavenCoordinates{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `<path> <coordinates>`", file, line)
+		}
+		name := manifestPath(fields[0])
+		if _, ok := coords[name]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is listed twice", file, line, name)
+		}
+		c, err := parseMavenCoordinates(fields[1], name)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		coords[name] = c
+	}
+	return coords, scanner.Err()
+}
+
+// nameMavenSubjects renames the file subjects listed in coords, or else laid
+// out as in a Maven repository, to pkg:maven purls, and the others to
+// subpaths of base. The entries of coords used are deleted, leaving those of
+// files that aren't subjects.
+func nameMavenSubjects(subjects []Subject, coords map[string]mavenCoordinates, base PackageURL) {
+	for i := range subjects {
+		c, ok := coords[subjects[i].Name]
+		delete(coords, subjects[i].Name)
+		if !ok {
+			c, ok = mavenLayoutCoordinates(subjects[i].Name)
+		}
+		if ok {
+			subjects[i].Name = c.purl().String()
+		} else {
+			nameFileSubjects(subjects[i:i+1], base)
+		}
+	}
+}
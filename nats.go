@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// natsQueue is a minimal NATS core client that subscribes to a subject as a
+// member of a queue group, so each job is delivered to exactly one worker.
+// With a tls:// URL, or a server that requires it, the connection is
+// upgraded to TLS after the server's INFO, verifying that the server's
+// certificate names its host against the system roots or those of the
+// tls_ca parameter. Credentials are only sent over TLS.
+// See https://docs.nats.io/reference/reference-protocols/nats-protocol
+type natsQueue struct {
+	conn net.Conn
+	mu   sync.Mutex // guards writes to conn
+	msgs chan *Delivery
+	err  error
+	// maxPayload is the largest message the server accepts, and so sends.
+	maxPayload int
+}
+
+type natsInfo struct {
+	TLSRequired  bool `json:"tls_required"`
+	TLSAvailable bool `json:"tls_available"`
+	AuthRequired bool `json:"auth_required"`
+	MaxPayload   int  `json:"max_payload"`
+}
+
+// natsMaxPayload is the largest payload NATS servers can be configured to
+// accept, for servers that don't announce their max_payload.
+const natsMaxPayload = 64 << 20
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+func dialNATS(u *url.URL, group string) (*natsQueue, error) {
+	subject := strings.TrimPrefix(u.Path, "/")
+	if subject == "" {
+		return nil, errors.New("nats queue URL must name a subject, e.g. nats://localhost:4222/provenance.jobs")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	info := natsInfo{}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(line))
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	secure := u.Scheme == "tls" || info.TLSRequired
+	if secure {
+		if !info.TLSRequired && !info.TLSAvailable {
+			conn.Close()
+			return nil, fmt.Errorf("NATS server %s doesn't support TLS", host)
+		}
+		config, err := natsTLSConfig(u)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("NATS TLS handshake with %s: %w", host, err)
+		}
+		conn, r = tc, bufio.NewReader(tc)
+	}
+	if u.User != nil && !secure {
+		conn.Close()
+		return nil, fmt.Errorf("refusing to send the NATS credentials to %s in plaintext; connect with tls://", host)
+	}
+	connect := natsConnect{Name: "create_provenance", Lang: "go", Version: "0.1"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	payload, _ := json.Marshal(connect)
+	q := &natsQueue{conn: conn, msgs: make(chan *Delivery, 64), maxPayload: info.MaxPayload}
+	if q.maxPayload <= 0 || q.maxPayload > natsMaxPayload {
+		q.maxPayload = natsMaxPayload
+	}
+	if err := q.write(fmt.Sprintf("CONNECT %s\r\nSUB %s %s 1\r\n", payload, subject, group)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go q.read(r)
+	return q, nil
+}
+
+// natsTLSConfig returns the TLS configuration of the server of u, verifying
+// its host against the roots of the tls_ca parameter, if set.
+func natsTLSConfig(u *url.URL) (*tls.Config, error) {
+	config := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if path := u.Query().Get("tls_ca"); path != "" {
+		roots, err := readRoots(path)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+	}
+	return config, nil
+}
+
+// readRoots returns the pool of the PEM certificates in the file at path.
+func readRoots(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return roots, nil
+}
+
+func (q *natsQueue) write(s string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, err := io.WriteString(q.conn, s)
+	return err
+}
+
+// read dispatches protocol messages until the connection fails. Server PINGs
+// are answered here so that long-running jobs don't get the worker dropped.
+func (q *natsQueue) read(r *bufio.Reader) {
+	defer close(q.msgs)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			q.err = fmt.Errorf("NATS connection lost: %s", err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if err := q.write("PONG\r\n"); err != nil {
+				q.err = err
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			q.err = fmt.Errorf("NATS server error: %s", strings.TrimSpace(line[len("-ERR"):]))
+			return
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || len(fields) > 5 {
+				q.err = fmt.Errorf("malformed NATS message header: %q", line)
+				return
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				q.err = fmt.Errorf("malformed NATS message header: %q", line)
+				return
+			}
+			// A size past what the server accepts would have the body
+			// allocated before anything is read.
+			if size > q.maxPayload {
+				q.err = fmt.Errorf("NATS message of %d bytes exceeds the max_payload of %d", size, q.maxPayload)
+				return
+			}
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				q.err = fmt.Errorf("NATS connection lost: %s", err)
+				return
+			}
+			d := &Delivery{Body: body[:size]}
+			if len(fields) == 5 {
+				reply := fields[3]
+				d.Reply = func(result []byte) error {
+					return q.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", reply, len(result), result))
+				}
+			}
+			q.msgs <- d
+		}
+	}
+}
+
+func (q *natsQueue) Receive() (*Delivery, error) {
+	d, ok := <-q.msgs
+	if !ok {
+		return nil, q.err
+	}
+	return d, nil
+}
+
+func (q *natsQueue) Close() error {
+	return q.conn.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// offline is set by --offline, which forbids all network access. Features
+// that need the network check it with requireOnline to fail fast.
+var offline bool
+
+// errOffline is returned for network requests made with --offline.
+var errOffline = errors.New("network access is disabled by --offline")
+
+func init() {
+	addOfflineFlag(flag.CommandLine)
+}
+
+// addOfflineFlag adds --offline to flags.
+func addOfflineFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&offline, "offline", false, "Make no network calls. Features that need the network fail instead, and TUF metadata is read from the cache.")
+}
+
+// requireOnline returns an error naming feature if --offline is set.
+func requireOnline(feature string) error {
+	if offline {
+		return fmt.Errorf("%s needs network access, which --offline disables", feature)
+	}
+	return nil
+}
+
+// guardedTransport refuses every request with --offline, as a backstop to
+// requireOnline, and otherwise sends it with base.
+type guardedTransport struct {
+	base http.RoundTripper
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if offline {
+		return nil, errOffline
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newHTTPClient returns an HTTP client with the given timeout that makes no
+// requests with --offline.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: guardedTransport{http.DefaultTransport}}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// OutputName holds the fields an output path template may refer to, e.g.
+// `{{.Name}}.{{.RunID}}-{{.Attempt}}.intoto.jsonl`, so that the jobs of a
+// matrix each write provenance of their own.
+type OutputName struct {
+	// Name is the base name of the only subject or, with several, that of
+	// the fallback given, e.g. the artifact path, or else of the repository.
+	// Characters other than letters, digits, '.', '-' and '_' become '_'.
+	Name string
+	// Digest is the hex digest of the only subject, preferring sha256, or
+	// with several the sha256 of their sorted names and digests. Use
+	// {{slice .Digest 0 12}} to shorten it.
+	Digest  string
+	RunID   string
+	Attempt string
+	Job     string
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// isOutputTemplate reports whether path is a template to expand.
+func isOutputTemplate(path string) bool {
+	return strings.Contains(path, "{{")
+}
+
+// parseOutputTemplate parses the output path template tmpl.
+func parseOutputTemplate(tmpl string) (*template.Template, error) {
+	return template.New("output_path").Option("missingkey=error").Parse(tmpl)
+}
+
+// expandOutputPath expands the output path template tmpl for stmt, naming
+// it by fallback, a path, when it has several subjects. Paths that aren't
+// templates are returned as they are.
+func expandOutputPath(tmpl string, stmt *Statement, fallback string, opts Options) (string, error) {
+	if !isOutputTemplate(tmpl) {
+		return tmpl, nil
+	}
+	t, err := parseOutputTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	gh := GitHubContext{}
+	if err := json.Unmarshal([]byte(opts.GitHubContext), &gh); err != nil {
+		return "", fmt.Errorf("parsing github context: %w", err)
+	}
+	data := OutputName{RunID: gh.RunId, Attempt: gh.RunAttempt, Job: gh.Job}
+	if data.Attempt == "" {
+		data.Attempt = "1"
+	}
+	switch len(stmt.Subject) {
+	case 0:
+		return "", fmt.Errorf("output path %q names the subjects, but there are none", tmpl)
+	case 1:
+		s := stmt.Subject[0]
+		data.Name = path.Base(strings.TrimSuffix(s.Name, "/"))
+		data.Digest = s.Digest[DefaultDigestAlgorithm]
+		if data.Digest == "" {
+			algs := make([]string, 0, len(s.Digest))
+			for alg := range s.Digest {
+				algs = append(algs, alg)
+			}
+			sort.Strings(algs)
+			if len(algs) > 0 {
+				data.Digest = s.Digest[algs[0]]
+			}
+		}
+	default:
+		data.Name = path.Base(fallback)
+		if fallback == "" || data.Name == "." || data.Name == "/" {
+			data.Name = path.Base(gh.Repository)
+		}
+		lines := make([]string, 0, len(stmt.Subject))
+		for _, s := range stmt.Subject {
+			algs := make([]string, 0, len(s.Digest))
+			for alg, d := range s.Digest {
+				algs = append(algs, alg+":"+d)
+			}
+			sort.Strings(algs)
+			lines = append(lines, strings.Join(algs, ",")+"  "+s.Name+"\n")
+		}
+		sort.Strings(lines)
+		sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+		data.Digest = hex.EncodeToString(sum[:])
+	}
+	data.Name = unsafeNameChars.ReplaceAllString(data.Name, "_")
+	if data.Name == "" || data.Name == "." || data.Name == ".." {
+		data.Name = "provenance"
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("expanding output path %q: %w", tmpl, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("output path %q expands to an empty path", tmpl)
+	}
+	return buf.String(), nil
+}
+
+// checkOverwrite fails if any of paths exists, unless force is set, so that
+// parallel jobs writing to the same directory don't clobber each other's
+// provenance.
+func checkOverwrite(force bool, paths ...string) error {
+	if force {
+		return nil
+	}
+	for _, p := range paths {
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%s already exists; set --force to overwrite it", p)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutput writes payload to path, which must not exist unless force is
+// set. The payload is written to a temporary file and then moved into place,
+// so that peers never read a partial file; without force it's hard linked,
+// which fails if path exists, so that of two jobs racing to write the same
+// path, one fails.
+func writeOutput(path string, payload []byte, force bool) error {
+	tmp, err := writeTemp(path, payload, 0755)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if force {
+		return os.Rename(tmp, path)
+	}
+	err = os.Link(tmp, path)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists; set --force to overwrite it", path)
+	} else if err != nil {
+		// Some filesystems, e.g. FAT, have no hard links.
+		return writeExclusive(path, payload)
+	}
+	return nil
+}
+
+// writeExclusive writes payload to path, which it creates exclusively.
+func writeExclusive(path string, payload []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists; set --force to overwrite it", path)
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.Write(payload); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
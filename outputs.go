@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stepOutput is an output of the step running the action, for later steps to
+// refer to as steps.<id>.outputs.<name>.
+type stepOutput struct {
+	Name, Value string
+}
+
+// provenanceOutputs returns the step outputs of generated provenance: where it
+// and its bundles were written, the first subject with its digest, and where
+// the first envelope uploaded to Rekor, if any, was logged.
+func provenanceOutputs(stmt *Statement, path, bundleFile string, signed []string, receipts []RekorReceipt) []stepOutput {
+	outputs := []stepOutput{{"provenance_path", path}}
+	if bundleFile != "" {
+		outputs = append(outputs, stepOutput{"bundle_path", bundleFile})
+	}
+	for _, f := range signed {
+		if strings.HasSuffix(f, ".sigstore.json") {
+			outputs = append(outputs, stepOutput{"sigstore_bundle_path", f})
+			break
+		}
+	}
+	if len(stmt.Subject) > 0 {
+		s := stmt.Subject[0]
+		outputs = append(outputs, stepOutput{"subject_name", s.Name})
+		if digest := primaryDigest(s.Digest); digest != "" {
+			outputs = append(outputs, stepOutput{"subject_digest", digest})
+		}
+	}
+	if len(receipts) > 0 {
+		r := receipts[0]
+		outputs = append(outputs, stepOutput{"rekor_log_index", strconv.FormatInt(r.LogIndex, 10)}, stepOutput{"rekor_uuid", r.UUID})
+	}
+	return outputs
+}
+
+// primaryDigest returns the sha256 digest of d as "sha256:<hex>", or failing
+// that, the first of its digests by algorithm.
+func primaryDigest(d DigestSet) string {
+	if v, ok := d["sha256"]; ok {
+		return "sha256:" + v
+	}
+	algs := make([]string, 0, len(d))
+	for alg := range d {
+		algs = append(algs, alg)
+	}
+	if len(algs) == 0 {
+		return ""
+	}
+	sort.Strings(algs)
+	return algs[0] + ":" + d[algs[0]]
+}
+
+// writeStepOutputs appends outputs to the file named by $GITHUB_OUTPUT. It
+// does nothing outside of GitHub Actions, when the variable is unset. Values
+// spanning lines are written with a random delimiter, so that they can't end
+// the value early.
+func writeStepOutputs(getenv func(string) string, outputs []stepOutput) error {
+	path := getenv("GITHUB_OUTPUT")
+	if path == "" {
+		return nil
+	}
+	var b strings.Builder
+	for _, o := range outputs {
+		if !strings.ContainsAny(o.Value, "\r\n") {
+			fmt.Fprintf(&b, "%s=%s\n", o.Name, o.Value)
+			continue
+		}
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		delimiter := "ghadelimiter_" + hex.EncodeToString(nonce)
+		fmt.Fprintf(&b, "%s<<%s\n%s\n%s\n", o.Name, delimiter, o.Value, delimiter)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PackagesConfig describes the packages of a monorepo, each attested in its
+// own provenance Statement.
+type PackagesConfig struct {
+	Packages []Package `json:"packages"`
+}
+
+type Package struct {
+	Name string `json:"name"`
+	// Artifacts are filepath.Match patterns of the package's files or
+	// directories, relative to the working directory.
+	Artifacts []string `json:"artifacts"`
+	// OutputPath defaults to "<name>.provenance", and may be a template as
+	// --output_path may, with the package name as the fallback name.
+	OutputPath string `json:"output_path"`
+}
+
+func readPackagesConfig(path string) (*PackagesConfig, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &PackagesConfig{}
+	if err := json.Unmarshal(contents, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i, p := range cfg.Packages {
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("package %d of %s has no name", i, path)
+		case seen[p.Name]:
+			return nil, fmt.Errorf("package %s is listed twice in %s", p.Name, path)
+		case len(p.Artifacts) == 0:
+			return nil, fmt.Errorf("package %s in %s has no artifacts", p.Name, path)
+		}
+		seen[p.Name] = true
+		if p.OutputPath == "" {
+			cfg.Packages[i].OutputPath = p.Name + ".provenance"
+		}
+	}
+	return cfg, nil
+}
+
+// packageSubjects hashes the files matched by the artifact patterns of p.
+func packageSubjects(p Package, opts Options, findings *Findings) ([]Subject, error) {
+	var all []Subject
+	for _, pattern := range p.Artifacts {
+		matches, err := filepath.Glob(normalizeInputPath(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", p.Name, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("package %s: no artifacts match %s", p.Name, pattern)
+		}
+		for _, m := range matches {
+			s, err := subjects([]artifactRoot{{Path: m}}, opts, findings)
+			if err != nil {
+				return nil, fmt.Errorf("package %s: %w", p.Name, err)
+			}
+			all = append(all, s...)
+		}
+	}
+	return all, nil
+}
+
+// emitPackages generates one provenance Statement per package in the config:
+// the predicate, and the context parsing and lookups behind it, are shared
+// and only the subjects differ.
+func emitPackages(path string, opts Options) {
+	cfg, err := readPackagesConfig(path)
+	if err != nil {
+		fmt.Printf("Failed to read packages config: %s\n", err)
+		os.Exit(1)
+	}
+	shared, findings, err := generate(opts)
+	if err != nil {
+		findings.report(opts.Severities)
+		fmt.Printf("Failed to generate provenance: %s\n", err)
+		os.Exit(1)
+	}
+	if opts.Workspace == "" {
+		opts.Workspace = "."
+	}
+	opts.Workspace = normalizeInputPath(opts.Workspace)
+	statements := make([]Statement, len(cfg.Packages))
+	for i, p := range cfg.Packages {
+		subjects, err := packageSubjects(p, opts, &findings)
+		if err == nil {
+			subjects, err = resolveCollisions(subjects, opts.OnCollision, &findings)
+		}
+		if err != nil {
+			findings.report(opts.Severities)
+			fmt.Printf("Failed to generate provenance: %s\n", err)
+			os.Exit(1)
+		}
+		statements[i] = *shared
+		statements[i].Subject = subjects
+		if opts.Reproducible {
+			sortStatement(&statements[i])
+		}
+	}
+	findings.report(opts.Severities)
+	// Hashing the packages may have added findings, e.g. workspace escapes.
+	if codes := findings.failing(opts.Severities, opts.FailOn); len(codes) > 0 {
+		fmt.Printf("Failed to generate provenance: findings configured to fail the run: %s\n", strings.Join(codes, ", "))
+		os.Exit(1)
+	}
+	var written []string
+	for i, p := range cfg.Packages {
+		path, err := expandOutputPath(p.OutputPath, &statements[i], p.Name, opts)
+		if err != nil {
+			fmt.Printf("Failed to name provenance for package %s: %s\n", p.Name, err)
+			os.Exit(1)
+		}
+		payload, err := writeStatement(&statements[i], path, opts)
+		if err != nil {
+			fmt.Printf("Failed to write provenance for package %s: %s\n", p.Name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote provenance for package %s: %s\n", p.Name, path)
+		written = append(written, outputFiles(path, payload)...)
+	}
+	emitTar(written, opts)
+	opts.Timing.print()
+}
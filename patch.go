@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchOperation is an operation of a JSON Patch (RFC 6902), applied to the
+// provenance before it is written with --patch.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// readPatch reads the JSON Patch at path and checks that it leaves the
+// statement type and subjects alone: those identify what is attested, and
+// the subjects differ between the shards the patch is applied to.
+func readPatch(path string) ([]PatchOperation, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(contents, &ops); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%s: operation %d (%s) has no value", path, i, op.Op)
+			}
+		case "remove":
+		case "move", "copy":
+			if _, err := splitPointer(op.From); err != nil {
+				return nil, fmt.Errorf("%s: operation %d (%s): %w", path, i, op.Op, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: operation %d has unknown op %q", path, i, op.Op)
+		}
+		tokens, err := splitPointer(op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: operation %d (%s): %w", path, i, op.Op, err)
+		}
+		protected := func(tokens []string) bool {
+			return len(tokens) == 0 || tokens[0] == "_type" || tokens[0] == "subject"
+		}
+		from, _ := splitPointer(op.From)
+		if op.Op != "test" && (protected(tokens) || op.Op == "move" && protected(from)) {
+			return nil, fmt.Errorf("%s: operation %d (%s) may not change the statement type or subjects", path, i, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// applyPatch applies ops, in order, to the JSON document doc.
+func applyPatch(doc []byte, ops []PatchOperation) ([]byte, error) {
+	var root interface{}
+	if err := decodeJSON(doc, &root); err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		var err error
+		if root, err = applyOperation(root, op); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyOperation(root interface{}, op PatchOperation) (interface{}, error) {
+	tokens, _ := splitPointer(op.Path)
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if err := decodeJSON(op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, _ := splitPointer(op.From)
+		v, err := getPointer(root, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// Copy the value, so that later operations on either location
+			// don't affect the other.
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			if err := decodeJSON(b, &v); err != nil {
+				return nil, err
+			}
+		} else {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("a value can't be moved into itself")
+			}
+			if root, err = updatePointer(root, from, removeValue); err != nil {
+				return nil, err
+			}
+		}
+		value = v
+	}
+	switch op.Op {
+	case "add", "move", "copy":
+		return updatePointer(root, tokens, func(parent interface{}, key string) (interface{}, error) {
+			return addValue(parent, key, value)
+		})
+	case "remove":
+		return updatePointer(root, tokens, removeValue)
+	case "replace":
+		return updatePointer(root, tokens, func(parent interface{}, key string) (interface{}, error) {
+			parent, err := removeValue(parent, key)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(parent, key, value)
+		})
+	default: // test
+		v, err := getPointer(root, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, value) {
+			return nil, errors.New("test failed")
+		}
+		return root, nil
+	}
+}
+
+// decodeJSON decodes b into v, keeping numbers as json.Number so that they
+// are written back unchanged.
+func decodeJSON(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// splitPointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("JSON pointer %q doesn't start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getPointer(node interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", t)
+			}
+			node = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("can't look up %q in a scalar", t)
+		}
+	}
+	return node, nil
+}
+
+// updatePointer replaces the parent of the value at tokens with the result
+// of fn, which is passed the parent and the last token, and returns the
+// updated node.
+func updatePointer(node interface{}, tokens []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("the whole document can't be patched")
+	}
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", tokens[0])
+		}
+		updated, err := updatePointer(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[tokens[0]] = updated
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updatePointer(n[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	default:
+		return nil, fmt.Errorf("can't look up %q in a scalar", tokens[0])
+	}
+}
+
+func addValue(parent interface{}, key string, value interface{}) (interface{}, error) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[key] = value
+		return p, nil
+	case []interface{}:
+		if key == "-" {
+			return append(p, value), nil
+		}
+		i, err := arrayIndex(key, len(p))
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = value
+		return p, nil
+	default:
+		return nil, fmt.Errorf("can't add %q to a scalar", key)
+	}
+}
+
+func removeValue(parent interface{}, key string) (interface{}, error) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[key]; !ok {
+			return nil, fmt.Errorf("no member %q", key)
+		}
+		delete(p, key)
+		return p, nil
+	case []interface{}:
+		i, err := arrayIndex(key, len(p)-1)
+		if err != nil {
+			return nil, err
+		}
+		return append(p[:i], p[i+1:]...), nil
+	default:
+		return nil, fmt.Errorf("can't remove %q from a scalar", key)
+	}
+}
+
+// arrayIndex parses an array index token, which must be at most max.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || strings.Trim(token, "0123456789") != "" || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d is out of bounds", i)
+	}
+	return i, nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// normalizeInputPath is a no-op outside Windows.
+func normalizeInputPath(p string) string {
+	return p
+}
@@ -0,0 +1,17 @@
+package main
+
+import "strings"
+
+// normalizeInputPath strips the \\?\ prefix from long and UNC paths, so that
+// filepath.Rel, filepath.EvalSymlinks and the workspace checks treat them like
+// any other absolute path. The os package re-adds the prefix itself when it
+// is needed to access long paths.
+func normalizeInputPath(p string) string {
+	switch {
+	case strings.HasPrefix(p, `\\?\UNC\`):
+		return `\\` + p[len(`\\?\UNC\`):]
+	case strings.HasPrefix(p, `\\?\`):
+		return p[len(`\\?\`):]
+	}
+	return p
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeInputPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{`C:\a\dist`, `C:\a\dist`},
+		{`\\?\C:\a\dist`, `C:\a\dist`},
+		{`\\?\UNC\server\share\dist`, `\\server\share\dist`},
+		{`\\server\share\dist`, `\\server\share\dist`},
+		{`dist\app.exe`, `dist\app.exe`},
+		{`\\?\`, ``},
+	}
+	for _, tt := range tests {
+		if got := normalizeInputPath(tt.path); got != tt.want {
+			t.Errorf("normalizeInputPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// writeTree writes the files of names, with forward slashes, under dir.
+func writeTree(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSubjectNamesUseForwardSlashes(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, "dist/app.exe", "dist/windows/amd64/app.exe", "dist/lib/app.dll")
+	dist := filepath.Join(dir, "dist")
+	for _, root := range []string{dist, `\\?\` + dist} {
+		roots, err := expandArtifactPaths([]string{root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var findings Findings
+		s, err := subjects(roots, Options{Workspace: normalizeInputPath(root), OnEscape: EscapeError}, &findings)
+		if err != nil {
+			t.Fatalf("subjects(%s): %v", root, err)
+		}
+		var names []string
+		for _, subject := range s {
+			names = append(names, subject.Name)
+		}
+		want := []string{"app.exe", "lib/app.dll", "windows/amd64/app.exe"}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("subjects(%s) are named %q, want %q", root, names, want)
+		}
+	}
+}
+
+func TestGlobSubjectNames(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, "dist/py3/app.whl", "dist/py2/app.whl", "dist/app.tar.gz")
+	roots, err := expandArtifactPaths([]string{filepath.Join(dir, "dist") + `\**\*.whl`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings Findings
+	s, err := subjects(roots, Options{Workspace: dir, OnEscape: EscapeError}, &findings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, subject := range s {
+		names = append(names, subject.Name)
+	}
+	want := []string{"py2/app.whl", "py3/app.whl"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("subjects are named %q, want %q", names, want)
+	}
+}
+
+func TestWorkspaceLongPath(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, "ws/dist/app.exe", "other/app.exe")
+	ws, err := newWorkspace(normalizeInputPath(`\\?\`+filepath.Join(dir, "ws")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings Findings
+	if err := ws.check(normalizeInputPath(`\\?\`+filepath.Join(dir, "ws", "dist", "app.exe")), EscapeError, &findings); err != nil {
+		t.Errorf("check of a file in the workspace: %v", err)
+	}
+	if err := ws.check(filepath.Join(dir, "ws", "..", "other", "app.exe"), EscapeError, &findings); err == nil {
+		t.Error("check of a file outside the workspace succeeded")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	usesPattern  = regexp.MustCompile(`^\s*(?:-\s+)?uses:\s*['"]?([^'"\s#]+)`)
+	commitSHARef = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// unpinnedActions returns the actions and reusable workflows the workflow
+// file at path uses by a tag or branch rather than a commit SHA, in the
+// order they appear. A tag can be moved to other code after the build, so
+// only a SHA pins what ran. Local actions and images pinned by digest are
+// pinned by the commit or the digest.
+func unpinnedActions(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var unpinned []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := usesPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		uses := m[1]
+		switch {
+		case strings.HasPrefix(uses, "./"):
+			continue
+		case strings.HasPrefix(uses, "docker://"):
+			if strings.Contains(uses, "@sha256:") {
+				continue
+			}
+		default:
+			if at := strings.LastIndex(uses, "@"); at >= 0 && commitSHARef.MatchString(uses[at+1:]) {
+				continue
+			}
+		}
+		if !seen[uses] {
+			seen[uses] = true
+			unpinned = append(unpinned, uses)
+		}
+	}
+	return unpinned, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PolicyPayloadType is the DSSE payload type of a signed verifyPolicy.
+const PolicyPayloadType = "application/vnd.slsa-framework.verify-policy+json"
+
+// PolicyArtifactType is the OCI artifact type of policy bundles: manifests
+// whose only layer is the signed policy envelope.
+const PolicyArtifactType = "application/vnd.slsa-framework.verify-policy.v1+json"
+
+// MediaTypeDSSE is the media type of a DSSE envelope stored in a registry.
+const MediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+
+// parseOCIReference splits an oci://<repository>[:<tag>|@<digest>] reference
+// into its repository and tag or digest, which defaults to latest.
+func parseOCIReference(ref string) (string, string, error) {
+	if !strings.HasPrefix(ref, "oci://") {
+		return "", "", fmt.Errorf("%q is not an oci:// reference", ref)
+	}
+	ref = ref[len("oci://"):]
+	repo := imageRepository(ref)
+	if repo == "" {
+		return "", "", fmt.Errorf("oci://%s has no repository", ref)
+	}
+	reference := strings.TrimLeft(ref[len(repo):], ":@")
+	if reference == "" {
+		reference = "latest"
+	}
+	return repo, reference, nil
+}
+
+// loadPolicy reads the policy bundle at source, a path or an oci:// reference,
+// and checks that it is signed by verifier.
+func loadPolicy(source string, verifier Verifier) (*verifyPolicy, error) {
+	var contents []byte
+	var err error
+	if strings.HasPrefix(source, "oci://") {
+		if err := requireOnline("an oci:// --policy"); err != nil {
+			return nil, err
+		}
+		contents, err = pullPolicy(newRegistryClient(), source)
+	} else {
+		contents, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := openEnvelope(contents, source, PolicyPayloadType, verifier)
+	if err != nil {
+		return nil, err
+	}
+	policy := &verifyPolicy{}
+	if err := json.Unmarshal(payload, policy); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", source, err)
+	}
+	return policy, nil
+}
+
+// pullPolicy fetches the policy envelope of the policy bundle at ref.
+func pullPolicy(c *registryClient, ref string) ([]byte, error) {
+	repo, reference, err := parseOCIReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := c.manifest(repo, reference)
+	if err != nil {
+		return nil, err
+	}
+	m := artifactManifest{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("parsing the manifest of %s: %w", ref, err)
+	}
+	if m.ArtifactType != PolicyArtifactType {
+		return nil, fmt.Errorf("%s has artifact type %q, want %q", ref, m.ArtifactType, PolicyArtifactType)
+	}
+	for _, l := range m.Layers {
+		if l.MediaType == MediaTypeDSSE {
+			return c.blob(repo, l.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%s has no %s layer", ref, MediaTypeDSSE)
+}
+
+// pushPolicy pushes the policy envelope to ref as a policy bundle and
+// returns the digest of its manifest.
+func pushPolicy(c *registryClient, ref string, envelope []byte) (string, error) {
+	repo, reference, err := parseOCIReference(ref)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(envelope)
+	layer := Descriptor{MediaType: MediaTypeDSSE, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(envelope))}
+	if err := c.pushBlob(repo, emptyDescriptor.Digest, []byte("{}")); err != nil {
+		return "", err
+	}
+	if err := c.pushBlob(repo, layer.Digest, envelope); err != nil {
+		return "", err
+	}
+	manifest, err := json.Marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  PolicyArtifactType,
+		Config:        emptyDescriptor,
+		Layers:        []Descriptor{layer},
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.putManifest(repo, reference, MediaTypeOCIManifest, manifest); err != nil {
+		return "", err
+	}
+	sum = sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// policyMain implements `policy --key <key> --policy <file> [--push
+// oci://<repository>:<tag>]`, signing a policy for verify --policy and
+// optionally publishing it to a registry.
+func policyMain(args []string) {
+	flags := flag.NewFlagSet("policy", flag.ExitOnError)
+	keyPath := flags.String("key", "", "The PEM private key to sign the policy with.")
+	policyPath := flags.String("policy", "", "The JSON policy to sign, with trusted_builders and revocations.")
+	outputPath := flags.String("output_path", "policy.dsse", "Path to write the signed policy to.")
+	push := flags.String("push", "", "An oci://<repository>:<tag> reference to push the signed policy to as a policy bundle.")
+	addOfflineFlag(flags)
+	cloudAuth := addCloudAuthFlags(flags)
+	flags.Parse(args)
+	if *keyPath == "" || *policyPath == "" {
+		fmt.Println("Both --key and --policy are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *push != "" {
+		if err := requireOnline("--push"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	contents, err := ioutil.ReadFile(*policyPath)
+	if err != nil {
+		fmt.Printf("Failed to read policy: %s\n", err)
+		os.Exit(1)
+	}
+	policy := verifyPolicy{}
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		fmt.Printf("Failed to parse policy: %s\n", err)
+		os.Exit(1)
+	}
+	// As with revocation lists, sign the policy as parsed.
+	payload, err := json.Marshal(policy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	env, err := signEnvelope(PolicyPayloadType, payload, signer)
+	if err != nil {
+		fmt.Printf("Failed to sign policy: %s\n", err)
+		os.Exit(1)
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*outputPath, out, 0644); err != nil {
+		fmt.Printf("Failed to write policy: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signed policy of %d trusted builders: %s\n", len(policy.TrustedBuilders), *outputPath)
+	if *push != "" {
+		digest, err := pushPolicy(newRegistryClient(), *push, out)
+		if err != nil {
+			fmt.Printf("Failed to push policy: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Pushed policy bundle to %s: %s\n", *push, digest)
+	}
+}
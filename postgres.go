@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// pgConn is a minimal PostgreSQL client speaking the extended query
+// protocol, with text parameters and results, over plain TCP or TLS. It
+// authenticates with SCRAM-SHA-256, MD5 or cleartext passwords. The store
+// runs a handful of statements, so, like the NATS, registry and S3 clients,
+// it speaks the protocol itself rather than add a driver, and its
+// dependencies, to a tool run with the credentials of release builds.
+// See https://www.postgresql.org/docs/current/protocol.html
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// status is the transaction status of the last ReadyForQuery: 'I'
+	// when idle, 'T' in a transaction and 'E' in a failed one.
+	status byte
+}
+
+// pgError is an ErrorResponse of the server.
+type pgError struct {
+	Code    string
+	Message string
+}
+
+func (e *pgError) Error() string {
+	return fmt.Sprintf("postgres: %s (SQLSTATE %s)", e.Message, e.Code)
+}
+
+const (
+	pgProtocolVersion = 3 << 16
+	pgSSLRequestCode  = 80877103
+)
+
+// dialPostgres connects to the database of a
+// postgres://[user[:password]@]host[:port]/database[?sslmode=...] URL.
+// The user and password default to $PGUSER and $PGPASSWORD, and sslmode is
+// as pgTLSConfig takes it.
+func dialPostgres(u *url.URL) (*pgConn, error) {
+	user, password := os.Getenv("PGUSER"), os.Getenv("PGPASSWORD")
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if user == "" {
+		return nil, errors.New("postgres store URL must name a user, e.g. postgres://provenance@localhost/provenance")
+	}
+	database := strings.TrimPrefix(u.Path, "/")
+	if database == "" {
+		database = user
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	tlsConfig, err := pgTLSConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		var request [8]byte
+		binary.BigEndian.PutUint32(request[:4], 8)
+		binary.BigEndian.PutUint32(request[4:], pgSSLRequestCode)
+		var answer [1]byte
+		if _, err = conn.Write(request[:]); err == nil {
+			_, err = io.ReadFull(conn, answer[:])
+		}
+		switch {
+		case err != nil:
+			conn.Close()
+			return nil, err
+		case answer[0] == 'S':
+			tc := tls.Client(conn, tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tc
+		default:
+			conn.Close()
+			return nil, fmt.Errorf("postgres server at %s doesn't support TLS, which sslmode=%s requires", host, u.Query().Get("sslmode"))
+		}
+	}
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.startup(user, password, database); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pgTLSConfig returns the TLS configuration of the sslmode of u, or nil with
+// sslmode=disable. The server's certificate is verified against the system
+// roots, or those of sslrootcert: with "verify-full", the default, it must
+// also name the host, while "require" and "verify-ca" only verify its chain.
+// The password and the attestations would otherwise cross the network to
+// whoever answers, so, unlike libpq, "require" verifies the chain, and
+// "allow" and "prefer", which fall back to plaintext, aren't supported.
+func pgTLSConfig(u *url.URL) (*tls.Config, error) {
+	q := u.Query()
+	mode := q.Get("sslmode")
+	if mode == "" {
+		mode = "verify-full"
+	}
+	var roots *x509.CertPool
+	if path := q.Get("sslrootcert"); path != "" {
+		var err error
+		if roots, err = readRoots(path); err != nil {
+			return nil, err
+		}
+	}
+	switch mode {
+	case "disable":
+		return nil, nil
+	case "require", "verify-ca":
+		return &tls.Config{
+			// Verified by VerifyConnection instead, without the host name.
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return errors.New("postgres: the server sent no certificate")
+				}
+				intermediates := x509.NewCertPool()
+				for _, c := range cs.PeerCertificates[1:] {
+					intermediates.AddCert(c)
+				}
+				_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+				return err
+			},
+		}, nil
+	case "verify-full":
+		return &tls.Config{ServerName: u.Hostname(), RootCAs: roots}, nil
+	case "allow", "prefer":
+		return nil, fmt.Errorf("sslmode=%s may fall back to plaintext, which isn't supported; use verify-full, or disable explicitly", mode)
+	default:
+		return nil, fmt.Errorf("unsupported sslmode %q", mode)
+	}
+}
+
+// send writes a message of type typ, or the startup message if typ is 0.
+func (c *pgConn) send(typ byte, body []byte) error {
+	msg := make([]byte, 0, len(body)+5)
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)+4))
+	msg = append(append(msg, length[:]...), body...)
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// receive reads the next message, returning ErrorResponses as errors.
+func (c *pgConn) receive() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n < 4 || n > 1<<30 {
+		return 0, nil, fmt.Errorf("postgres: malformed message of length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	if head[0] == 'E' {
+		return head[0], body, parsePGError(body)
+	}
+	return head[0], body, nil
+}
+
+func parsePGError(body []byte) error {
+	e := &pgError{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		switch field {
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		}
+		body = body[2+end:]
+	}
+	return e
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func (c *pgConn) startup(user, password, database string) error {
+	var body []byte
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], pgProtocolVersion)
+	body = append(body, version[:]...)
+	for _, kv := range [][2]string{{"user", user}, {"database", database}, {"application_name", "create_provenance"}, {"client_encoding", "UTF8"}} {
+		body = append(append(body, cstring(kv[0])...), cstring(kv[1])...)
+	}
+	if err := c.send(0, append(body, 0)); err != nil {
+		return err
+	}
+	var scram *scramClient
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(msg) < 4 {
+				return errors.New("postgres: malformed authentication request")
+			}
+			switch code := binary.BigEndian.Uint32(msg); code {
+			case 0:
+			case 3:
+				err = c.send('p', cstring(password))
+			case 5:
+				if len(msg) < 8 {
+					return errors.New("postgres: malformed MD5 authentication request")
+				}
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), msg[4:8]...))
+				err = c.send('p', cstring("md5"+hex.EncodeToString(outer[:])))
+			case 10:
+				if !strings.Contains(string(msg[4:]), "SCRAM-SHA-256\x00") {
+					return errors.New("postgres: the server offers no supported SASL mechanism")
+				}
+				if scram, err = newSCRAMClient(password); err != nil {
+					return err
+				}
+				first := scram.first()
+				var length [4]byte
+				binary.BigEndian.PutUint32(length[:], uint32(len(first)))
+				err = c.send('p', append(append(cstring("SCRAM-SHA-256"), length[:]...), first...))
+			case 11:
+				if scram == nil {
+					return errors.New("postgres: unexpected SASL continuation")
+				}
+				var final []byte
+				if final, err = scram.final(msg[4:]); err == nil {
+					err = c.send('p', final)
+				}
+			case 12:
+				if scram == nil {
+					return errors.New("postgres: unexpected SASL completion")
+				}
+				err = scram.verify(msg[4:])
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'Z':
+			return nil
+		}
+	}
+}
+
+// exec runs query with the text parameters args, returning the text columns
+// of the rows it returns.
+func (c *pgConn) exec(query string, args ...string) ([][]string, error) {
+	var parse []byte
+	parse = append(append(append(parse, 0), cstring(query)...), 0, 0)
+	bind := []byte{0, 0, 0, 0}
+	var n [4]byte
+	binary.BigEndian.PutUint16(n[:2], uint16(len(args)))
+	bind = append(bind, n[:2]...)
+	for _, a := range args {
+		binary.BigEndian.PutUint32(n[:], uint32(len(a)))
+		bind = append(append(bind, n[:]...), a...)
+	}
+	bind = append(bind, 0, 0)
+	for _, m := range []struct {
+		typ  byte
+		body []byte
+	}{{'P', parse}, {'B', bind}, {'E', []byte{0, 0, 0, 0, 0}}, {'S', nil}} {
+		if err := c.send(m.typ, m.body); err != nil {
+			return nil, err
+		}
+	}
+	var rows [][]string
+	var failed error
+	for {
+		typ, msg, err := c.receive()
+		var pgErr *pgError
+		if errors.As(err, &pgErr) {
+			// The server skips to the Sync, after which it's ready again.
+			failed = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'D':
+			row, err := parseDataRow(msg)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		case 'Z':
+			if len(msg) == 1 {
+				c.status = msg[0]
+			}
+			return rows, failed
+		}
+	}
+}
+
+func parseDataRow(msg []byte) ([]string, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("postgres: malformed data row")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	row := make([]string, n)
+	for i := range row {
+		if len(msg) < 4 {
+			return nil, errors.New("postgres: malformed data row")
+		}
+		size := int32(binary.BigEndian.Uint32(msg))
+		msg = msg[4:]
+		if size < 0 {
+			continue
+		}
+		if int(size) > len(msg) {
+			return nil, errors.New("postgres: malformed data row")
+		}
+		row[i], msg = string(msg[:size]), msg[size:]
+	}
+	return row, nil
+}
+
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+// scramClient authenticates with SCRAM-SHA-256 (RFC 7677). The user name is
+// left empty, as PostgreSQL takes it from the startup message.
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string
+	authMessage string
+	salted      []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+func (s *scramClient) first() []byte {
+	s.firstBare = "n=,r=" + s.nonce
+	return []byte("n,," + s.firstBare)
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func (s *scramClient) final(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			fmt.Sscanf(attr[2:], "%d", &iterations)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations < 1 {
+		return nil, errors.New("postgres: malformed SCRAM server-first-message")
+	}
+	s.salted = pbkdf2.Key([]byte(s.password), saltBytes, iterations, sha256.Size, sha256.New)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.firstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey := hmacSHA256(s.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server's signature, proving it knows the password too.
+func (s *scramClient) verify(serverFinal []byte) error {
+	want := hmacSHA256(hmacSHA256(s.salted, "Server Key"), s.authMessage)
+	got, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(serverFinal), "v="))
+	if err != nil || !hmac.Equal(got, want) {
+		return errors.New("postgres: the server's SCRAM signature doesn't match")
+	}
+	return nil
+}
+
+// pgStore stores provenance in two tables, created if they don't exist:
+// provenance_attestations, with the contents of each attestation, and
+// provenance_subjects, indexing them by subject digest.
+type pgStore struct {
+	c *pgConn
+}
+
+var pgSchema = []string{
+	`CREATE TABLE IF NOT EXISTS provenance_attestations (
+		digest text PRIMARY KEY,
+		repository text NOT NULL,
+		builder_id text NOT NULL,
+		created timestamptz NOT NULL,
+		contents text NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS provenance_attestations_repository ON provenance_attestations (repository)`,
+	`CREATE TABLE IF NOT EXISTS provenance_subjects (
+		subject text NOT NULL,
+		attestation text NOT NULL REFERENCES provenance_attestations (digest),
+		PRIMARY KEY (subject, attestation)
+	)`,
+}
+
+func dialPostgresStore(u *url.URL) (Store, error) {
+	c, err := dialPostgres(u)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range pgSchema {
+		if _, err := c.exec(stmt); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &pgStore{c: c}, nil
+}
+
+// Put inserts the attestation and its subjects in a single transaction, so
+// that a failure leaves neither.
+func (s *pgStore) Put(a StoredAttestation) error {
+	if _, err := s.c.exec("BEGIN"); err != nil {
+		return err
+	}
+	if s.c.status != 'T' {
+		return fmt.Errorf("postgres: BEGIN left transaction status %q", s.c.status)
+	}
+	err := s.put(a)
+	if err != nil {
+		s.c.exec("ROLLBACK")
+		return err
+	}
+	// COMMIT of a failed transaction rolls it back without an error.
+	if _, err = s.c.exec("COMMIT"); err == nil && s.c.status != 'I' {
+		err = fmt.Errorf("postgres: COMMIT left transaction status %q", s.c.status)
+	}
+	return err
+}
+
+func (s *pgStore) put(a StoredAttestation) error {
+	_, err := s.c.exec(`INSERT INTO provenance_attestations (digest, repository, builder_id, created, contents)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (digest) DO NOTHING`,
+		a.Digest, a.Repository, a.BuilderId, a.Created.Format(time.RFC3339Nano), string(a.Contents))
+	if err != nil {
+		return err
+	}
+	for _, d := range a.Subjects {
+		_, err := s.c.exec(`INSERT INTO provenance_subjects (subject, attestation) VALUES ($1, $2) ON CONFLICT DO NOTHING`, d, a.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pgSelect is the columns query reads the attestations from.
+const pgSelect = `SELECT a.digest, to_char(a.created AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'), a.contents FROM provenance_attestations a `
+
+func (s *pgStore) query(where string, arg string) ([]StoredAttestation, error) {
+	rows, err := s.c.exec(pgSelect+where+" ORDER BY a.created, a.digest", arg)
+	if err != nil {
+		return nil, err
+	}
+	var attestations []StoredAttestation
+	for _, row := range rows {
+		if len(row) != 3 {
+			return nil, errors.New("postgres: unexpected columns")
+		}
+		created, err := time.Parse(time.RFC3339Nano, row[1])
+		if err != nil {
+			return nil, fmt.Errorf("postgres: attestation %s: %w", row[0], err)
+		}
+		a, err := storedAttestation([]byte(row[2]), "attestation "+row[0], created)
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a)
+	}
+	return attestations, nil
+}
+
+func (s *pgStore) BySubject(digest string) ([]StoredAttestation, error) {
+	if !hexDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("malformed sha256 digest %q", digest)
+	}
+	return s.query("JOIN provenance_subjects s ON s.attestation = a.digest WHERE s.subject = $1", digest)
+}
+
+func (s *pgStore) ByRepository(repo string) ([]StoredAttestation, error) {
+	if repo = normalizeRepository(repo); repo == "" {
+		return nil, errors.New("no repository given")
+	}
+	return s.query("WHERE a.repository = $1", repo)
+}
+
+func (s *pgStore) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPGTLSConfig(t *testing.T) {
+	tests := []struct {
+		url      string
+		wantTLS  bool
+		wantHost string
+		wantErr  string
+	}{
+		{"postgres://u@db.internal/p", true, "db.internal", ""},
+		{"postgres://u@db.internal/p?sslmode=verify-full", true, "db.internal", ""},
+		{"postgres://u@db.internal/p?sslmode=verify-ca", true, "", ""},
+		{"postgres://u@db.internal/p?sslmode=require", true, "", ""},
+		{"postgres://u@db.internal/p?sslmode=disable", false, "", ""},
+		{"postgres://u@db.internal/p?sslmode=prefer", false, "", "fall back to plaintext"},
+		{"postgres://u@db.internal/p?sslmode=allow", false, "", "fall back to plaintext"},
+		{"postgres://u@db.internal/p?sslmode=other", false, "", "unsupported sslmode"},
+		{"postgres://u@db.internal/p?sslrootcert=/nonexistent", false, "", "nonexistent"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := pgTLSConfig(u)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("pgTLSConfig(%s) = %v, want an error containing %q", tt.url, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("pgTLSConfig(%s) = %v", tt.url, err)
+		case (config != nil) != tt.wantTLS:
+			t.Errorf("pgTLSConfig(%s) = %v, want TLS %v", tt.url, config, tt.wantTLS)
+		case config == nil:
+		case config.ServerName != tt.wantHost:
+			t.Errorf("pgTLSConfig(%s) verifies host %q, want %q", tt.url, config.ServerName, tt.wantHost)
+		case config.InsecureSkipVerify && config.VerifyConnection == nil:
+			t.Errorf("pgTLSConfig(%s) doesn't verify the server", tt.url)
+		}
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	// The example of RFC 7677, section 3, whose user name is sent in the
+	// client-first-message, unlike PostgreSQL's.
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO", firstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	final, err := s.final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; string(final) != want {
+		t.Errorf("final() = %s, want %s", final, want)
+	}
+	if err := s.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Error(err)
+	}
+	if err := s.verify([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Error("verify() accepted the wrong server signature")
+	}
+}
+
+// fakePostgres answers the extended queries of a pgConn, tracking the
+// transaction status, and failing the statements containing fail.
+type fakePostgres struct {
+	conn    net.Conn
+	fail    string
+	queries []string
+}
+
+func (f *fakePostgres) serve() {
+	r := bufio.NewReader(f.conn)
+	status, failed := byte('I'), false
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(head[1:])-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch head[0] {
+		case 'P':
+			query := strings.SplitN(string(body[1:]), "\x00", 2)[0]
+			f.queries = append(f.queries, query)
+			switch {
+			case status == 'E' && query != "ROLLBACK":
+				failed = true
+			case f.fail != "" && strings.Contains(query, f.fail):
+				failed = true
+				if status == 'T' {
+					status = 'E'
+				}
+			case query == "BEGIN":
+				status = 'T'
+			case query == "COMMIT", query == "ROLLBACK":
+				status = 'I'
+			}
+		case 'S':
+			if failed {
+				f.send('E', "SERROR\x00C23505\x00Mfailed\x00\x00")
+				failed = false
+			} else {
+				f.send('C', "OK\x00")
+			}
+			f.send('Z', string(status))
+		case 'X':
+			return
+		}
+	}
+}
+
+func (f *fakePostgres) send(typ byte, body string) {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	f.conn.Write(append(msg, body...))
+}
+
+func TestPGStorePutIsTransactional(t *testing.T) {
+	a := StoredAttestation{Digest: "aa", Repository: "https://github.com/o/r", Created: time.Unix(0, 0), Subjects: []string{"bb", "cc"}, Contents: []byte("{}")}
+	tests := []struct {
+		fail    string
+		wantErr bool
+		want    []string
+	}{
+		{"", false, []string{"BEGIN", "provenance_attestations", "provenance_subjects", "provenance_subjects", "COMMIT"}},
+		{"provenance_subjects", true, []string{"BEGIN", "provenance_attestations", "provenance_subjects", "ROLLBACK"}},
+		{"COMMIT", true, []string{"BEGIN", "provenance_attestations", "provenance_subjects", "provenance_subjects", "COMMIT"}},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		f := &fakePostgres{conn: server, fail: tt.fail}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f.serve()
+		}()
+		s := &pgStore{c: &pgConn{conn: client, r: bufio.NewReader(client)}}
+		err := s.Put(a)
+		s.Close()
+		<-done
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Put() failing %q = %v, want an error %v", tt.fail, err, tt.wantErr)
+		}
+		var got []string
+		for _, q := range f.queries {
+			switch {
+			case strings.Contains(q, "provenance_attestations"):
+				q = "provenance_attestations"
+			case strings.Contains(q, "provenance_subjects"):
+				q = "provenance_subjects"
+			}
+			got = append(got, q)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Put() failing %q ran %q, want %q", tt.fail, got, tt.want)
+		}
+	}
+}
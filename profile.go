@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// DefaultConfigPath is where --profile looks for the config file.
+const DefaultConfigPath = ".github/provenance.json"
+
+// Config is the config file of --config, whose named profiles bundle the
+// settings of a kind of provenance, e.g. of open source releases or internal
+// nightly builds, so that workflows only select one.
+type Config struct {
+	// Profiles map profile names to flags, by name without the leading
+	// dashes, and their values: strings, booleans, numbers, or arrays of
+	// strings for comma-separated lists.
+	Profiles map[string]map[string]json.RawMessage `json:"profiles"`
+}
+
+// profileExcluded are the flags a profile can't set: those describing the
+// run, and those selecting the profile.
+var profileExcluded = map[string]bool{
+	"config":         true,
+	"profile":        true,
+	"github_context": true,
+	"runner_context": true,
+	"job_context":    true,
+}
+
+func readConfig(path string) (*Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(contents, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// profileValues returns the flag values of v, a profile setting: the items of
+// a list, or else the one value.
+func profileValues(v json.RawMessage) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(v))
+	d.UseNumber()
+	var value interface{}
+	if err := d.Decode(&value); err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{fmt.Sprint(v)}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("lists may only hold strings, not %v", item)
+			}
+			items = append(items, s)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%s isn't a string, boolean, number or list of strings", v)
+}
+
+// applyProfile sets the flags of flags to the values of the profile name of
+// the config file at path. Flags given other values than their defaults on
+// the command line keep them, so that a workflow can override a setting of
+// its profile, but the action passing every input, unset inputs included,
+// doesn't.
+func applyProfile(flags *flag.FlagSet, path, name string) error {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(cfg.Profiles))
+		for n := range cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("%s has no profile %q (profiles: %s)", path, name, strings.Join(names, ", "))
+	}
+	keys := make([]string, 0, len(profile))
+	for k := range profile {
+		keys = append(keys, k)
+	}
+	// Flags are set in name order, so that errors are reported the same way
+	// each time.
+	sort.Strings(keys)
+	for _, k := range keys {
+		f := flags.Lookup(k)
+		if f == nil {
+			return fmt.Errorf("profile %s sets unknown flag %q", name, k)
+		}
+		if profileExcluded[k] {
+			return fmt.Errorf("profile %s can't set --%s", name, k)
+		}
+		values, err := profileValues(profile[k])
+		if err != nil {
+			return fmt.Errorf("profile %s: --%s: %w", name, k, err)
+		}
+		if f.Value.String() != f.DefValue {
+			continue
+		}
+		// Flags that may be given several times are set once per item, and
+		// the others to the comma-separated list.
+		if _, ok := f.Value.(*pathList); !ok {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			if err := flags.Set(k, value); err != nil {
+				return fmt.Errorf("profile %s: --%s: %w", name, k, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProtectionRuleEvent is the deployment_protection_rule webhook event GitHub
+// sends the app of a custom deployment protection rule when a deployment to
+// an environment it protects waits for its approval.
+// See https://docs.github.com/en/webhooks/webhook-events-and-payloads#deployment_protection_rule
+type ProtectionRuleEvent struct {
+	Action      string `json:"action"`
+	Environment string `json:"environment"`
+	CallbackURL string `json:"deployment_callback_url"`
+	Deployment  struct {
+		Id      int64           `json:"id"`
+		SHA     string          `json:"sha"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"deployment"`
+	Installation struct {
+		Id int64 `json:"id"`
+	} `json:"installation"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// DeploymentArtifacts are the artifacts a deployment deploys, listed in its
+// payload under "artifacts", e.g. by
+// `gh api repos/<owner>/<repo>/deployments -f environment=production ...`.
+type DeploymentArtifacts struct {
+	// Images are given as <repository>@sha256:<digest>.
+	Images   []string  `json:"images"`
+	Subjects []Subject `json:"subjects"`
+}
+
+// deploymentArtifacts returns the artifacts listed in payload, a deployment
+// payload, which the API returns as an object or, if it was created as
+// one, a string of JSON.
+func deploymentArtifacts(payload json.RawMessage) ([]gateArtifact, error) {
+	var s string
+	if json.Unmarshal(payload, &s) == nil {
+		payload = json.RawMessage(s)
+	}
+	var p struct {
+		Artifacts *DeploymentArtifacts `json:"artifacts"`
+	}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, fmt.Errorf("parsing the deployment payload: %w", err)
+		}
+	}
+	if p.Artifacts == nil || len(p.Artifacts.Images)+len(p.Artifacts.Subjects) == 0 {
+		return nil, errors.New("the deployment payload lists no artifacts")
+	}
+	for _, image := range p.Artifacts.Images {
+		if strings.Contains(image, ",") {
+			return nil, fmt.Errorf("image %q is not of the form <repository>@sha256:<digest>", image)
+		}
+	}
+	artifacts, err := gateArtifacts("", strings.Join(p.Artifacts.Images, ","))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range p.Artifacts.Subjects {
+		if s.Name == "" || !hexDigestPattern.MatchString(s.Digest["sha256"]) {
+			return nil, fmt.Errorf("subject %q has no sha256 digest", s.Name)
+		}
+		artifacts = append(artifacts, gateArtifact{s.Name, s, false})
+	}
+	return artifacts, nil
+}
+
+// githubApp authenticates as a GitHub App, to act on the repositories of
+// its installations.
+type githubApp struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+// loadGitHubApp reads the PEM private key of the app id from keyPath, as
+// downloaded from the app's settings.
+func loadGitHubApp(id, keyPath string) (*githubApp, error) {
+	contents, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s contains no PEM private key", keyPath)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", keyPath, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: GitHub App keys are RSA keys, not %T", keyPath, key)
+	}
+	return &githubApp{id: id, key: rsaKey}, nil
+}
+
+// jwt returns a JSON Web Token authenticating as the app for nine minutes,
+// backdated for clock drift.
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// installationToken returns a token of the installation of the app.
+func (a *githubApp) installationToken(c *githubClient, installation int64) (string, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	app := *c
+	app.token = jwt
+	var t struct {
+		Token string `json:"token"`
+	}
+	if err := app.post(fmt.Sprintf("/app/installations/%d/access_tokens", installation), struct{}{}, &t); err != nil {
+		return "", err
+	}
+	return t.Token, nil
+}
+
+// protectionRule approves deployments to Environments whose artifacts all
+// verify, as gate verifies them, and rejects the others. Deployments to
+// other environments are approved unchecked.
+type protectionRule struct {
+	Environments map[string]bool
+	// StoreDir is re-read for each deployment, so that provenance added to
+	// it since is found.
+	StoreDir string
+	Sources  gateSources
+	Policy   verifyPolicy
+	Verifier Verifier
+	// App, if set, authenticates the callbacks as its installation, and
+	// otherwise Client's token does.
+	App    *githubApp
+	Client *githubClient
+}
+
+// decide returns the state to report for the deployment of e, "approved"
+// or "rejected", with the reasons.
+func (r *protectionRule) decide(e ProtectionRuleEvent) (string, []string) {
+	if !r.Environments[e.Environment] {
+		return "approved", []string{fmt.Sprintf("environment %s is not gated", e.Environment)}
+	}
+	artifacts, err := deploymentArtifacts(e.Deployment.Payload)
+	if err != nil {
+		return "rejected", []string{err.Error()}
+	}
+	sources := r.Sources
+	if r.StoreDir != "" {
+		files, err := listStore(r.StoreDir)
+		if err != nil {
+			return "rejected", []string{fmt.Sprintf("reading the provenance store: %s", err)}
+		}
+		for _, f := range files {
+			a, err := readAttestations(f)
+			if err != nil {
+				return "rejected", []string{fmt.Sprintf("reading the provenance store: %s", err)}
+			}
+			sources.Local = append(sources.Local, a...)
+		}
+	}
+	var passed, failed []string
+	for _, artifact := range artifacts {
+		verified, _, problems := sources.verify(artifact, r.Policy, r.Verifier)
+		if verified != nil {
+			passed = append(passed, fmt.Sprintf("PASS %s: %s", artifact.Name, verified.URI))
+			continue
+		}
+		for _, p := range problems {
+			failed = append(failed, fmt.Sprintf("FAIL %s: %s", artifact.Name, p))
+		}
+	}
+	if len(failed) > 0 {
+		return "rejected", failed
+	}
+	return "approved", passed
+}
+
+// handle decides on the deployment of e and reports the decision to its
+// callback URL.
+func (r *protectionRule) handle(e ProtectionRuleEvent) (string, error) {
+	state, reasons := r.decide(e)
+	fmt.Printf("Deployment %d of %s to %s %s:\n  %s\n", e.Deployment.Id, e.Repository.FullName, e.Environment, state, strings.Join(reasons, "\n  "))
+	// The callback is sent the installation token, so it must be an API URL.
+	if !strings.HasPrefix(e.CallbackURL, r.Client.apiURL+"/") {
+		return state, fmt.Errorf("callback URL %q is not of the API at %s", e.CallbackURL, r.Client.apiURL)
+	}
+	c := *r.Client
+	if r.App != nil {
+		token, err := r.App.installationToken(r.Client, e.Installation.Id)
+		if err != nil {
+			return state, fmt.Errorf("authenticating as installation %d: %w", e.Installation.Id, err)
+		}
+		c.token = token
+	}
+	comment := strings.Join(reasons, "\n")
+	if len(comment) > 1024 {
+		comment = comment[:1021] + "..."
+	}
+	body := map[string]string{"environment_name": e.Environment, "state": state, "comment": comment}
+	if err := c.post(e.CallbackURL, body, nil); err != nil {
+		return state, fmt.Errorf("reporting the decision: %w", err)
+	}
+	return state, nil
+}
+
+// validWebhookSignature reports whether signature, the X-Hub-Signature-256
+// header of a webhook delivery, is that of body with secret.
+func validWebhookSignature(secret, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// serveHTTP receives the webhook deliveries of the app. Deployments are
+// verified after the delivery is acknowledged, since GitHub waits only ten
+// seconds for a response.
+func (r *protectionRule) serveHTTP(secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, 25<<20))
+		if err != nil {
+			http.Error(w, "reading the delivery failed", http.StatusBadRequest)
+			return
+		}
+		if !validWebhookSignature(secret, body, req.Header.Get("X-Hub-Signature-256")) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("X-GitHub-Event") != "deployment_protection_rule" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		e := ProtectionRuleEvent{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			http.Error(w, "malformed event", http.StatusBadRequest)
+			return
+		}
+		if e.Action != "requested" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			if _, err := r.handle(e); err != nil {
+				fmt.Printf("Failed to gate deployment %d of %s: %s\n", e.Deployment.Id, e.Repository.FullName, err)
+			}
+		}()
+	}
+}
+
+// protectMain implements `protect`, a custom deployment protection rule: as
+// the webhook receiver of a GitHub App with --listen, or for a single event
+// with --event, it approves deployments whose artifacts' provenance
+// verifies and rejects the others.
+func protectMain(args []string) {
+	flags := flag.NewFlagSet("protect", flag.ExitOnError)
+	listen := flags.String("listen", "", "The address to receive the app's webhook deliveries on, e.g. :8080.")
+	eventPath := flags.String("event", "", "A deployment_protection_rule event to decide on, instead of listening for deliveries.")
+	secretPath := flags.String("webhook_secret", "", "A file holding the app's webhook secret, which deliveries must be signed with.")
+	appId := flags.String("app_id", "", "The id of the GitHub App to report decisions as.")
+	appKey := flags.String("app_key", "", "The PEM private key of the GitHub App. Without an app, decisions are reported with $GITHUB_TOKEN.")
+	environments := flags.String("environment", "production", "Comma-separated environments whose deployments are gated; deployments to others are approved unchecked.")
+	storeDir := flags.String("provenance_store", "", "A directory of provenance files to look the artifacts up in.")
+	useCAS := flags.Bool("cas", false, "Look the artifacts up in the local content-addressed store.")
+	casDir := flags.String("cas_dir", defaultCASDir(), "The directory of the local content-addressed store.")
+	useRekor := flags.Bool("rekor", false, "Look the artifacts up in the transparency log.")
+	rekorURL := flags.String("rekor_url", DefaultRekorURL, "The Rekor transparency log to search with --rekor.")
+	keyPath := flags.String("key", "", "The PEM public key the provenance must be signed with (required). Unsigned provenance is rejected.")
+	loadPolicyFlags := addPolicyFlags(flags, "")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if (*listen == "") == (*eventPath == "") {
+		fmt.Println("Exactly one of --listen and --event is required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *keyPath == "" {
+		fmt.Println("No value found for required flag: --key")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if (*appId == "") != (*appKey == "") {
+		fmt.Println("--app_id and --app_key must be given together")
+		os.Exit(1)
+	}
+	if *listen != "" && (*secretPath == "" || *appId == "") {
+		fmt.Println("--listen requires --webhook_secret, --app_id and --app_key")
+		os.Exit(1)
+	}
+	if err := requireOnline("protect"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policy, _ := loadPolicyFlags()
+	client, err := newGitHubClient("{}", Options{Getenv: os.Getenv})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	rule := &protectionRule{
+		Environments: stringSet(parseList(*environments)...),
+		StoreDir:     *storeDir,
+		Sources:      gateSources{Registry: newRegistryClient()},
+		Policy:       policy,
+		Client:       client,
+	}
+	if *useCAS {
+		rule.Sources.CASDir = *casDir
+	}
+	if *useRekor {
+		rule.Sources.Rekor = newRekorClient(*rekorURL)
+	}
+	if rule.Verifier, err = loadVerifier(*keyPath); err != nil {
+		fmt.Printf("Failed to load key: %s\n", err)
+		os.Exit(1)
+	}
+	if *appId != "" {
+		if rule.App, err = loadGitHubApp(*appId, *appKey); err != nil {
+			fmt.Printf("Failed to load app key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *eventPath != "" {
+		contents, err := ioutil.ReadFile(*eventPath)
+		if err != nil {
+			fmt.Printf("Failed to read event: %s\n", err)
+			os.Exit(1)
+		}
+		e := ProtectionRuleEvent{}
+		if err := json.Unmarshal(contents, &e); err != nil || e.CallbackURL == "" {
+			fmt.Printf("%s is not a deployment_protection_rule event\n", *eventPath)
+			os.Exit(1)
+		}
+		state, err := rule.handle(e)
+		if err != nil {
+			fmt.Printf("Failed to gate deployment: %s\n", err)
+			os.Exit(1)
+		}
+		if state != "approved" {
+			os.Exit(1)
+		}
+		return
+	}
+	secret, err := ioutil.ReadFile(*secretPath)
+	if err != nil {
+		fmt.Printf("Failed to read webhook secret: %s\n", err)
+		os.Exit(1)
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		fmt.Printf("%s holds no webhook secret\n", *secretPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Gating deployments to %s, receiving deliveries on %s\n", strings.Join(parseList(*environments), ", "), *listen)
+	if err := http.ListenAndServe(*listen, rule.serveHTTP(secret)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Predicate versions of --predicate_version.
+const (
+	PredicateV01 = "v0.1"
+	PredicateV1  = "v1"
+)
+
+const (
+	// ProvenanceV01Type and ProvenanceV1Type are the predicate types of SLSA
+	// provenance v0.1 and v1.0, which in-toto Statements v0.1 and v1 carry.
+	ProvenanceV01Type = "https://slsa.dev/provenance/v0.1"
+	ProvenanceV1Type  = "https://slsa.dev/provenance/v1"
+	StatementV01Type  = "https://in-toto.io/Statement/v0.1"
+	StatementV1Type   = "https://in-toto.io/Statement/v1"
+	// BuildTypeV1 is the build type of GitHub Actions workflow runs in SLSA
+	// v1.0 provenance, whose external parameters are the workflow and its
+	// inputs.
+	BuildTypeV1 = "https://slsa-framework.github.io/github-actions-buildtypes/workflow/v1"
+)
+
+// StatementV1 is how a Statement is serialized as SLSA v1.0 provenance. The
+// Statement stays the representation everything else works with:
+// marshalStatement maps Statements of ProvenanceV1Type to a StatementV1, and
+// decodeStatement maps them back.
+type StatementV1 struct {
+	Type          string       `json:"_type"`
+	Subject       []Subject    `json:"subject"`
+	PredicateType string       `json:"predicateType"`
+	Predicate     ProvenanceV1 `json:"predicate"`
+}
+type ProvenanceV1 struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+type BuildDefinition struct {
+	BuildType          string             `json:"buildType"`
+	ExternalParameters ExternalParameters `json:"externalParameters"`
+	// InternalParameters are the github and runner contexts the run was
+	// recorded with, which the workflow doesn't control.
+	InternalParameters   *AnyContext          `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+type ExternalParameters struct {
+	Workflow WorkflowParameters `json:"workflow"`
+	Inputs   json.RawMessage    `json:"inputs,omitempty"`
+}
+type WorkflowParameters struct {
+	Ref        string `json:"ref"`
+	Repository string `json:"repository"`
+	Path       string `json:"path"`
+}
+type RunDetails struct {
+	Builder    BuilderV1            `json:"builder"`
+	Metadata   BuildMetadata        `json:"metadata"`
+	Byproducts []ResourceDescriptor `json:"byproducts,omitempty"`
+}
+type BuilderV1 struct {
+	Id string `json:"id"`
+}
+
+// BuildMetadata is the run metadata of SLSA v1.0, with the metadata it has no
+// field for in extension fields.
+type BuildMetadata struct {
+	InvocationId string         `json:"invocationId"`
+	StartedOn    string         `json:"startedOn,omitempty"`
+	FinishedOn   string         `json:"finishedOn"`
+	Completeness Completeness   `json:"demo_completeness"`
+	Reproducible bool           `json:"demo_reproducible,omitempty"`
+	Isolation    *Isolation     `json:"demo_isolation,omitempty"`
+	Hermeticity  *Hermeticity   `json:"demo_hermeticity,omitempty"`
+	Command      *CommandTrace  `json:"demo_command,omitempty"`
+	Commands     []CommandTrace `json:"demo_commands,omitempty"`
+	Approvals    *Approvals     `json:"demo_approvals,omitempty"`
+	SourceCommit *SourceCommit  `json:"demo_sourceCommit,omitempty"`
+	Caches       []CacheRestore `json:"demo_caches,omitempty"`
+	Retroactive  *Retroactive   `json:"demo_retroactive,omitempty"`
+	Validity     *Validity      `json:"demo_validity,omitempty"`
+}
+
+// ResourceDescriptor is a material or byproduct of SLSA v1.0.
+type ResourceDescriptor struct {
+	URI         string                `json:"uri,omitempty"`
+	Name        string                `json:"name,omitempty"`
+	Digest      DigestSet             `json:"digest"`
+	Annotations *ByproductAnnotations `json:"annotations,omitempty"`
+}
+
+// ByproductAnnotations are the fields of a Byproduct that a resource
+// descriptor has none for.
+type ByproductAnnotations struct {
+	Kind    string         `json:"kind"`
+	Subject string         `json:"subject,omitempty"`
+	Egress  *EgressSummary `json:"egress,omitempty"`
+}
+
+// provenanceV1 maps stmt to SLSA v1.0 provenance.
+func provenanceV1(stmt *Statement) *StatementV1 {
+	p := &stmt.Predicate
+	md := &p.Metadata
+	v1 := &StatementV1{Type: StatementV1Type, Subject: stmt.Subject, PredicateType: ProvenanceV1Type}
+	def := &v1.Predicate.BuildDefinition
+	def.BuildType = BuildTypeV1
+	def.ExternalParameters.Workflow.Path = p.Recipe.EntryPoint
+	if env := p.Recipe.Environment; env != nil {
+		gh := env.GitHubContext
+		w := &def.ExternalParameters.Workflow
+		w.Ref, w.Repository = gh.Ref, "https://github.com/"+gh.Repository
+		// The workflow ref also identifies a reusable workflow, and isn't
+		// redacted along with the ref of the run.
+		if wf, ok := parseWorkflowRef(gh.WorkflowRef); ok {
+			w.Ref, w.Repository, w.Path = wf.Ref, "https://github.com/"+wf.Repository, wf.Path
+		}
+		def.InternalParameters = env
+	}
+	if args := p.Recipe.Arguments; len(args) > 0 && string(args) != "null" {
+		def.ExternalParameters.Inputs = args
+	}
+	def.ResolvedDependencies = []ResourceDescriptor{}
+	for _, m := range p.Materials {
+		def.ResolvedDependencies = append(def.ResolvedDependencies, ResourceDescriptor{URI: m.URI, Digest: m.Digest})
+	}
+	run := &v1.Predicate.RunDetails
+	run.Builder.Id = p.Builder.Id
+	run.Metadata = BuildMetadata{
+		InvocationId: md.BuildInvocationId,
+		StartedOn:    md.BuildStartedOn,
+		FinishedOn:   md.BuildFinishedOn,
+		Completeness: md.Completeness,
+		Reproducible: md.Reproducible,
+		Isolation:    md.Isolation,
+		Hermeticity:  md.Hermeticity,
+		Command:      md.Command,
+		Commands:     md.Commands,
+		Approvals:    md.Approvals,
+		SourceCommit: md.SourceCommit,
+		Caches:       md.Caches,
+		Retroactive:  md.Retroactive,
+		Validity:     md.Validity,
+	}
+	for _, b := range md.Byproducts {
+		run.Byproducts = append(run.Byproducts, ResourceDescriptor{
+			Name:        b.Name,
+			Digest:      b.Digest,
+			Annotations: &ByproductAnnotations{Kind: b.Kind, Subject: b.Subject, Egress: b.Egress},
+		})
+	}
+	return v1
+}
+
+// statementFromV1 maps SLSA v1.0 provenance back to a Statement.
+func statementFromV1(v1 *StatementV1) (*Statement, error) {
+	def, run := &v1.Predicate.BuildDefinition, &v1.Predicate.RunDetails
+	if def.BuildType != BuildTypeV1 {
+		return nil, fmt.Errorf("build type %q isn't a GitHub Actions workflow", def.BuildType)
+	}
+	stmt := &Statement{Type: v1.Type, Subject: v1.Subject, PredicateType: v1.PredicateType}
+	p := &stmt.Predicate
+	p.Builder.Id = run.Builder.Id
+	md := run.Metadata
+	p.Metadata = Metadata{
+		BuildInvocationId: md.InvocationId,
+		Completeness:      md.Completeness,
+		Reproducible:      md.Reproducible,
+		BuildStartedOn:    md.StartedOn,
+		BuildFinishedOn:   md.FinishedOn,
+		Isolation:         md.Isolation,
+		Hermeticity:       md.Hermeticity,
+		Command:           md.Command,
+		Commands:          md.Commands,
+		Approvals:         md.Approvals,
+		SourceCommit:      md.SourceCommit,
+		Caches:            md.Caches,
+		Retroactive:       md.Retroactive,
+		Validity:          md.Validity,
+	}
+	for _, b := range run.Byproducts {
+		byproduct := Byproduct{Name: b.Name, Digest: b.Digest}
+		if a := b.Annotations; a != nil {
+			byproduct.Kind, byproduct.Subject, byproduct.Egress = a.Kind, a.Subject, a.Egress
+		}
+		p.Metadata.Byproducts = append(p.Metadata.Byproducts, byproduct)
+	}
+	p.Recipe = Recipe{
+		Type:        TypeId,
+		EntryPoint:  def.ExternalParameters.Workflow.Path,
+		Arguments:   def.ExternalParameters.Inputs,
+		Environment: def.InternalParameters,
+	}
+	p.Materials = []Item{}
+	for _, d := range def.ResolvedDependencies {
+		p.Materials = append(p.Materials, Item{URI: d.URI, Digest: d.Digest})
+	}
+	// A workflow defined at another commit than the source was recorded as
+	// a material of its own, as generate does.
+	if env := def.InternalParameters; env != nil {
+		gh := env.GitHubContext
+		wf, ok := parseWorkflowRef(gh.WorkflowRef)
+		if ok && gh.WorkflowSHA != "" && (wf.Repository != gh.Repository || gh.WorkflowSHA != gh.SHA) {
+			for i := 1; i < len(p.Materials); i++ {
+				if p.Materials[i].Digest["sha1"] == gh.WorkflowSHA {
+					p.Recipe.DefinedInMaterial = i
+					break
+				}
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// decodeStatement decodes the serialized statement payload into stmt,
+// mapping SLSA v1.0 provenance as written by marshalStatement.
+func decodeStatement(payload []byte, stmt *Statement) error {
+	var header struct {
+		PredicateType string `json:"predicateType"`
+	}
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return err
+	}
+	if header.PredicateType != ProvenanceV1Type {
+		return json.Unmarshal(payload, stmt)
+	}
+	v1 := &StatementV1{}
+	if err := json.Unmarshal(payload, v1); err != nil {
+		return err
+	}
+	mapped, err := statementFromV1(v1)
+	if err != nil {
+		return err
+	}
+	*stmt = *mapped
+	return nil
+}
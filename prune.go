@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prunePolicy selects the provenance referrers of an image to delete. The
+// newest referrer of each image is always kept.
+type prunePolicy struct {
+	// OlderThan, if positive, selects referrers created longer ago.
+	OlderThan time.Duration
+	// Superseded selects all but the newest referrer.
+	Superseded bool
+}
+
+// prunable returns the referrers selected by p, mapped to the reason they
+// are, as of now.
+func (p prunePolicy) prunable(refs []referrerDescriptor, now time.Time) map[string]string {
+	created := func(r referrerDescriptor) time.Time {
+		t, _ := time.Parse(time.RFC3339, r.Annotations["org.opencontainers.image.created"])
+		return t
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return created(refs[i]).After(created(refs[j])) })
+	selected := map[string]string{}
+	for i, r := range refs {
+		if i == 0 {
+			continue
+		}
+		t := created(r)
+		switch {
+		case p.Superseded:
+			selected[r.Digest] = fmt.Sprintf("superseded by %s", refs[0].Digest)
+		case p.OlderThan > 0 && !t.IsZero() && now.Sub(t) > p.OlderThan:
+			selected[r.Digest] = fmt.Sprintf("created %s", t.UTC().Format(time.RFC3339))
+		}
+	}
+	return selected
+}
+
+// pruneImage deletes the provenance referrers of image, a repo@sha256:digest
+// reference, selected by policy, or only prints them if dryRun.
+func pruneImage(c *registryClient, image string, policy prunePolicy, dryRun bool, now time.Time) (int, error) {
+	i := strings.LastIndex(image, "@")
+	repo, digest := image[:i], image[i+1:]
+	refs, fromTag, err := c.referrers(repo, digest, ProvenanceReferenceType)
+	if err != nil {
+		return 0, err
+	}
+	selected := policy.prunable(refs, now)
+	if len(selected) == 0 {
+		return 0, nil
+	}
+	var digests []string
+	for d := range selected {
+		digests = append(digests, d)
+	}
+	sort.Strings(digests)
+	for _, d := range digests {
+		if dryRun {
+			fmt.Printf("Would delete %s@%s, a referrer of %s: %s\n", repo, d, digest, selected[d])
+			continue
+		}
+		if err := c.deleteManifest(repo, d); err != nil {
+			return 0, err
+		}
+		fmt.Printf("Deleted %s@%s, a referrer of %s: %s\n", repo, d, digest, selected[d])
+	}
+	if fromTag && !dryRun {
+		if err := removeFromReferrersTag(c, repo, digest, selected); err != nil {
+			return 0, err
+		}
+	}
+	return len(selected), nil
+}
+
+// removeFromReferrersTag removes the referrers in removed from the referrers
+// tag of the manifest with the given digest.
+func removeFromReferrersTag(c *registryClient, repo, digest string, removed map[string]string) error {
+	tag := strings.Replace(digest, ":", "-", 1)
+	_, body, err := c.manifest(repo, tag)
+	if errors.Is(err, errManifestUnknown) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	index := referrersIndex{}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("parsing the referrers index %s:%s: %w", repo, tag, err)
+	}
+	kept := []referrerDescriptor{}
+	for _, m := range index.Manifests {
+		if _, ok := removed[m.Digest]; !ok {
+			kept = append(kept, m)
+		}
+	}
+	index.Manifests = kept
+	body, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	_, err = c.putManifest(repo, tag, MediaTypeOCIIndex, body)
+	return err
+}
+
+// referrerTagSubjects returns the images of repo that have a referrers tag,
+// i.e. were annotated on a registry without the referrers API.
+func referrerTagSubjects(c *registryClient, repo string) ([]string, error) {
+	tags, err := c.tags(repo)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, t := range tags {
+		if strings.HasPrefix(t, "sha256-") && hexDigestPattern.MatchString(t[len("sha256-"):]) {
+			images = append(images, repo+"@sha256:"+t[len("sha256-"):])
+		}
+	}
+	return images, nil
+}
+
+// pruneMain implements `prune --image <image> --older_than <duration>
+// --superseded`, deleting stale provenance referrers pushed by annotate.
+func pruneMain(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	images := flags.String("image", "", "Comma-separated images whose provenance referrers to prune, as <repository>@sha256:<digest>, or repositories, whose referrers tags are all pruned.")
+	olderThan := flags.Duration("older_than", 0, "Delete referrers created longer ago than this, e.g. 2160h.")
+	superseded := flags.Bool("superseded", false, "Delete referrers superseded by a newer one of the same image, e.g. after re-signing.")
+	dryRun := flags.Bool("dry_run", false, "List the referrers that would be deleted without deleting them.")
+	addOfflineFlag(flags)
+	cloudAuth := addCloudAuthFlags(flags)
+	flags.Parse(args)
+	if err := requireOnline("prune"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *images == "" {
+		fmt.Println("No value found for required flag: --image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *olderThan <= 0 && !*superseded {
+		fmt.Println("At least one of --older_than and --superseded is required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	policy := prunePolicy{OlderThan: *olderThan, Superseded: *superseded}
+	c := newRegistryClient()
+	now := time.Now()
+	pruned := 0
+	for _, image := range parseList(*images) {
+		subjects := []string{image}
+		if !strings.Contains(image, "@") {
+			var err error
+			if subjects, err = referrerTagSubjects(c, image); err != nil {
+				fmt.Printf("Failed to list the referrers tags of %s: %s\n", image, err)
+				os.Exit(1)
+			}
+		}
+		for _, s := range subjects {
+			n, err := pruneImage(c, s, policy, *dryRun, now)
+			if err != nil {
+				fmt.Printf("Failed to prune %s: %s\n", s, err)
+				os.Exit(1)
+			}
+			pruned += n
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Would prune %d referrers\n", pruned)
+	} else {
+		fmt.Printf("Pruned %d referrers\n", pruned)
+	}
+}
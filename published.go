@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// verifyPublished downloads each of the published artifacts, given as
+// "<subject>=<url>" or "<url>", and checks that it hashes to the digest of
+// its subject, so that the file attested is the file published. A subject is
+// named as in the provenance or, for subjects named by purl, by path; a bare
+// URL is matched to the only subject with the same base name.
+func verifyPublished(published []string, subjects []Subject) error {
+	names := map[string]int{}
+	bases := map[string][]int{}
+	for i, s := range subjects {
+		names[s.Name] = i
+		names[subjectPath(s.Name)] = i
+		base := path.Base(subjectPath(s.Name))
+		bases[base] = append(bases[base], i)
+	}
+	client := newHTTPClient(5 * time.Minute)
+	for _, p := range published {
+		subject, u := "", p
+		// URLs contain '=' in their query, but subject names rarely contain
+		// "://".
+		if i := strings.Index(p, "="); i >= 0 && !strings.Contains(p[:i], "://") {
+			subject, u = p[:i], p[i+1:]
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			return fmt.Errorf("published artifact %q is not an http(s) URL", u)
+		}
+		var s Subject
+		if subject != "" {
+			i, ok := names[subject]
+			if !ok {
+				return fmt.Errorf("published artifact %s names %q, which is not a subject", u, subject)
+			}
+			s = subjects[i]
+		} else {
+			matches := bases[path.Base(parsed.Path)]
+			if len(matches) != 1 {
+				return fmt.Errorf("published artifact %s matches %d subjects by name; name its subject as <subject>=<url>", u, len(matches))
+			}
+			s = subjects[matches[0]]
+		}
+		resp, err := client.Get(u)
+		if err != nil {
+			return fmt.Errorf("downloading published artifact: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("downloading published artifact %s: %s", u, resp.Status)
+		}
+		digest, err := digestReader(resp.Body, knownAlgorithms(s.Digest)...)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("downloading published artifact %s: %w", u, err)
+		}
+		if !matchDigest(s.Digest, digest) {
+			return fmt.Errorf("the artifact published at %s doesn't match the digest of subject %s", u, s.Name)
+		}
+	}
+	return nil
+}
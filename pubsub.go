@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The resource names of Pub/Sub subscriptions and topics, which are part of
+// the paths of requests.
+var (
+	pubsubSubscriptionPattern = regexp.MustCompile(`^projects/[a-z][a-z0-9.:-]*/subscriptions/[A-Za-z][A-Za-z0-9._~%+-]*$`)
+	pubsubTopicPattern        = regexp.MustCompile(`^projects/[a-z][a-z0-9.:-]*/topics/[A-Za-z][A-Za-z0-9._~%+-]*$`)
+)
+
+// pubsubAckDeadline is how long a received job is left unacknowledged before
+// Pub/Sub redelivers it. It is extended while the job runs, so that a worker
+// that dies leaves the job to be redelivered soon after.
+const pubsubAckDeadline = 60 * time.Second
+
+// pubsubQueue consumes jobs from a Google Cloud Pub/Sub subscription by
+// pulling, with the REST API. Requests are authorized with the access token
+// of --cloud_auth, $GOOGLE_OAUTH_ACCESS_TOKEN or else the service account of
+// the GCE instance, and sent to $PUBSUB_EMULATOR_HOST, without one, if set.
+// A job is acknowledged once it's handled, and the result is published to
+// the topic of its reply_to attribute, if any.
+// See https://cloud.google.com/pubsub/docs/reference/rest
+type pubsubQueue struct {
+	subscription string
+	endpoint     string
+	emulator     bool
+	client       *http.Client
+	getenv       func(string) string
+
+	mu      sync.Mutex // guards token and expires
+	token   string
+	expires time.Time
+}
+
+// newPubSubQueue returns the queue of a pubsub://<project>/<subscription> URL.
+func newPubSubQueue(u *url.URL) (*pubsubQueue, error) {
+	sub := "projects/" + u.Host + "/subscriptions/" + strings.Trim(u.Path, "/")
+	if !pubsubSubscriptionPattern.MatchString(sub) {
+		return nil, errors.New("pubsub queue URL must name a subscription, e.g. pubsub://my-project/provenance-jobs")
+	}
+	q := &pubsubQueue{
+		subscription: sub,
+		endpoint:     "https://pubsub.googleapis.com",
+		client:       newHTTPClient(time.Minute),
+		getenv:       os.Getenv,
+	}
+	if host := q.getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		q.endpoint, q.emulator = "http://"+host, true
+	}
+	return q, nil
+}
+
+// accessToken returns the token requests are authorized with, as
+// pubsubQueue documents, caching that of the instance until it expires.
+func (q *pubsubQueue) accessToken() (string, error) {
+	if cloudCreds != nil && cloudCreds.Provider == "gcp" {
+		return cloudCreds.AccessToken, nil
+	}
+	if t := q.getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.token != "" && time.Now().Before(q.expires) {
+		return q.token, nil
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if _, err := metadataRequest(q.client, http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/token", map[string]string{"Metadata-Flavor": "Google"}, &t); err != nil {
+		return "", fmt.Errorf("no Google access token for Pub/Sub: use --cloud_auth, set $GOOGLE_OAUTH_ACCESS_TOKEN or run on GCE: %w", err)
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("the GCE metadata server returned no access token")
+	}
+	// Tokens are renewed a minute early, so none expires in flight.
+	q.token, q.expires = t.AccessToken, time.Now().Add(time.Duration(t.ExpiresIn)*time.Second-time.Minute)
+	return q.token, nil
+}
+
+// call posts in to the method of the resource name and decodes the response
+// into out.
+func (q *pubsubQueue) call(name, method string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, q.endpoint+"/v1/"+name+":"+method, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if !q.emulator {
+		token, err := q.accessToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("Pub/Sub %s %s: %s", method, name, e.Error.Message)
+		}
+		return fmt.Errorf("Pub/Sub %s %s: %s", method, name, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (q *pubsubQueue) Receive() (*Delivery, error) {
+	for {
+		var r struct {
+			ReceivedMessages []struct {
+				AckId   string `json:"ackId"`
+				Message struct {
+					Data       []byte            `json:"data"`
+					Attributes map[string]string `json:"attributes"`
+				} `json:"message"`
+			} `json:"receivedMessages"`
+		}
+		if err := q.call(q.subscription, "pull", map[string]int{"maxMessages": 1}, &r); err != nil {
+			return nil, err
+		}
+		if len(r.ReceivedMessages) == 0 {
+			// Pulls can return early with no messages.
+			time.Sleep(time.Second)
+			continue
+		}
+		m := r.ReceivedMessages[0]
+		if err := q.modifyAckDeadline(m.AckId); err != nil {
+			return nil, err
+		}
+		stop := q.extend(m.AckId)
+		d := &Delivery{Body: m.Message.Data}
+		d.Ack = func() error {
+			stop()
+			return q.call(q.subscription, "acknowledge", map[string][]string{"ackIds": {m.AckId}}, nil)
+		}
+		if topic := m.Message.Attributes["reply_to"]; topic != "" {
+			d.Reply = func(result []byte) error {
+				if !pubsubTopicPattern.MatchString(topic) {
+					return fmt.Errorf("reply_to %q is not a topic, projects/<project>/topics/<topic>", topic)
+				}
+				msg := map[string]string{"data": base64.StdEncoding.EncodeToString(result)}
+				return q.call(topic, "publish", map[string][]map[string]string{"messages": {msg}}, nil)
+			}
+		}
+		return d, nil
+	}
+}
+
+// modifyAckDeadline sets the deadline of the message of ackID to
+// pubsubAckDeadline from now.
+func (q *pubsubQueue) modifyAckDeadline(ackID string) error {
+	return q.call(q.subscription, "modifyAckDeadline", map[string]interface{}{
+		"ackIds":             []string{ackID},
+		"ackDeadlineSeconds": int(pubsubAckDeadline / time.Second),
+	}, nil)
+}
+
+// extend keeps extending the deadline of the message of ackID until the
+// returned function is called.
+func (q *pubsubQueue) extend(ackID string) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(pubsubAckDeadline / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := q.modifyAckDeadline(ackID); err != nil {
+					fmt.Printf("Failed to extend the ack deadline of the job: %s\n", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (q *pubsubQueue) Close() error {
+	return nil
+}
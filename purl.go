@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Subject and material naming schemes. Subjects are named by path by default
+// and materials by URI; with NamingPurl, both are named by package URL, as
+// GUAC and policy engines key artifacts by purl.
+const (
+	NamingPath = "path"
+	NamingURI  = "uri"
+	NamingPurl = "purl"
+)
+
+// PackageURL is a package URL (purl).
+// See https://github.com/package-url/purl-spec
+type PackageURL struct {
+	Type       string
+	Namespace  string
+	Name       string
+	Version    string
+	Qualifiers map[string]string
+	Subpath    string
+}
+
+var purlTypePattern = regexp.MustCompile(`^[a-z][a-z0-9.+-]*$`)
+
+// purlEscape percent-encodes a namespace segment, name or version, including
+// '@' and ':', as in the purl spec's examples.
+func purlEscape(s string) string {
+	return strings.NewReplacer("@", "%40", ":", "%3A").Replace(url.PathEscape(s))
+}
+
+// String returns the canonical form of p, with sorted qualifiers.
+func (p PackageURL) String() string {
+	var b strings.Builder
+	b.WriteString("pkg:" + p.Type + "/")
+	for _, segment := range strings.Split(p.Namespace, "/") {
+		if segment != "" {
+			b.WriteString(purlEscape(segment) + "/")
+		}
+	}
+	b.WriteString(purlEscape(p.Name))
+	if p.Version != "" {
+		b.WriteString("@" + purlEscape(p.Version))
+	}
+	if len(p.Qualifiers) > 0 {
+		var keys []string
+		for k, v := range p.Qualifiers {
+			if v != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			sep := "&"
+			if i == 0 {
+				sep = "?"
+			}
+			b.WriteString(sep + k + "=" + url.QueryEscape(p.Qualifiers[k]))
+		}
+	}
+	var subpath []string
+	for _, segment := range strings.Split(p.Subpath, "/") {
+		if segment != "" && segment != "." && segment != ".." {
+			subpath = append(subpath, url.PathEscape(segment))
+		}
+	}
+	if len(subpath) > 0 {
+		b.WriteString("#" + strings.Join(subpath, "/"))
+	}
+	return b.String()
+}
+
+// parsePackageURL parses the purl s.
+func parsePackageURL(s string) (PackageURL, error) {
+	p := PackageURL{}
+	rest := strings.TrimPrefix(s, "pkg:")
+	if rest == s {
+		return p, fmt.Errorf("%q is not a package URL: it doesn't start with pkg:", s)
+	}
+	if i := strings.Index(rest, "#"); i >= 0 {
+		subpath, err := url.PathUnescape(rest[i+1:])
+		if err != nil {
+			return p, fmt.Errorf("%q has a malformed subpath: %w", s, err)
+		}
+		p.Subpath, rest = strings.Trim(subpath, "/"), rest[:i]
+	}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		q, err := url.ParseQuery(rest[i+1:])
+		if err != nil {
+			return p, fmt.Errorf("%q has malformed qualifiers: %w", s, err)
+		}
+		p.Qualifiers = map[string]string{}
+		for k, v := range q {
+			p.Qualifiers[strings.ToLower(k)] = v[0]
+		}
+		rest = rest[:i]
+	}
+	segments := strings.Split(strings.Trim(rest, "/"), "/")
+	if len(segments) < 2 {
+		return p, fmt.Errorf("%q is not a package URL: it has no type and name", s)
+	}
+	p.Type = strings.ToLower(segments[0])
+	if !purlTypePattern.MatchString(p.Type) {
+		return p, fmt.Errorf("%q has invalid type %q", s, p.Type)
+	}
+	last := segments[len(segments)-1]
+	if i := strings.LastIndex(last, "@"); i >= 0 {
+		v, err := url.PathUnescape(last[i+1:])
+		if err != nil {
+			return p, fmt.Errorf("%q has a malformed version: %w", s, err)
+		}
+		p.Version, last = v, last[:i]
+	}
+	var err error
+	if p.Name, err = url.PathUnescape(last); err != nil || p.Name == "" {
+		return p, fmt.Errorf("%q has a malformed name", s)
+	}
+	var namespace []string
+	for _, segment := range segments[1 : len(segments)-1] {
+		n, err := url.PathUnescape(segment)
+		if err != nil {
+			return p, fmt.Errorf("%q has a malformed namespace: %w", s, err)
+		}
+		namespace = append(namespace, n)
+	}
+	p.Namespace = strings.Join(namespace, "/")
+	return p, nil
+}
+
+// subjectPath returns the path a subject named name was generated from: its
+// name, or for a purl, its subpath.
+func subjectPath(name string) string {
+	if p, err := parsePackageURL(name); err == nil && p.Subpath != "" {
+		return p.Subpath
+	}
+	return name
+}
+
+// imagePurl names the image subject named repo, which may have the query
+// of a platform manifest or layer, with the sha256 digest by an oci purl.
+func imagePurl(name, digest string) string {
+	repo, query := name, ""
+	if i := strings.Index(name, "?"); i >= 0 {
+		repo, query = name[:i], name[i+1:]
+	}
+	q := map[string]string{"repository_url": repo}
+	if values, err := url.ParseQuery(query); err == nil {
+		for k, v := range values {
+			q[k] = v[0]
+		}
+	}
+	return PackageURL{Type: "oci", Name: repo[strings.LastIndex(repo, "/")+1:], Version: "sha256:" + digest, Qualifiers: q}.String()
+}
+
+// filePurl returns the purl file subjects are named with, as subpaths of:
+// base if set, or else pkg:generic/<repository name>@<tag or commit>.
+func filePurl(base, githubContext string) (PackageURL, error) {
+	if base != "" {
+		p, err := parsePackageURL(base)
+		if err == nil && p.Subpath != "" {
+			err = fmt.Errorf("%q has a subpath, which would be replaced by the file path", base)
+		}
+		return p, err
+	}
+	var gh struct {
+		Repository string `json:"repository"`
+		Ref        string `json:"ref"`
+		SHA        string `json:"sha"`
+	}
+	if err := json.Unmarshal([]byte(githubContext), &gh); err != nil {
+		return PackageURL{}, fmt.Errorf("parsing github context: %w", err)
+	}
+	name := gh.Repository[strings.LastIndex(gh.Repository, "/")+1:]
+	if name == "" {
+		return PackageURL{}, fmt.Errorf("the repository naming file purls is unknown; set --file_purl")
+	}
+	version := gh.SHA
+	if strings.HasPrefix(gh.Ref, "refs/tags/") {
+		version = strings.TrimPrefix(gh.Ref, "refs/tags/")
+	}
+	return PackageURL{Type: "generic", Name: name, Version: version}, nil
+}
+
+// nameFileSubjects renames file subjects to subpaths of base.
+func nameFileSubjects(subjects []Subject, base PackageURL) {
+	for i := range subjects {
+		p := base
+		p.Subpath = subjects[i].Name
+		subjects[i].Name = p.String()
+	}
+}
+
+// nameImageSubjects renames image subjects to oci purls.
+func nameImageSubjects(subjects []Subject) {
+	for i, s := range subjects {
+		if d := s.Digest["sha256"]; d != "" {
+			subjects[i].Name = imagePurl(s.Name, d)
+		}
+	}
+}
+
+// materialPurl renames the source, workflow and generator materials to
+// github purls at the commit or version they were used at. Other materials,
+// such as traced files, have no package and keep their URIs.
+func materialPurl(item Item) Item {
+	uri := item.URI
+	version := item.Digest["sha1"]
+	switch {
+	case strings.HasPrefix(uri, "git+https://github.com/"):
+		uri = strings.TrimPrefix(uri, "git+https://github.com/")
+		if i := strings.Index(uri, "@"); i >= 0 {
+			uri = uri[:i]
+		}
+	case strings.HasPrefix(uri, GeneratorURI+"@"):
+		uri, version = strings.TrimPrefix(GeneratorURI, "https://github.com/"), strings.TrimPrefix(uri, GeneratorURI+"@")
+	default:
+		return item
+	}
+	parts := strings.SplitN(uri, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return item
+	}
+	item.URI = PackageURL{Type: "github", Namespace: parts[0], Name: parts[1], Version: version}.String()
+	return item
+}
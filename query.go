@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultArchivistaURL is the public Archivista instance.
+const DefaultArchivistaURL = "https://archivista.testifysec.io"
+
+// subjectLookup is the lookup query needs of a store: Stores provide it, as
+// do the read-only oci://, s3:// and Archivista stores.
+type subjectLookup interface {
+	BySubject(digest string) ([]StoredAttestation, error)
+	Close() error
+}
+
+// openQueryStore opens the store named by spec for query: local, for the
+// local content-addressed store; a Store as openStore takes; an
+// oci://<repository> whose images carry their attestations as referrers, as
+// attach pushes them; an s3://<bucket>[/<prefix>]; or archivista, or
+// archivista+https://<host>, for an Archivista server.
+func openQueryStore(spec string) (subjectLookup, error) {
+	switch {
+	case spec == "local":
+		dir := defaultCASDir()
+		if dir == "" {
+			return nil, errors.New("no user cache directory found for the local store")
+		}
+		return openStore(dir)
+	case strings.HasPrefix(spec, "oci://"):
+		if err := requireOnline("an oci:// store"); err != nil {
+			return nil, err
+		}
+		repo := strings.TrimPrefix(spec, "oci://")
+		if imageRepository(repo) != repo {
+			return nil, fmt.Errorf("%q is not an oci://<repository> store", spec)
+		}
+		return &ociStore{repo: repo, c: newRegistryClient()}, nil
+	case strings.HasPrefix(spec, "s3://"):
+		if err := requireOnline("an s3:// store"); err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Store(u)
+	case spec == "archivista" || strings.HasPrefix(spec, "archivista+"):
+		if err := requireOnline("an Archivista store"); err != nil {
+			return nil, err
+		}
+		server := DefaultArchivistaURL
+		if spec != "archivista" {
+			server = strings.TrimPrefix(spec, "archivista+")
+		}
+		return &archivistaStore{url: strings.TrimSuffix(server, "/"), client: newHTTPClient(30 * time.Second)}, nil
+	default:
+		return openStore(spec)
+	}
+}
+
+// ociStore finds the attestations of an image among the referrers of its
+// manifest in repo.
+type ociStore struct {
+	repo string
+	c    *registryClient
+}
+
+func (s *ociStore) BySubject(digest string) ([]StoredAttestation, error) {
+	if !hexDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("malformed sha256 digest %q", digest)
+	}
+	referrers, _, err := s.c.referrers(s.repo, "sha256:"+digest, PayloadContentType)
+	if err != nil {
+		return nil, err
+	}
+	var attestations []StoredAttestation
+	for _, r := range referrers {
+		_, body, err := s.c.manifest(s.repo, r.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var m artifactManifest
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, fmt.Errorf("parsing referrer %s@%s: %w", s.repo, r.Digest, err)
+		}
+		if len(m.Layers) != 1 {
+			continue
+		}
+		contents, err := s.c.blob(s.repo, m.Layers[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		created, _ := time.Parse(time.RFC3339, m.Annotations["org.opencontainers.image.created"])
+		a, err := storedAttestation(contents, s.repo+"@"+r.Digest, created.UTC())
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a)
+	}
+	return attestations, nil
+}
+
+func (s *ociStore) Close() error {
+	return nil
+}
+
+// archivistaStore searches an Archivista server's GraphQL API for the DSSE
+// envelopes of a subject, as witness does, and downloads them by gitoid.
+// See https://github.com/in-toto/archivista
+type archivistaStore struct {
+	url    string
+	client *http.Client
+}
+
+const archivistaSearch = `query($algo: String!, $digest: String!) {
+  dsses(where: {hasStatementWith: {hasSubjectsWith: {hasSubjectDigestsWith: {value: $digest, algorithm: $algo}}}}) {
+    edges { node { gitoidSha256 } }
+  }
+}`
+
+func (s *archivistaStore) BySubject(digest string) ([]StoredAttestation, error) {
+	if !hexDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("malformed sha256 digest %q", digest)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     archivistaSearch,
+		"variables": map[string]string{"algo": "sha256", "digest": digest},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(s.url+"/query", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("searching %s: %s", s.url, resp.Status)
+	}
+	var result struct {
+		Data struct {
+			Dsses struct {
+				Edges []struct {
+					Node struct {
+						GitoidSha256 string `json:"gitoidSha256"`
+					} `json:"node"`
+				} `json:"edges"`
+			} `json:"dsses"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("searching %s: %w", s.url, err)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("searching %s: %s", s.url, result.Errors[0].Message)
+	}
+	var attestations []StoredAttestation
+	for _, e := range result.Data.Dsses.Edges {
+		contents, err := s.download(e.Node.GitoidSha256)
+		if err != nil {
+			return nil, err
+		}
+		// Archivista doesn't say when it stored the envelope.
+		a, err := storedAttestation(contents, s.url+"/download/"+e.Node.GitoidSha256, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a)
+	}
+	return attestations, nil
+}
+
+func (s *archivistaStore) download(gitoid string) ([]byte, error) {
+	resp, err := s.client.Get(s.url + "/download/" + url.PathEscape(gitoid))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s from %s: %s", gitoid, s.url, resp.Status)
+	}
+	return readLimited(resp.Body, s.url+"/download/"+gitoid)
+}
+
+func (s *archivistaStore) Close() error {
+	return nil
+}
+
+// queryMain implements `query --digest sha256:<hex> --store <store>,...`,
+// listing the attestations each store holds of the artifact with that
+// digest, with who built them and when.
+func queryMain(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	digest := flags.String("digest", "", "The digest of the artifact to look up, as sha256:<hex>.")
+	stores := flags.String("store", "local", "Comma-separated stores to search: local, for the local content-addressed store; a directory or file:// URL of a worker --store; postgres://user@host/database; oci://<repository>, for referrers pushed by attach; s3://<bucket>[/<prefix>], for a store synced to S3; or archivista or archivista+https://<host>.")
+	addOfflineFlag(flags)
+	cloudAuth := addCloudAuthFlags(flags)
+	flags.Parse(args)
+	if *digest == "" {
+		fmt.Println("No value found for required flag: --digest")
+		flags.Usage()
+		os.Exit(1)
+	}
+	hexDigest := strings.TrimPrefix(*digest, "sha256:")
+	if !hexDigestPattern.MatchString(hexDigest) {
+		fmt.Printf("Invalid value for flag --digest: %q is not of the form sha256:<hex>\n", *digest)
+		os.Exit(1)
+	}
+	if err := cloudAuth(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var found, failed int
+	for _, spec := range parseList(*stores) {
+		s, err := openQueryStore(spec)
+		if u, perr := url.Parse(spec); perr == nil && u.User != nil {
+			// Store URLs may carry passwords.
+			spec = u.Redacted()
+		}
+		if err != nil {
+			fmt.Printf("Failed to open store %s: %s\n", spec, err)
+			failed++
+			continue
+		}
+		attestations, err := s.BySubject(hexDigest)
+		s.Close()
+		if err != nil {
+			fmt.Printf("Failed to query store %s: %s\n", spec, err)
+			failed++
+			continue
+		}
+		for _, a := range attestations {
+			found++
+			fmt.Printf("\nsha256:%s in %s\n", a.Digest, spec)
+			printStoredAttestation(a)
+		}
+	}
+	if found == 0 {
+		fmt.Printf("No attestation of sha256:%s found\n", hexDigest)
+	} else {
+		noun := "attestations"
+		if found == 1 {
+			noun = "attestation"
+		}
+		fmt.Printf("\n%d %s of sha256:%s found\n", found, noun, hexDigest)
+	}
+	if found == 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// printStoredAttestation describes a, which storedAttestation has parsed.
+func printStoredAttestation(a StoredAttestation) {
+	stmt, sigs, _ := parseProvenance(a.Contents, a.Digest)
+	fmt.Printf("  Type:       %s\n", stmt.PredicateType)
+	if a.BuilderId != "" {
+		fmt.Printf("  Builder:    %s\n", a.BuilderId)
+	}
+	// The repository is that of the material the recipe is defined in.
+	if a.Repository != "" {
+		fmt.Printf("  Repository: %s\n", a.Repository)
+		if m := stmt.Predicate.Materials[stmt.Predicate.Recipe.DefinedInMaterial]; m.Digest["sha1"] != "" {
+			fmt.Printf("  Commit:     %s\n", m.Digest["sha1"])
+		}
+	}
+	if t := stmt.Predicate.Metadata.BuildStartedOn; t != "" {
+		fmt.Printf("  Started:    %s\n", t)
+	}
+	if t := stmt.Predicate.Metadata.BuildFinishedOn; t != "" {
+		fmt.Printf("  Finished:   %s\n", t)
+	}
+	if !a.Created.IsZero() {
+		fmt.Printf("  Stored:     %s\n", a.Created.Format(time.RFC3339))
+	}
+	for _, s := range sigs {
+		fmt.Printf("  Signed by:  %s\n", s.KeyId)
+	}
+	if len(sigs) == 0 {
+		fmt.Printf("  Unsigned\n")
+	}
+}
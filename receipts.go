@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ByproductSigningReceipt is the kind of a Byproduct recording a signature
+// made by an external signer.
+const ByproductSigningReceipt = "signing-receipt"
+
+// Byproduct is a file produced alongside the subjects that isn't attested as
+// a subject itself. It is an extension to the SLSA v0.1 metadata.
+type Byproduct struct {
+	Name   string    `json:"name"`
+	Digest DigestSet `json:"digest"`
+	Kind   string    `json:"kind"`
+	// Subject is the name of the subject a signing receipt covers, if known.
+	Subject string `json:"subject,omitempty"`
+	// Egress summarizes an egress report.
+	Egress *EgressSummary `json:"egress,omitempty"`
+}
+
+// signingReceipts hashes the receipt files of external signers, such as
+// Authenticode signatures or notarization tickets, given as "<path>" or
+// "<subject>=<path>", so that code-signing evidence is tied to the build.
+// Named subjects must be among subjects, by name or, for subjects named by
+// purl, by path.
+func signingReceipts(receipts []string, subjects []Subject) ([]Byproduct, error) {
+	names := map[string]string{}
+	for _, s := range subjects {
+		names[s.Name] = s.Name
+		if p := subjectPath(s.Name); p != s.Name {
+			names[p] = s.Name
+		}
+	}
+	var byproducts []Byproduct
+	for _, r := range receipts {
+		subject, path := "", r
+		if i := strings.LastIndex(r, "="); i >= 0 {
+			subject, path = r[:i], r[i+1:]
+			name, ok := names[subject]
+			if !ok {
+				return nil, fmt.Errorf("signing receipt %s names %q, which is not a subject", path, subject)
+			}
+			subject = name
+		}
+		digest, err := digestFile(normalizeInputPath(path))
+		if err != nil {
+			return nil, fmt.Errorf("hashing signing receipt: %w", err)
+		}
+		byproducts = append(byproducts, Byproduct{
+			Name:    filepath.ToSlash(path),
+			Digest:  digest,
+			Kind:    ByproductSigningReceipt,
+			Subject: subject,
+		})
+	}
+	return byproducts, nil
+}
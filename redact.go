@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Redaction modes of --redact, for provenance of private sources that is
+// published with public artifacts.
+const (
+	// RedactStrip removes the repository-private details.
+	RedactStrip = "strip"
+	// RedactHash replaces them by their SHA-256 digests, which those who
+	// know a value can still match.
+	RedactHash = "hash"
+)
+
+// redactor removes the repository-private details of provenance: who ran
+// the build and approved it, the branches, the event payload, and the
+// runner's host. The builder, the workflow identity, the source commit and
+// the digests of the subjects and materials are kept, so that the provenance
+// can still be verified.
+type redactor struct {
+	mode string
+	// redacted are the paths of the fields redacted, in statement order.
+	redacted []string
+}
+
+// value returns the redacted form of s, the field at path, recording it if
+// it was set.
+func (r *redactor) value(path, s string) string {
+	if s == "" {
+		return ""
+	}
+	r.redacted = append(r.redacted, path)
+	if r.mode == RedactStrip {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// redactStatement redacts stmt in place according to mode and returns the
+// paths of the fields redacted.
+func redactStatement(stmt *Statement, mode string) ([]string, error) {
+	r := &redactor{mode: mode}
+	if env := stmt.Predicate.Recipe.Environment; env != nil {
+		gh := &env.GitHubContext
+		gh.Actor = r.value("github.actor", gh.Actor)
+		gh.ActorId = r.value("github.actor_id", gh.ActorId)
+		gh.TriggeringActor = r.value("github.triggering_actor", gh.TriggeringActor)
+		gh.Ref = r.value("github.ref", gh.Ref)
+		gh.BaseRef = r.value("github.base_ref", gh.BaseRef)
+		gh.HeadRef = r.value("github.head_ref", gh.HeadRef)
+		gh.EventPath = r.value("github.event_path", gh.EventPath)
+		gh.ActionPath = r.value("github.action_path", gh.ActionPath)
+		gh.Workspace = r.value("github.workspace", gh.Workspace)
+		if len(gh.Event) > 0 && string(gh.Event) != "null" && string(gh.Event) != "{}" {
+			event, err := json.Marshal(r.value("github.event", string(gh.Event)))
+			if err != nil {
+				return nil, err
+			}
+			if mode == RedactStrip {
+				event = []byte("{}")
+			}
+			gh.Event = event
+		}
+		runner := &env.RunnerContext
+		runner.Name = r.value("runner.name", runner.Name)
+		runner.Temp = r.value("runner.temp", runner.Temp)
+		runner.ToolCache = r.value("runner.tool_cache", runner.ToolCache)
+		// The host's identity and configuration can't be redacted field by
+		// field without leaving it recognizable.
+		if env.Instance != nil {
+			r.redacted = append(r.redacted, "instance")
+			env.Instance = nil
+		}
+		if env.RunnerConfig != nil {
+			r.redacted = append(r.redacted, "runner_config")
+			env.RunnerConfig = nil
+		}
+	}
+	md := &stmt.Predicate.Metadata
+	if a := md.Approvals; a != nil {
+		if pr := a.PullRequest; pr != nil {
+			pr.Author = r.value("approvals.pullRequest.author", pr.Author)
+			pr.BaseRef = r.value("approvals.pullRequest.baseRef", pr.BaseRef)
+			for i, approver := range pr.Approvers {
+				pr.Approvers[i] = r.value(fmt.Sprintf("approvals.pullRequest.approvers[%d]", i), approver)
+				if pr.Approvers[i] == "" {
+					// Stripped approvers are still counted.
+					pr.Approvers[i] = Redacted
+				}
+			}
+		}
+		for i := range a.Environments {
+			e := &a.Environments[i]
+			at := fmt.Sprintf("approvals.environments[%d].", i)
+			e.Reviewer = r.value(at+"reviewer", e.Reviewer)
+			e.Comment = r.value(at+"comment", e.Comment)
+		}
+	}
+	if c := md.SourceCommit; c != nil {
+		r.identity("sourceCommit.author", &c.Author)
+		r.identity("sourceCommit.committer", &c.Committer)
+		if c.Tag != nil && c.Tag.Tagger != nil {
+			r.identity("sourceCommit.tag.tagger", c.Tag.Tagger)
+		}
+	}
+	return r.redacted, nil
+}
+
+// redactedVariables are the environment variables recorded by the environment
+// attestor that hold the details redactStatement redacts from the GitHub and
+// runner contexts.
+var redactedVariables = []string{
+	"GITHUB_ACTOR", "GITHUB_ACTOR_ID", "GITHUB_TRIGGERING_ACTOR",
+	"GITHUB_REF", "GITHUB_REF_NAME", "GITHUB_BASE_REF", "GITHUB_HEAD_REF",
+	"GITHUB_EVENT_PATH", "GITHUB_ACTION_PATH", "GITHUB_WORKSPACE",
+	"RUNNER_NAME", "RUNNER_TEMP", "RUNNER_TOOL_CACHE",
+}
+
+// redactAttestation returns the attestation a of an attestor of
+// collectAttestations redacted according to mode, as redactStatement redacts
+// the provenance it is bundled with: the run's actors, branches and host, the
+// commit's author, committer and message, and the output of commands.
+func redactAttestation(a interface{}, mode string) interface{} {
+	r := &redactor{mode: mode}
+	switch a := a.(type) {
+	case EnvironmentAttestation:
+		for _, name := range redactedVariables {
+			if v, ok := a.Variables[name]; ok && v != Redacted {
+				if v = r.value(name, v); v == "" {
+					delete(a.Variables, name)
+				} else {
+					a.Variables[name] = v
+				}
+			}
+		}
+		a.Hostname = r.value("hostname", a.Hostname)
+		a.Username = r.value("username", a.Username)
+		return a
+	case GitAttestation:
+		a.Author = r.value("author", a.Author)
+		a.AuthorEmail = r.value("authoremail", a.AuthorEmail)
+		a.CommitterName = r.value("committername", a.CommitterName)
+		a.CommitterEmail = r.value("committeremail", a.CommitterEmail)
+		a.CommitMessage = r.value("commitmessage", a.CommitMessage)
+		return a
+	case CommandRunAttestation:
+		a.Stdout = r.value("stdout", a.Stdout)
+		a.Stderr = r.value("stderr", a.Stderr)
+		return a
+	}
+	return a
+}
+
+// identity redacts the git identity id at path, but not when it was made.
+func (r *redactor) identity(path string, id *GitIdentity) {
+	id.Name = r.value(path+".name", id.Name)
+	if id.Email != Redacted {
+		id.Email = r.value(path+".email", id.Email)
+	}
+	id.Login = r.value(path+".login", id.Login)
+}
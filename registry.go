@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifest media types.
+const (
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerSchema = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// errManifestUnknown is returned for manifests the registry doesn't have.
+var errManifestUnknown = errors.New("manifest unknown")
+
+var manifestMediaTypes = []string{MediaTypeOCIIndex, MediaTypeDockerList, MediaTypeOCIManifest, MediaTypeDockerSchema}
+
+// Descriptor references content in a registry.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ImageIndex is an OCI image index or Docker manifest list.
+type ImageIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// ImageManifest is an OCI image manifest or Docker schema 2 manifest.
+type ImageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerList
+}
+
+// registryClient is a minimal client of the OCI distribution API, supporting
+// anonymous access, the credentials stored by `docker login`, and the cloud
+// registries of --cloud_auth. It is safe for concurrent use.
+type registryClient struct {
+	client *http.Client
+	// auth caches Authorization headers by registry host and scope, guarded
+	// by mu.
+	mu   sync.Mutex
+	auth map[string]string
+	// limiter, if set, spaces out the requests sent to registries.
+	limiter *rateLimiter
+}
+
+// rateLimiter spaces the requests of all goroutines sharing it at least
+// interval apart.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter to perSecond requests per second, or nil,
+// which doesn't limit, if perSecond isn't positive.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next request may be sent.
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{client: newHTTPClient(30 * time.Second), auth: map[string]string{}}
+}
+
+// splitRepository splits an image repository such as "ghcr.io/org/app" into
+// its registry host and path, applying Docker Hub's defaults.
+func splitRepository(repo string) (host, path string) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, path = parts[0], parts[1]
+	} else {
+		host, path = "docker.io", repo
+	}
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(path, "/") {
+			path = "library/" + path
+		}
+	}
+	return host, path
+}
+
+func registryScheme(host string) string {
+	if h := strings.SplitN(host, ":", 2)[0]; h == "localhost" || h == "127.0.0.1" {
+		return "http"
+	}
+	return "https"
+}
+
+// manifest fetches the manifest of repo at reference, a tag or digest. A
+// manifest fetched by a sha256 digest is checked to match it.
+func (c *registryClient) manifest(repo, reference string) (string, []byte, error) {
+	host, path := splitRepository(repo)
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", registryScheme(host), host, path, reference)
+	resp, err := c.do(host, "repository:"+path+":pull", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ","))
+		return req, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil, fmt.Errorf("fetching %s@%s: %w", repo, reference, errManifestUnknown)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetching %s@%s: %s", repo, reference, resp.Status)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		if sum := sha256.Sum256(body); "sha256:"+hex.EncodeToString(sum[:]) != reference {
+			return "", nil, fmt.Errorf("manifest %s@%s doesn't match its digest", repo, reference)
+		}
+	}
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+// blob fetches the blob of repo with the given sha256 digest, checking that
+// its content matches it.
+func (c *registryClient) blob(repo, digest string) ([]byte, error) {
+	host, path := splitRepository(repo)
+	u := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", registryScheme(host), host, path, digest)
+	resp, err := c.do(host, "repository:"+path+":pull", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s@%s: %s", repo, digest, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(body); "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("blob %s@%s doesn't match its digest", repo, digest)
+	}
+	return body, nil
+}
+
+// putManifest pushes the manifest body of mediaType to repo at reference,
+// a tag or its digest, and returns the response headers.
+func (c *registryClient) putManifest(repo, reference, mediaType string, body []byte) (http.Header, error) {
+	host, path := splitRepository(repo)
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", registryScheme(host), host, path, reference)
+	resp, err := c.do(host, "repository:"+path+":pull,push", func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("pushing %s@%s: %s", repo, reference, resp.Status)
+	}
+	return resp.Header, nil
+}
+
+// deleteManifest deletes the manifest of repo with the given digest.
+func (c *registryClient) deleteManifest(repo, digest string) error {
+	host, path := splitRepository(repo)
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", registryScheme(host), host, path, digest)
+	resp, err := c.do(host, "repository:"+path+":delete", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, u, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deleting %s@%s: %s", repo, digest, resp.Status)
+	}
+	return nil
+}
+
+// tags lists the tags of repo, following pagination.
+func (c *registryClient) tags(repo string) ([]string, error) {
+	host, path := splitRepository(repo)
+	next := fmt.Sprintf("%s://%s/v2/%s/tags/list?n=1000", registryScheme(host), host, path)
+	var tags []string
+	for next != "" {
+		u := next
+		resp, err := c.do(host, "repository:"+path+":pull", func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, u, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("listing the tags of %s: %s", repo, resp.Status)
+		} else if err != nil {
+			return nil, fmt.Errorf("listing the tags of %s: %w", repo, err)
+		}
+		tags = append(tags, page.Tags...)
+		next = ""
+		// The next page is linked as <url>; rel="next".
+		if link := resp.Header.Get("Link"); strings.HasPrefix(link, "<") && strings.Contains(link, ">") {
+			ref, err := url.Parse(link[1:strings.Index(link, ">")])
+			if err != nil {
+				return nil, err
+			}
+			next = resp.Request.URL.ResolveReference(ref).String()
+		}
+	}
+	return tags, nil
+}
+
+// referrers lists the referrers of the manifest of repo with the given
+// digest whose artifact type is artifactType, from the referrers API or, if
+// the registry lacks it, the sha256-<hex> referrers tag, reporting which.
+func (c *registryClient) referrers(repo, digest, artifactType string) ([]referrerDescriptor, bool, error) {
+	host, path := splitRepository(repo)
+	u := fmt.Sprintf("%s://%s/v2/%s/referrers/%s?artifactType=%s", registryScheme(host), host, path, digest, url.QueryEscape(artifactType))
+	resp, err := c.do(host, "repository:"+path+":pull", func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	var index referrersIndex
+	fromTag := false
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			return nil, false, fmt.Errorf("listing the referrers of %s@%s: %w", repo, digest, err)
+		}
+	case http.StatusNotFound:
+		fromTag = true
+		_, body, err := c.manifest(repo, strings.Replace(digest, ":", "-", 1))
+		if errors.Is(err, errManifestUnknown) {
+			return nil, true, nil
+		} else if err != nil {
+			return nil, true, err
+		}
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, true, fmt.Errorf("parsing the referrers tag of %s@%s: %w", repo, digest, err)
+		}
+	default:
+		return nil, false, fmt.Errorf("listing the referrers of %s@%s: %s", repo, digest, resp.Status)
+	}
+	// Registries may ignore the artifactType filter.
+	var matching []referrerDescriptor
+	for _, m := range index.Manifests {
+		if m.ArtifactType == artifactType {
+			matching = append(matching, m)
+		}
+	}
+	return matching, fromTag, nil
+}
+
+// pushBlob uploads body, whose digest is digest, to repo in a single PUT,
+// unless the registry already has it.
+func (c *registryClient) pushBlob(repo, digest string, body []byte) error {
+	host, path := splitRepository(repo)
+	scope := "repository:" + path + ":pull,push"
+	base := fmt.Sprintf("%s://%s/v2/%s/blobs/", registryScheme(host), host, path)
+	resp, err := c.do(host, scope, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, base+digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	resp, err = c.do(host, scope, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, base+"uploads/", nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting upload to %s: %s", repo, resp.Status)
+	}
+	// The upload location may be relative and may already have a query.
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("starting upload to %s: %w", repo, err)
+	}
+	location = resp.Request.URL.ResolveReference(location)
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+	resp, err = c.do(host, scope, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, location.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading %s to %s: %s", digest, repo, resp.Status)
+	}
+	return nil
+}
+
+// do sends the request built by newReq, authenticating with a bearer token
+// for scope when the registry challenges it.
+func (c *registryClient) do(host, scope string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+	key := host + " " + scope
+	c.mu.Lock()
+	auth, ok := c.auth[key]
+	c.mu.Unlock()
+	if ok {
+		req.Header.Set("Authorization", auth)
+	}
+	c.limiter.wait()
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if strings.HasPrefix(challenge, "Basic ") {
+		// Amazon ECR takes its credentials directly.
+		user, pass, ok, err := c.credentials(host)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("no credentials for %s, which requires them", host)
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	} else {
+		token, err := c.token(host, scope, challenge)
+		if err != nil {
+			return nil, err
+		}
+		auth = "Bearer " + token
+	}
+	c.mu.Lock()
+	c.auth[key] = auth
+	c.mu.Unlock()
+	if req, err = newReq(); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth)
+	c.limiter.wait()
+	return c.client.Do(req)
+}
+
+// token answers a "Bearer realm=...,service=..." authentication challenge.
+func (c *registryClient) token(host, scope, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(challenge[len("Bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry authentication challenge has no realm: %q", challenge)
+	}
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", scope)
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	user, pass, ok, err := c.credentials(host)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching registry token for %s: %s", host, resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	return t.AccessToken, nil
+}
+
+// credentials returns the credentials to log in to host with: those of
+// --cloud_auth, if it is a registry of that cloud, or else those of
+// `docker login`.
+func (c *registryClient) credentials(host string) (string, string, bool, error) {
+	user, pass, ok, err := cloudCreds.registryCredentials(host, c.client)
+	if ok || err != nil {
+		return user, pass, ok, err
+	}
+	user, pass, ok = dockerCredentials(host)
+	return user, pass, ok, nil
+}
+
+// dockerCredentials looks up the credentials `docker login` stored inline for
+// host. Credential helpers are not supported.
+func dockerCredentials(host string) (string, string, bool) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", "", false
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(contents, &cfg) != nil {
+		return "", "", false
+	}
+	keys := []string{host, "https://" + host}
+	if host == "registry-1.docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/", "docker.io")
+	}
+	for _, k := range keys {
+		if a, ok := cfg.Auths[k]; ok && a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				continue
+			}
+			kv := strings.SplitN(string(decoded), ":", 2)
+			if len(kv) == 2 {
+				return kv[0], kv[1], true
+			}
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRekorURL is the public Sigstore transparency log.
+const DefaultRekorURL = "https://rekor.sigstore.dev"
+
+// rekorBatchSize is the most entries Rekor returns from one retrieve call.
+const rekorBatchSize = 10
+
+// rekorClient is a minimal client of the Rekor REST API.
+// See https://github.com/sigstore/rekor/blob/main/openapi.yaml
+type rekorClient struct {
+	url    string
+	client *http.Client
+}
+
+func newRekorClient(url string) *rekorClient {
+	return &rekorClient{url: strings.TrimSuffix(url, "/"), client: newHTTPClient(30 * time.Second)}
+}
+
+// RekorEntry is a transparency log entry.
+type RekorEntry struct {
+	UUID           string `json:"-"`
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	Attestation    *struct {
+		Data string `json:"data"`
+	} `json:"attestation,omitempty"`
+	// Verification holds the log's promise to include the entry and, once
+	// it is included, the proof.
+	Verification *struct {
+		SignedEntryTimestamp string               `json:"signedEntryTimestamp"`
+		InclusionProof       *RekorInclusionProof `json:"inclusionProof,omitempty"`
+	} `json:"verification,omitempty"`
+}
+
+// errRekorUnavailable is returned for requests the log couldn't be reached
+// for or didn't serve, rather than refused.
+var errRekorUnavailable = errors.New("the log is unavailable")
+
+func (c *rekorClient) post(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := c.client.Post(c.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errRekorUnavailable, err)
+	}
+	defer r.Body.Close()
+	contents, err := readLimited(r.Body, c.url+path)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode >= http.StatusInternalServerError || r.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("rekor %s: %w: %s", path, errRekorUnavailable, r.Status)
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusCreated {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(contents, &e) == nil && e.Message != "" {
+			return fmt.Errorf("rekor %s: %s: %s", path, r.Status, e.Message)
+		}
+		return fmt.Errorf("rekor %s: %s", path, r.Status)
+	}
+	return json.Unmarshal(contents, resp)
+}
+
+// search returns the UUIDs of the entries indexed under digest, given as
+// "sha256:<hex>".
+func (c *rekorClient) search(digest string) ([]string, error) {
+	var uuids []string
+	return uuids, c.post("/api/v1/index/retrieve", map[string]string{"hash": digest}, &uuids)
+}
+
+// entries retrieves the entries with the given UUIDs.
+func (c *rekorClient) entries(uuids []string) ([]RekorEntry, error) {
+	var entries []RekorEntry
+	for start := 0; start < len(uuids); start += rekorBatchSize {
+		end := start + rekorBatchSize
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		var batch []map[string]RekorEntry
+		if err := c.post("/api/v1/log/entries/retrieve", map[string][]string{"entryUUIDs": uuids[start:end]}, &batch); err != nil {
+			return nil, err
+		}
+		for _, m := range batch {
+			for uuid, e := range m {
+				e.UUID = uuid
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LogIndex < entries[j].LogIndex })
+	return entries, nil
+}
+
+// rekorBody is the decoded body of an entry, covering the fields of the
+// hashedrekord, rekord, intoto and dsse kinds that identify signers, and of
+// the intoto and dsse kinds that identify payloads.
+type rekorBody struct {
+	Kind       string `json:"kind"`
+	APIVersion string `json:"apiVersion"`
+	Spec       struct {
+		// hashedrekord and rekord.
+		Signature *struct {
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+		// intoto v0.0.1.
+		PublicKey string `json:"publicKey"`
+		// intoto v0.0.2.
+		Content *struct {
+			Envelope *struct {
+				PayloadType string `json:"payloadType"`
+				Signatures  []struct {
+					Sig       string `json:"sig"`
+					PublicKey string `json:"publicKey"`
+				} `json:"signatures"`
+			} `json:"envelope"`
+			PayloadHash *rekorHash `json:"payloadHash"`
+		} `json:"content"`
+		// dsse.
+		Signatures []struct {
+			Signature string `json:"signature"`
+			Verifier  string `json:"verifier"`
+		} `json:"signatures"`
+		PayloadHash *rekorHash `json:"payloadHash"`
+	} `json:"spec"`
+}
+
+// rekorHash is a digest in an entry body.
+type rekorHash struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// payloadHash returns the hex SHA-256 of the DSSE payload of an intoto or
+// dsse entry, or "" for other kinds.
+func (b rekorBody) payloadHash() string {
+	h := b.Spec.PayloadHash
+	if b.Spec.Content != nil && b.Spec.Content.PayloadHash != nil {
+		h = b.Spec.Content.PayloadHash
+	}
+	if h == nil || h.Algorithm != "sha256" {
+		return ""
+	}
+	return h.Value
+}
+
+// recordsPayload reports whether payload is the DSSE payload b records the
+// digest of.
+func (b rekorBody) recordsPayload(payload []byte) bool {
+	sum := sha256.Sum256(payload)
+	h := b.payloadHash()
+	return h != "" && h == hex.EncodeToString(sum[:])
+}
+
+// envelope returns the envelope of payload signed with the signatures of the
+// intoto v0.0.2 or dsse entry b, or an unsigned one for other kinds.
+func (b rekorBody) envelope(payload []byte) *Envelope {
+	env := &Envelope{PayloadType: PayloadContentType, Payload: base64.StdEncoding.EncodeToString(payload)}
+	if c := b.Spec.Content; c != nil && c.Envelope != nil {
+		if c.Envelope.PayloadType != "" {
+			env.PayloadType = c.Envelope.PayloadType
+		}
+		for _, s := range c.Envelope.Signatures {
+			env.Signatures = append(env.Signatures, Signature{Sig: s.Sig})
+		}
+	}
+	for _, s := range b.Spec.Signatures {
+		env.Signatures = append(env.Signatures, Signature{Sig: s.Signature})
+	}
+	return env
+}
+
+// body decodes the body of the entry.
+func (e RekorEntry) body() (rekorBody, error) {
+	b := rekorBody{}
+	raw, err := base64.StdEncoding.DecodeString(e.Body)
+	if err != nil {
+		return b, err
+	}
+	return b, json.Unmarshal(raw, &b)
+}
+
+// keys returns the base64 PEM keys or certificates that signed the entry.
+func (b rekorBody) keys() []string {
+	var keys []string
+	if b.Spec.Signature != nil {
+		keys = append(keys, b.Spec.Signature.PublicKey.Content)
+	}
+	if b.Spec.PublicKey != "" {
+		keys = append(keys, b.Spec.PublicKey)
+	}
+	if b.Spec.Content != nil && b.Spec.Content.Envelope != nil {
+		for _, s := range b.Spec.Content.Envelope.Signatures {
+			keys = append(keys, s.PublicKey)
+		}
+	}
+	for _, s := range b.Spec.Signatures {
+		keys = append(keys, s.Verifier)
+	}
+	return keys
+}
+
+// signers describes the keys or certificates that signed the entry.
+func (e RekorEntry) signers() (kind string, signers []string, err error) {
+	b, err := e.body()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, k := range b.keys() {
+		signers = append(signers, describeSigner(k))
+	}
+	return b.Kind + " " + b.APIVersion, signers, nil
+}
+
+// Fulcio certificate extensions naming the OIDC issuer of the identity.
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// describeSigner summarizes a base64 PEM certificate or public key.
+func describeSigner(encoded string) string {
+	contents, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "unparseable key"
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return "unparseable key"
+	}
+	if block.Type != "CERTIFICATE" {
+		sum := sha256.Sum256(block.Bytes)
+		return "key sha256:" + hex.EncodeToString(sum[:])
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "unparseable certificate"
+	}
+	ids := append([]string{}, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	if len(ids) == 0 {
+		ids = append(ids, cert.Subject.String())
+	}
+	s := strings.Join(ids, ", ")
+	for _, ext := range cert.Extensions {
+		var issuer string
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err != nil {
+				continue
+			}
+		case ext.Id.Equal(oidFulcioIssuer):
+			issuer = string(ext.Value)
+		default:
+			continue
+		}
+		s += " (issuer " + issuer + ")"
+		break
+	}
+	return s
+}
+
+var hexDigestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// searchDigest returns the "sha256:<hex>" digest of artifact, which is a file
+// or a digest with or without the algorithm prefix.
+func searchDigest(artifact string) (string, error) {
+	if d := strings.ToLower(strings.TrimPrefix(artifact, "sha256:")); hexDigestPattern.MatchString(d) {
+		if _, err := os.Stat(artifact); os.IsNotExist(err) {
+			return "sha256:" + d, nil
+		}
+	}
+	digest, err := digestFile(artifact)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + digest["sha256"], nil
+}
+
+// searchMain implements `search --artifact <file|digest>`, printing the
+// transparency log entries, and their signers and attestations, that
+// reference the artifact.
+func searchMain(args []string) {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	artifact := flags.String("artifact", "", "The artifact to search for: a file, or its sha256 digest.")
+	rekorURL := flags.String("rekor_url", DefaultRekorURL, "The Rekor transparency log to search.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if err := requireOnline("search"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *artifact == "" {
+		fmt.Println("No value found for required flag: --artifact")
+		flags.Usage()
+		os.Exit(1)
+	}
+	digest, err := searchDigest(*artifact)
+	if err != nil {
+		fmt.Printf("Failed to hash artifact: %s\n", err)
+		os.Exit(1)
+	}
+	c := newRekorClient(*rekorURL)
+	uuids, err := c.search(digest)
+	if err == nil && len(uuids) == 0 {
+		err = errors.New("no entries found")
+	}
+	if err != nil {
+		fmt.Printf("Failed to search %s for %s: %s\n", *rekorURL, digest, err)
+		os.Exit(1)
+	}
+	entries, err := c.entries(uuids)
+	if err != nil {
+		fmt.Printf("Failed to retrieve entries: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d entries reference %s:\n", len(entries), digest)
+	for _, e := range entries {
+		fmt.Printf("\n%s\n", e.UUID)
+		fmt.Printf("  Log index:  %d\n", e.LogIndex)
+		fmt.Printf("  Integrated: %s\n", time.Unix(e.IntegratedTime, 0).UTC().Format(time.RFC3339))
+		kind, signers, err := e.signers()
+		if err != nil {
+			fmt.Printf("  Unparseable entry body: %s\n", err)
+			continue
+		}
+		fmt.Printf("  Kind:       %s\n", kind)
+		for _, s := range signers {
+			fmt.Printf("  Signer:     %s\n", s)
+		}
+		if e.Attestation != nil && e.Attestation.Data != "" {
+			fmt.Printf("  Attestation: %s\n", describeAttestation(e.Attestation.Data))
+		}
+	}
+}
+
+// describeAttestation summarizes an attestation stored in the log.
+func describeAttestation(data string) string {
+	contents, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "unparseable"
+	}
+	var stmt struct {
+		PredicateType string    `json:"predicateType"`
+		Subject       []Subject `json:"subject"`
+	}
+	if err := json.Unmarshal(contents, &stmt); err != nil || stmt.PredicateType == "" {
+		return fmt.Sprintf("%d bytes", len(contents))
+	}
+	var names []string
+	for _, s := range stmt.Subject {
+		names = append(names, s.Name)
+	}
+	return fmt.Sprintf("%s for %s", stmt.PredicateType, strings.Join(names, ", "))
+}
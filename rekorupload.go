@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// RekorInclusionProof proves that an entry is in the log's Merkle tree, as
+// of the signed checkpoint of a tree of TreeSize entries. Hashes are hex.
+type RekorInclusionProof struct {
+	LogIndex   int64    `json:"logIndex"`
+	RootHash   string   `json:"rootHash"`
+	TreeSize   int64    `json:"treeSize"`
+	Hashes     []string `json:"hashes"`
+	Checkpoint string   `json:"checkpoint"`
+}
+
+// RekorReceipt is written to <file>.rekor.json for each envelope uploaded to
+// the log, so that its entry can be found and checked without searching.
+type RekorReceipt struct {
+	URL                  string               `json:"url"`
+	UUID                 string               `json:"uuid"`
+	LogIndex             int64                `json:"logIndex"`
+	LogID                string               `json:"logID"`
+	IntegratedTime       int64                `json:"integratedTime"`
+	SignedEntryTimestamp string               `json:"signedEntryTimestamp,omitempty"`
+	InclusionProof       *RekorInclusionProof `json:"inclusionProof,omitempty"`
+}
+
+// upload adds env, signed by the key or certificate verifier in PEM, to the
+// log as a dsse entry. An envelope the log already has, e.g. uploaded by an
+// earlier attempt of the run, isn't added twice: its entry is returned
+// instead.
+func (c *rekorClient) upload(env *Envelope, verifier []byte) (*RekorEntry, error) {
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decoding envelope payload: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	digest := hex.EncodeToString(sum[:])
+	envelope, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "dsse",
+		"spec": map[string]interface{}{
+			"proposedContent": map[string]interface{}{
+				"envelope":  string(envelope),
+				"verifiers": []string{base64.StdEncoding.EncodeToString(verifier)},
+			},
+		},
+	}
+	var created map[string]RekorEntry
+	if err := c.post("/api/v1/log/entries", req, &created); err != nil {
+		if entry, _ := findLogEntry(c, env); entry != nil {
+			return entry, nil
+		}
+		return nil, err
+	}
+	for uuid, e := range created {
+		if b, err := e.body(); err != nil || b.payloadHash() != digest {
+			return nil, fmt.Errorf("log entry %s doesn't record the envelope", uuid)
+		}
+		e.UUID = uuid
+		return &e, nil
+	}
+	return nil, fmt.Errorf("%s returned no log entry", c.url)
+}
+
+// receipt describes entry, of the log at c.
+func (c *rekorClient) receipt(entry *RekorEntry) RekorReceipt {
+	r := RekorReceipt{URL: c.url, UUID: entry.UUID, LogIndex: entry.LogIndex, LogID: entry.LogID, IntegratedTime: entry.IntegratedTime}
+	if v := entry.Verification; v != nil {
+		r.SignedEntryTimestamp, r.InclusionProof = v.SignedEntryTimestamp, v.InclusionProof
+	}
+	return r
+}
+
+// signedEnvelope returns the envelope of the provenance written to path:
+// path itself, with --envelope, or the signature written next to a bare
+// statement by signKeyless.
+func signedEnvelope(path string) (*Envelope, error) {
+	for _, p := range []string{path, path + ".sig"} {
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		env := &Envelope{}
+		if json.Unmarshal(contents, env) == nil && env.PayloadType != "" && len(env.Signatures) > 0 {
+			return env, nil
+		}
+	}
+	return nil, fmt.Errorf("%s isn't signed", path)
+}
+
+// logProvenance uploads the envelopes of the written files, leaving out shard
+// indexes, to the log at c, signed by the key or certificate verifier in PEM.
+// The receipt of each is written to <file>.rekor.json and, for keyless
+// signatures by the certificate chain certs, the entry is added to the
+// Sigstore bundle signKeyless wrote. It returns the receipts and the files
+// written.
+func logProvenance(written []string, c *rekorClient, verifier []byte, certs []BundleCertificate, force bool) ([]RekorReceipt, []string, error) {
+	var receipts []RekorReceipt
+	var files []string
+	for _, path := range written {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return receipts, files, err
+		}
+		if parseShardIndex(contents) != nil {
+			continue
+		}
+		env, err := signedEnvelope(path)
+		if err != nil {
+			return receipts, files, err
+		}
+		entry, err := c.upload(env, verifier)
+		if err != nil {
+			return receipts, files, fmt.Errorf("uploading %s: %w", path, err)
+		}
+		if certs != nil {
+			t, _, err := bundleTlogEntry(entry)
+			if err != nil {
+				return receipts, files, err
+			}
+			b := keylessBundle(env, certs)
+			b.VerificationMaterial.TlogEntries = append(b.VerificationMaterial.TlogEntries, t)
+			bundle, err := json.Marshal(b)
+			if err != nil {
+				return receipts, files, err
+			}
+			// The bundle was only just written without the entry.
+			if err := writeOutput(path+".sigstore.json", bundle, true); err != nil {
+				return receipts, files, err
+			}
+		}
+		r := c.receipt(entry)
+		out, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return receipts, files, err
+		}
+		if err := writeOutput(path+".rekor.json", out, force); err != nil {
+			return receipts, files, err
+		}
+		receipts = append(receipts, r)
+		files = append(files, path+".rekor.json")
+	}
+	return receipts, files, nil
+}
+
+// uploadProvenance logs the envelopes of the written files in the Rekor log
+// at rekorURL, as logProvenance does, verified by the leaf of the keyless
+// certificate chain certs, if set, or else by the public key of signer.
+func uploadProvenance(rekorURL string, written []string, signer Signer, certs []BundleCertificate, force bool) ([]RekorReceipt, []string, error) {
+	var verifier []byte
+	if len(certs) > 0 {
+		der, err := base64.StdEncoding.DecodeString(certs[0].RawBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding the signing certificate: %w", err)
+		}
+		verifier = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	} else {
+		var err error
+		if verifier, err = marshalPublicKey(signer.Public()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return logProvenance(written, newRekorClient(rekorURL), verifier, certs, force)
+}
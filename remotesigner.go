@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SignRemote signs provenance with a key held by a signing service, which
+// the runner never sees.
+const SignRemote = "remote"
+
+// The remote signing protocol is a single call, POST <service>/v1/sign, with
+// a remoteSignRequest of the SHA-256 digest of the message to sign. The
+// caller authenticates with the job's GitHub OIDC token, of the service's URL
+// as audience, as a bearer token, with a TLS client certificate, or both,
+// which lets the service decide by the repository and workflow of the token
+// whether, and with which key, to sign. It answers with a remoteSignResponse,
+// or a 4xx status whose body says why it refused.
+type remoteSignRequest struct {
+	Digest DigestSet `json:"digest"`
+}
+
+// remoteSignResponse is the signature of a remoteSignRequest: an ASN.1 ECDSA
+// P-256 signature of the digest by the key certified by the first of the PEM
+// certificates, which are its chain, the leaf first.
+type remoteSignResponse struct {
+	Signature    string   `json:"signature"`
+	KeyId        string   `json:"keyId,omitempty"`
+	Certificates []string `json:"certificates"`
+}
+
+// remoteSigner signs with the key of a signing service. Its key and chain are
+// those of the first response, and are unset until then.
+type remoteSigner struct {
+	url    string
+	token  string
+	client *http.Client
+	keyId  string
+	public *ecdsa.PublicKey
+	certs  []BundleCertificate
+}
+
+// newRemoteSigner returns a signer of the service at serviceURL, authenticated
+// with the PEM client certificate and key at certPath and keyPath, if set, and
+// the job's OIDC token, if the job may request one.
+func newRemoteSigner(serviceURL, certPath, keyPath string, getenv func(string) string) (*remoteSigner, error) {
+	// The digests sent are harmless, but the token authenticating them mustn't
+	// cross the network in the clear.
+	if u, err := url.Parse(serviceURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("the signing service %q isn't an https URL", serviceURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if certPath != "" {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading the client certificate: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
+	}
+	s := &remoteSigner{
+		url:    strings.TrimSuffix(serviceURL, "/"),
+		client: &http.Client{Timeout: 30 * time.Second, Transport: guardedTransport{transport}},
+	}
+	if getenv("ACTIONS_ID_TOKEN_REQUEST_URL") != "" {
+		token, err := githubIDToken(s.url, s.client, getenv)
+		if err != nil {
+			return nil, err
+		}
+		s.token = token
+	} else if certPath == "" {
+		return nil, errors.New("no GitHub OIDC token or client certificate to authenticate to the signing service with; the job needs `permissions: id-token: write`")
+	}
+	return s, nil
+}
+
+func (s *remoteSigner) KeyId() string {
+	return s.keyId
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	if s.public == nil {
+		return nil
+	}
+	return s.public
+}
+
+// Sign has the service sign the digest of msg, and checks the signature
+// before returning it, so that a misconfigured service is found now rather
+// than by whoever verifies the provenance.
+func (s *remoteSigner) Sign(msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	body, err := json.Marshal(remoteSignRequest{DigestSet{"sha256": hex.EncodeToString(digest[:])}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url+"/v1/sign", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the signing service refused: %s: %s", resp.Status, bytes.TrimSpace(contents))
+	}
+	var r remoteSignResponse
+	if err := json.Unmarshal(contents, &r); err != nil {
+		return nil, fmt.Errorf("parsing the signing service response: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the signature: %w", err)
+	}
+	if len(r.Certificates) == 0 {
+		return nil, errors.New("the signing service returned no certificate")
+	}
+	var certs []BundleCertificate
+	var leaf *x509.Certificate
+	for _, c := range r.Certificates {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("the signing service returned a malformed certificate")
+		}
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("parsing the signing certificate: %w", err)
+			}
+		}
+		certs = append(certs, BundleCertificate{base64.StdEncoding.EncodeToString(block.Bytes)})
+	}
+	public, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || public.Curve != elliptic.P256() {
+		return nil, errors.New("the signing certificate isn't of an ECDSA P-256 key")
+	}
+	if !ecdsa.VerifyASN1(public, digest[:], sig) {
+		return nil, errors.New("the signing service returned a signature its certificate doesn't verify")
+	}
+	// All the provenance of a run is signed by the same key, which a service
+	// rotating keys mid-run would break.
+	if s.public != nil && !s.public.Equal(public) {
+		return nil, errors.New("the signing service changed keys while signing")
+	}
+	if s.public == nil {
+		s.public, s.certs, s.keyId = public, certs, r.KeyId
+		if s.keyId == "" {
+			der, err := x509.MarshalPKIXPublicKey(public)
+			if err != nil {
+				return nil, err
+			}
+			id := sha256.Sum256(der)
+			s.keyId = hex.EncodeToString(id[:])
+		}
+	}
+	return sig, nil
+}
+
+// signingCertificates returns the certificate chain of signer: certs, that of
+// a keyless signer, or the chain the signing service of a remote signer
+// returned.
+func signingCertificates(signer Signer, certs []BundleCertificate) []BundleCertificate {
+	if s, ok := signer.(*remoteSigner); ok {
+		return s.certs
+	}
+	return certs
+}
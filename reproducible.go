@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// buildFinishedOn returns the completion timestamp to record. In reproducible
+// mode this is taken from SOURCE_DATE_EPOCH rather than the wall clock or,
+// if it isn't set, from when the workflow run started, which is the same for
+// every generation in the run.
+// See https://reproducible-builds.org/docs/source-date-epoch/
+func buildFinishedOn(opts Options) (time.Time, error) {
+	if !opts.Reproducible {
+		return time.Now().UTC(), nil
+	}
+	epoch := opts.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		started, err := runStartedAt(opts)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("reproducible mode requires SOURCE_DATE_EPOCH, or the start time of the workflow run: %w", err)
+		}
+		return started, nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// runStartedAt reads when the workflow run described by the github context
+// started from the API.
+func runStartedAt(opts Options) (time.Time, error) {
+	var gh GitHubContext
+	if err := json.Unmarshal([]byte(opts.GitHubContext), &gh); err != nil {
+		return time.Time{}, fmt.Errorf("parsing github context: %w", err)
+	}
+	if gh.Repository == "" || gh.RunId == "" {
+		return time.Time{}, errors.New("the github context names no workflow run")
+	}
+	if err := requireOnline("--reproducible without SOURCE_DATE_EPOCH"); err != nil {
+		return time.Time{}, err
+	}
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if opts.Timing != nil {
+		defer track(&opts.Timing.API)()
+	}
+	var run workflowRun
+	if err := c.get(fmt.Sprintf("/repos/%s/actions/runs/%s", gh.Repository, gh.RunId), &run); err != nil {
+		return time.Time{}, fmt.Errorf("reading workflow run %s: %w", gh.RunId, err)
+	}
+	if run.RunStartedAt.IsZero() {
+		return time.Time{}, fmt.Errorf("workflow run %s has no start time", gh.RunId)
+	}
+	return run.RunStartedAt.UTC().Truncate(time.Second), nil
+}
+
+// sortStatement orders every list in stmt so that its serialization doesn't
+// depend on filesystem walk or input order. The recipe's definedInMaterial
+// follows its material to where it is sorted.
+func sortStatement(stmt *Statement) {
+	sort.SliceStable(stmt.Subject, func(i, j int) bool {
+		return stmt.Subject[i].Name < stmt.Subject[j].Name
+	})
+	materials := stmt.Predicate.Materials
+	order := make([]int, len(materials))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return materials[order[i]].URI < materials[order[j]].URI
+	})
+	sorted := make([]Item, len(materials))
+	defined := stmt.Predicate.Recipe.DefinedInMaterial
+	for i, k := range order {
+		sorted[i] = materials[k]
+		if k == defined {
+			stmt.Predicate.Recipe.DefinedInMaterial = i
+		}
+	}
+	stmt.Predicate.Materials = sorted
+}
+
+// canonicalJSON serializes v with object keys sorted, no insignificant
+// whitespace and no HTML escaping, so equal values yield identical bytes.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// resign replaces the signatures of env, which must be signed by verifier,
+// e.g. a retired key of the build, with one by signer. The payload is left as
+// is, so the statement, and the validity window it records, are unchanged.
+func resign(env *Envelope, verifier Verifier, signer Signer, now time.Time) error {
+	payload, err := verifyEnvelope(env, verifier)
+	if err != nil {
+		return err
+	}
+	if env.PayloadType == PayloadContentType {
+		stmt := &Statement{}
+		if err := decodeStatement(payload, stmt); err != nil {
+			return fmt.Errorf("parsing envelope payload: %w", err)
+		}
+		if stmt.Type != StatementV01Type && stmt.Type != StatementV1Type {
+			return errors.New("envelope payload is not an in-toto statement")
+		}
+		if v := stmt.Predicate.Metadata.Validity; v != nil {
+			if notAfter, err := time.Parse(time.RFC3339, v.NotAfter); err == nil && now.After(notAfter) {
+				return fmt.Errorf("the provenance expired on %s; regenerate it instead", v.NotAfter)
+			}
+		}
+	}
+	resigned, err := signEnvelope(env.PayloadType, payload, signer)
+	if err != nil {
+		return err
+	}
+	env.Signatures = resigned.Signatures
+	return nil
+}
+
+// resignMain implements `resign --envelope <file> --verify_key <key> --key
+// <key>`, moving a signed envelope, or each envelope of a JSON Lines bundle,
+// to a new key, e.g. on rotation, without regenerating its statement.
+func resignMain(args []string) {
+	flags := flag.NewFlagSet("resign", flag.ExitOnError)
+	envelopePath := flags.String("envelope", "", "The DSSE envelope, or JSON Lines attestation bundle, to re-sign.")
+	verifyKey := flags.String("verify_key", "", "The PEM public key the envelopes are signed with now.")
+	keyPath := flags.String("key", "", "The PEM private key to re-sign with.")
+	outputPath := flags.String("output_path", "", "Path to write the re-signed envelopes to (default: --envelope, in place).")
+	flags.Parse(args)
+	if *envelopePath == "" || *verifyKey == "" || *keyPath == "" {
+		fmt.Println("--envelope, --verify_key and --key are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *outputPath == "" {
+		*outputPath = *envelopePath
+	}
+	verifier, err := loadVerifier(*verifyKey)
+	if err != nil {
+		fmt.Printf("Failed to load verification key: %s\n", err)
+		os.Exit(1)
+	}
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	contents, err := readAttestationFile(*envelopePath)
+	if err != nil {
+		fmt.Printf("Failed to read envelope: %s\n", err)
+		os.Exit(1)
+	}
+	// A single envelope may be indented; a bundle has an envelope per line.
+	lines := [][]byte{contents}
+	if !json.Valid(contents) {
+		lines = bytes.Split(contents, []byte("\n"))
+	}
+	var out bytes.Buffer
+	n := 0
+	now := time.Now()
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		env := &Envelope{}
+		if err := json.Unmarshal(line, env); err != nil || env.PayloadType == "" {
+			fmt.Printf("%s: envelope %d is not a DSSE envelope\n", *envelopePath, i+1)
+			os.Exit(1)
+		}
+		if err := resign(env, verifier, signer, now); err != nil {
+			fmt.Printf("Failed to re-sign envelope %d of %s: %s\n", i+1, *envelopePath, err)
+			os.Exit(1)
+		}
+		b, err := json.Marshal(env)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(lines) > 1 {
+			b = append(b, '\n')
+		}
+		out.Write(b)
+		n++
+	}
+	if err := ioutil.WriteFile(*outputPath, out.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write envelope: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-signed with key %s (%d envelopes): %s\n", signer.KeyId(), n, *outputPath)
+}
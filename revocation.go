@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RevocationListPayloadType is the DSSE payload type of a signed
+// RevocationList.
+const RevocationListPayloadType = "application/vnd.slsa-framework.revocations+json"
+
+// RevocationList names the builds, keys and artifacts whose attestations
+// must no longer be trusted, e.g. after an incident.
+type RevocationList struct {
+	// Runs are build invocation ids, as in metadata.buildInvocationId.
+	Runs []string `json:"runs,omitempty"`
+	// Keys are signing key ids: the hex SHA-256 of the DER public key.
+	Keys []string `json:"keys,omitempty"`
+	// Digests are artifact digests of the form "<algorithm>:<hex>".
+	Digests []string `json:"digests,omitempty"`
+}
+
+// loadRevocationList reads the revocation list envelope at source, a path or
+// an http(s) URL, and checks that it is signed by verifier.
+func loadRevocationList(source string, verifier Verifier) (*RevocationList, error) {
+	var contents []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		if err := requireOnline("a --revocation_list URL"); err != nil {
+			return nil, err
+		}
+		contents, err = fetchURL(source)
+	} else {
+		contents, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := openEnvelope(contents, source, RevocationListPayloadType, verifier)
+	if err != nil {
+		return nil, err
+	}
+	list := &RevocationList{}
+	if err := json.Unmarshal(payload, list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", source, err)
+	}
+	return list, nil
+}
+
+// fetchURL returns the body of a GET request for url.
+func fetchURL(url string) ([]byte, error) {
+	client := newHTTPClient(30 * time.Second)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// check returns a problem for each revoked run, key or digest the provenance
+// stmt, verified with the keys of keyIds, refers to. The key ids a signature
+// names are chosen by its signer, so only those of the keys that verified it
+// are matched.
+func (l *RevocationList) check(stmt *Statement, keyIds []string) []string {
+	runs, keys, digests := stringSet(l.Runs...), stringSet(l.Keys...), stringSet(l.Digests...)
+	var problems []string
+	if id := stmt.Predicate.Metadata.BuildInvocationId; runs[id] {
+		problems = append(problems, fmt.Sprintf("run %s is revoked", id))
+	}
+	for _, id := range keyIds {
+		if keys[id] {
+			problems = append(problems, fmt.Sprintf("signing key %s is revoked", id))
+		}
+	}
+	revoked := func(digest DigestSet) string {
+		for alg, d := range digest {
+			if digests[alg+":"+d] {
+				return alg + ":" + d
+			}
+		}
+		return ""
+	}
+	for _, s := range stmt.Subject {
+		if d := revoked(s.Digest); d != "" {
+			problems = append(problems, fmt.Sprintf("subject %s (%s) is revoked", s.Name, d))
+		}
+	}
+	for _, m := range stmt.Predicate.Materials {
+		if d := revoked(m.Digest); d != "" {
+			problems = append(problems, fmt.Sprintf("material %s (%s) is revoked", m.URI, d))
+		}
+	}
+	return problems
+}
+
+// revokeMain implements `revoke --key <key> --list <file>`, signing a
+// RevocationList for verify --revocation_list.
+func revokeMain(args []string) {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	keyPath := flags.String("key", "", "The PEM private key to sign the revocation list with.")
+	listPath := flags.String("list", "", "The JSON revocation list to sign.")
+	outputPath := flags.String("output_path", "revocations.dsse", "Path to write the signed revocation list to.")
+	flags.Parse(args)
+	if *keyPath == "" || *listPath == "" {
+		fmt.Println("Both --key and --list are required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	signer, err := loadSigner(*keyPath)
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	contents, err := ioutil.ReadFile(*listPath)
+	if err != nil {
+		fmt.Printf("Failed to read revocation list: %s\n", err)
+		os.Exit(1)
+	}
+	list := RevocationList{}
+	if err := json.Unmarshal(contents, &list); err != nil {
+		fmt.Printf("Failed to parse revocation list: %s\n", err)
+		os.Exit(1)
+	}
+	// Sign the list as parsed, so that unknown fields aren't signed without
+	// taking effect.
+	payload, err := json.Marshal(list)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	env, err := signEnvelope(RevocationListPayloadType, payload, signer)
+	if err != nil {
+		fmt.Printf("Failed to sign revocation list: %s\n", err)
+		os.Exit(1)
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*outputPath, out, 0644); err != nil {
+		fmt.Printf("Failed to write revocation list: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signed revocation list of %d runs, %d keys and %d digests: %s\n", len(list.Runs), len(list.Keys), len(list.Digests), *outputPath)
+}
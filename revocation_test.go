@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRevocationListCheck(t *testing.T) {
+	stmt := testProvenance("app", "https://builder", "git+https://github.com/o/r")
+	stmt.Subject[0].Digest["sha512"] = strings.Repeat("f", 128)
+	stmt.Predicate.Metadata.BuildInvocationId = "https://github.com/o/r/actions/runs/42"
+	appDigest := "sha256:" + testDigest("app")["sha256"]
+	tests := []struct {
+		name   string
+		list   RevocationList
+		keyIds []string
+		want   []string
+	}{
+		{"empty list", RevocationList{}, []string{"k1"}, nil},
+		{"run", RevocationList{Runs: []string{"https://github.com/o/r/actions/runs/42"}}, nil, []string{"run https://github.com/o/r/actions/runs/42 is revoked"}},
+		{"other run", RevocationList{Runs: []string{"https://github.com/o/r/actions/runs/4"}}, nil, nil},
+		{"verifying key", RevocationList{Keys: []string{"k1"}}, []string{"k2", "k1"}, []string{"signing key k1 is revoked"}},
+		// A key id the signature names but whose key didn't verify it isn't
+		// among keyIds.
+		{"key of an unverified signature", RevocationList{Keys: []string{"k1"}}, []string{"k2"}, nil},
+		{"unsigned", RevocationList{Keys: []string{"k1"}}, nil, nil},
+		{"subject digest", RevocationList{Digests: []string{appDigest}}, nil, []string{"subject app (" + appDigest + ") is revoked"}},
+		{"subject digest of another algorithm", RevocationList{Digests: []string{"sha512:" + strings.Repeat("f", 128)}}, nil, []string{"subject app (sha512:" + strings.Repeat("f", 128) + ") is revoked"}},
+		{"bare digest", RevocationList{Digests: []string{testDigest("app")["sha256"]}}, nil, nil},
+		{"digest of another algorithm", RevocationList{Digests: []string{"sha1:" + testDigest("app")["sha256"]}}, nil, nil},
+		{"material digest", RevocationList{Digests: []string{"sha256:" + testDigest("git+https://github.com/o/r")["sha256"]}}, nil,
+			[]string{"material git+https://github.com/o/r (sha256:" + testDigest("git+https://github.com/o/r")["sha256"] + ") is revoked"}},
+		{"everything", RevocationList{Runs: []string{"https://github.com/o/r/actions/runs/42"}, Keys: []string{"k1"}, Digests: []string{appDigest}}, []string{"k1"},
+			[]string{"run https://github.com/o/r/actions/runs/42 is revoked", "signing key k1 is revoked", "subject app (" + appDigest + ") is revoked"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.list.check(stmt, tt.keyIds); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	dir := t.TempDir()
+	signer, verifier := testVerifier(t)
+	_, other := testVerifier(t)
+	payload, err := json.Marshal(RevocationList{Runs: []string{"42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, payloadType string) string {
+		env, err := signEnvelope(payloadType, payload, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	list := write("revocations.dsse", RevocationListPayloadType)
+	provenance := write("provenance.dsse", PayloadContentType)
+	tests := []struct {
+		name     string
+		path     string
+		verifier Verifier
+		wantErr  string
+	}{
+		{"signed", list, verifier, ""},
+		{"signed by another key", list, other, "signature"},
+		{"other payload type", provenance, verifier, "payload type"},
+		{"missing", filepath.Join(dir, "missing.dsse"), verifier, "missing.dsse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadRevocationList(tt.path, tt.verifier)
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadRevocationList() = %v, want an error containing %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("loadRevocationList() = %v", err)
+			case !reflect.DeepEqual(got.Runs, []string{"42"}):
+				t.Errorf("loadRevocationList() runs = %q, want 42", got.Runs)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// runArtifactSpec identifies a workflow run artifact, e.g.
+// "name=dist,run_id=123,repository=org/repo", where the run and repository
+// default to those of the github context.
+type runArtifactSpec struct {
+	Name       string
+	RunId      string
+	Repository string
+}
+
+func parseRunArtifactSpec(s string, githubContext string) (runArtifactSpec, error) {
+	spec := runArtifactSpec{}
+	for _, kv := range parseList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return spec, fmt.Errorf("invalid run artifact %q: expected key=value pairs", s)
+		}
+		switch parts[0] {
+		case "name":
+			spec.Name = parts[1]
+		case "run_id":
+			spec.RunId = parts[1]
+		case "repository":
+			spec.Repository = parts[1]
+		default:
+			return spec, fmt.Errorf("invalid run artifact %q: unknown key %q", s, parts[0])
+		}
+	}
+	if spec.Name == "" {
+		return spec, fmt.Errorf("invalid run artifact %q: missing name", s)
+	}
+	var gh struct {
+		Repository string `json:"repository"`
+		RunId      string `json:"run_id"`
+	}
+	if err := json.Unmarshal([]byte(githubContext), &gh); err != nil {
+		return spec, fmt.Errorf("parsing github context: %w", err)
+	}
+	if spec.RunId == "" {
+		spec.RunId = gh.RunId
+	}
+	if spec.Repository == "" {
+		spec.Repository = gh.Repository
+	}
+	if spec.RunId == "" || spec.Repository == "" {
+		return spec, fmt.Errorf("invalid run artifact %q: the run and repository are unknown", s)
+	}
+	return spec, nil
+}
+
+// runArtifactSubjects downloads the workflow run artifact described by s and
+// returns the files it contains as subjects, named by their path within it.
+func runArtifactSubjects(s string, opts Options) ([]Subject, error) {
+	spec, err := parseRunArtifactSpec(s, opts.GitHubContext)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Artifacts []struct {
+			Name               string `json:"name"`
+			Expired            bool   `json:"expired"`
+			ArchiveDownloadURL string `json:"archive_download_url"`
+		} `json:"artifacts"`
+	}
+	q := url.Values{"name": {spec.Name}, "per_page": {"100"}}
+	if err := c.get(fmt.Sprintf("/repos/%s/actions/runs/%s/artifacts?%s", spec.Repository, url.PathEscape(spec.RunId), q.Encode()), &list); err != nil {
+		return nil, err
+	}
+	download := ""
+	for _, a := range list.Artifacts {
+		if a.Name == spec.Name && !a.Expired {
+			download = a.ArchiveDownloadURL
+		}
+	}
+	if download == "" {
+		return nil, fmt.Errorf("run %s of %s has no unexpired artifact named %q", spec.RunId, spec.Repository, spec.Name)
+	}
+	f, size, err := downloadArtifact(c, download, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	return zipSubjects(f, size, opts.DigestAlgorithms)
+}
+
+// downloadArtifact downloads the zip archive of the artifact name from
+// download to a temporary file, which the caller removes, returning it and
+// its size.
+func downloadArtifact(c *githubClient, download, name string) (*os.File, int64, error) {
+	body, err := c.open(download)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+	// zip needs random access, so the archive is spooled to disk.
+	f, err := ioutil.TempFile("", "run-artifact-*.zip")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, fmt.Errorf("downloading artifact %s: %w", name, err)
+	}
+	return f, size, nil
+}
+
+// zipSubjects hashes the files in a zip archive with algorithms.
+func zipSubjects(r io.ReaderAt, size int64, algorithms []string) ([]Subject, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var subjects []Subject
+	for _, file := range z.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(strings.Replace(file.Name, `\`, "/", -1), "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("artifact entry %q escapes the artifact", file.Name)
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := digestReader(rc, algorithms...)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading artifact entry %s: %w", file.Name, err)
+		}
+		subjects = append(subjects, Subject{Name: name, Digest: digest})
+	}
+	return subjects, nil
+}
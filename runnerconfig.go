@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// RunnerConfig identifies the self-hosted runner that executed the job, and
+// the pool it was registered to, by the .runner file its configuration
+// wrote. It is an extension to the recorded environment.
+type RunnerConfig struct {
+	// Digest is the digest of the .runner file, which holds no credentials:
+	// those are in .credentials, which is never read.
+	Digest    DigestSet `json:"digest"`
+	AgentId   int       `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	PoolId    int       `json:"pool_id"`
+	PoolName  string    `json:"pool_name"`
+	GitHubURL string    `json:"github_url"`
+	Ephemeral bool      `json:"ephemeral"`
+	// Labels are those the job ran on, which the runner matched, and
+	// RunnerGroup the group the API reports the runner belongs to.
+	Labels      []string `json:"labels,omitempty"`
+	RunnerGroup string   `json:"runner_group,omitempty"`
+}
+
+// findRunnerDir returns dir if set or else the runner directory holding the
+// .runner file, which is an ancestor of the runner's temp and work
+// directories.
+func findRunnerDir(dir string, getenv func(string) string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	for _, env := range []string{"RUNNER_TEMP", "RUNNER_WORKSPACE"} {
+		for d := getenv(env); d != ""; d = filepath.Dir(d) {
+			if _, err := os.Stat(filepath.Join(d, ".runner")); err == nil {
+				return d, nil
+			}
+			if parent := filepath.Dir(d); parent == d {
+				break
+			}
+		}
+	}
+	return "", errors.New("no .runner file found above $RUNNER_TEMP or $RUNNER_WORKSPACE; set --runner_dir")
+}
+
+// runnerConfig reads the configuration of the runner in dir. The labels the
+// job ran on are read from the jobs of the run with the API, unless
+// --offline is set; failing to read them is reported, but doesn't fail.
+func runnerConfig(dir string, gh GitHubContext, runner RunnerContext, opts Options, findings *Findings) (*RunnerConfig, error) {
+	dir, err := findRunnerDir(dir, opts.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, ".runner"))
+	if err != nil {
+		return nil, err
+	}
+	digest, err := digestReader(bytes.NewReader(contents), DefaultDigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	var settings struct {
+		AgentId   int    `json:"agentId"`
+		AgentName string `json:"agentName"`
+		PoolId    int    `json:"poolId"`
+		PoolName  string `json:"poolName"`
+		GitHubURL string `json:"gitHubUrl"`
+		Ephemeral bool   `json:"ephemeral"`
+	}
+	// The runner writes the file with a byte order mark.
+	if err := json.Unmarshal(bytes.TrimPrefix(contents, []byte("\xef\xbb\xbf")), &settings); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filepath.Join(dir, ".runner"), err)
+	}
+	config := &RunnerConfig{
+		Digest:    digest,
+		AgentId:   settings.AgentId,
+		AgentName: settings.AgentName,
+		PoolId:    settings.PoolId,
+		PoolName:  settings.PoolName,
+		GitHubURL: settings.GitHubURL,
+		Ephemeral: settings.Ephemeral,
+	}
+	if settings.AgentName != runner.Name && runner.Name != "" {
+		return nil, fmt.Errorf("%s configures runner %q, but the job ran on %q", filepath.Join(dir, ".runner"), settings.AgentName, runner.Name)
+	}
+	if err := requireOnline("reading runner labels"); err != nil {
+		findings.add(CodeNoRunnerConfig, "the runner's labels were not recorded: %s", err)
+		return config, nil
+	}
+	if err := runnerLabels(config, gh, opts); err != nil {
+		findings.add(CodeNoRunnerConfig, "unable to read the runner's labels: %s", err)
+	}
+	return config, nil
+}
+
+// runnerLabels records the labels and runner group of the job of the run
+// that is in progress on the runner.
+func runnerLabels(config *RunnerConfig, gh GitHubContext, opts Options) error {
+	c, err := newGitHubClient(opts.GitHubContext, opts)
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Jobs []struct {
+			Status          string   `json:"status"`
+			Labels          []string `json:"labels"`
+			RunnerName      string   `json:"runner_name"`
+			RunnerGroupName string   `json:"runner_group_name"`
+		} `json:"jobs"`
+	}
+	path := fmt.Sprintf("/repos/%s/actions/runs/%s/attempts/%s/jobs?per_page=100", gh.Repository, gh.RunId, gh.RunAttempt)
+	if gh.RunAttempt == "" {
+		path = fmt.Sprintf("/repos/%s/actions/runs/%s/jobs?per_page=100", gh.Repository, gh.RunId)
+	}
+	if err := c.get(path, &list); err != nil {
+		return err
+	}
+	for _, j := range list.Jobs {
+		if j.Status == "in_progress" && j.RunnerName == config.AgentName {
+			config.Labels, config.RunnerGroup = j.Labels, j.RunnerGroupName
+			return nil
+		}
+	}
+	return fmt.Errorf("no job of run %s is in progress on runner %q", gh.RunId, config.AgentName)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// s3Store reads provenance from an S3 bucket laid out as a filesystem store,
+// e.g. the --store directory of workers synced to it with `aws s3 sync`,
+// under an optional key prefix. It is read-only.
+type s3Store struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	region   string
+	client   *http.Client
+	getenv   func(string) string
+}
+
+// newS3Store returns the store of an s3://<bucket>[/<prefix>] URL. Requests
+// are signed with the credentials of --cloud_auth or the AWS credentials in
+// $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, or sent
+// anonymously without them, to the bucket in $AWS_REGION, or to
+// $AWS_ENDPOINT_URL for S3-compatible storage.
+func newS3Store(u *url.URL) (*s3Store, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 store URL %q names no bucket", u.String())
+	}
+	s := &s3Store{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		client: newHTTPClient(30 * time.Second),
+		getenv: os.Getenv,
+	}
+	s.region = awsRegion(s.getenv)
+	if endpoint := s.getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		// S3-compatible storage is addressed by path.
+		s.endpoint = strings.TrimSuffix(endpoint, "/") + "/" + s.bucket
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	}
+	return s, nil
+}
+
+// get reads the object at key, relative to the prefix, returning its
+// contents and modification time, or nil contents if it doesn't exist.
+func (s *s3Store) get(key string) ([]byte, time.Time, error) {
+	escaped := (&url.URL{Path: "/" + path.Join(s.prefix, key)}).EscapedPath()
+	req, err := http.NewRequest(http.MethodGet, s.endpoint+escaped, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	signAWSRequest(req, nil, "s3", s.region, awsEnvCredentials(s.getenv), time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, time.Time{}, nil
+	default:
+		return nil, time.Time{}, fmt.Errorf("reading s3://%s/%s: %s", s.bucket, path.Join(s.prefix, key), resp.Status)
+	}
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return contents, modified.UTC(), nil
+}
+
+func (s *s3Store) BySubject(digest string) ([]StoredAttestation, error) {
+	if !hexDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("malformed sha256 digest %q", digest)
+	}
+	index, _, err := s.get("subjects/sha256/" + digest)
+	if err != nil {
+		return nil, err
+	}
+	var attestations []StoredAttestation
+	for _, d := range parseIndex(index) {
+		contents, modified, err := s.get("objects/sha256/" + d)
+		if err != nil {
+			return nil, err
+		}
+		if contents == nil {
+			return nil, fmt.Errorf("s3://%s/%s indexes %s, which is missing", s.bucket, s.prefix, d)
+		}
+		if sum := sha256.Sum256(contents); hex.EncodeToString(sum[:]) != d {
+			return nil, fmt.Errorf("s3://%s/%s: object %s doesn't match its digest", s.bucket, s.prefix, d)
+		}
+		a, err := storedAttestation(contents, "s3://"+path.Join(s.bucket, s.prefix, "objects/sha256", d), modified)
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a)
+	}
+	return attestations, nil
+}
+
+func (s *s3Store) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verify reports its problems in SARIF, for upload to GitHub code scanning,
+// under these rules.
+// See https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+const (
+	RuleUnverifiedArtifact   = "unverified-artifact"
+	RulePolicyViolation      = "policy-violation"
+	RuleUntrustedSigner      = "untrusted-signer"
+	RuleUnreadableProvenance = "unreadable-provenance"
+	RuleNoProvenance         = "no-provenance"
+)
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+var sarifRules = []sarifRule{
+	{RuleUnverifiedArtifact, "Artifact doesn't match its provenance", "An artifact is missing, differs from its subject digest or, with --exhaustive, isn't a subject of the provenance."},
+	{RulePolicyViolation, "Provenance violates the verify policy", "The provenance, or that of a material in the chain, isn't SLSA provenance, comes from an untrusted builder, isn't signed with the key given, is revoked or lacks a verified source commit."},
+	{RuleUntrustedSigner, "Provenance isn't signed by the expected key", "The provenance isn't signed with --public_key or, with --tofu, is signed with a key other than the one pinned for its repository and builder."},
+	{RuleUnreadableProvenance, "Provenance can't be read", "The provenance can't be parsed, or doesn't attest the artifact."},
+	{RuleNoProvenance, "Artifact has no provenance", "No provenance of the artifact was found."},
+}
+
+type sarifRule struct {
+	Id               string
+	ShortDescription string
+	FullDescription  string
+}
+
+func (r sarifRule) MarshalJSON() ([]byte, error) {
+	type text struct {
+		Text string `json:"text"`
+	}
+	return json.Marshal(struct {
+		Id                   string            `json:"id"`
+		ShortDescription     text              `json:"shortDescription"`
+		FullDescription      text              `json:"fullDescription"`
+		DefaultConfiguration map[string]string `json:"defaultConfiguration"`
+		Properties           map[string]string `json:"properties"`
+	}{r.Id, text{r.ShortDescription}, text{r.FullDescription}, map[string]string{"level": "error"}, map[string]string{"security-severity": "8.0"}})
+}
+
+type sarifResult struct {
+	RuleId  string `json:"ruleId"`
+	Level   string `json:"level"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI       string `json:"uri"`
+			URIBaseId string `json:"uriBaseId,omitempty"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+type sarifVersionControl struct {
+	RepositoryURI string `json:"repositoryUri"`
+	RevisionId    string `json:"revisionId,omitempty"`
+}
+
+// sarifReport collects the problems verify reports as SARIF results, each
+// located at the artifact or provenance file it concerns. Code scanning
+// closes the alerts of a rule once an upload has no results for it, so the
+// report is written on success too.
+type sarifReport struct {
+	path    string
+	results []sarifResult
+	source  []sarifVersionControl
+}
+
+func newSARIFReport(path string) *sarifReport {
+	return &sarifReport{path: path}
+}
+
+// add records problems under rule, located at the file at path.
+func (r *sarifReport) add(rule, path string, problems []string) {
+	var loc sarifLocation
+	loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(path)
+	if !filepath.IsAbs(path) {
+		// Relative paths are those of the checkout the upload is for.
+		loc.PhysicalLocation.ArtifactLocation.URIBaseId = "%SRCROOT%"
+	}
+	for _, p := range problems {
+		res := sarifResult{RuleId: rule, Level: "error", Locations: []sarifLocation{loc}}
+		res.Message.Text = p
+		r.results = append(r.results, res)
+	}
+}
+
+// describe records the source repository and commit stmt was built from.
+func (r *sarifReport) describe(stmt *Statement) {
+	repo := strings.TrimPrefix(provenanceRepository(stmt), "git+")
+	if repo == "" || len(r.source) > 0 {
+		return
+	}
+	vc := sarifVersionControl{RepositoryURI: repo}
+	if m := stmt.Predicate.Materials[stmt.Predicate.Recipe.DefinedInMaterial]; m.Digest["sha1"] != "" {
+		vc.RevisionId = m.Digest["sha1"]
+	}
+	r.source = []sarifVersionControl{vc}
+}
+
+// write writes the report, if a path was given, exiting if it can't.
+func (r *sarifReport) write() {
+	if r.path == "" {
+		return
+	}
+	driver := map[string]interface{}{
+		"name":           "create_provenance",
+		"informationUri": GeneratorURI,
+		"version":        generatorVersion(),
+		"rules":          sarifRules,
+	}
+	run := map[string]interface{}{
+		"tool":    map[string]interface{}{"driver": driver},
+		"results": r.results,
+	}
+	if r.results == nil {
+		run["results"] = []sarifResult{}
+	}
+	if r.source != nil {
+		run["versionControlProvenance"] = r.source
+	}
+	out, err := json.MarshalIndent(map[string]interface{}{
+		"$schema": sarifSchema,
+		"version": "2.1.0",
+		"runs":    []interface{}{run},
+	}, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(r.path, append(out, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Failed to write SARIF: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SCITT signed statements are COSE_Sign1 messages, whose CWT claims name the
+// issuer and the artifact the statement is about.
+// See https://datatracker.ietf.org/doc/draft-ietf-scitt-architecture/
+const (
+	COSEType        = "application/cose"
+	coseSign1Tag    = 18
+	coseAlgES256    = -7
+	coseAlgEdDSA    = -8
+	coseHeaderAlg   = 1
+	coseHeaderCty   = 3
+	coseHeaderKid   = 4
+	coseHeaderCWT   = 15
+	cwtClaimIssuer  = 1
+	cwtClaimSubject = 2
+)
+
+// scittPollInterval and scittTimeout bound waiting for a transparency
+// service to register a statement.
+const (
+	scittPollInterval = time.Second
+	scittTimeout      = 2 * time.Minute
+)
+
+// cbor is a minimal encoder of the deterministic CBOR COSE needs: integers,
+// byte and text strings, arrays, maps with integer keys and tags.
+type cbor struct {
+	bytes.Buffer
+}
+
+func (c *cbor) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		c.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		c.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= 0xffff:
+		c.Write([]byte{major<<5 | 25, byte(n >> 8), byte(n)})
+	case n <= 0xffffffff:
+		c.Write([]byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	default:
+		c.WriteByte(major<<5 | 27)
+		for shift := 56; shift >= 0; shift -= 8 {
+			c.WriteByte(byte(n >> uint(shift)))
+		}
+	}
+}
+
+func (c *cbor) int(n int64) {
+	if n < 0 {
+		c.head(1, uint64(-1-n))
+	} else {
+		c.head(0, uint64(n))
+	}
+}
+
+func (c *cbor) bstr(b []byte) {
+	c.head(2, uint64(len(b)))
+	c.Write(b)
+}
+
+func (c *cbor) tstr(s string) {
+	c.head(3, uint64(len(s)))
+	c.WriteString(s)
+}
+
+// coseAlgorithm returns the COSE algorithm of signer's key.
+func coseAlgorithm(signer Signer) (int64, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return coseAlgES256, nil
+	case ed25519.PublicKey:
+		return coseAlgEdDSA, nil
+	}
+	return 0, fmt.Errorf("unsupported key type %T", signer.Public())
+}
+
+// coseSignature converts a signature of signer to its COSE form, in which
+// ECDSA signatures are the fixed-size concatenation of r and s rather than
+// ASN.1.
+func coseSignature(signer Signer, sig []byte) ([]byte, error) {
+	if _, ok := signer.Public().(*ecdsa.PublicKey); !ok {
+		return sig, nil
+	}
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return nil, fmt.Errorf("parsing ECDSA signature: %w", err)
+	}
+	raw := make([]byte, 64)
+	rs.R.FillBytes(raw[:32])
+	rs.S.FillBytes(raw[32:])
+	return raw, nil
+}
+
+// scittStatement wraps payload, of the given content type, in a SCITT signed
+// statement by issuer about subject, signed by signer.
+func scittStatement(payload []byte, contentType, issuer, subject string, signer Signer) ([]byte, error) {
+	alg, err := coseAlgorithm(signer)
+	if err != nil {
+		return nil, err
+	}
+	var protected cbor
+	protected.head(5, 4)
+	protected.int(coseHeaderAlg)
+	protected.int(alg)
+	protected.int(coseHeaderCty)
+	protected.tstr(contentType)
+	protected.int(coseHeaderKid)
+	protected.bstr([]byte(signer.KeyId()))
+	protected.int(coseHeaderCWT)
+	protected.head(5, 2)
+	protected.int(cwtClaimIssuer)
+	protected.tstr(issuer)
+	protected.int(cwtClaimSubject)
+	protected.tstr(subject)
+	// The signature covers the Sig_structure of RFC 9052, section 4.4.
+	var toSign cbor
+	toSign.head(4, 4)
+	toSign.tstr("Signature1")
+	toSign.bstr(protected.Bytes())
+	toSign.bstr(nil)
+	toSign.bstr(payload)
+	sig, err := signer.Sign(toSign.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if sig, err = coseSignature(signer, sig); err != nil {
+		return nil, err
+	}
+	var msg cbor
+	msg.head(6, coseSign1Tag)
+	msg.head(4, 4)
+	msg.bstr(protected.Bytes())
+	msg.head(5, 0)
+	msg.bstr(payload)
+	msg.bstr(sig)
+	return msg.Bytes(), nil
+}
+
+// scittClient registers signed statements with a SCITT transparency
+// service: one speaking SCRAPI, which answers with the receipt or redirects
+// to the operation registering the statement, or a CCF ledger such as
+// Microsoft's, which reports the operation as JSON.
+// See https://datatracker.ietf.org/doc/draft-ietf-scitt-scrapi/
+type scittClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newSCITTClient(url string) *scittClient {
+	return &scittClient{url: strings.TrimSuffix(url, "/"), token: os.Getenv("SCITT_TOKEN"), client: newHTTPClient(30 * time.Second)}
+}
+
+func (c *scittClient) do(method, url string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", COSEType)
+	}
+	req.Header.Set("Accept", COSEType+", application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	return resp, contents, err
+}
+
+func isCOSE(resp *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return t == COSEType
+}
+
+// submit registers statement, waiting for the service to do so, and returns
+// the receipt of its registration.
+func (c *scittClient) submit(statement []byte) ([]byte, error) {
+	resp, body, err := c.do(http.MethodPost, c.url+"/entries", statement)
+	deadline := time.Now().Add(scittTimeout)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			var e struct {
+				Error *struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if json.Unmarshal(body, &e) == nil && e.Error != nil && e.Error.Message != "" {
+				return nil, fmt.Errorf("%s: %s: %s", resp.Request.URL, resp.Status, e.Error.Message)
+			}
+			return nil, fmt.Errorf("%s: %s", resp.Request.URL, resp.Status)
+		}
+		if isCOSE(resp) {
+			return body, nil
+		}
+		var op struct {
+			OperationId string `json:"operationId"`
+			Status      string `json:"status"`
+			EntryId     string `json:"entryId"`
+			Error       *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &op); err != nil {
+			return nil, fmt.Errorf("%s: unexpected response: %w", resp.Request.URL, err)
+		}
+		switch op.Status {
+		case "succeeded":
+			if op.EntryId == "" {
+				return nil, fmt.Errorf("%s: registered, but no entry id was returned", resp.Request.URL)
+			}
+			resp, body, err = c.do(http.MethodGet, c.url+"/entries/"+op.EntryId+"/receipt", nil)
+			if err == nil && (resp.StatusCode != http.StatusOK || !isCOSE(resp)) {
+				err = fmt.Errorf("fetching the receipt of entry %s: %s", op.EntryId, resp.Status)
+			}
+			return body, err
+		case "failed":
+			if op.Error != nil {
+				return nil, fmt.Errorf("registration failed: %s", op.Error.Message)
+			}
+			return nil, errors.New("registration failed")
+		}
+		next := c.url + "/operations/" + op.OperationId
+		if loc := resp.Header.Get("Location"); loc != "" {
+			u, err := resp.Request.URL.Parse(loc)
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		} else if op.OperationId == "" {
+			return nil, fmt.Errorf("%s: %s, without an operation to wait for", resp.Request.URL, resp.Status)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", next)
+		}
+		time.Sleep(scittPollInterval)
+		resp, body, err = c.do(http.MethodGet, next, nil)
+	}
+}
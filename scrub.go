@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces the values of scrubbed event fields.
+const Redacted = "[REDACTED]"
+
+// defaultScrubFields matches the event keys that commonly hold credentials
+// (e.g. installation tokens) or personal data.
+var defaultScrubFields = []string{"token", "*_token", "*secret*", "*password*", "*private_key*", "email"}
+
+// scrubEvent redacts, at any depth of the event document, the value of every
+// key matching one of the case-insensitive glob patterns in fields. It also
+// returns the paths of the redacted keys, e.g. "pull_request.user.email", in
+// name order.
+func scrubEvent(event json.RawMessage, fields []string) (json.RawMessage, []string, error) {
+	if len(event) == 0 || len(fields) == 0 {
+		return event, nil, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(event))
+	// Preserve large numeric IDs exactly instead of round-tripping via float64.
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, nil, err
+	}
+	var redacted []string
+	scrubbed, err := json.Marshal(scrub(doc, fields, "", &redacted))
+	sort.Strings(redacted)
+	return scrubbed, redacted, err
+}
+
+func scrub(v interface{}, fields []string, at string, redacted *[]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			key := k
+			if at != "" {
+				key = at + "." + k
+			}
+			if matchesAny(k, fields) {
+				v[k] = Redacted
+				*redacted = append(*redacted, key)
+			} else {
+				v[k] = scrub(child, fields, key, redacted)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = scrub(child, fields, fmt.Sprintf("%s[%d]", at, i), redacted)
+		}
+	}
+	return v
+}
+
+func matchesAny(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseList splits a comma-separated flag value, ignoring empty elements.
+func parseList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
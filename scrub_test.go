@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScrubEventDefaults(t *testing.T) {
+	event := `{
+		"action": "opened",
+		"token": "ghs_installation",
+		"installation": {"id": 12345678901234567890, "access_token": "ghs_1"},
+		"pull_request": {
+			"title": "Fix the build",
+			"user": {"login": "octocat", "Email": "octocat@example.com"},
+			"labels": [{"name": "ci", "client_secret": "s"}, {"name": "docs"}]
+		},
+		"inputs": {"DB_PASSWORD": "hunter2", "deploy_private_key_pem": "-----BEGIN", "version": "1.0"},
+		"tokens_used": 3
+	}`
+	got, redacted, err := scrubEvent([]byte(event), defaultScrubFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRedacted := []string{
+		"inputs.DB_PASSWORD",
+		"inputs.deploy_private_key_pem",
+		"installation.access_token",
+		"pull_request.labels[0].client_secret",
+		"pull_request.user.Email",
+		"token",
+	}
+	if !reflect.DeepEqual(redacted, wantRedacted) {
+		t.Errorf("scrubEvent() redacted %q, want %q", redacted, wantRedacted)
+	}
+	want := `{"action":"opened","inputs":{"DB_PASSWORD":"[REDACTED]","deploy_private_key_pem":"[REDACTED]","version":"1.0"},` +
+		`"installation":{"access_token":"[REDACTED]","id":12345678901234567890},` +
+		`"pull_request":{"labels":[{"client_secret":"[REDACTED]","name":"ci"},{"name":"docs"}],"title":"Fix the build","user":{"Email":"[REDACTED]","login":"octocat"}},` +
+		`"token":"[REDACTED]","tokens_used":3}`
+	if string(got) != want {
+		t.Errorf("scrubEvent() = %s, want %s", got, want)
+	}
+}
+
+func TestScrubEvent(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        string
+		fields       []string
+		want         string
+		wantRedacted []string
+	}{
+		{"no fields", `{"token": "t"}`, nil, `{"token": "t"}`, nil},
+		{"empty event", ``, defaultScrubFields, ``, nil},
+		{"custom pattern", `{"sender": {"login": "o", "id": 1}, "token": "t"}`, []string{"login"}, `{"sender":{"id":1,"login":"[REDACTED]"},"token":"t"}`, []string{"sender.login"}},
+		{"whole object", `{"sender": {"login": "o"}}`, []string{"sender"}, `{"sender":"[REDACTED]"}`, []string{"sender"}},
+		{"top-level array", `[{"token": "t"}]`, defaultScrubFields, `[{"token":"[REDACTED]"}]`, []string{"[0].token"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, redacted, err := scrubEvent([]byte(tt.event), tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want || !reflect.DeepEqual(redacted, tt.wantRedacted) {
+				t.Errorf("scrubEvent() = %s, %q, want %s, %q", got, redacted, tt.want, tt.wantRedacted)
+			}
+		})
+	}
+	if _, _, err := scrubEvent([]byte(`{"token":`), defaultScrubFields); err == nil {
+		t.Error("scrubEvent() of a malformed event succeeded")
+	}
+}
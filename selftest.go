@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const selftestArtifact = "selftest.txt"
+
+// selftestMain generates, signs and verifies a sample attestation, checking
+// it the way `cosign verify-blob-attestation` does: the DSSE signature over
+// the pre-authentication encoding, the payload type, the statement and
+// predicate types and the subject digest. It signs with a local key only, so
+// it doesn't exercise --sign=keyless or --sign=remote.
+func selftestMain(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of selftest: signs and verifies a sample attestation with a local key. --sign=keyless and --sign=remote, and their failure modes, are not tested.")
+		flags.PrintDefaults()
+	}
+	keyPath := flags.String("key", "", "PEM private key to sign with (ECDSA P-256 or Ed25519). When empty, an ephemeral key is generated.")
+	pubPath := flags.String("public_key", "", "PEM public key to verify with, e.g. the cosign.pub matching --key. When empty, the signer's own public key is used.")
+	pubTarget := flags.String("public_key_target", "", "The TUF target holding the PEM public key to verify with, instead of --public_key.")
+	outputDir := flags.String("output_dir", "", "When set, write the sample artifact, envelope and public key here for checking with cosign.")
+	trust := addTrustFlags(flags)
+	addOfflineFlag(flags)
+	flags.Parse(args)
+
+	dir, tmp := *outputDir, ""
+	if dir == "" {
+		var err error
+		if tmp, err = ioutil.TempDir("", "selftest"); err != nil {
+			fmt.Printf("Failed to create temporary directory: %s\n", err)
+			os.Exit(1)
+		}
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("Failed to create output directory: %s\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	step := func(name string, err error) bool {
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			failed = true
+			return false
+		}
+		fmt.Printf("PASS %s\n", name)
+		return true
+	}
+	// os.Exit skips deferred calls, so the temporary directory is removed
+	// first.
+	defer func() {
+		if tmp != "" {
+			os.RemoveAll(tmp)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
+	var signer *keySigner
+	var err error
+	if *keyPath != "" {
+		signer, err = loadSigner(*keyPath)
+	} else {
+		signer, err = generateSigner()
+	}
+	if !step("load signing key", err) {
+		return
+	}
+	var verifier Verifier = &keyVerifier{key: signer.Public()}
+	if *pubPath != "" {
+		v, err := loadVerifier(*pubPath)
+		if !step("load public key", err) {
+			return
+		}
+		verifier = v
+	} else if *pubTarget != "" {
+		contents, err := trust.target(*pubTarget)
+		if !step("fetch public key from TUF", err) {
+			return
+		}
+		v, err := parseVerifier(contents, *pubTarget)
+		if !step("load public key", err) {
+			return
+		}
+		verifier = v
+	}
+
+	artifact := filepath.Join(dir, selftestArtifact)
+	stmt, err := selftestStatement(artifact)
+	if !step("generate provenance", err) {
+		return
+	}
+	payload, err := json.Marshal(stmt)
+	if !step("serialize statement", err) {
+		return
+	}
+	env, err := signEnvelope(PayloadContentType, payload, signer)
+	if !step("sign envelope", err) {
+		return
+	}
+	if !step("verify envelope", verifySelftest(env, verifier, artifact)) {
+		return
+	}
+
+	if *outputDir == "" {
+		return
+	}
+	envPath := filepath.Join(dir, selftestArtifact+".intoto.jsonl")
+	contents, err := json.Marshal(env)
+	if err == nil {
+		err = ioutil.WriteFile(envPath, append(contents, '\n'), 0644)
+	}
+	if !step("write envelope", err) {
+		return
+	}
+	pub := *pubPath
+	if pub == "" {
+		pub = filepath.Join(dir, "selftest.pub")
+		pem, err := marshalPublicKey(signer.Public())
+		if err == nil {
+			err = ioutil.WriteFile(pub, pem, 0644)
+		}
+		if !step("write public key", err) {
+			return
+		}
+	}
+	fmt.Println("To check the sample with cosign, run:")
+	fmt.Printf("  cosign verify-blob-attestation --key %s --signature %s --type slsaprovenance %s\n", pub, envPath, artifact)
+}
+
+// selftestStatement writes a sample artifact to path and generates its
+// provenance from synthetic contexts.
+func selftestStatement(path string) (*Statement, error) {
+	if err := ioutil.WriteFile(path, []byte("create_provenance selftest\n"), 0644); err != nil {
+		return nil, err
+	}
+	gh := map[string]interface{}{
+		"repository": "slsa-framework/selftest",
+		"sha":        "0000000000000000000000000000000000000000",
+		"run_id":     "1",
+		"event_name": "workflow_dispatch",
+		"workflow":   "selftest",
+		"event":      map[string]interface{}{},
+	}
+	runner := map[string]interface{}{"os": "Linux", "arch": "X64", "environment": "github-hosted"}
+	ghContext, _ := json.Marshal(gh)
+	runnerContext, _ := json.Marshal(runner)
+	stmt, _, err := generate(Options{
+		ArtifactPaths: []string{path},
+		GitHubContext: string(ghContext),
+		RunnerContext: string(runnerContext),
+		Getenv:        func(string) string { return "" },
+	})
+	return stmt, err
+}
+
+// verifySelftest repeats the checks cosign applies to a blob attestation.
+func verifySelftest(env *Envelope, verifier Verifier, artifact string) error {
+	if env.PayloadType != PayloadContentType {
+		return fmt.Errorf("payload type is %q, want %q", env.PayloadType, PayloadContentType)
+	}
+	payload, err := verifyEnvelope(env, verifier)
+	if err != nil {
+		return err
+	}
+	stmt := Statement{}
+	if err := json.Unmarshal(payload, &stmt); err != nil {
+		return fmt.Errorf("payload is not an in-toto statement: %w", err)
+	}
+	if stmt.Type != StatementV01Type {
+		return fmt.Errorf("statement type is %q", stmt.Type)
+	}
+	if stmt.PredicateType != ProvenanceV01Type {
+		return fmt.Errorf("predicate type is %q", stmt.PredicateType)
+	}
+	digest, err := digestFile(artifact)
+	if err != nil {
+		return err
+	}
+	for _, s := range stmt.Subject {
+		if s.Digest["sha256"] == digest["sha256"] {
+			return nil
+		}
+	}
+	return fmt.Errorf("no subject matches the sha256 digest of %s", filepath.Base(artifact))
+}
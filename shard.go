@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// ShardIndexType is the media type of a ShardIndex.
+const ShardIndexType = "application/vnd.slsa-framework.provenance-shards+json"
+
+// ShardIndex is written to the output path in place of a Statement whose
+// subjects exceed the subject limit. It lists the Statements the subjects
+// were split across, each with the same predicate.
+type ShardIndex struct {
+	MediaType string  `json:"mediaType"`
+	Subjects  int     `json:"subjects"`
+	Shards    []Shard `json:"shards"`
+}
+
+type Shard struct {
+	// Path is relative to the directory of the index.
+	Path     string    `json:"path"`
+	Digest   DigestSet `json:"digest"`
+	Subjects int       `json:"subjects"`
+}
+
+// writeShards splits the subjects of stmt into Statements of at most max
+// subjects, written to path.1, path.2 and so on, and writes their index to
+// path. It returns the serialized index.
+func writeShards(stmt *Statement, path string, max int, opts Options) ([]byte, error) {
+	paths := []string{path}
+	for i := 0; i*max < len(stmt.Subject); i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i+1))
+	}
+	// Fail before writing any shard, rather than leave a partial set.
+	if err := checkOverwrite(opts.Force, paths...); err != nil {
+		return nil, err
+	}
+	index := ShardIndex{MediaType: ShardIndexType, Subjects: len(stmt.Subject)}
+	for i := 0; i*max < len(stmt.Subject); i++ {
+		end := (i + 1) * max
+		if end > len(stmt.Subject) {
+			end = len(stmt.Subject)
+		}
+		shard := *stmt
+		shard.Subject = stmt.Subject[i*max : end]
+		payload, err := marshalStatement(&shard, opts)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = wrapStatement(payload, opts); err != nil {
+			return nil, err
+		}
+		shardPath := fmt.Sprintf("%s.%d", path, i+1)
+		if err := writeOutput(shardPath, payload, opts.Force); err != nil {
+			return nil, err
+		}
+		if opts.CASDir != "" {
+			if err := casAdd(opts.CASDir, payload, shard.Subject); err != nil {
+				return nil, fmt.Errorf("adding to the local CAS: %w", err)
+			}
+		}
+		sum := sha256.Sum256(payload)
+		index.Shards = append(index.Shards, Shard{
+			Path:     filepath.Base(shardPath),
+			Digest:   DigestSet{"sha256": hex.EncodeToString(sum[:])},
+			Subjects: len(shard.Subject),
+		})
+	}
+	var payload []byte
+	var err error
+	if opts.Reproducible {
+		payload, err = canonicalJSON(index)
+	} else {
+		payload, err = json.MarshalIndent(index, "", "  ")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload, writeOutput(path, payload, opts.Force)
+}
+
+// parseShardIndex returns the index in contents, or nil if contents isn't a
+// ShardIndex.
+func parseShardIndex(contents []byte) *ShardIndex {
+	index := &ShardIndex{}
+	if err := json.Unmarshal(contents, index); err != nil || index.MediaType != ShardIndexType {
+		return nil
+	}
+	return index
+}
+
+// readShard reads the shard s of the index at path, checking its digest. As
+// writeShards names shards after their index, s.Path must be a file in the
+// same directory, and no shard is an index itself.
+func readShard(s Shard, path string) (string, []byte, error) {
+	if s.Path == "" || s.Path == "." || s.Path == ".." || filepath.Base(s.Path) != s.Path || s.Path != filepath.ToSlash(s.Path) {
+		return "", nil, fmt.Errorf("%s lists the shard %q outside its directory", path, s.Path)
+	}
+	shardPath := filepath.Join(filepath.Dir(path), s.Path)
+	contents, err := readAttestationFile(shardPath)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(contents)
+	if s.Digest["sha256"] != hex.EncodeToString(sum[:]) {
+		return "", nil, fmt.Errorf("%s doesn't match its digest in %s", shardPath, path)
+	}
+	if parseShardIndex(contents) != nil {
+		return "", nil, fmt.Errorf("%s is a shard index, not a shard of %s", shardPath, path)
+	}
+	return shardPath, contents, nil
+}
+
+// readShards reads the shards listed by the index at path, checking their
+// digests, and joins them back into one Statement. It also returns the
+// signatures of all shards that are envelopes.
+func readShards(index *ShardIndex, path string) (*Statement, []Signature, error) {
+	if len(index.Shards) == 0 {
+		return nil, nil, fmt.Errorf("%s lists no shards", path)
+	}
+	var joined *Statement
+	var signatures []Signature
+	for _, s := range index.Shards {
+		shardPath, contents, err := readShard(s, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		stmt, sigs, err := parseProvenance(contents, shardPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		signatures = append(signatures, sigs...)
+		if joined == nil {
+			joined = stmt
+			continue
+		}
+		if !samePredicate(joined, stmt) {
+			return nil, nil, fmt.Errorf("%s has a different predicate than the other shards of %s", shardPath, path)
+		}
+		joined.Subject = append(joined.Subject, stmt.Subject...)
+	}
+	if len(joined.Subject) != index.Subjects {
+		return nil, nil, fmt.Errorf("%s lists %d subjects but its shards have %d", path, index.Subjects, len(joined.Subject))
+	}
+	return joined, signatures, nil
+}
+
+func samePredicate(a, b *Statement) bool {
+	pa, err := json.Marshal(a.Predicate)
+	if err != nil {
+		return false
+	}
+	pb, err := json.Marshal(b.Predicate)
+	return err == nil && a.PredicateType == b.PredicateType && string(pa) == string(pb)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Signer produces signatures over DSSE pre-authentication encodings.
+type Signer interface {
+	KeyId() string
+	Sign(msg []byte) ([]byte, error)
+	Public() crypto.PublicKey
+}
+
+// Verifier checks signatures made by a Signer.
+type Verifier interface {
+	Verify(msg, sig []byte) error
+}
+
+// keySigner signs with a local ECDSA P-256 or Ed25519 private key, the
+// algorithms cosign supports for key-based verification.
+type keySigner struct {
+	key   crypto.Signer
+	keyId string
+}
+
+// generateSigner creates a signer with a new ECDSA P-256 key.
+func generateSigner() (*keySigner, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newKeySigner(key)
+}
+
+// loadSigner reads an unencrypted PEM private key (PKCS #8, SEC 1 EC).
+func loadSigner(path string) (*keySigner, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s contains no PEM private key", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY":
+		return nil, fmt.Errorf("%s is an encrypted cosign key; export it unencrypted with openssl or use a PKCS #8 key", path)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return newKeySigner(s)
+}
+
+func newKeySigner(key crypto.Signer) (*keySigner, error) {
+	switch k := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only the P-256 curve is supported for ECDSA keys")
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	// Identify keys by the SHA-256 of their DER-encoded public key.
+	id := sha256.Sum256(der)
+	return &keySigner{key: key, keyId: hex.EncodeToString(id[:])}, nil
+}
+
+func (s *keySigner) KeyId() string {
+	return s.keyId
+}
+
+func (s *keySigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s *keySigner) Sign(msg []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// keyVerifier verifies signatures with an ECDSA P-256 or Ed25519 public key.
+type keyVerifier struct {
+	key crypto.PublicKey
+}
+
+// loadVerifier reads a PEM "PUBLIC KEY" block, as written by cosign.
+func loadVerifier(path string) (*keyVerifier, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseVerifier(contents, path)
+}
+
+// parseVerifier parses the PEM public key read from source.
+func parseVerifier(contents []byte, source string) (*keyVerifier, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s contains no PEM public key", source)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &keyVerifier{key: key}, nil
+}
+
+// KeyId returns the id of the key, as keySigner.KeyId does.
+func (v *keyVerifier) KeyId() string {
+	der, err := x509.MarshalPKIXPublicKey(v.key)
+	if err != nil {
+		return ""
+	}
+	id := sha256.Sum256(der)
+	return hex.EncodeToString(id[:])
+}
+
+// verifiedKeyIds returns the ids of the keys of verifier, the ones
+// provenance verified with it is signed with.
+func verifiedKeyIds(verifier Verifier) []string {
+	if v, ok := verifier.(*keyVerifier); ok && v != nil {
+		return []string{v.KeyId()}
+	}
+	return nil
+}
+
+func (v *keyVerifier) Verify(msg, sig []byte) error {
+	switch k := v.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		if ecdsa.VerifyASN1(k, digest[:], sig) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(k, msg, sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", k)
+	}
+	return errors.New("invalid signature")
+}
+
+// marshalPublicKey PEM-encodes key as cosign does.
+func marshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqsHostPattern matches the host of an SQS queue URL, capturing its region.
+var sqsHostPattern = regexp.MustCompile(`^sqs\.([a-z0-9-]+)\.amazonaws\.com$`)
+
+// sqsVisibility is how long a received job stays invisible to other workers.
+// It is extended while the job runs, so that a worker that dies leaves the
+// job to be redelivered soon after.
+const sqsVisibility = 60 * time.Second
+
+// sqsQueue consumes jobs from an Amazon SQS queue with long polling, using
+// the AWS JSON protocol. Requests are signed with the credentials of
+// --cloud_auth or those in $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN, and sent to $AWS_ENDPOINT_URL_SQS if set. A job is
+// deleted once it's handled, and the result is sent to the queue URL of its
+// reply_to message attribute, if any.
+// See https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/Welcome.html
+type sqsQueue struct {
+	queueURL string
+	endpoint string
+	region   string
+	client   *http.Client
+	getenv   func(string) string
+}
+
+// newSQSQueue returns the queue of an sqs://sqs.<region>.amazonaws.com/<account>/<queue> URL.
+func newSQSQueue(u *url.URL) (*sqsQueue, error) {
+	if u.Host == "" || len(strings.Split(strings.Trim(u.Path, "/"), "/")) != 2 {
+		return nil, errors.New("sqs queue URL must name a queue, e.g. sqs://sqs.us-east-1.amazonaws.com/123456789012/provenance-jobs")
+	}
+	q := &sqsQueue{
+		queueURL: "https://" + u.Host + u.Path,
+		client:   newHTTPClient(time.Minute),
+		getenv:   os.Getenv,
+	}
+	q.region = awsRegion(q.getenv)
+	if m := sqsHostPattern.FindStringSubmatch(u.Host); m != nil {
+		q.region = m[1]
+	}
+	q.endpoint = awsEndpoint("SQS", u.Host, q.getenv)
+	return q, nil
+}
+
+// call sends the request in of action and decodes its response into out.
+func (q *sqsQueue) call(action string, in, out interface{}) error {
+	creds := awsEnvCredentials(q.getenv)
+	if creds == nil {
+		return errors.New("no AWS credentials for SQS: use --cloud_auth or set $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, q.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	signAWSRequest(req, payload, "sqs", q.region, creds, time.Now().UTC())
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Type != "" {
+			return fmt.Errorf("SQS %s: %s: %s", action, e.Type[strings.LastIndex(e.Type, "#")+1:], e.Message)
+		}
+		return fmt.Errorf("SQS %s: %s", action, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (q *sqsQueue) Receive() (*Delivery, error) {
+	for {
+		var r struct {
+			Messages []struct {
+				ReceiptHandle     string
+				Body              string
+				MessageAttributes map[string]struct {
+					StringValue string
+				}
+			}
+		}
+		err := q.call("ReceiveMessage", map[string]interface{}{
+			"QueueUrl":              q.queueURL,
+			"MaxNumberOfMessages":   1,
+			"WaitTimeSeconds":       20,
+			"VisibilityTimeout":     int(sqsVisibility / time.Second),
+			"MessageAttributeNames": []string{"reply_to"},
+		}, &r)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Messages) == 0 {
+			continue
+		}
+		m := r.Messages[0]
+		stop := q.extend(m.ReceiptHandle)
+		d := &Delivery{Body: []byte(m.Body)}
+		d.Ack = func() error {
+			stop()
+			return q.call("DeleteMessage", map[string]string{"QueueUrl": q.queueURL, "ReceiptHandle": m.ReceiptHandle}, nil)
+		}
+		if reply := m.MessageAttributes["reply_to"].StringValue; reply != "" {
+			d.Reply = func(result []byte) error {
+				return q.call("SendMessage", map[string]string{"QueueUrl": reply, "MessageBody": string(result)}, nil)
+			}
+		}
+		return d, nil
+	}
+}
+
+// extend keeps the message of receipt invisible until the returned function
+// is called.
+func (q *sqsQueue) extend(receipt string) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(sqsVisibility / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				err := q.call("ChangeMessageVisibility", map[string]interface{}{
+					"QueueUrl":          q.queueURL,
+					"ReceiptHandle":     receipt,
+					"VisibilityTimeout": int(sqsVisibility / time.Second),
+				}, nil)
+				if err != nil {
+					fmt.Printf("Failed to extend the visibility of the job: %s\n", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (q *sqsQueue) Close() error {
+	return nil
+}
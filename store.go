@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StoredAttestation is provenance kept in a Store.
+type StoredAttestation struct {
+	// Digest is the sha256 digest of Contents, which identifies it.
+	Digest string
+	// Repository is the source repository, as normalizeRepository names it.
+	Repository string
+	BuilderId  string
+	// Subjects are the sha256 digests of the subjects.
+	Subjects []string
+	// Created is when the attestation was first stored.
+	Created time.Time
+	// Contents is the provenance as written: a Statement or an envelope.
+	Contents []byte
+}
+
+// Store persists the provenance generated by a worker, indexed by subject
+// digest and source repository, to answer what built an artifact.
+type Store interface {
+	// Put stores a, unless it's stored already.
+	Put(a StoredAttestation) error
+	// BySubject returns the attestations of the subject with the given
+	// sha256 digest, oldest first.
+	BySubject(digest string) ([]StoredAttestation, error)
+	// ByRepository returns the attestations of builds of repo, oldest first.
+	ByRepository(repo string) ([]StoredAttestation, error)
+	Close() error
+}
+
+// openStore returns the Store identified by rawurl: a directory, as a path
+// or file:// URL, or a postgres:// database.
+func openStore(rawurl string) (Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		if err := requireOnline("a postgres:// store"); err != nil {
+			return nil, err
+		}
+		return dialPostgresStore(u)
+	case "file":
+		return &fsStore{dir: u.Path}, nil
+	case "":
+		return &fsStore{dir: rawurl}, nil
+	default:
+		return nil, fmt.Errorf("unsupported store scheme: %q", u.Scheme)
+	}
+}
+
+// normalizeRepository names a repository as stores index it: the https URL
+// of a git URI or pkg:github purl as recorded in provenance, or of an
+// <owner>/<repo> on GitHub, in lower case, as repository names are case
+// insensitive.
+func normalizeRepository(repo string) string {
+	repo = strings.TrimSuffix(strings.TrimPrefix(repo, "git+"), ".git")
+	switch {
+	case strings.HasPrefix(repo, "pkg:github/"):
+		repo = "https://github.com/" + strings.TrimPrefix(repo, "pkg:github/")
+	case !strings.Contains(repo, "://") && strings.Count(repo, "/") == 1:
+		repo = "https://github.com/" + repo
+	}
+	return strings.ToLower(repo)
+}
+
+// storedAttestation describes the provenance contents, read from source,
+// for a Store.
+func storedAttestation(contents []byte, source string, created time.Time) (StoredAttestation, error) {
+	stmt, _, err := parseProvenance(contents, source)
+	if err != nil {
+		return StoredAttestation{}, err
+	}
+	sum := sha256.Sum256(contents)
+	a := StoredAttestation{
+		Digest:     hex.EncodeToString(sum[:]),
+		Repository: normalizeRepository(provenanceRepository(stmt)),
+		BuilderId:  stmt.Predicate.Builder.Id,
+		Created:    created,
+		Contents:   contents,
+	}
+	seen := map[string]bool{}
+	for _, s := range stmt.Subject {
+		if d := s.Digest["sha256"]; hexDigestPattern.MatchString(d) && !seen[d] {
+			seen[d] = true
+			a.Subjects = append(a.Subjects, d)
+		}
+	}
+	return a, nil
+}
+
+// storeOutput stores the provenance a job wrote to path, which is a
+// Statement or envelope, or a shard index whose shards are stored instead.
+func storeOutput(s Store, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	files := outputFiles(path, contents)
+	if len(files) > 1 {
+		files = files[1:]
+	}
+	now := time.Now().UTC()
+	for _, f := range files {
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		a, err := storedAttestation(contents, f, now)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsStore stores provenance in a directory laid out as the local CAS, which
+// verify --cas reads, with an index of each repository's provenance in
+// repositories/sha256/<hex>, named by the digest of the repository.
+type fsStore struct {
+	dir string
+}
+
+func (s *fsStore) repositoryIndex(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return filepath.Join(s.dir, "repositories", "sha256", hex.EncodeToString(sum[:]))
+}
+
+func (s *fsStore) Put(a StoredAttestation) error {
+	subjects := make([]Subject, len(a.Subjects))
+	for i, d := range a.Subjects {
+		subjects[i] = Subject{Digest: DigestSet{"sha256": d}}
+	}
+	if err := casAdd(s.dir, a.Contents, subjects); err != nil {
+		return err
+	}
+	if a.Repository == "" {
+		return nil
+	}
+	index := s.repositoryIndex(a.Repository)
+	if err := os.MkdirAll(filepath.Dir(index), 0700); err != nil {
+		return err
+	}
+	return addToIndex(index, a.Digest)
+}
+
+// read reads the provenance objects with the given digests. Objects are
+// dated by their modification time, that of when they were first stored.
+func (s *fsStore) read(digests []string) ([]StoredAttestation, error) {
+	var attestations []StoredAttestation
+	for _, d := range digests {
+		path := filepath.Join(casObjects(s.dir), d)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		a, err := storedAttestation(contents, path, info.ModTime().UTC())
+		if err != nil {
+			return nil, err
+		}
+		attestations = append(attestations, a)
+	}
+	return attestations, nil
+}
+
+func (s *fsStore) BySubject(digest string) ([]StoredAttestation, error) {
+	digests, err := casLookup(s.dir, digest)
+	if err != nil {
+		return nil, err
+	}
+	return s.read(digests)
+}
+
+func (s *fsStore) ByRepository(repo string) ([]StoredAttestation, error) {
+	if repo = normalizeRepository(repo); repo == "" {
+		return nil, errors.New("no repository given")
+	}
+	digests, err := readIndex(s.repositoryIndex(repo))
+	if err != nil {
+		return nil, err
+	}
+	return s.read(digests)
+}
+
+func (s *fsStore) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Documented properties of the "github" and "runner" contexts.
+// See https://docs.github.com/en/actions/learn-github-actions/contexts
+var (
+	knownGitHubKeys = stringSet(
+		"action", "action_path", "action_ref", "action_repository", "action_status",
+		"actor", "actor_id", "api_url", "base_ref", "env", "event", "event_name",
+		"event_path", "graphql_url", "head_ref", "job", "job_workflow_sha", "output",
+		"path", "ref", "ref_name", "ref_protected", "ref_type", "repository",
+		"repository_id", "repository_owner", "repository_owner_id", "repositoryUrl",
+		"retention_days", "run_attempt", "run_id", "run_number", "secret_source",
+		"server_url", "sha", "state", "step_summary", "token", "triggering_actor",
+		"workflow", "workflow_ref", "workflow_sha", "workspace",
+	)
+	knownRunnerKeys = stringSet(
+		"arch", "debug", "environment", "name", "os", "temp", "tool_cache", "workspace",
+	)
+
+	shaPattern        = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+	repositoryPattern = regexp.MustCompile(`^[A-Za-z0-9-]+/[A-Za-z0-9._-]+$`)
+	runIdPattern      = regexp.MustCompile(`^[0-9]+$`)
+)
+
+func stringSet(keys ...string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set
+}
+
+// validateContexts implements --strict: rather than emitting provenance with
+// blank fields, it reports every unknown key, malformed event payload and
+// missing or malformed critical field in the contexts.
+func validateContexts(githubContext, runnerContext string) error {
+	var problems []string
+	gh := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(githubContext), &gh); err != nil {
+		return fmt.Errorf("github context is not a JSON object: %w", err)
+	}
+	runner := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(runnerContext), &runner); err != nil {
+		return fmt.Errorf("runner context is not a JSON object: %w", err)
+	}
+	problems = append(problems, unknownKeys("github", gh, knownGitHubKeys)...)
+	problems = append(problems, unknownKeys("runner", runner, knownRunnerKeys)...)
+
+	critical := []struct {
+		key     string
+		pattern *regexp.Regexp
+	}{
+		{"sha", shaPattern},
+		{"repository", repositoryPattern},
+		{"run_id", runIdPattern},
+		{"event_name", nil},
+	}
+	for _, c := range critical {
+		var v string
+		if raw, ok := gh[c.key]; !ok {
+			problems = append(problems, fmt.Sprintf("github.%s is missing", c.key))
+			continue
+		} else if err := json.Unmarshal(raw, &v); err != nil {
+			problems = append(problems, fmt.Sprintf("github.%s is not a string", c.key))
+			continue
+		}
+		if v == "" {
+			problems = append(problems, fmt.Sprintf("github.%s is empty", c.key))
+		} else if c.pattern != nil && !c.pattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("github.%s is malformed: %q", c.key, v))
+		}
+	}
+
+	event := map[string]json.RawMessage{}
+	if raw, ok := gh["event"]; !ok {
+		problems = append(problems, "github.event is missing")
+	} else if err := json.Unmarshal(raw, &event); err != nil || event == nil {
+		problems = append(problems, "github.event is not a JSON object")
+	} else if inputs, ok := event["inputs"]; ok {
+		if err := json.Unmarshal(inputs, &map[string]json.RawMessage{}); err != nil {
+			problems = append(problems, "github.event.inputs is not a JSON object")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("strict mode: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func unknownKeys(name string, ctx map[string]json.RawMessage, known map[string]bool) []string {
+	var problems []string
+	for k := range ctx {
+		if !known[k] {
+			problems = append(problems, fmt.Sprintf("unknown field %s.%s", name, k))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateContexts(t *testing.T) {
+	valid := func(change func(map[string]interface{})) string {
+		gh := map[string]interface{}{
+			"sha":        strings.Repeat("a", 40),
+			"repository": "o/r",
+			"run_id":     "42",
+			"event_name": "push",
+			"event":      map[string]interface{}{"ref": "refs/heads/main"},
+		}
+		if change != nil {
+			change(gh)
+		}
+		contents, err := json.Marshal(gh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	tests := []struct {
+		name    string
+		github  string
+		runner  string
+		wantErr string
+	}{
+		{"valid", valid(nil), `{"os": "Linux", "arch": "X64"}`, ""},
+		{"sha-256 commit", valid(func(gh map[string]interface{}) { gh["sha"] = strings.Repeat("b", 64) }), `{}`, ""},
+		{"workflow_dispatch inputs", valid(func(gh map[string]interface{}) {
+			gh["event"] = map[string]interface{}{"inputs": map[string]string{"version": "1.0"}}
+		}), `{}`, ""},
+		{"github is not an object", `[]`, `{}`, "github context is not a JSON object"},
+		{"runner is not an object", valid(nil), `"Linux"`, "runner context is not a JSON object"},
+		{"unknown github field", valid(func(gh map[string]interface{}) { gh["shaa"] = "x" }), `{}`, "unknown field github.shaa"},
+		{"unknown runner field", valid(nil), `{"oss": "Linux"}`, "unknown field runner.oss"},
+		{"missing sha", valid(func(gh map[string]interface{}) { delete(gh, "sha") }), `{}`, "github.sha is missing"},
+		{"short sha", valid(func(gh map[string]interface{}) { gh["sha"] = "abc123" }), `{}`, "github.sha is malformed"},
+		{"upper-case sha", valid(func(gh map[string]interface{}) { gh["sha"] = strings.Repeat("A", 40) }), `{}`, "github.sha is malformed"},
+		{"repository without owner", valid(func(gh map[string]interface{}) { gh["repository"] = "r" }), `{}`, "github.repository is malformed"},
+		{"repository with a path", valid(func(gh map[string]interface{}) { gh["repository"] = "o/r/../x" }), `{}`, "github.repository is malformed"},
+		{"numeric run_id", valid(func(gh map[string]interface{}) { gh["run_id"] = 42 }), `{}`, "github.run_id is not a string"},
+		{"malformed run_id", valid(func(gh map[string]interface{}) { gh["run_id"] = "42a" }), `{}`, "github.run_id is malformed"},
+		{"empty event_name", valid(func(gh map[string]interface{}) { gh["event_name"] = "" }), `{}`, "github.event_name is empty"},
+		{"missing event", valid(func(gh map[string]interface{}) { delete(gh, "event") }), `{}`, "github.event is missing"},
+		{"null event", valid(func(gh map[string]interface{}) { gh["event"] = nil }), `{}`, "github.event is not a JSON object"},
+		{"event is a string", valid(func(gh map[string]interface{}) { gh["event"] = "push" }), `{}`, "github.event is not a JSON object"},
+		{"inputs is a list", valid(func(gh map[string]interface{}) {
+			gh["event"] = map[string]interface{}{"inputs": []string{"1.0"}}
+		}), `{}`, "github.event.inputs is not a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContexts(tt.github, tt.runner)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validateContexts() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validateContexts() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateContextsReportsEveryProblem(t *testing.T) {
+	err := validateContexts(`{"sha": "x", "extra": 1}`, `{"extra": 1}`)
+	if err == nil {
+		t.Fatal("validateContexts() succeeded")
+	}
+	for _, want := range []string{"unknown field github.extra", "unknown field runner.extra", "github.sha is malformed", "github.repository is missing", "github.run_id is missing", "github.event_name is missing", "github.event is missing"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validateContexts() = %v, want it to report %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// RunSummaryPredicateType identifies the extension predicate listing the
+// attestations the jobs of a workflow run produced.
+const RunSummaryPredicateType = GeneratorURI + "/run-summary/v0.1"
+
+// RunSummaryStatement is an in-toto Statement about every subject attested
+// in a workflow run, so that consumers of a release run have a single
+// attestation to start from.
+type RunSummaryStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []Subject           `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     RunSummaryPredicate `json:"predicate"`
+}
+type RunSummaryPredicate struct {
+	Run          RunSummaryRun           `json:"run"`
+	Attestations []RunSummaryAttestation `json:"attestations"`
+}
+type RunSummaryRun struct {
+	Repository string `json:"repository"`
+	Id         int64  `json:"id"`
+	Attempt    int    `json:"attempt"`
+	Workflow   string `json:"workflow"`
+	Event      string `json:"event"`
+	HeadSha    string `json:"headSha"`
+	URL        string `json:"url"`
+}
+
+// RunSummaryAttestation is an attestation found among the artifacts of the
+// run: Name is its path within Artifact, with #<n> appended for the nth line
+// of JSON Lines, and Digest that of the file or line.
+type RunSummaryAttestation struct {
+	Artifact      string    `json:"artifact"`
+	Name          string    `json:"name"`
+	Digest        DigestSet `json:"digest"`
+	PredicateType string    `json:"predicateType"`
+	Signed        bool      `json:"signed"`
+	Subjects      []string  `json:"subjects"`
+}
+
+// workflowArtifact is a workflow run artifact as the API describes it.
+type workflowArtifact struct {
+	Name               string `json:"name"`
+	Expired            bool   `json:"expired"`
+	ArchiveDownloadURL string `json:"archive_download_url"`
+}
+
+// listRunArtifacts returns the artifacts of run runID of repo.
+func listRunArtifacts(c *githubClient, repo string, runID int64) ([]workflowArtifact, error) {
+	var all []workflowArtifact
+	for page := 1; ; page++ {
+		var list struct {
+			TotalCount int                `json:"total_count"`
+			Artifacts  []workflowArtifact `json:"artifacts"`
+		}
+		q := url.Values{"per_page": {"100"}, "page": {fmt.Sprint(page)}}
+		if err := c.get(fmt.Sprintf("/repos/%s/actions/runs/%d/artifacts?%s", repo, runID, q.Encode()), &list); err != nil {
+			return nil, err
+		}
+		all = append(all, list.Artifacts...)
+		if len(list.Artifacts) < 100 || len(all) >= list.TotalCount {
+			return all, nil
+		}
+	}
+}
+
+// isRunAttestation reports whether the artifact entry name may hold
+// attestations: provenance, attestation bundles and keyless signatures.
+func isRunAttestation(name string) bool {
+	return isAttestationAsset(name) || strings.HasSuffix(strings.ToLower(name), ".sig")
+}
+
+// zipAttestations returns the attestations among the entries of the
+// artifact archive z, describing the entries that look like attestations
+// but aren't in warnings.
+func zipAttestations(z *zip.Reader, artifact string) (attestations []RunSummaryAttestation, subjects []Subject, warnings []string, err error) {
+	for _, file := range z.File {
+		name := path.Clean(strings.TrimPrefix(strings.Replace(file.Name, `\`, "/", -1), "/"))
+		if file.FileInfo().IsDir() || !isRunAttestation(name) {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading artifact entry %s: %w", file.Name, err)
+		}
+		if parseShardIndex(contents) != nil {
+			continue
+		}
+		docs, err := splitAttestations(contents, name)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("artifact %s: %s", artifact, err))
+			continue
+		}
+		for _, doc := range docs {
+			stmt, sigs, err := parseRunAttestation(doc.Contents)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("artifact %s: %s: %s", artifact, doc.URI, err))
+				continue
+			}
+			sum := sha256.Sum256(doc.Contents)
+			if len(docs) == 1 {
+				sum = sha256.Sum256(contents)
+			}
+			a := RunSummaryAttestation{
+				Artifact:      artifact,
+				Name:          doc.URI,
+				Digest:        DigestSet{"sha256": hex.EncodeToString(sum[:])},
+				PredicateType: stmt.PredicateType,
+				Signed:        len(sigs) > 0,
+				Subjects:      []string{},
+			}
+			for _, s := range stmt.Subject {
+				a.Subjects = append(a.Subjects, s.Name)
+			}
+			attestations = append(attestations, a)
+			subjects = append(subjects, stmt.Subject...)
+		}
+	}
+	return attestations, subjects, warnings, nil
+}
+
+// attestationHeader is the part of an in-toto Statement common to every
+// predicate type.
+type attestationHeader struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+}
+
+// parseRunAttestation parses an attestation of any predicate type, a
+// Statement or the envelope of one.
+func parseRunAttestation(contents []byte) (*attestationHeader, []Signature, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(contents, env); err == nil && env.PayloadType != "" {
+		if env.PayloadType != PayloadContentType {
+			return nil, nil, fmt.Errorf("payload type is %q", env.PayloadType)
+		}
+		payload, err := base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding envelope payload: %w", err)
+		}
+		contents = payload
+	}
+	stmt := &attestationHeader{}
+	if err := json.Unmarshal(contents, stmt); err != nil || !strings.HasPrefix(stmt.Type, "https://in-toto.io/Statement/") {
+		return nil, nil, errors.New("not an in-toto statement")
+	}
+	return stmt, env.Signatures, nil
+}
+
+// mergeSubjects returns subjects without duplicates, which list the same
+// name and digests, in order.
+func mergeSubjects(subjects []Subject) []Subject {
+	seen := map[string]bool{}
+	merged := []Subject{}
+	for _, s := range subjects {
+		digest, _ := json.Marshal(s.Digest)
+		key := s.Name + "\x00" + string(digest)
+		if !seen[key] {
+			seen[key] = true
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// summarizeMain implements `summarize`, which, in the last job of a
+// workflow run, collects the attestations the other jobs uploaded as
+// artifacts into a signed run summary.
+func summarizeMain(args []string) {
+	flags := flag.NewFlagSet("summarize", flag.ExitOnError)
+	repo := flags.String("repo", os.Getenv("GITHUB_REPOSITORY"), "The repository, as <owner>/<repo>, of the workflow run.")
+	runID := flags.Int64("run_id", 0, "The workflow run whose attestations to summarize (default: $GITHUB_RUN_ID).")
+	artifactNames := flags.String("artifacts", "", "Comma-separated names of the run artifacts holding the attestations (default: every unexpired artifact of the run).")
+	keyPath := flags.String("key", "", "The PEM private key to sign the summary with.")
+	sign := flags.String("sign", "", "Sign the summary 'keyless' instead of with --key, also writing its Sigstore bundle to <output_path>.sigstore.json. Needs permissions: id-token: write.")
+	fulcio := flags.String("fulcio_url", DefaultFulcioURL, "The Fulcio certificate authority of --sign=keyless.")
+	outputPath := flags.String("output_path", "run-summary.intoto.jsonl", "Path to write the signed summary to.")
+	force := flags.Bool("force", false, "Overwrite the summary if it already exists, rather than failing.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if err := requireOnline("summarize"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if (*keyPath == "") == (*sign == "") {
+		fmt.Println("Exactly one of --key and --sign is required")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *sign != "" && *sign != SignKeyless {
+		fmt.Printf("Invalid value for flag --sign: %q\n", *sign)
+		os.Exit(1)
+	}
+	if strings.Count(*repo, "/") != 1 {
+		fmt.Printf("Invalid value for flag --repo: %q\n", *repo)
+		os.Exit(1)
+	}
+	if *runID == 0 {
+		fmt.Sscan(os.Getenv("GITHUB_RUN_ID"), runID)
+	}
+	if *runID == 0 {
+		fmt.Println("No value found for flag --run_id or $GITHUB_RUN_ID")
+		os.Exit(1)
+	}
+	if err := checkOverwrite(*force, *outputPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	c, err := newGitHubClient("{}", Options{Getenv: os.Getenv})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var run workflowRun
+	if err := c.get(fmt.Sprintf("/repos/%s/actions/runs/%d", *repo, *runID), &run); err != nil {
+		fmt.Printf("Failed to read run %d of %s: %s\n", *runID, *repo, err)
+		os.Exit(1)
+	}
+	artifacts, err := listRunArtifacts(c, *repo, *runID)
+	if err != nil {
+		fmt.Printf("Failed to list the artifacts of run %d: %s\n", *runID, err)
+		os.Exit(1)
+	}
+	wanted := parseList(*artifactNames)
+	missing := stringSet(wanted...)
+	stmt := &RunSummaryStatement{
+		Type:          StatementV01Type,
+		PredicateType: RunSummaryPredicateType,
+		Predicate: RunSummaryPredicate{
+			Run: RunSummaryRun{
+				Repository: *repo,
+				Id:         run.Id,
+				Attempt:    run.RunAttempt,
+				Workflow:   run.Path,
+				Event:      run.Event,
+				HeadSha:    run.HeadSHA,
+				URL:        run.HTMLURL,
+			},
+			Attestations: []RunSummaryAttestation{},
+		},
+	}
+	var subjects []Subject
+	for _, a := range artifacts {
+		if a.Expired || (len(wanted) > 0 && !missing[a.Name]) {
+			continue
+		}
+		delete(missing, a.Name)
+		f, size, err := downloadArtifact(c, a.ArchiveDownloadURL, a.Name)
+		if err != nil {
+			fmt.Printf("Failed to download artifact %s: %s\n", a.Name, err)
+			os.Exit(1)
+		}
+		z, err := zip.NewReader(f, size)
+		var found []RunSummaryAttestation
+		var attested []Subject
+		var warnings []string
+		if err == nil {
+			found, attested, warnings, err = zipAttestations(z, a.Name)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			fmt.Printf("Failed to read artifact %s: %s\n", a.Name, err)
+			os.Exit(1)
+		}
+		for _, w := range warnings {
+			fmt.Printf("  Warning: %s; skipped\n", w)
+		}
+		if len(found) > 0 {
+			fmt.Printf("%s: %d attestations\n", a.Name, len(found))
+		}
+		stmt.Predicate.Attestations = append(stmt.Predicate.Attestations, found...)
+		subjects = append(subjects, attested...)
+	}
+	for name := range missing {
+		fmt.Printf("Run %d has no unexpired artifact named %q\n", *runID, name)
+		os.Exit(1)
+	}
+	if len(stmt.Predicate.Attestations) == 0 {
+		fmt.Printf("The artifacts of run %d hold no attestations\n", *runID)
+		os.Exit(1)
+	}
+	stmt.Subject = mergeSubjects(subjects)
+	payload, err := json.Marshal(stmt)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var signer Signer
+	var certs []BundleCertificate
+	if *sign == SignKeyless {
+		signer, certs, err = keylessSigner(*fulcio)
+	} else {
+		signer, err = loadSigner(*keyPath)
+	}
+	if err != nil {
+		fmt.Printf("Failed to load signing key: %s\n", err)
+		os.Exit(1)
+	}
+	env, err := signEnvelope(PayloadContentType, payload, signer)
+	if err != nil {
+		fmt.Printf("Failed to sign the summary: %s\n", err)
+		os.Exit(1)
+	}
+	line, err := json.Marshal(env)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := writeOutput(*outputPath, append(line, '\n'), *force); err != nil {
+		fmt.Printf("Failed to write the summary: %s\n", err)
+		os.Exit(1)
+	}
+	if certs != nil {
+		bundle, err := json.Marshal(keylessBundle(env, certs))
+		if err == nil {
+			err = writeOutput(*outputPath+".sigstore.json", bundle, *force)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write the Sigstore bundle: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Summarized %d attestations of %d subjects from run %d: %s\n", len(stmt.Predicate.Attestations), len(stmt.Subject), *runID, *outputPath)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stdout is the standard output of the process. With --output_tar -, it
+// carries the tarball, and os.Stdout is pointed at stderr so that messages
+// don't corrupt it.
+var stdout = os.Stdout
+
+// redirectMessages sends messages printed to os.Stdout to stderr instead.
+func redirectMessages() {
+	os.Stdout = os.Stderr
+}
+
+// outputFiles returns the files writeStatement wrote to path, whose contents
+// are payload: path itself and, if it is a shard index, its shards.
+func outputFiles(path string, payload []byte) []string {
+	files := []string{path}
+	if index := parseShardIndex(payload); index != nil {
+		for _, s := range index.Shards {
+			files = append(files, filepath.Join(filepath.Dir(path), s.Path))
+		}
+	}
+	return files
+}
+
+// tarName names file in a tarball by its path, if it is within the working
+// directory, or else by its base name.
+func tarName(file string) string {
+	name := filepath.ToSlash(filepath.Clean(file))
+	if filepath.IsAbs(file) || name == ".." || strings.HasPrefix(name, "../") {
+		return filepath.Base(file)
+	}
+	return name
+}
+
+// writeTar writes the files, named by tarName, and a SHA256SUMS file of
+// their digests as a tarball to path, or to stdout if path is "-". Entries
+// are dated modTime.
+func writeTar(path string, files []string, modTime time.Time) error {
+	var entries []tarEntry
+	for _, f := range files {
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, tarEntry{tarName(f), contents})
+	}
+	return writeTarEntries(path, entries, modTime)
+}
+
+// tarEntry is a file of a tarball.
+type tarEntry struct {
+	Name     string
+	Contents []byte
+}
+
+// writeTarEntries writes entries, and a SHA256SUMS file of their digests, as
+// writeTar does.
+func writeTarEntries(path string, entries []tarEntry, modTime time.Time) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	var sums bytes.Buffer
+	names := map[string]bool{}
+	add := func(name string, contents []byte) error {
+		if names[name] {
+			return fmt.Errorf("two files are named %s", name)
+		}
+		names[name] = true
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(contents)
+		return err
+	}
+	for _, e := range entries {
+		if err := add(e.Name, e.Contents); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(e.Contents)
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), e.Name)
+	}
+	if err := add("SHA256SUMS", sums.Bytes()); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err := io.Copy(stdout, &buf)
+		return err
+	}
+	// The caller checked whether path may be overwritten.
+	return writeOutput(path, buf.Bytes(), true)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOIDCIssuer is the issuer of the OIDC tokens of GitHub Actions jobs.
+const DefaultOIDCIssuer = "https://token.actions.githubusercontent.com"
+
+// tenantPattern matches the owners and repositories tenants are keyed by.
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9-]+(/[A-Za-z0-9._-]+)?$`)
+
+// tenantKeys selects the key a worker signs the provenance of a job with by
+// the repository that ran it, so that one tenant never signs with another
+// tenant's key. Producers on the queue can claim any github_context, so the
+// repository is that of the OIDC token of the run, issued by GitHub for the
+// worker's audience, which must also be the run of the job.
+type tenantKeys struct {
+	// keys holds the signers of owners and of owner/repo repositories, in
+	// lower case as GitHub names are case-insensitive.
+	keys     map[string]Signer
+	issuer   string
+	audience string
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex // guards jwks and fetched
+	jwks    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// readTenantKeys reads the JSON file at path mapping owners and owner/repo
+// repositories to the PEM private keys of their tenants, e.g.
+//
+//	{"octo-org": "octo-org.pem", "octo-org/release": "release.pem"}
+//
+// Key paths are relative to the directory of the file. A repository's own
+// key is preferred to its owner's.
+func readTenantKeys(path, issuer, audience string) (*tenantKeys, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	t := &tenantKeys{
+		keys:     map[string]Signer{},
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   newHTTPClient(30 * time.Second),
+		now:      time.Now,
+	}
+	for tenant, keyPath := range m {
+		if !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("%s: %q is neither an owner nor an owner/repo repository", path, tenant)
+		}
+		if _, ok := t.keys[strings.ToLower(tenant)]; ok {
+			return nil, fmt.Errorf("%s: %s is listed twice", path, tenant)
+		}
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		signer, err := loadSigner(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("the key of %s: %w", tenant, err)
+		}
+		t.keys[strings.ToLower(tenant)] = signer
+	}
+	return t, nil
+}
+
+// oidcClaims are the claims of a GitHub Actions OIDC token used to identify
+// the tenant.
+// See https://docs.github.com/en/actions/deployment/security-hardening-your-deployments/about-security-hardening-with-openid-connect#understanding-the-oidc-token
+type oidcClaims struct {
+	Issuer     string          `json:"iss"`
+	Audience   json.RawMessage `json:"aud"`
+	Expires    int64           `json:"exp"`
+	NotBefore  int64           `json:"nbf"`
+	Repository string          `json:"repository"`
+	Owner      string          `json:"repository_owner"`
+	RunId      string          `json:"run_id"`
+}
+
+// signer returns the signer of the tenant of the repository token is issued
+// to, which must be the repository and run of gh.
+func (t *tenantKeys) signer(token string, gh GitHubContext) (Signer, error) {
+	claims, err := t.verifyToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id_token: %w", err)
+	}
+	if !strings.EqualFold(claims.Repository, gh.Repository) || claims.RunId != gh.RunId {
+		return nil, fmt.Errorf("id_token is for run %s of %s, not run %s of %s", claims.RunId, claims.Repository, gh.RunId, gh.Repository)
+	}
+	if s, ok := t.keys[strings.ToLower(claims.Repository)]; ok {
+		return s, nil
+	}
+	if s, ok := t.keys[strings.ToLower(claims.Owner)]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("no tenant key for %s", claims.Repository)
+}
+
+// verifyToken checks the RS256 signature of the OIDC token against the keys
+// of the issuer, its issuer, audience and validity, returning its claims.
+func (t *tenantKeys) verifyToken(token string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, err := t.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("the signature doesn't verify")
+	}
+	claims := &oidcClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != t.issuer {
+		return nil, fmt.Errorf("issued by %q, not %q", claims.Issuer, t.issuer)
+	}
+	var audiences []string
+	if json.Unmarshal(claims.Audience, &audiences) != nil {
+		var aud string
+		json.Unmarshal(claims.Audience, &aud)
+		audiences = []string{aud}
+	}
+	if !stringSet(audiences...)[t.audience] {
+		return nil, fmt.Errorf("issued for %q, not %q", audiences, t.audience)
+	}
+	// A minute of leeway allows for clock skew.
+	now := t.now().Unix()
+	if now > claims.Expires+60 {
+		return nil, fmt.Errorf("expired at %s", time.Unix(claims.Expires, 0).UTC())
+	}
+	if now < claims.NotBefore-60 {
+		return nil, fmt.Errorf("not valid before %s", time.Unix(claims.NotBefore, 0).UTC())
+	}
+	if claims.Repository == "" || claims.Owner == "" {
+		return nil, errors.New("names no repository")
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON of a JWT into v.
+func decodeJWTPart(part string, v interface{}) error {
+	contents, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed JWT: %w", err)
+	}
+	if err := json.Unmarshal(contents, v); err != nil {
+		return fmt.Errorf("malformed JWT: %w", err)
+	}
+	return nil
+}
+
+// key returns the RSA key kid of the issuer's JWKS, fetching it again for
+// unknown keys, as the issuer rotates them, at most once a minute.
+func (t *tenantKeys) key(kid string) (*rsa.PublicKey, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if k, ok := t.jwks[kid]; ok {
+		return k, nil
+	}
+	if t.now().Sub(t.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := requireOnline("verifying id_token"); err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Get(t.issuer + "/.well-known/jwks")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the keys of %s: %s", t.issuer, resp.Status)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("fetching the keys of %s: %w", t.issuer, err)
+	}
+	t.jwks, t.fetched = map[string]*rsa.PublicKey{}, t.now()
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		t.jwks[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k, ok := t.jwks[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
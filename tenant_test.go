@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC issuer serving the JWKS of its key.
+type testIssuer struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key}
+	iss.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(iss.srv.Close)
+	return iss
+}
+
+// token returns a token of claims signed with key, by default the issuer's.
+func (iss *testIssuer) token(t *testing.T, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	if key == nil {
+		key = iss.key
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestReadTenantKeys(t *testing.T) {
+	dir := t.TempDir()
+	signer, _ := testVerifier(t)
+	der, err := x509.MarshalPKCS8PrivateKey(signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "org.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contents string
+		wantErr  string
+	}{
+		{`{"octo-org": "org.pem", "octo-org/app": "org.pem"}`, ""},
+		{`{"octo-org": "missing.pem"}`, "missing.pem"},
+		{`{"octo-org/app/x": "org.pem"}`, "neither an owner"},
+		{`{"../octo-org": "org.pem"}`, "neither an owner"},
+		{`{"octo-org": "org.pem", "Octo-Org": "org.pem"}`, "listed twice"},
+		{`["octo-org"]`, "parsing"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "tenants.json")
+		if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tenants, err := readTenantKeys(path, DefaultOIDCIssuer, "create_provenance")
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readTenantKeys(%s) = %v, want an error containing %q", tt.contents, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("readTenantKeys(%s) = %v", tt.contents, err)
+		case tenants.keys["octo-org"].KeyId() != signer.KeyId():
+			t.Errorf("readTenantKeys(%s) has the key %s of octo-org, want %s", tt.contents, tenants.keys["octo-org"].KeyId(), signer.KeyId())
+		}
+	}
+}
+
+func TestTenantKeysSigner(t *testing.T) {
+	iss := newTestIssuer(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgKey, _ := testVerifier(t)
+	appKey, _ := testVerifier(t)
+	tenants := &tenantKeys{
+		keys:     map[string]Signer{"octo-org": orgKey, "octo-org/app": appKey},
+		issuer:   iss.srv.URL,
+		audience: "create_provenance",
+		client:   iss.srv.Client(),
+		now:      time.Now,
+	}
+	claims := func(repo, runID string, change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":              iss.srv.URL,
+			"aud":              "create_provenance",
+			"exp":              time.Now().Add(5 * time.Minute).Unix(),
+			"nbf":              time.Now().Add(-time.Minute).Unix(),
+			"repository":       repo,
+			"repository_owner": strings.SplitN(repo, "/", 2)[0],
+			"run_id":           runID,
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		gh      GitHubContext
+		want    Signer
+		wantErr string
+	}{
+		{"repository key", iss.token(t, claims("octo-org/app", "1", nil), nil), GitHubContext{Repository: "octo-org/app", RunId: "1"}, appKey, ""},
+		{"owner key", iss.token(t, claims("octo-org/lib", "1", nil), nil), GitHubContext{Repository: "Octo-Org/lib", RunId: "1"}, orgKey, ""},
+		{"audience list", iss.token(t, claims("octo-org/lib", "1", func(c map[string]interface{}) { c["aud"] = []string{"other", "create_provenance"} }), nil), GitHubContext{Repository: "octo-org/lib", RunId: "1"}, orgKey, ""},
+		{"no tenant", iss.token(t, claims("evil/app", "1", nil), nil), GitHubContext{Repository: "evil/app", RunId: "1"}, nil, "no tenant key"},
+		{"another tenant's repository", iss.token(t, claims("evil/app", "1", nil), nil), GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "not run 1 of octo-org/app"},
+		{"another run", iss.token(t, claims("octo-org/app", "1", nil), nil), GitHubContext{Repository: "octo-org/app", RunId: "2"}, nil, "not run 2"},
+		{"forged signature", iss.token(t, claims("octo-org/app", "1", nil), other), GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "doesn't verify"},
+		{"other issuer", iss.token(t, claims("octo-org/app", "1", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }), nil), GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "issued by"},
+		{"other audience", iss.token(t, claims("octo-org/app", "1", func(c map[string]interface{}) { c["aud"] = "sts.amazonaws.com" }), nil), GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "issued for"},
+		{"expired", iss.token(t, claims("octo-org/app", "1", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }), nil), GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "expired"},
+		{"not a JWT", "token", GitHubContext{Repository: "octo-org/app", RunId: "1"}, nil, "not a JWT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tenants.signer(tt.token, tt.gh)
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("signer() = %v, want an error containing %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("signer() = %v", err)
+			case got != tt.want:
+				t.Errorf("signer() = the key of %s, want %s", got.KeyId(), tt.want.KeyId())
+			}
+		})
+	}
+}
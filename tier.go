@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	HostingGitHub = "github-hosted"
+	HostingSelf   = "self-hosted"
+)
+
+// Isolation describes the build environment's ability to keep builds from
+// influencing one another, as required by the SLSA isolation expectations.
+// It is an extension to the SLSA v0.1 metadata.
+type Isolation struct {
+	// Hosting is HostingGitHub or HostingSelf.
+	Hosting string `json:"hosting"`
+	// Ephemeral is true when the runner executes a single job and is then
+	// discarded. It is declared, not verified, for self-hosted runners.
+	Ephemeral bool `json:"ephemeral"`
+	// Container is true when the job steps ran inside a job container.
+	Container   bool   `json:"container"`
+	RunnerGroup string `json:"runnerGroup,omitempty"`
+	// Isolated is false when the environment cannot support the isolation
+	// expectations; Warnings explains why.
+	Isolated bool     `json:"isolated"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// JobContext holds the parts of the "job" context used for classification.
+type JobContext struct {
+	Container struct {
+		Id string `json:"id"`
+	} `json:"container"`
+}
+
+// classifyRunner determines the builder tier of the run being attested.
+func classifyRunner(runner RunnerContext, opts Options) (Isolation, error) {
+	iso := Isolation{RunnerGroup: opts.RunnerGroup}
+	if opts.JobContext != "" {
+		job := JobContext{}
+		if err := json.Unmarshal([]byte(opts.JobContext), &job); err != nil {
+			return iso, err
+		}
+		iso.Container = job.Container.Id != ""
+	}
+
+	env := runner.Environment
+	if env == "" {
+		env = opts.Getenv("RUNNER_ENVIRONMENT")
+	}
+	switch env {
+	case HostingGitHub, HostingSelf:
+		iso.Hosting = env
+	default:
+		// Older runners don't report their environment. Fall back to the
+		// historical behavior, which can't tell self-hosted runners apart.
+		if opts.Getenv("GITHUB_ACTIONS") == "true" {
+			iso.Hosting = HostingGitHub
+		} else {
+			iso.Hosting = HostingSelf
+		}
+		iso.Warnings = append(iso.Warnings, "the runner did not report whether it is GitHub-hosted or self-hosted; assuming "+iso.Hosting)
+	}
+
+	if iso.Hosting == HostingGitHub {
+		iso.Ephemeral = true
+	} else {
+		iso.Ephemeral = opts.EphemeralRunner
+		if !iso.Ephemeral {
+			iso.Warnings = append(iso.Warnings, "the self-hosted runner is persistent, so earlier jobs may have influenced this build")
+		}
+	}
+	iso.Isolated = iso.Ephemeral && len(iso.Warnings) == 0
+	return iso, nil
+}
+
+// builderIdSuffix returns the builder ID suffix for the tier in iso.
+func builderIdSuffix(iso Isolation) string {
+	switch {
+	case iso.Hosting == HostingGitHub:
+		return GitHubHostedIdSuffix
+	case iso.Ephemeral:
+		return SelfHostedEphemeralIdSuffix
+	default:
+		return SelfHostedIdSuffix
+	}
+}
+
+// builderId returns the builder ID of a run of the repository at repoURI: a
+// configured --builder_id, or the tier suffix under --builder_namespace or
+// repoURI.
+func builderId(repoURI string, iso Isolation, opts Options) string {
+	if opts.BuilderId != "" {
+		return opts.BuilderId
+	}
+	if opts.BuilderNamespace != "" {
+		return strings.TrimSuffix(opts.BuilderNamespace, "/") + builderIdSuffix(iso)
+	}
+	return repoURI + builderIdSuffix(iso)
+}
+
+// validateBuilderId checks that id, the builder ID or namespace named name,
+// is an https URL that verification policies can match exactly.
+func validateBuilderId(name, id string) error {
+	u, err := url.Parse(id)
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid %s %q: %w", name, id, err)
+	case u.Scheme != "https" || u.Host == "":
+		return fmt.Errorf("invalid %s %q: must be an https URL", name, id)
+	case u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("invalid %s %q: must not have user info, a query or a fragment", name, id)
+	case strings.TrimSpace(id) != id:
+		return fmt.Errorf("invalid %s %q: must not have surrounding whitespace", name, id)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Timing accounts for where the time of a run goes, so that pipeline owners
+// can track the overhead of provenance generation.
+type Timing struct {
+	started time.Time
+	// Walk is the time spent finding file subjects, excluding Hash.
+	Walk time.Duration
+	Hash time.Duration
+	// API is the time spent on GitHub and registry requests, including
+	// hashing the run artifacts they download.
+	API    time.Duration
+	Sign   time.Duration
+	Upload time.Duration
+	// FilesHashed and BytesHashed count the file subjects hashed.
+	FilesHashed int
+	BytesHashed int64
+}
+
+func newTiming() *Timing {
+	return &Timing{started: time.Now()}
+}
+
+// track starts timing a phase, adding the elapsed time to *phase when the
+// returned function is called.
+func track(phase *time.Duration) func() {
+	start := time.Now()
+	return func() { *phase += time.Since(start) }
+}
+
+// TimingReport is the structured form of a Timing, in seconds.
+type TimingReport struct {
+	WalkSeconds    float64 `json:"walk_seconds"`
+	HashSeconds    float64 `json:"hash_seconds"`
+	APISeconds     float64 `json:"api_seconds"`
+	SignSeconds    float64 `json:"sign_seconds"`
+	UploadSeconds  float64 `json:"upload_seconds"`
+	TotalSeconds   float64 `json:"total_seconds"`
+	FilesHashed    int     `json:"files_hashed"`
+	BytesHashed    int64   `json:"bytes_hashed"`
+	FilesPerSecond float64 `json:"files_per_second"`
+}
+
+// report summarizes t, with the total time being the time since it was
+// created.
+func (t *Timing) report() *TimingReport {
+	seconds := func(d time.Duration) float64 { return d.Round(time.Millisecond).Seconds() }
+	r := &TimingReport{
+		WalkSeconds:   seconds(t.Walk),
+		HashSeconds:   seconds(t.Hash),
+		APISeconds:    seconds(t.API),
+		SignSeconds:   seconds(t.Sign),
+		UploadSeconds: seconds(t.Upload),
+		TotalSeconds:  seconds(time.Since(t.started)),
+		FilesHashed:   t.FilesHashed,
+		BytesHashed:   t.BytesHashed,
+	}
+	if d := (t.Walk + t.Hash).Seconds(); d > 0 {
+		r.FilesPerSecond = float64(int(float64(t.FilesHashed)/d*10)) / 10
+	}
+	return r
+}
+
+// print writes the report of t as a single JSON line.
+func (t *Timing) print() {
+	line, _ := json.Marshal(t.report())
+	fmt.Printf("Timing: %s\n", line)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TOFUStore pins, on first use, the signer of the provenance of each source
+// repository built by each builder, so that provenance of the same
+// repository and builder signed by anyone else is caught, as a substituted
+// key would be, without a PKI vouching for the key.
+type TOFUStore struct {
+	Pins []TOFUPin `json:"pins"`
+}
+
+// TOFUPin is the signer first seen for a repository and builder.
+type TOFUPin struct {
+	Builder    string `json:"builder"`
+	Repository string `json:"repository"`
+	// Signer is as described by describeSigner, e.g. "key sha256:<hex>".
+	Signer     string `json:"signer"`
+	FirstSeen  string `json:"first_seen"`
+	Provenance string `json:"provenance"`
+}
+
+// defaultTOFUStore is the path of the TOFU store in the user's config
+// directory, or "" if it has none.
+func defaultTOFUStore() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "provenance", "tofu.json")
+}
+
+// readTOFUStore reads the TOFU store at path, which is empty until written.
+func readTOFUStore(path string) (*TOFUStore, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &TOFUStore{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := &TOFUStore{}
+	if err := json.Unmarshal(contents, s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// write writes the store to path, replacing it atomically so that a
+// concurrent verify reads either version.
+func (s *TOFUStore) write(path string) error {
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tofu-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(contents, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// provenanceRepository returns the source repository stmt was built from:
+// the URI of the material defining its recipe, without a version.
+func provenanceRepository(stmt *Statement) string {
+	i := stmt.Predicate.Recipe.DefinedInMaterial
+	if i < 0 || i >= len(stmt.Predicate.Materials) {
+		return ""
+	}
+	uri := stmt.Predicate.Materials[i].URI
+	// pkg:github purls carry the commit as their version.
+	if at := strings.LastIndex(uri, "@"); at > 0 && strings.HasPrefix(uri, "pkg:") {
+		uri = uri[:at]
+	}
+	return uri
+}
+
+// pin checks signer, that of stmt read from path, against the signer the
+// store pins for the repository and builder of stmt, and pins it at now if
+// there is none. With accept, a different signer replaces the pinned one,
+// e.g. after a key rotation. It reports whether the store changed.
+func (s *TOFUStore) pin(stmt *Statement, signer, path string, accept bool, now time.Time) (bool, error) {
+	repo, builder := provenanceRepository(stmt), stmt.Predicate.Builder.Id
+	if repo == "" {
+		return false, fmt.Errorf("%s records no source repository to pin its signer for", path)
+	}
+	pin := TOFUPin{builder, repo, signer, now.UTC().Format(time.RFC3339), path}
+	for i, p := range s.Pins {
+		if p.Builder != builder || p.Repository != repo {
+			continue
+		}
+		if p.Signer == signer {
+			return false, nil
+		}
+		if !accept {
+			return false, fmt.Errorf("signed by %s, but provenance of %s built by %s was first signed by %s (%s, on %s); if the key was rotated, rerun with --tofu_accept",
+				signer, repo, builder, p.Signer, p.Provenance, p.FirstSeen)
+		}
+		s.Pins[i] = pin
+		return true, nil
+	}
+	s.Pins = append(s.Pins, pin)
+	return true, nil
+}
+
+// envelopeSigner checks that the provenance read from path is an envelope
+// signed with the key of verifier, or a shard index of such envelopes, and
+// describes the key.
+func envelopeSigner(path string, contents []byte, verifier *keyVerifier) (string, error) {
+	if index := parseShardIndex(contents); index != nil {
+		for _, s := range index.Shards {
+			shardPath, shard, err := readShard(s, path)
+			if err != nil {
+				return "", err
+			}
+			if _, err := envelopeSigner(shardPath, shard, verifier); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		env := &Envelope{}
+		if json.Unmarshal(contents, env) != nil || env.PayloadType == "" {
+			return "", fmt.Errorf("%s isn't signed", path)
+		}
+		if _, err := verifyEnvelope(env, verifier); err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	pem, err := marshalPublicKey(verifier.key)
+	if err != nil {
+		return "", err
+	}
+	return describeSigner(base64.StdEncoding.EncodeToString(pem)), nil
+}
+
+// signerCheck checks the signer of the provenance verify verifies.
+type signerCheck struct {
+	// Verifier, if set, is the key the provenance must be signed with.
+	Verifier *keyVerifier
+	// TOFU, if set, pins the signer, and is written back to TOFUPath once
+	// verification passes.
+	TOFU     *TOFUStore
+	TOFUPath string
+	Accept   bool
+
+	changed bool
+}
+
+// check appends the problems with the signer of stmt, read from path as
+// contents, to problems. The signer is only pinned if there are none, so that provenance
+// failing verification isn't trusted on first use.
+func (c *signerCheck) check(path string, contents []byte, stmt *Statement, problems []string) []string {
+	if c.Verifier == nil {
+		return problems
+	}
+	signer, err := envelopeSigner(path, contents, c.Verifier)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if c.TOFU == nil || len(problems) > 0 {
+		return problems
+	}
+	changed, err := c.TOFU.pin(stmt, signer, path, c.Accept, time.Now())
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if changed {
+		fmt.Printf("Pinned %s as the signer of %s built by %s\n", signer, provenanceRepository(stmt), stmt.Predicate.Builder.Id)
+	}
+	c.changed = c.changed || changed
+	return problems
+}
+
+// save writes the TOFU store back if a signer was pinned.
+func (c *signerCheck) save() {
+	if !c.changed {
+		return
+	}
+	if err := c.TOFU.write(c.TOFUPath); err != nil {
+		fmt.Printf("Failed to write the TOFU store: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// toolCacheMaterials hashes the runner tool cache entries on the PATH, e.g.
+// the Go toolchain setup-go added, which builds use without recording them,
+// returning one material per entry. Entries that can't be hashed are
+// reported and left out.
+func toolCacheMaterials(runner RunnerContext, opts Options, findings *Findings) []Item {
+	var items []Item
+	for _, e := range toolCacheEntries(opts.Getenv("PATH"), runner.ToolCache, opts.Getenv("RUNNER_TOOL_CACHE")) {
+		digest, err := digestTree(e.Dir)
+		if err != nil {
+			findings.add(CodeToolchainUnhashed, "unable to hash the tool cache entry %s: %s", e.Name, err)
+			continue
+		}
+		items = append(items, Item{URI: "file://" + filepath.ToSlash(e.Dir), Digest: digest})
+	}
+	return items
+}
+
+// digestTree hashes the regular files under dir, returning the sha256 digest
+// of their listing in the format of sha256sum, sorted by path, as
+//
+//	cd dir && find . -type f -print0 | LC_ALL=C sort -z | xargs -0 sha256sum | sha256sum
+//
+// computes it. Symlinks are skipped, as find skips them.
+func digestTree(dir string) (DigestSet, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	var paths []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, "./"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var listing bytes.Buffer
+	for _, p := range paths {
+		digest, err := digestFile(filepath.Join(dir, filepath.FromSlash(p)), DefaultDigestAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&listing, "%s  %s\n", digest[DefaultDigestAlgorithm], p)
+	}
+	return digestReader(&listing, DefaultDigestAlgorithm)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TracerStrace identifies file accesses traced with strace.
+const TracerStrace = "strace"
+
+// Trace is the evidence recorded while running a build command.
+type Trace struct {
+	Command    []string
+	ExitCode   int
+	StartedOn  time.Time
+	FinishedOn time.Time
+	// Tracer is empty when file accesses couldn't be traced, in which case
+	// Reads and Writes are empty too.
+	Tracer string
+	// Reads and Writes are the absolute paths of the files the command and
+	// its children opened, sorted. Files that were written are not reads.
+	Reads  []string
+	Writes []string
+	// Execs are the programs the command and its children executed, as
+	// execve was given them, and Connects the addresses of the sockets they
+	// connected, both sorted.
+	Execs    []string
+	Connects []string
+}
+
+// CommandTrace records the traced build command in the provenance metadata.
+type CommandTrace struct {
+	Command  []string `json:"command"`
+	ExitCode int      `json:"exitCode"`
+	// Duration is omitted from reproducible provenance.
+	Duration string   `json:"duration,omitempty"`
+	Tracer   string   `json:"tracer,omitempty"`
+	Writes   []string `json:"writes,omitempty"`
+}
+
+// straceSyscalls are the system calls from which file accesses are derived.
+const straceSyscalls = "trace=execve,open,openat,openat2,creat,rename,renameat,renameat2,connect"
+
+// runTraced runs argv with the standard streams of this process attached. On
+// Linux, if strace is installed, the command and all its children are traced
+// to find the files they read and wrote.
+func runTraced(argv []string) (*Trace, error) {
+	t := &Trace{Command: argv}
+	name, args := argv[0], argv[1:]
+	var traceFile string
+	if runtime.GOOS == "linux" {
+		if strace, err := exec.LookPath("strace"); err == nil {
+			f, err := ioutil.TempFile("", "trace")
+			if err != nil {
+				return nil, err
+			}
+			f.Close()
+			traceFile = f.Name()
+			defer os.Remove(traceFile)
+			// -y resolves file descriptors to paths, so that the paths of
+			// relative opens needn't be reconstructed from chdir calls.
+			name = strace
+			args = append([]string{"-f", "-qq", "-y", "-e", straceSyscalls, "-o", traceFile, "--"}, argv...)
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	t.StartedOn = time.Now().UTC()
+	err := cmd.Run()
+	t.FinishedOn = time.Now().UTC()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		t.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+	if traceFile == "" {
+		return t, nil
+	}
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	traced, err := parseStrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading strace output: %w", err)
+	}
+	if len(traced.Execs) == 0 {
+		// strace reports its own failures, e.g. when ptrace is not
+		// permitted in a container, on stderr.
+		return nil, errors.New("strace could not trace the build command")
+	}
+	t.Tracer, t.Reads, t.Writes = TracerStrace, traced.Reads, traced.Writes
+	t.Execs, t.Connects = traced.Execs, traced.Connects
+	return t, nil
+}
+
+var (
+	stracePid     = regexp.MustCompile(`^([0-9]+) +`)
+	straceResumed = regexp.MustCompile(`^<\.\.\. [a-z0-9_]+ resumed>`)
+	straceOpen    = regexp.MustCompile(`^(open|openat|openat2|creat)\((.*)\) = [0-9]+<(.*)>$`)
+	straceExecve  = regexp.MustCompile(`^execve\("((?:[^"\\]|\\.)*)", .*\) = 0$`)
+	straceRename  = regexp.MustCompile(`^(?:rename|renameat|renameat2)\((?:[^,]*<(.*?)>, )?"((?:[^"\\]|\\.)*)", (?:[^,]*<(.*?)>, )?"((?:[^"\\]|\\.)*)"(?:, .*)?\) = 0$`)
+	// Non-blocking connects return EINPROGRESS, and still connect.
+	straceConnect = regexp.MustCompile(`^connect\([^,]*, \{sa_family=(AF_[A-Z0-9]+)(.*)\}, [0-9]+\) = (?:0|-1 EINPROGRESS .*)$`)
+	straceAddr    = regexp.MustCompile(`inet_addr\("([^"]*)"\)|inet_pton\(AF_INET6, "([^"]*)"`)
+	stracePort    = regexp.MustCompile(`_port=htons\(([0-9]+)\)`)
+	straceSunPath = regexp.MustCompile(`sun_path=(@?"(?:[^"\\]|\\.)*")`)
+)
+
+// parseStrace derives the files read and written, the programs executed and
+// the sockets connected from the output of strace -f -y, returning them in a
+// Trace. Its Reads are the paths read but never written.
+func parseStrace(r io.Reader) (*Trace, error) {
+	read, written, execs, connects := map[string]bool{}, map[string]bool{}, map[string]bool{}, map[string]bool{}
+	// With -f, calls interrupted by another process are split across an
+	// "<unfinished ...>" and a "<... resumed>" line.
+	pending := map[string]string{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		pid := ""
+		if m := stracePid.FindStringSubmatch(line); m != nil {
+			pid, line = m[1], line[len(m[0]):]
+		}
+		if strings.HasSuffix(line, " <unfinished ...>") {
+			pending[pid] = strings.TrimSuffix(line, " <unfinished ...>")
+			continue
+		}
+		if m := straceResumed.FindString(line); m != "" {
+			line = pending[pid] + line[len(m):]
+			delete(pending, pid)
+		}
+		if m := straceOpen.FindStringSubmatch(line); m != nil {
+			path := unescapeStrace(m[3])
+			if m[1] == "creat" || strings.Contains(m[2], "O_WRONLY") || strings.Contains(m[2], "O_RDWR") || strings.Contains(m[2], "O_CREAT") {
+				written[path] = true
+			} else {
+				read[path] = true
+			}
+		} else if m := straceExecve.FindStringSubmatch(line); m != nil {
+			path := unescapeStrace(m[1])
+			execs[path] = true
+			if filepath.IsAbs(path) {
+				read[path] = true
+			}
+		} else if m := straceConnect.FindStringSubmatch(line); m != nil {
+			// Netlink sockets talk to the kernel, not to other hosts.
+			if m[1] != "AF_NETLINK" {
+				connects[straceSocketAddress(m[1], m[2])] = true
+			}
+		} else if m := straceRename.FindStringSubmatch(line); m != nil {
+			target := unescapeStrace(m[4])
+			if !filepath.IsAbs(target) {
+				if m[3] == "" {
+					continue
+				}
+				target = filepath.Join(unescapeStrace(m[3]), target)
+			}
+			written[target] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	t := &Trace{}
+	for path := range read {
+		if !written[path] && !pseudoFile(path) {
+			t.Reads = append(t.Reads, path)
+		}
+	}
+	for path := range written {
+		if !pseudoFile(path) {
+			t.Writes = append(t.Writes, path)
+		}
+	}
+	for path := range execs {
+		t.Execs = append(t.Execs, path)
+	}
+	for addr := range connects {
+		t.Connects = append(t.Connects, addr)
+	}
+	sort.Strings(t.Reads)
+	sort.Strings(t.Writes)
+	sort.Strings(t.Execs)
+	sort.Strings(t.Connects)
+	return t, nil
+}
+
+// straceSocketAddress describes the socket address of the given family that
+// strace printed as fields: host:port for IP sockets, the path of Unix
+// sockets, or else the family.
+func straceSocketAddress(family, fields string) string {
+	switch family {
+	case "AF_INET", "AF_INET6":
+		host, port := "", ""
+		if m := straceAddr.FindStringSubmatch(fields); m != nil {
+			host = m[1] + m[2]
+		}
+		if m := stracePort.FindStringSubmatch(fields); m != nil {
+			port = m[1]
+		}
+		return net.JoinHostPort(host, port)
+	case "AF_UNIX":
+		if m := straceSunPath.FindStringSubmatch(fields); m != nil {
+			if strings.HasPrefix(m[1], "@") {
+				return "@" + unescapeStrace(m[1][2:len(m[1])-1])
+			}
+			return unescapeStrace(m[1][1 : len(m[1])-1])
+		}
+	}
+	return family
+}
+
+// unescapeStrace decodes the C-style escapes strace applies to paths.
+func unescapeStrace(s string) string {
+	if u, err := strconv.Unquote(`"` + s + `"`); err == nil {
+		return u
+	}
+	return s
+}
+
+// pseudoFile reports whether path is on a kernel pseudo-filesystem, which
+// doesn't hold build inputs.
+func pseudoFile(path string) bool {
+	for _, prefix := range []string{"/proc/", "/sys/", "/dev/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceMaterials hashes the regular files read by a traced command. It
+// returns why they aren't all of its inputs, or "" if they are: some
+// couldn't be hashed, it ran a program that isn't among them, such as one it
+// wrote itself, or it connected a socket, through which it may have received
+// any input, as what is received isn't traced.
+func traceMaterials(t *Trace) ([]Item, string) {
+	var items []Item
+	hashed := map[string]bool{}
+	partial := ""
+	for _, path := range t.Reads {
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			continue
+		}
+		var digest DigestSet
+		if err == nil {
+			digest, err = digestFile(path)
+		}
+		if err != nil {
+			partial = "some files read by the build command no longer exist"
+			continue
+		}
+		items = append(items, Item{URI: "file://" + path, Digest: digest})
+		hashed[path] = true
+	}
+	if partial != "" {
+		return items, partial
+	}
+	for _, path := range t.Execs {
+		if !hashed[path] {
+			return items, fmt.Sprintf("the build command ran %s, which isn't a material", path)
+		}
+	}
+	if len(t.Connects) > 0 {
+		return items, fmt.Sprintf("the build command connected to %s, whose responses aren't traced", strings.Join(t.Connects, ", "))
+	}
+	return items, ""
+}
+
+// runMain implements `run [flags] -- <build command>`: it runs the build,
+// then generates provenance that records the command and the files it read.
+func runMain(args []string) {
+	i := 0
+	for i < len(args) && args[i] != "--" {
+		i++
+	}
+	if i >= len(args)-1 {
+		fmt.Println("Usage: create_provenance run [flags] -- <build command> [args...]")
+		os.Exit(1)
+	}
+	parseFlags(args[:i])
+	opts := flagOptions()
+	trace, err := runTraced(args[i+1:])
+	if err != nil {
+		fmt.Printf("Failed to run build command: %s\n", err)
+		os.Exit(1)
+	}
+	if trace.ExitCode != 0 {
+		fmt.Printf("Build command failed with exit status %d; no provenance generated\n", trace.ExitCode)
+		os.Exit(trace.ExitCode)
+	}
+	opts.Trace = trace
+	emit(opts)
+}
+
+// foldTrace records opts.Trace in stmt: the command and its timing in the
+// metadata, and the files it read as materials. It returns why the
+// materials are incomplete, as traceMaterials does, or "" if they are
+// complete.
+func foldTrace(stmt *Statement, opts Options) string {
+	t := opts.Trace
+	md := &stmt.Predicate.Metadata
+	md.Command = &CommandTrace{Command: t.Command, ExitCode: t.ExitCode, Tracer: t.Tracer, Writes: t.Writes}
+	if opts.Reproducible {
+		// Timestamps come from SOURCE_DATE_EPOCH instead.
+		md.BuildStartedOn = md.BuildFinishedOn
+	} else {
+		md.BuildStartedOn = t.StartedOn.Format(time.RFC3339)
+		md.BuildFinishedOn = t.FinishedOn.Format(time.RFC3339)
+		md.Command.Duration = t.FinishedOn.Sub(t.StartedOn).String()
+	}
+	if t.Tracer == "" {
+		return "the files read by the build command were not traced"
+	}
+	materials, partial := traceMaterials(t)
+	stmt.Predicate.Materials = append(stmt.Predicate.Materials, materials...)
+	md.Completeness.Materials = partial == ""
+	return partial
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal client of TUF repositories, for distributing verification
+// material (public keys, Fulcio roots, Rekor keys) as TUF targets. Only
+// top-level targets are supported; delegations are ignored.
+// See https://theupdateframework.github.io/specification/latest/
+
+const (
+	maxTUFMetadataSize = 512 << 10
+	// maxTUFRootRotations bounds the root versions fetched in one update.
+	maxTUFRootRotations = 1024
+)
+
+type tufSignedFile struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []Signature     `json:"signatures"`
+}
+
+type tufKey struct {
+	KeyType string `json:"keytype"`
+	Scheme  string `json:"scheme"`
+	KeyVal  struct {
+		Public string `json:"public"`
+	} `json:"keyval"`
+}
+
+type tufRole struct {
+	KeyIds    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type tufRoot struct {
+	Type               string             `json:"_type"`
+	Version            int64              `json:"version"`
+	Expires            time.Time          `json:"expires"`
+	ConsistentSnapshot bool               `json:"consistent_snapshot"`
+	Keys               map[string]tufKey  `json:"keys"`
+	Roles              map[string]tufRole `json:"roles"`
+}
+
+type tufMeta struct {
+	Version int64             `json:"version"`
+	Length  int64             `json:"length,omitempty"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+}
+
+// tufMetaFile is timestamp.json or snapshot.json.
+type tufMetaFile struct {
+	Type    string             `json:"_type"`
+	Version int64              `json:"version"`
+	Expires time.Time          `json:"expires"`
+	Meta    map[string]tufMeta `json:"meta"`
+}
+
+type tufTarget struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+type tufTargets struct {
+	Type    string               `json:"_type"`
+	Version int64                `json:"version"`
+	Expires time.Time            `json:"expires"`
+	Targets map[string]tufTarget `json:"targets"`
+}
+
+// tufClient keeps the trusted metadata of one repository in a local cache.
+type tufClient struct {
+	url    string
+	dir    string
+	client *http.Client
+	now    func() time.Time
+
+	root    *tufRoot
+	targets *tufTargets
+}
+
+// newTUFClient returns a client of the repository at repoURL, trusting the
+// pinned root metadata at rootPath until a newer root is cached.
+func newTUFClient(repoURL, rootPath, cacheDir string) (*tufClient, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http" && u.Scheme != "file") {
+		return nil, fmt.Errorf("invalid TUF repository URL %q", repoURL)
+	}
+	if cacheDir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(base, "create_provenance", "tuf")
+	}
+	c := &tufClient{
+		url:    strings.TrimSuffix(repoURL, "/"),
+		dir:    filepath.Join(cacheDir, url.PathEscape(u.Host+u.Path)),
+		client: newHTTPClient(30 * time.Second),
+		now:    time.Now,
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, "targets"), 0755); err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(c.dir, "root.json"))
+	if os.IsNotExist(err) {
+		if rootPath == "" {
+			return nil, errors.New("no trusted TUF root is cached; pin one with --tuf_root")
+		}
+		contents, err = ioutil.ReadFile(rootPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root := &tufRoot{}
+	signed, err := verifyTUFRole(contents, "root", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(signed, root); err != nil {
+		return nil, fmt.Errorf("parsing TUF root: %w", err)
+	}
+	// A root is trusted on first use only if it's signed by its own root
+	// role, like every later version.
+	if _, err := verifyTUFRole(contents, "root", root); err != nil {
+		return nil, fmt.Errorf("pinned TUF root: %w", err)
+	}
+	c.root = root
+	return c, c.save("root.json", contents)
+}
+
+// update refreshes the trusted metadata, following root rotations. When the
+// repository can't be reached, unexpired cached metadata is used instead.
+func (c *tufClient) update() error {
+	err := c.refresh()
+	var fe *tufFetchError
+	if !errors.As(err, &fe) {
+		return err
+	}
+	if cacheErr := c.loadCached(); cacheErr != nil {
+		return fmt.Errorf("%s, and no usable metadata is cached: %s", err, cacheErr)
+	}
+	return nil
+}
+
+func (c *tufClient) refresh() error {
+	rotated := false
+	for i := 0; i < maxTUFRootRotations; i++ {
+		name := fmt.Sprintf("%d.root.json", c.root.Version+1)
+		contents, err := c.fetch(name, maxTUFMetadataSize)
+		if errors.Is(err, errTUFNotFound) {
+			break
+		} else if err != nil {
+			return err
+		}
+		// A new root must be signed by both the trusted and its own root role.
+		if _, err := verifyTUFRole(contents, "root", c.root); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		signed, _ := verifyTUFRole(contents, "root", nil)
+		next := &tufRoot{}
+		if err := json.Unmarshal(signed, next); err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+		if _, err := verifyTUFRole(contents, "root", next); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if next.Version != c.root.Version+1 {
+			return fmt.Errorf("%s has version %d", name, next.Version)
+		}
+		c.root, rotated = next, true
+		if err := c.save("root.json", contents); err != nil {
+			return err
+		}
+	}
+	if c.now().After(c.root.Expires) {
+		return fmt.Errorf("TUF root version %d expired at %s", c.root.Version, c.root.Expires)
+	}
+	if rotated {
+		// Keys may have been rotated, so cached metadata can't be trusted.
+		for _, name := range []string{"timestamp.json", "snapshot.json", "targets.json"} {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+	}
+	// The metadata trusted so far bounds the versions of the new metadata,
+	// even once expired, so that a repository can't be rolled back.
+	var trustedTimestamp, trustedSnapshot tufMetaFile
+	var trustedTargets tufTargets
+	c.loadTrusted("timestamp", &trustedTimestamp)
+	c.loadTrusted("snapshot", &trustedSnapshot)
+	c.loadTrusted("targets", &trustedTargets)
+
+	contents, err := c.fetch("timestamp.json", maxTUFMetadataSize)
+	if errors.Is(err, errTUFNotFound) {
+		// Every repository has a timestamp, so this isn't the repository.
+		return &tufFetchError{"timestamp.json", err}
+	} else if err != nil {
+		return err
+	}
+	timestamp := &tufMetaFile{}
+	if err := c.verifyMetadata("timestamp", contents, timestamp, &timestamp.Version, timestamp.expires); err != nil {
+		return err
+	}
+	if timestamp.Version < trustedTimestamp.Version {
+		return fmt.Errorf("timestamp version %d is older than the trusted version %d", timestamp.Version, trustedTimestamp.Version)
+	}
+	if got, trusted := timestamp.Meta["snapshot.json"].Version, trustedTimestamp.Meta["snapshot.json"].Version; got < trusted {
+		return fmt.Errorf("timestamp version %d lists snapshot version %d, older than the trusted version %d", timestamp.Version, got, trusted)
+	}
+	if err := c.save("timestamp.json", contents); err != nil {
+		return err
+	}
+
+	snapshot := &tufMetaFile{}
+	if contents, err = c.fetchRole("snapshot", timestamp.Meta["snapshot.json"], snapshot, &snapshot.Version, snapshot.expires); err != nil {
+		return err
+	}
+	if snapshot.Version < trustedSnapshot.Version {
+		return fmt.Errorf("snapshot version %d is older than the trusted version %d", snapshot.Version, trustedSnapshot.Version)
+	}
+	for name, trusted := range trustedSnapshot.Meta {
+		if got, ok := snapshot.Meta[name]; !ok || got.Version < trusted.Version {
+			return fmt.Errorf("snapshot version %d lists %s version %d, older than the trusted version %d", snapshot.Version, name, got.Version, trusted.Version)
+		}
+	}
+	if err := c.save("snapshot.json", contents); err != nil {
+		return err
+	}
+	targets := &tufTargets{}
+	if contents, err = c.fetchRole("targets", snapshot.Meta["targets.json"], targets, &targets.Version, targets.expires); err != nil {
+		return err
+	}
+	if targets.Version < trustedTargets.Version {
+		return fmt.Errorf("targets version %d is older than the trusted version %d", targets.Version, trustedTargets.Version)
+	}
+	if err := c.save("targets.json", contents); err != nil {
+		return err
+	}
+	c.targets = targets
+	return nil
+}
+
+// loadTrusted parses the cached metadata of role into v if the trusted root
+// signs it, whether or not it has expired.
+func (c *tufClient) loadTrusted(role string, v interface{}) {
+	contents, err := ioutil.ReadFile(filepath.Join(c.dir, role+".json"))
+	if err != nil {
+		return
+	}
+	if signed, err := verifyTUFRole(contents, role, c.root); err == nil {
+		json.Unmarshal(signed, v)
+	}
+}
+
+// fetchRole fetches and verifies the snapshot or targets metadata described
+// by meta, returning its contents for the caller to cache.
+func (c *tufClient) fetchRole(role string, meta tufMeta, v interface{}, version *int64, expires func() time.Time) ([]byte, error) {
+	name := role + ".json"
+	if c.root.ConsistentSnapshot {
+		name = fmt.Sprintf("%d.%s.json", meta.Version, role)
+	}
+	limit := int64(10 << 20)
+	if meta.Length > 0 {
+		limit = meta.Length
+	}
+	contents, err := c.fetch(name, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTUFHashes(contents, meta.Length, meta.Hashes); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := c.verifyMetadata(role, contents, v, version, expires); err != nil {
+		return nil, err
+	}
+	if *version != meta.Version {
+		return nil, fmt.Errorf("%s has version %d, want %d", name, *version, meta.Version)
+	}
+	return contents, nil
+}
+
+func (t *tufMetaFile) expires() time.Time { return t.Expires }
+func (t *tufTargets) expires() time.Time  { return t.Expires }
+
+// verifyMetadata checks the signatures and expiry of the metadata of role
+// and parses it into v.
+func (c *tufClient) verifyMetadata(role string, contents []byte, v interface{}, version *int64, expires func() time.Time) error {
+	signed, err := verifyTUFRole(contents, role, c.root)
+	if err != nil {
+		return fmt.Errorf("%s: %w", role, err)
+	}
+	if err := json.Unmarshal(signed, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", role, err)
+	}
+	if c.now().After(expires()) {
+		return fmt.Errorf("TUF %s metadata version %d expired at %s", role, *version, expires())
+	}
+	return nil
+}
+
+// loadMetadata verifies the cached metadata of role, returning its version.
+func (c *tufClient) loadMetadata(role string, v interface{}) (int64, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(c.dir, role+".json"))
+	if err != nil {
+		return 0, err
+	}
+	var header struct {
+		Version int64     `json:"version"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := c.verifyMetadata(role, contents, &header, &header.Version, func() time.Time { return header.Expires }); err != nil {
+		return 0, err
+	}
+	return header.Version, json.Unmarshal(mustSigned(contents), v)
+}
+
+func (c *tufClient) loadCached() error {
+	if c.now().After(c.root.Expires) {
+		return fmt.Errorf("TUF root version %d expired at %s", c.root.Version, c.root.Expires)
+	}
+	for _, role := range []string{"timestamp", "snapshot"} {
+		if _, err := c.loadMetadata(role, &tufMetaFile{}); err != nil {
+			return err
+		}
+	}
+	targets := &tufTargets{}
+	if _, err := c.loadMetadata("targets", targets); err != nil {
+		return err
+	}
+	c.targets = targets
+	return nil
+}
+
+func mustSigned(contents []byte) []byte {
+	f := tufSignedFile{}
+	json.Unmarshal(contents, &f)
+	return f.Signed
+}
+
+// target returns the verified contents of the named target, from the cache
+// when it's current. update must have been called.
+func (c *tufClient) target(name string) ([]byte, error) {
+	t, ok := c.targets.Targets[name]
+	if !ok {
+		return nil, fmt.Errorf("TUF repository has no target %q", name)
+	}
+	dir, err := newWorkspace(filepath.Join(c.dir, "targets"), false)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := targetPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if contents, err := ioutil.ReadFile(cached); err == nil && checkTUFHashes(contents, t.Length, t.Hashes) == nil {
+		return contents, nil
+	}
+	remote := "targets/" + name
+	if c.root.ConsistentSnapshot {
+		digest, ok := t.Hashes["sha256"]
+		if !ok {
+			for _, d := range t.Hashes {
+				digest = d
+				break
+			}
+		}
+		dir, file := path.Split(name)
+		remote = "targets/" + dir + digest + "." + file
+	}
+	contents, err := c.fetch(remote, t.Length)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTUFHashes(contents, t.Length, t.Hashes); err != nil {
+		return nil, fmt.Errorf("target %s: %w", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return nil, err
+	}
+	return contents, ioutil.WriteFile(cached, contents, 0644)
+}
+
+var errTUFNotFound = errors.New("not found")
+
+// tufFetchError reports that the repository couldn't be reached, as opposed
+// to it serving metadata that fails verification.
+type tufFetchError struct {
+	name string
+	err  error
+}
+
+func (e *tufFetchError) Error() string {
+	return fmt.Sprintf("fetching TUF metadata %s: %s", e.name, e.err)
+}
+
+func (c *tufClient) fetch(name string, limit int64) ([]byte, error) {
+	if strings.HasPrefix(c.url, "file://") {
+		contents, err := ioutil.ReadFile(filepath.Join(strings.TrimPrefix(c.url, "file://"), filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return nil, errTUFNotFound
+		} else if err != nil {
+			return nil, &tufFetchError{name, err}
+		}
+		if int64(len(contents)) > limit {
+			return nil, fmt.Errorf("%s exceeds %d bytes", name, limit)
+		}
+		return contents, nil
+	}
+	resp, err := c.client.Get(c.url + "/" + name)
+	if err != nil {
+		return nil, &tufFetchError{name, err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		// Object stores such as GCS answer 403 for missing objects.
+		return nil, errTUFNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, &tufFetchError{name, errors.New(resp.Status)}
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, &tufFetchError{name, err}
+	}
+	if int64(len(contents)) > limit {
+		return nil, fmt.Errorf("%s exceeds %d bytes", name, limit)
+	}
+	return contents, nil
+}
+
+func (c *tufClient) save(name string, contents []byte) error {
+	return ioutil.WriteFile(filepath.Join(c.dir, name), contents, 0644)
+}
+
+// verifyTUFRole checks that the signed metadata in contents carries at least
+// the threshold of valid signatures of role in root, returning the signed
+// portion. When root is nil, the signatures are not checked.
+func verifyTUFRole(contents []byte, role string, root *tufRoot) (json.RawMessage, error) {
+	f := tufSignedFile{}
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return nil, err
+	}
+	var header struct {
+		Type string `json:"_type"`
+	}
+	if err := json.Unmarshal(f.Signed, &header); err != nil {
+		return nil, err
+	}
+	if header.Type != role {
+		return nil, fmt.Errorf("metadata type is %q, want %q", header.Type, role)
+	}
+	if root == nil {
+		return f.Signed, nil
+	}
+	r, ok := root.Roles[role]
+	if !ok || r.Threshold < 1 {
+		return nil, fmt.Errorf("root doesn't define the %s role", role)
+	}
+	msg, err := tufCanonical(f.Signed)
+	if err != nil {
+		return nil, err
+	}
+	authorized := stringSet(r.KeyIds...)
+	valid := map[string]bool{}
+	for _, s := range f.Signatures {
+		key, ok := root.Keys[s.KeyId]
+		if !authorized[s.KeyId] || !ok || valid[s.KeyId] {
+			continue
+		}
+		sig, err := hex.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if v, err := tufVerifier(key); err == nil && v.Verify(msg, sig) == nil {
+			valid[s.KeyId] = true
+		}
+	}
+	if len(valid) < r.Threshold {
+		return nil, fmt.Errorf("%d of the %d required %s signatures are valid", len(valid), r.Threshold, role)
+	}
+	return f.Signed, nil
+}
+
+// tufVerifier returns a verifier for an ed25519 or ECDSA P-256 TUF key.
+func tufVerifier(k tufKey) (Verifier, error) {
+	switch k.KeyType {
+	case "ed25519":
+		pub, err := hex.DecodeString(k.KeyVal.Public)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed ed25519 key")
+		}
+		return &keyVerifier{key: ed25519.PublicKey(pub)}, nil
+	case "ecdsa", "ecdsa-sha2-nistp256":
+		der := []byte(nil)
+		if block, _ := pem.Decode([]byte(k.KeyVal.Public)); block != nil {
+			der = block.Bytes
+		} else if b, err := hex.DecodeString(k.KeyVal.Public); err == nil {
+			der = b
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return &keyVerifier{key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported TUF key type %q", k.KeyType)
+	}
+}
+
+func checkTUFHashes(contents []byte, length int64, hashes map[string]string) error {
+	if length > 0 && int64(len(contents)) != length {
+		return fmt.Errorf("length is %d, want %d", len(contents), length)
+	}
+	for alg, want := range hashes {
+		var h hash.Hash
+		switch alg {
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		default:
+			continue
+		}
+		h.Write(contents)
+		if hex.EncodeToString(h.Sum(nil)) != want {
+			return fmt.Errorf("%s digest doesn't match", alg)
+		}
+	}
+	return nil
+}
+
+// tufCanonical encodes a JSON document in the canonical form over which TUF
+// signatures are computed: sorted keys, no insignificant whitespace and only
+// quotes and backslashes escaped.
+func tufCanonical(raw json.RawMessage) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeTUFCanonical(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTUFCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		if _, err := v.Int64(); err != nil {
+			return fmt.Errorf("canonical JSON only allows integers, found %s", v)
+		}
+		buf.WriteString(v.String())
+	case string:
+		buf.WriteByte('"')
+		buf.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v))
+		buf.WriteByte('"')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeTUFCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeTUFCanonical(buf, k)
+			buf.WriteByte(':')
+			if err := writeTUFCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	}
+	return nil
+}
+
+// trustOptions are the flags locating verification material in a TUF
+// repository, shared by the commands that verify signatures.
+type trustOptions struct {
+	url, root, cache *string
+}
+
+func addTrustFlags(flags *flag.FlagSet) *trustOptions {
+	return &trustOptions{
+		url:   flags.String("tuf_url", "", "The TUF repository distributing verification material, e.g. https://tuf-repo-cdn.sigstore.dev."),
+		root:  flags.String("tuf_root", "", "The pinned root.json of --tuf_url, trusted until a newer root is cached."),
+		cache: flags.String("tuf_cache", "", "The directory caching TUF metadata and targets. Defaults to the user cache directory."),
+	}
+}
+
+// target updates the TUF metadata and returns the verified named target.
+func (t *trustOptions) target(name string) ([]byte, error) {
+	if *t.url == "" {
+		return nil, errors.New("--tuf_url is required to fetch TUF targets")
+	}
+	c, err := newTUFClient(*t.url, *t.root, *t.cache)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.update(); err != nil {
+		return nil, err
+	}
+	return c.target(name)
+}
+
+// verifier returns the verifier of the PEM public key at path or, if path is
+// empty, of the named target.
+func (t *trustOptions) verifier(path, target string) (*keyVerifier, error) {
+	if path != "" {
+		return loadVerifier(path)
+	}
+	contents, err := t.target(target)
+	if err != nil {
+		return nil, err
+	}
+	return parseVerifier(contents, "TUF target "+target)
+}
+
+// targetPath returns the path in dir the named target is written to, which
+// neither ".." nor symlinks in dir take out of it: target names are chosen by
+// the repository.
+func targetPath(dir workspace, name string) (string, error) {
+	resolved, err := resolveExisting(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	if resolved == string(dir) || !dir.contains(resolved) {
+		return "", fmt.Errorf("target %q resolves to %s, outside --output_dir %s", name, resolved, dir)
+	}
+	return resolved, nil
+}
+
+// tufMain refreshes the cached TUF metadata and lists or writes out targets.
+func tufMain(args []string) {
+	flags := flag.NewFlagSet("tuf", flag.ExitOnError)
+	trust := addTrustFlags(flags)
+	targets := flags.String("targets", "", "Comma-separated names of targets to write to --output_dir. When empty, all targets are listed.")
+	outputDir := flags.String("output_dir", ".", "The directory to which --targets are written.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *trust.url == "" {
+		fmt.Println("No value found for required flag: --tuf_url")
+		flags.Usage()
+		os.Exit(1)
+	}
+	c, err := newTUFClient(*trust.url, *trust.root, *trust.cache)
+	if err == nil {
+		err = c.update()
+	}
+	if err != nil {
+		fmt.Printf("Failed to update TUF metadata: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Trusted TUF root version %d, targets version %d\n", c.root.Version, c.targets.Version)
+	names := parseList(*targets)
+	if len(names) == 0 {
+		for name := range c.targets.Targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\t%d bytes\n", name, c.targets.Targets[name].Length)
+		}
+		return
+	}
+	err = os.MkdirAll(*outputDir, 0755)
+	var dir workspace
+	if err == nil {
+		dir, err = newWorkspace(*outputDir, false)
+	}
+	if err != nil {
+		fmt.Printf("Failed to create output directory: %s\n", err)
+		os.Exit(1)
+	}
+	for _, name := range names {
+		contents, err := c.target(name)
+		if err != nil {
+			fmt.Printf("Failed to fetch target: %s\n", err)
+			os.Exit(1)
+		}
+		out, err := targetPath(dir, name)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(out), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(out, contents, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write target: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", out)
+	}
+}
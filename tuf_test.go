@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTUFRepo is a TUF repository in a directory, served as a file:// URL,
+// whose roles all share one key.
+type testTUFRepo struct {
+	t    *testing.T
+	dir  string
+	root tufRoot
+	keys map[string]ed25519.PrivateKey
+}
+
+func newTestTUFRepo(t *testing.T) *testTUFRepo {
+	r := &testTUFRepo{t: t, dir: t.TempDir(), keys: map[string]ed25519.PrivateKey{}}
+	r.root = tufRoot{Type: "root", Version: 1, Expires: time.Now().Add(time.Hour).UTC()}
+	r.setKey(r.newKey("k1"))
+	r.write("root.json", r.sign(r.root, "k1"))
+	return r
+}
+
+// newKey generates the key id.
+func (r *testTUFRepo) newKey(id string) string {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.keys[id] = priv
+	if r.root.Keys == nil {
+		r.root.Keys = map[string]tufKey{}
+	}
+	k := tufKey{KeyType: "ed25519", Scheme: "ed25519"}
+	k.KeyVal.Public = hex.EncodeToString(pub)
+	r.root.Keys[id] = k
+	return id
+}
+
+// setKey makes id the only key of every role.
+func (r *testTUFRepo) setKey(id string) {
+	r.root.Roles = map[string]tufRole{}
+	for _, role := range []string{"root", "timestamp", "snapshot", "targets"} {
+		r.root.Roles[role] = tufRole{KeyIds: []string{id}, Threshold: 1}
+	}
+}
+
+// rotate publishes the next root version, whose roles all have a new key,
+// signed with both the old and the new key.
+func (r *testTUFRepo) rotate(oldKey, newKey string) {
+	r.root.Version++
+	r.newKey(newKey)
+	r.setKey(newKey)
+	r.write(strconv.FormatInt(r.root.Version, 10)+".root.json", r.sign(r.root, oldKey, newKey))
+}
+
+func (r *testTUFRepo) sign(signed interface{}, keys ...string) []byte {
+	raw, err := json.Marshal(signed)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	msg, err := tufCanonical(raw)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	f := tufSignedFile{Signed: raw}
+	for _, k := range keys {
+		f.Signatures = append(f.Signatures, Signature{KeyId: k, Sig: hex.EncodeToString(ed25519.Sign(r.keys[k], msg))})
+	}
+	contents, err := json.Marshal(f)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return contents
+}
+
+func (r *testTUFRepo) write(name string, contents []byte) {
+	path := filepath.Join(r.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// testTUFVersions are the versions of the top-level metadata published.
+type testTUFVersions struct {
+	timestamp, snapshot, targets int64
+	expires                      time.Time
+}
+
+// publish writes the timestamp, snapshot and targets metadata of v, signed
+// with key, with the target "key.pem" of contents.
+func (r *testTUFRepo) publish(v testTUFVersions, key, contents string) {
+	if v.expires.IsZero() {
+		v.expires = time.Now().Add(time.Hour).UTC()
+	}
+	r.write("targets/key.pem", []byte(contents))
+	sum := sha256.Sum256([]byte(contents))
+	targets := tufTargets{Type: "targets", Version: v.targets, Expires: v.expires, Targets: map[string]tufTarget{
+		"key.pem": {Length: int64(len(contents)), Hashes: map[string]string{"sha256": hex.EncodeToString(sum[:])}},
+	}}
+	r.write("targets.json", r.sign(targets, key))
+	snapshot := tufMetaFile{Type: "snapshot", Version: v.snapshot, Expires: v.expires, Meta: map[string]tufMeta{"targets.json": {Version: v.targets}}}
+	r.write("snapshot.json", r.sign(snapshot, key))
+	timestamp := tufMetaFile{Type: "timestamp", Version: v.timestamp, Expires: v.expires, Meta: map[string]tufMeta{"snapshot.json": {Version: v.snapshot}}}
+	r.write("timestamp.json", r.sign(timestamp, key))
+}
+
+// client returns a client caching in cache, trusting the repository's first
+// root.
+func (r *testTUFRepo) client(cache string, now time.Time) *tufClient {
+	c, err := newTUFClient("file://"+r.dir, filepath.Join(r.dir, "root.json"), cache)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+	return c
+}
+
+func TestTUFRotation(t *testing.T) {
+	r := newTestTUFRepo(t)
+	cache := t.TempDir()
+	r.publish(testTUFVersions{timestamp: 1, snapshot: 1, targets: 1}, "k1", "old key")
+	c := r.client(cache, time.Now())
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	r.rotate("k1", "k2")
+	r.publish(testTUFVersions{timestamp: 2, snapshot: 2, targets: 2}, "k2", "new key")
+	c = r.client(cache, time.Now())
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	if c.root.Version != 2 {
+		t.Errorf("root version = %d, want 2", c.root.Version)
+	}
+	if got, err := c.target("key.pem"); err != nil || string(got) != "new key" {
+		t.Errorf("target() = %q, %v, want the new key", got, err)
+	}
+	// Metadata is only trusted from the rotated keys.
+	r.publish(testTUFVersions{timestamp: 3, snapshot: 3, targets: 3}, "k1", "forged key")
+	if err := r.client(cache, time.Now()).refresh(); err == nil || !strings.Contains(err.Error(), "signatures are valid") {
+		t.Errorf("refresh() of metadata signed with the old key = %v", err)
+	}
+	// A root must be signed with the keys of the trusted root too.
+	r.root.Version++
+	r.newKey("k3")
+	r.setKey("k3")
+	r.write("3.root.json", r.sign(r.root, "k3"))
+	if err := r.client(cache, time.Now()).refresh(); err == nil || !strings.Contains(err.Error(), "3.root.json") {
+		t.Errorf("refresh() of a root signed with its own key only = %v", err)
+	}
+}
+
+func TestTUFRollback(t *testing.T) {
+	trusted := testTUFVersions{timestamp: 5, snapshot: 5, targets: 5}
+	tests := []struct {
+		name    string
+		v       testTUFVersions
+		wantErr string
+	}{
+		{"newer", testTUFVersions{timestamp: 6, snapshot: 6, targets: 6}, ""},
+		{"same", trusted, ""},
+		{"older timestamp", testTUFVersions{timestamp: 4, snapshot: 6, targets: 6}, "timestamp version 4 is older"},
+		{"older snapshot in the timestamp", testTUFVersions{timestamp: 6, snapshot: 4, targets: 6}, "lists snapshot version 4"},
+		{"older targets in the snapshot", testTUFVersions{timestamp: 6, snapshot: 6, targets: 4}, "lists targets.json version 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestTUFRepo(t)
+			cache := t.TempDir()
+			r.publish(trusted, "k1", "key")
+			if err := r.client(cache, time.Now()).update(); err != nil {
+				t.Fatal(err)
+			}
+			r.publish(tt.v, "k1", "key")
+			err := r.client(cache, time.Now()).refresh()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("refresh() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("refresh() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTUFRollbackPastExpiry(t *testing.T) {
+	// Metadata trusted once bounds the versions even after it expires.
+	r := newTestTUFRepo(t)
+	cache := t.TempDir()
+	now := time.Now()
+	r.publish(testTUFVersions{timestamp: 5, snapshot: 5, targets: 5, expires: now.Add(time.Minute).UTC()}, "k1", "key")
+	if err := r.client(cache, now).update(); err != nil {
+		t.Fatal(err)
+	}
+	r.publish(testTUFVersions{timestamp: 4, snapshot: 4, targets: 4, expires: now.Add(time.Hour).UTC()}, "k1", "key")
+	if err := r.client(cache, now.Add(10*time.Minute)).refresh(); err == nil || !strings.Contains(err.Error(), "older than the trusted") {
+		t.Errorf("refresh() of older metadata once the trusted metadata expired = %v", err)
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	ws, err := newWorkspace(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"key.pem", false},
+		{"keys/key.pem", false},
+		{"keys/../key.pem", false},
+		{"../key.pem", true},
+		{"keys/../../key.pem", true},
+		{"/etc/key.pem", false},
+		{"link/key.pem", true},
+		{".", true},
+	}
+	for _, tt := range tests {
+		got, err := targetPath(ws, tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("targetPath(%q) = %q, %v, want an error %v", tt.name, got, err, tt.wantErr)
+		}
+	}
+}
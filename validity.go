@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Validity is the window in which provenance may be relied on, outside of
+// which verification rejects it. It is an extension to the SLSA v0.1
+// metadata.
+type Validity struct {
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+}
+
+// newValidity returns the window of d from from.
+func newValidity(from time.Time, d time.Duration) *Validity {
+	return &Validity{NotBefore: from.UTC().Format(time.RFC3339), NotAfter: from.Add(d).UTC().Format(time.RFC3339)}
+}
+
+// check returns the problem with relying at now on provenance valid in v, if
+// any.
+func (v *Validity) check(now time.Time) string {
+	notBefore, err := time.Parse(time.RFC3339, v.NotBefore)
+	if err != nil {
+		return fmt.Sprintf("validity notBefore %q is not an RFC 3339 timestamp", v.NotBefore)
+	}
+	notAfter, err := time.Parse(time.RFC3339, v.NotAfter)
+	if err != nil {
+		return fmt.Sprintf("validity notAfter %q is not an RFC 3339 timestamp", v.NotAfter)
+	}
+	switch {
+	case now.Before(notBefore):
+		return fmt.Sprintf("the provenance isn't valid until %s", v.NotBefore)
+	case now.After(notAfter):
+		return fmt.Sprintf("the provenance expired on %s", v.NotAfter)
+	}
+	return ""
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readStatement reads the provenance Statement written to path.
+func readStatement(path string) (*Statement, error) {
+	stmt, _, err := readProvenance(path)
+	return stmt, err
+}
+
+// readProvenance reads the provenance at path, which is either a Statement
+// or a DSSE envelope of one, in which case it also returns the envelope's
+// signatures, or a ShardIndex, whose shards are joined. The signatures are
+// not verified.
+func readProvenance(path string) (*Statement, []Signature, error) {
+	contents, err := readAttestationFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeProvenance(contents, path)
+}
+
+// decodeProvenance decodes the provenance read from path as readProvenance
+// does.
+func decodeProvenance(contents []byte, path string) (*Statement, []Signature, error) {
+	if index := parseShardIndex(contents); index != nil {
+		return readShards(index, path)
+	}
+	return parseProvenance(contents, path)
+}
+
+// parseProvenance parses the provenance read from path.
+func parseProvenance(contents []byte, path string) (*Statement, []Signature, error) {
+	if err := checkAttestation(contents, path); err != nil {
+		return nil, nil, err
+	}
+	env := &Envelope{}
+	if err := json.Unmarshal(contents, env); err == nil && env.PayloadType != "" {
+		if env.PayloadType != PayloadContentType {
+			return nil, nil, fmt.Errorf("%s has payload type %q", path, env.PayloadType)
+		}
+		var err error
+		contents, err = base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding envelope payload of %s: %w", path, err)
+		}
+		if err := checkAttestation(contents, "the envelope payload of "+path); err != nil {
+			return nil, nil, err
+		}
+	}
+	stmt := &Statement{}
+	if err := decodeStatement(contents, stmt); err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if stmt.Type != StatementV01Type && stmt.Type != StatementV1Type {
+		return nil, nil, fmt.Errorf("%s is not an in-toto statement", path)
+	}
+	return stmt, env.Signatures, nil
+}
+
+// matchDigest reports whether got agrees with want on every algorithm both
+// contain, and they share at least one.
+func matchDigest(want, got DigestSet) bool {
+	shared := false
+	for alg, d := range got {
+		if w, ok := want[alg]; ok {
+			if w != d {
+				return false
+			}
+			shared = true
+		}
+	}
+	return shared
+}
+
+// subjectReport is how the files at an artifact path compare with the
+// subjects of provenance: the files that match their subject digest, that
+// don't, the subjects without a file and the files that aren't subjects.
+type subjectReport struct {
+	Matched  int
+	Modified []string
+	Missing  []string
+	Extra    []string
+}
+
+// problems returns a problem for each modified file and missing subject
+// and, if exhaustive, each extra file.
+func (r *subjectReport) problems(exhaustive bool) []string {
+	var problems []string
+	for _, name := range r.Modified {
+		problems = append(problems, fmt.Sprintf("%s doesn't match its subject digest", name))
+	}
+	if exhaustive {
+		for _, name := range r.Extra {
+			problems = append(problems, fmt.Sprintf("%s is not attested", name))
+		}
+	}
+	for _, name := range r.Missing {
+		problems = append(problems, fmt.Sprintf("%s is attested but missing", name))
+	}
+	return problems
+}
+
+// summary describes r in a line.
+func (r *subjectReport) summary() string {
+	return fmt.Sprintf("%d matched, %d modified, %d missing, %d extra", r.Matched, len(r.Modified), len(r.Missing), len(r.Extra))
+}
+
+// compareSubjects hashes the files at root and compares them with the
+// subjects of stmt, named as they would be by generate, either by path, by
+// purl with the path as subpath or, for the files of Maven artifacts, by
+// pkg:maven purl, of their coordinates in coords or the repository layout.
+func compareSubjects(stmt *Statement, root string, coords map[string]mavenCoordinates) (*subjectReport, error) {
+	want := map[string]DigestSet{}
+	for _, s := range stmt.Subject {
+		want[subjectPath(s.Name)] = s.Digest
+	}
+	r := &subjectReport{}
+	seen := map[string]bool{}
+	err := walkFiles(root, func(abspath, name string, info fs.FileInfo) error {
+		key := name
+		digest, ok := want[key]
+		if !ok {
+			c, isMaven := coords[name]
+			if !isMaven {
+				c, isMaven = mavenLayoutCoordinates(name)
+			}
+			if isMaven {
+				key = c.purl().String()
+				digest, ok = want[key]
+			}
+		}
+		if !ok {
+			r.Extra = append(r.Extra, name)
+			return nil
+		}
+		seen[key] = true
+		got, err := digestFile(abspath, knownAlgorithms(digest)...)
+		if err != nil {
+			return err
+		}
+		if matchDigest(digest, got) {
+			r.Matched++
+		} else {
+			r.Modified = append(r.Modified, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stmt.Subject {
+		if !seen[subjectPath(s.Name)] {
+			r.Missing = append(r.Missing, s.Name)
+		}
+	}
+	return r, nil
+}
+
+// storedStatement is a provenance file found in a provenance store.
+type storedStatement struct {
+	Path      string
+	Statement *Statement
+	// KeyIds are those of the keys the provenance is verified with.
+	KeyIds []string
+	// Unsigned, if set, is why provenance in a store doesn't verify with the
+	// key given, which rejects it as a link of a chain.
+	Unsigned string
+}
+
+// provenanceStore indexes provenance by the sha256 digests of its subjects.
+type provenanceStore map[string][]storedStatement
+
+// loadProvenanceStore reads the provenance files in dir, in name order,
+// checking that each is signed with the key of verifier, if set: anyone who
+// can write to the store could add provenance of a trusted builder otherwise.
+// Files that aren't in-toto statements are skipped, as are shard indexes,
+// whose shards are read on their own.
+func loadProvenanceStore(dir string, verifier *keyVerifier) (provenanceStore, error) {
+	files, err := listStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	store := provenanceStore{}
+	for _, path := range files {
+		contents, err := readAttestationFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if parseShardIndex(contents) != nil {
+			continue
+		}
+		stmt, _, err := parseProvenance(contents, path)
+		if err != nil {
+			continue
+		}
+		link := storedStatement{Path: path, Statement: stmt}
+		if verifier != nil {
+			if _, err := envelopeSigner(path, contents, verifier); err != nil {
+				link.Unsigned = err.Error()
+			} else {
+				link.KeyIds = verifiedKeyIds(verifier)
+			}
+		}
+		for _, s := range stmt.Subject {
+			if d := s.Digest["sha256"]; d != "" {
+				store[d] = append(store[d], link)
+			}
+		}
+	}
+	return store, nil
+}
+
+// verifyPolicy is what the verified provenance, and each provenance in its
+// chain, must satisfy.
+type verifyPolicy struct {
+	// TrustedBuilders are the accepted builder ids; any builder is accepted
+	// if empty.
+	TrustedBuilders []string `json:"trusted_builders,omitempty"`
+	// Revocations, if set, lists the runs, keys and digests to reject.
+	Revocations *RevocationList `json:"revocations,omitempty"`
+	// RequireVerifiedCommit rejects provenance that doesn't record, with
+	// --record_commit, a source commit signed with a verified signature.
+	RequireVerifiedCommit bool `json:"require_verified_commit,omitempty"`
+}
+
+// check returns the problems with the provenance stmt, verified with the keys
+// of keyIds.
+func (p verifyPolicy) check(stmt *Statement, keyIds []string) []string {
+	var problems []string
+	if stmt.PredicateType != ProvenanceV01Type && stmt.PredicateType != ProvenanceV1Type {
+		problems = append(problems, fmt.Sprintf("predicate type %q is not SLSA provenance", stmt.PredicateType))
+	}
+	if len(p.TrustedBuilders) > 0 && !stringSet(p.TrustedBuilders...)[stmt.Predicate.Builder.Id] {
+		problems = append(problems, fmt.Sprintf("builder %q is not trusted", stmt.Predicate.Builder.Id))
+	}
+	if p.Revocations != nil {
+		problems = append(problems, p.Revocations.check(stmt, keyIds)...)
+	}
+	if v := stmt.Predicate.Metadata.Validity; v != nil {
+		if problem := v.check(time.Now()); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if p.RequireVerifiedCommit {
+		switch c := stmt.Predicate.Metadata.SourceCommit; {
+		case c == nil:
+			problems = append(problems, "no source commit is recorded, as --record_commit does")
+		case !c.Verification.Verified:
+			problems = append(problems, fmt.Sprintf("commit %s is not signed with a verified signature (%s)", c.SHA, c.Verification.Reason))
+		case c.Tag != nil && (c.Tag.Verification == nil || !c.Tag.Verification.Verified):
+			problems = append(problems, fmt.Sprintf("tag %s of commit %s is not signed with a verified signature", c.Tag.Name, c.SHA))
+		}
+	}
+	return problems
+}
+
+// verifyChain checks the provenance at path against policy and then, for
+// each material with provenance in store, that provenance, recursively,
+// rejecting the provenance loadProvenanceStore found unsigned. It
+// prints the chain as it is walked and returns the problems found, each
+// prefixed with the provenance file it concerns.
+func verifyChain(link storedStatement, store provenanceStore, policy verifyPolicy, depth int, visiting map[string]bool) []string {
+	path, stmt := link.Path, link.Statement
+	indent := strings.Repeat("  ", depth)
+	fmt.Printf("%s%s (builder %s)\n", indent, path, stmt.Predicate.Builder.Id)
+	var problems []string
+	for _, p := range policy.check(stmt, link.KeyIds) {
+		problems = append(problems, path+": "+p)
+	}
+	visiting[path] = true
+	defer delete(visiting, path)
+	for _, m := range stmt.Predicate.Materials {
+		links := store[m.Digest["sha256"]]
+		if m.Digest["sha256"] == "" || len(links) == 0 {
+			fmt.Printf("%s  %s: no provenance\n", indent, m.URI)
+			continue
+		}
+		fmt.Printf("%s  %s:\n", indent, m.URI)
+		for _, l := range links {
+			if visiting[l.Path] {
+				problems = append(problems, fmt.Sprintf("%s: material %s is built from its own output", l.Path, m.URI))
+				continue
+			}
+			if !matchDigest(m.Digest, subjectDigest(l.Statement, m.Digest["sha256"])) {
+				problems = append(problems, fmt.Sprintf("%s: material %s doesn't match its subject digest", l.Path, m.URI))
+				continue
+			}
+			if l.Unsigned != "" {
+				problems = append(problems, l.Unsigned)
+				continue
+			}
+			problems = append(problems, verifyChain(l, store, policy, depth+2, visiting)...)
+		}
+	}
+	return problems
+}
+
+// subjectDigest returns the digest of the subject of stmt with the given
+// sha256 digest.
+func subjectDigest(stmt *Statement, sha256 string) DigestSet {
+	for _, s := range stmt.Subject {
+		if s.Digest["sha256"] == sha256 {
+			return s.Digest
+		}
+	}
+	return nil
+}
+
+// verifyMain implements `verify --provenance <file> --artifact_path <path>`,
+// checking that the artifacts at the path are the subjects of the provenance
+// and that it, and with --chain the provenance of its materials, satisfies
+// policy.
+func verifyMain(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	provenance := flags.String("provenance", "build.provenance", "The provenance to verify.")
+	artifactPath := flags.String("artifact_path", "", "The artifact, or directory of artifacts, to check against the subjects.")
+	exhaustive := flags.Bool("exhaustive", false, "Also fail if the artifact directory contains files that aren't subjects.")
+	mavenCoordsFile := flags.String("maven_coordinates", "", "The coordinates file subjects named with --subject_naming maven were named with, for files not laid out as in a Maven repository.")
+	chain := flags.Bool("chain", false, "Verify the provenance of the materials too, recursively.")
+	storeDir := flags.String("provenance_store", "", "The directory holding the provenance of materials (default: the directory of --provenance).")
+	loadPolicyFlags := addPolicyFlags(flags, " anywhere in the chain")
+	useCAS := flags.Bool("cas", false, "Look up the provenance of the file at --artifact_path by its digest in the local content-addressed store, instead of reading --provenance.")
+	casDir := flags.String("cas_dir", defaultCASDir(), "The directory of the local content-addressed store.")
+	keyPath := flags.String("public_key", "", "The PEM public key the provenance must be signed with, as a DSSE envelope.")
+	keyTarget := flags.String("public_key_target", "", "The TUF target of --tuf_url holding the PEM public key the provenance must be signed with, instead of --public_key.")
+	trust := addTrustFlags(flags)
+	tofu := flags.Bool("tofu", false, "Pin the signer of provenance of each source repository and builder on first use, failing if provenance of the same repository and builder is later signed with another key. Requires --public_key or --public_key_target.")
+	tofuStore := flags.String("tofu_store", defaultTOFUStore(), "The file the signers are pinned in with --tofu.")
+	tofuAccept := flags.Bool("tofu_accept", false, "With --tofu, pin the new signer instead of failing, e.g. after a key rotation.")
+	kitPath := flags.String("kit", "", "A verification kit written by `create_provenance kit`, whose provenance, public key and policy are verified with, without network access.")
+	kitDigest := flags.String("kit_sha256", "", "With --kit, the SHA-256 digest the kit must have, as published with it (required with --kit).")
+	sarifOutput := flags.String("sarif_output", "", "Also write the problems found to this file as SARIF, for upload to GitHub code scanning.")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *artifactPath == "" && (!*chain || *useCAS) {
+		fmt.Println("No value found for required flag: --artifact_path")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *keyPath != "" && *keyTarget != "" {
+		fmt.Println("--public_key and --public_key_target are mutually exclusive")
+		os.Exit(1)
+	}
+	if *tofu && ((*keyPath == "" && *keyTarget == "") || *tofuStore == "") {
+		fmt.Println("--tofu requires --public_key or --public_key_target, and --tofu_store")
+		os.Exit(1)
+	}
+	var kit *verificationKit
+	if *kitPath != "" {
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "provenance", "public_key", "public_key_target", "tofu", "cas", "trusted_builders", "policy", "policy_key", "revocation_list", "revocation_key":
+				fmt.Printf("--kit can't be combined with --%s: the kit holds the provenance and what to trust\n", f.Name)
+				os.Exit(1)
+			}
+		})
+		// The key and policy in the kit are only trusted once the kit is
+		// known to be the one published.
+		if *kitDigest == "" {
+			fmt.Println("No value found for flag required with --kit: --kit_sha256")
+			flags.Usage()
+			os.Exit(1)
+		}
+		// Everything verify needs is in the kit.
+		offline = true
+		var err error
+		if kit, err = readKit(*kitPath, *kitDigest); err != nil {
+			fmt.Printf("Failed to read the verification kit: %s\n", err)
+			os.Exit(1)
+		}
+		*provenance = *kitPath + "#" + KitProvenance
+		if *storeDir == "" {
+			*storeDir = filepath.Dir(*kitPath)
+		}
+	} else if *kitDigest != "" {
+		fmt.Println("--kit_sha256 requires --kit")
+		os.Exit(1)
+	}
+	policy, _ := loadPolicyFlags()
+	signers := &signerCheck{TOFUPath: *tofuStore, Accept: *tofuAccept}
+	if kit != nil {
+		// Like the policy flags, --require_verified_commit only adds to the
+		// kit's policy.
+		kit.Policy.RequireVerifiedCommit = kit.Policy.RequireVerifiedCommit || policy.RequireVerifiedCommit
+		policy, signers.Verifier = kit.Policy, kit.Verifier
+	}
+	if *keyPath != "" || *keyTarget != "" {
+		var err error
+		if signers.Verifier, err = trust.verifier(*keyPath, *keyTarget); err != nil {
+			fmt.Printf("Failed to load key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *tofu {
+		var err error
+		if signers.TOFU, err = readTOFUStore(*tofuStore); err != nil {
+			fmt.Printf("Failed to read the TOFU store: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	sarif := newSARIFReport(*sarifOutput)
+	if *useCAS {
+		verifyFromCAS(*casDir, normalizeInputPath(*artifactPath), policy, *chain, *storeDir, signers, sarif)
+		return
+	}
+	var contents []byte
+	var err error
+	if kit != nil {
+		contents = kit.Provenance
+	} else {
+		contents, err = readAttestationFile(*provenance)
+	}
+	var stmt *Statement
+	if err == nil {
+		stmt, _, err = decodeProvenance(contents, *provenance)
+	}
+	if err != nil {
+		sarif.add(RuleUnreadableProvenance, *provenance, []string{err.Error()})
+		sarif.write()
+		fmt.Printf("Failed to read provenance: %s\n", err)
+		os.Exit(1)
+	}
+	sarif.describe(stmt)
+	var problems []string
+	var report *subjectReport
+	if *artifactPath != "" {
+		var coords map[string]mavenCoordinates
+		if *mavenCoordsFile != "" {
+			if coords, err = readMavenCoordinates(*mavenCoordsFile); err != nil {
+				fmt.Printf("Failed to read maven coordinates: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		report, err = compareSubjects(stmt, normalizeInputPath(*artifactPath), coords)
+		if err != nil {
+			fmt.Printf("Failed to hash artifacts: %s\n", err)
+			os.Exit(1)
+		}
+		problems = report.problems(*exhaustive)
+		sarif.add(RuleUnverifiedArtifact, *artifactPath, problems)
+	}
+	if *storeDir == "" {
+		*storeDir = filepath.Dir(*provenance)
+	}
+	root := storedStatement{Path: filepath.Clean(*provenance), Statement: stmt, KeyIds: verifiedKeyIds(signers.Verifier)}
+	policyProblems := checkProvenance(root, policy, *chain, *storeDir, signers.Verifier)
+	sarif.add(RulePolicyViolation, root.Path, policyProblems)
+	problems = append(problems, policyProblems...)
+	n := len(problems)
+	problems = signers.check(root.Path, contents, stmt, problems)
+	sarif.add(RuleUntrustedSigner, root.Path, problems[n:])
+	sarif.write()
+	for _, p := range problems {
+		fmt.Println("FAIL", p)
+	}
+	if report != nil {
+		if !*exhaustive && len(report.Extra) > 0 {
+			fmt.Printf("Note: not subjects, which --exhaustive fails on: %s\n", strings.Join(report.Extra, ", "))
+		}
+		fmt.Printf("Artifacts: %s\n", report.summary())
+	}
+	if len(problems) > 0 {
+		fmt.Printf("Verification of %s failed\n", *provenance)
+		os.Exit(1)
+	}
+	signers.save()
+	fmt.Printf("Verified %s\n", *provenance)
+	if r := stmt.Predicate.Metadata.Retroactive; r != nil {
+		fmt.Printf("Note: the provenance is retroactive, reconstructed by backfill on %s rather than recorded by the build\n", r.ReconstructedOn)
+	}
+}
+
+// addPolicyFlags adds the flags selecting the verify policy to flags, with
+// where builders are trusted in the usage of --trusted_builders. The returned
+// function loads the policy once the flags are parsed, and its source, which
+// is empty unless it came from --policy; it exits if the policy can't be
+// loaded.
+func addPolicyFlags(flags *flag.FlagSet, where string) func() (verifyPolicy, string) {
+	trustedBuilders := flags.String("trusted_builders", "", "Comma-separated builder ids accepted"+where+" (default: any).")
+	policyRef := flags.String("policy", "", "A signed policy bundle of trusted builders and revocations, as a path or an oci://<repository>:<tag> reference.")
+	policyKey := flags.String("policy_key", "", "The PEM public key the policy bundle must be signed with.")
+	revocationList := flags.String("revocation_list", "", "A signed revocation list, as a path or URL, of runs, keys and digests to reject.")
+	revocationKey := flags.String("revocation_key", "", "The PEM public key the revocation list must be signed with.")
+	verifiedCommit := flags.Bool("require_verified_commit", false, "Require the source commit, and the tag a run was started for, recorded by --record_commit, to be signed with a verified signature, in addition to the policy.")
+	return func() (verifyPolicy, string) {
+		policy := verifyPolicy{TrustedBuilders: parseList(*trustedBuilders)}
+		if *policyRef != "" {
+			if *policyKey == "" {
+				fmt.Println("--policy requires --policy_key")
+				os.Exit(1)
+			}
+			if *trustedBuilders != "" {
+				fmt.Println("--trusted_builders can't be combined with --policy")
+				os.Exit(1)
+			}
+			verifier, err := loadVerifier(*policyKey)
+			if err != nil {
+				fmt.Printf("Failed to load policy key: %s\n", err)
+				os.Exit(1)
+			}
+			p, err := loadPolicy(*policyRef, verifier)
+			if err != nil {
+				fmt.Printf("Failed to load policy: %s\n", err)
+				os.Exit(1)
+			}
+			policy = *p
+		}
+		if *revocationList != "" {
+			if *revocationKey == "" {
+				fmt.Println("--revocation_list requires --revocation_key")
+				os.Exit(1)
+			}
+			verifier, err := loadVerifier(*revocationKey)
+			if err != nil {
+				fmt.Printf("Failed to load revocation key: %s\n", err)
+				os.Exit(1)
+			}
+			list, err := loadRevocationList(*revocationList, verifier)
+			if err != nil {
+				fmt.Printf("Failed to load revocation list: %s\n", err)
+				os.Exit(1)
+			}
+			// Revocations only ever add to those of the policy.
+			if policy.Revocations == nil {
+				policy.Revocations = list
+			} else {
+				policy.Revocations.Runs = append(policy.Revocations.Runs, list.Runs...)
+				policy.Revocations.Keys = append(policy.Revocations.Keys, list.Keys...)
+				policy.Revocations.Digests = append(policy.Revocations.Digests, list.Digests...)
+			}
+		}
+		// Like revocations, the flag only adds to the policy.
+		policy.RequireVerifiedCommit = policy.RequireVerifiedCommit || *verifiedCommit
+		return policy, *policyRef
+	}
+}
+
+// checkProvenance returns the problems with root under policy and, if
+// chain, with the provenance of its materials in the store at storeDir, which
+// must be signed with the key of verifier, if set, as root must.
+func checkProvenance(root storedStatement, policy verifyPolicy, chain bool, storeDir string, verifier *keyVerifier) []string {
+	if !chain {
+		return policy.check(root.Statement, root.KeyIds)
+	}
+	store, err := loadProvenanceStore(storeDir, verifier)
+	if err != nil {
+		fmt.Printf("Failed to read provenance store: %s\n", err)
+		os.Exit(1)
+	}
+	return verifyChain(root, store, policy, 0, map[string]bool{})
+}
+
+// verifyFromCAS verifies the file at artifact with the provenance attesting
+// its digest in the local CAS at dir. Provenance is tried oldest first, and
+// the artifact is verified by the first that satisfies policy and signers;
+// its name needn't match the subject's, as downloaded files are often
+// renamed. The problems of each provenance tried are only reported to sarif
+// if none verifies the artifact.
+func verifyFromCAS(dir, artifact string, policy verifyPolicy, chain bool, storeDir string, signers *signerCheck, sarif *sarifReport) {
+	digest, err := digestFile(artifact)
+	if err != nil {
+		fmt.Printf("Failed to hash artifact: %s\n", err)
+		os.Exit(1)
+	}
+	digests, err := casLookup(dir, digest["sha256"])
+	if err != nil {
+		fmt.Printf("Failed to read the local CAS: %s\n", err)
+		os.Exit(1)
+	}
+	if storeDir == "" {
+		storeDir = casObjects(dir)
+	}
+	failed := newSARIFReport(sarif.path)
+	for _, d := range digests {
+		path := filepath.Join(casObjects(dir), d)
+		contents, err := readAttestationFile(path)
+		var stmt *Statement
+		if err == nil {
+			stmt, _, err = decodeProvenance(contents, path)
+		}
+		if err == nil && subjectDigest(stmt, digest["sha256"]) == nil {
+			err = fmt.Errorf("%s doesn't attest sha256:%s", path, digest["sha256"])
+		}
+		if err != nil {
+			failed.add(RuleUnreadableProvenance, path, []string{err.Error()})
+			fmt.Println("FAIL", err)
+			continue
+		}
+		failed.describe(stmt)
+		problems := checkProvenance(storedStatement{Path: path, Statement: stmt, KeyIds: verifiedKeyIds(signers.Verifier)}, policy, chain, storeDir, signers.Verifier)
+		for i, p := range problems {
+			if !chain {
+				// Chain problems already name their provenance.
+				problems[i] = path + ": " + p
+			}
+			fmt.Println("FAIL", problems[i])
+		}
+		failed.add(RulePolicyViolation, path, problems)
+		if len(problems) > 0 {
+			continue
+		}
+		// Signer problems name their provenance.
+		if problems = signers.check(path, contents, stmt, nil); len(problems) == 0 {
+			sarif.describe(stmt)
+			sarif.write()
+			signers.save()
+			fmt.Printf("Verified %s with %s\n", artifact, path)
+			return
+		}
+		failed.add(RuleUntrustedSigner, path, problems)
+		for _, p := range problems {
+			fmt.Println("FAIL", p)
+		}
+	}
+	if len(digests) == 0 {
+		msg := fmt.Sprintf("No provenance of %s (sha256:%s) in %s", artifact, digest["sha256"], dir)
+		failed.add(RuleNoProvenance, artifact, []string{msg})
+		fmt.Println(msg)
+	}
+	failed.write()
+	fmt.Printf("Verification of %s failed\n", artifact)
+	os.Exit(1)
+}
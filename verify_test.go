@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBuilder = "https://github.com/o/r/Attestations/GitHubHostedActions@v1"
+
+// testProvenance returns provenance of a subject with the digest of name,
+// built by builder from materials, of the digests of their names.
+func testProvenance(name, builder string, materials ...string) *Statement {
+	stmt := &Statement{
+		Type:          StatementV01Type,
+		Subject:       []Subject{{Name: name, Digest: testDigest(name)}},
+		PredicateType: ProvenanceV01Type,
+	}
+	stmt.Predicate.Builder.Id = builder
+	for _, m := range materials {
+		stmt.Predicate.Materials = append(stmt.Predicate.Materials, Item{URI: m, Digest: testDigest(m)})
+	}
+	return stmt
+}
+
+// testDigest returns a made-up sha256 digest of name.
+func testDigest(name string) DigestSet {
+	return DigestSet{"sha256": strings.Repeat("0", 64-len(name)) + name}
+}
+
+// writeProvenance writes stmt to path, in an envelope signed with signer if
+// it is set.
+func writeProvenance(t *testing.T, path string, stmt *Statement, signer Signer) {
+	t.Helper()
+	contents, err := json.Marshal(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != nil {
+		env, err := signEnvelope(PayloadContentType, contents, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents, err = json.Marshal(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testVerifier returns a new signer and its verifier.
+func testVerifier(t *testing.T) (*keySigner, *keyVerifier) {
+	t.Helper()
+	signer, err := generateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, &keyVerifier{key: signer.Public()}
+}
+
+func TestVerifyChainSignatures(t *testing.T) {
+	signer, verifier := testVerifier(t)
+	other, _ := testVerifier(t)
+	tests := []struct {
+		name     string
+		linkKey  Signer
+		verifier *keyVerifier
+		wantErr  string
+	}{
+		{"signed link", signer, verifier, ""},
+		{"unsigned link", nil, verifier, "isn't signed"},
+		{"link signed with another key", other, verifier, "no envelope signature verifies"},
+		{"unsigned link without a key", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeProvenance(t, filepath.Join(dir, "lib.provenance"), testProvenance("11", testBuilder), tt.linkKey)
+			root := storedStatement{Path: "app.provenance", Statement: testProvenance("22", testBuilder, "11"), KeyIds: verifiedKeyIds(tt.verifier)}
+			policy := verifyPolicy{TrustedBuilders: []string{testBuilder}}
+			problems := checkProvenance(root, policy, true, dir, tt.verifier)
+			got := strings.Join(problems, "\n")
+			switch {
+			case tt.wantErr == "" && len(problems) > 0:
+				t.Errorf("checkProvenance() = %q, want no problems", problems)
+			case tt.wantErr != "" && !strings.Contains(got, tt.wantErr):
+				t.Errorf("checkProvenance() = %q, want a problem containing %q", problems, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyPolicyCheck(t *testing.T) {
+	verified := SignatureStatus{Verified: true, Reason: "valid"}
+	commit := func(c *SourceCommit) func(*Statement) {
+		return func(s *Statement) { s.Predicate.Metadata.SourceCommit = c }
+	}
+	validity := func(from, d time.Duration) func(*Statement) {
+		return func(s *Statement) { s.Predicate.Metadata.Validity = newValidity(time.Now().Add(from), d) }
+	}
+	tests := []struct {
+		name    string
+		policy  verifyPolicy
+		change  func(*Statement)
+		keyIds  []string
+		wantErr string
+	}{
+		{"any builder", verifyPolicy{}, nil, nil, ""},
+		{"trusted builder", verifyPolicy{TrustedBuilders: []string{"https://other", testBuilder}}, nil, nil, ""},
+		{"untrusted builder", verifyPolicy{TrustedBuilders: []string{"https://other"}}, nil, nil, "is not trusted"},
+		{"v1 provenance", verifyPolicy{}, func(s *Statement) { s.PredicateType = ProvenanceV1Type }, nil, ""},
+		{"not provenance", verifyPolicy{}, func(s *Statement) { s.PredicateType = "https://example.com/test-result" }, nil, "is not SLSA provenance"},
+		{"revoked key", verifyPolicy{Revocations: &RevocationList{Keys: []string{"k1"}}}, nil, []string{"k1"}, "signing key k1 is revoked"},
+		// Unsigned provenance has no verified keys to revoke; gate and
+		// verify --public_key reject it as unsigned instead.
+		{"revoked key, unsigned", verifyPolicy{Revocations: &RevocationList{Keys: []string{"k1"}}}, nil, nil, ""},
+		{"valid window", verifyPolicy{}, validity(-time.Hour, 2*time.Hour), nil, ""},
+		{"expired", verifyPolicy{}, validity(-2*time.Hour, time.Hour), nil, "expired"},
+		{"verified commit", verifyPolicy{RequireVerifiedCommit: true}, commit(&SourceCommit{SHA: "abc", Verification: verified}), nil, ""},
+		{"no commit", verifyPolicy{RequireVerifiedCommit: true}, nil, nil, "no source commit is recorded"},
+		{"unsigned commit", verifyPolicy{RequireVerifiedCommit: true}, commit(&SourceCommit{SHA: "abc", Verification: SignatureStatus{Reason: "unsigned"}}), nil, "commit abc is not signed with a verified signature (unsigned)"},
+		{"unsigned tag", verifyPolicy{RequireVerifiedCommit: true}, commit(&SourceCommit{SHA: "abc", Verification: verified, Tag: &SourceCommitTag{Name: "v1"}}), nil, "tag v1 of commit abc"},
+		{"verified tag", verifyPolicy{RequireVerifiedCommit: true}, commit(&SourceCommit{SHA: "abc", Verification: verified, Tag: &SourceCommitTag{Name: "v1", Annotated: true, Verification: &verified}}), nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := testProvenance("app", testBuilder)
+			if tt.change != nil {
+				tt.change(stmt)
+			}
+			problems := tt.policy.check(stmt, tt.keyIds)
+			got := strings.Join(problems, "\n")
+			switch {
+			case tt.wantErr == "" && len(problems) > 0:
+				t.Errorf("check() = %q, want no problems", problems)
+			case tt.wantErr != "" && !strings.Contains(got, tt.wantErr):
+				t.Errorf("check() = %q, want a problem containing %q", problems, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompareSubjects(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "dist/app", "dist/lib/app.so", "dist/app.sig")
+	digest := func(name string) DigestSet {
+		d, err := digestFile(filepath.Join(dir, filepath.FromSlash(name)), "sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	stmt := testProvenance("app", testBuilder)
+	stmt.Subject = []Subject{
+		{Name: "app", Digest: digest("dist/app")},
+		{Name: "lib/app.so", Digest: testDigest("modified")},
+		{Name: "app.exe", Digest: testDigest("app.exe")},
+	}
+	r, err := compareSubjects(stmt, filepath.Join(dir, "dist"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &subjectReport{Matched: 1, Modified: []string{"lib/app.so"}, Missing: []string{"app.exe"}, Extra: []string{"app.sig"}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("compareSubjects() = %+v, want %+v", r, want)
+	}
+	if got, want := r.summary(), "1 matched, 1 modified, 1 missing, 1 extra"; got != want {
+		t.Errorf("summary() = %q, want %q", got, want)
+	}
+	for _, tt := range []struct {
+		exhaustive bool
+		want       []string
+	}{
+		{false, []string{"lib/app.so doesn't match its subject digest", "app.exe is attested but missing"}},
+		{true, []string{"lib/app.so doesn't match its subject digest", "app.sig is not attested", "app.exe is attested but missing"}},
+	} {
+		if got := r.problems(tt.exhaustive); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("problems(%v) = %q, want %q", tt.exhaustive, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalBuilderId identifies provenance generated by --watch outside of a
+// workflow, which no verifier should accept as that of a trusted builder.
+const LocalBuilderId = "https://localhost/Attestations/LocalBuild@v1"
+
+// watchPollInterval is how often --watch checks the artifact path.
+const watchPollInterval = 250 * time.Millisecond
+
+// localContexts returns the github and runner contexts of a build on this
+// machine, standing in for those of a workflow run, which --watch doesn't
+// require.
+func localContexts(artifactPath string) (string, string, error) {
+	dir, err := filepath.Abs(artifactPath)
+	if err != nil {
+		return "", "", err
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	gh, err := json.Marshal(GitHubContext{
+		Event:      json.RawMessage("{}"),
+		EventName:  "local",
+		Repository: "local/" + filepath.Base(dir),
+		RunId:      "local",
+		RunAttempt: "1",
+		Workspace:  dir,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	// Runner contexts name platforms as GitHub does.
+	osNames := map[string]string{"linux": "Linux", "darwin": "macOS", "windows": "Windows"}
+	archNames := map[string]string{"amd64": "X64", "386": "X86", "arm64": "ARM64", "arm": "ARM"}
+	runner, err := json.Marshal(RunnerContext{
+		Name:        "local",
+		OS:          osNames[runtime.GOOS],
+		Arch:        archNames[runtime.GOARCH],
+		Environment: "self-hosted",
+		Temp:        os.TempDir(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return string(gh), string(runner), nil
+}
+
+// watchState is what --watch compares to notice a change to a file.
+type watchState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+}
+
+// snapshot returns the state of the files under root, except those in skip,
+// the provenance written so far, so that writing it doesn't retrigger.
+func snapshot(root string, skip map[string]bool) (map[string]watchState, error) {
+	states := map[string]watchState{}
+	err := walkFiles(root, func(abspath, name string, info fs.FileInfo) error {
+		if !skip[absPath(abspath)] {
+			states[name] = watchState{info.Size(), info.ModTime(), info.Mode()}
+		}
+		return nil
+	})
+	return states, err
+}
+
+// absPath returns the absolute path of path, or path if it has none.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func sameSnapshot(a, b map[string]watchState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, s := range a {
+		if t, ok := b[name]; !ok || !s.ModTime.Equal(t.ModTime) || s.Size != t.Size || s.Mode != t.Mode {
+			return false
+		}
+	}
+	return true
+}
+
+// formatDigest formats digest as sorted <alg>:<hex> pairs.
+func formatDigest(digest DigestSet) string {
+	var pairs []string
+	for alg, d := range digest {
+		pairs = append(pairs, alg+":"+d)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// diffItems returns the lines describing how the named digests of after
+// differ from those of before: "+" for added, "-" for removed and "~" for
+// changed.
+func diffItems(kind string, before, after map[string]DigestSet) []string {
+	var lines []string
+	for name, d := range after {
+		if old, ok := before[name]; !ok {
+			lines = append(lines, fmt.Sprintf("  + %s %s %s", kind, name, formatDigest(d)))
+		} else if formatDigest(old) != formatDigest(d) {
+			lines = append(lines, fmt.Sprintf("  ~ %s %s %s", kind, name, formatDigest(d)))
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			lines = append(lines, fmt.Sprintf("  - %s %s", kind, name))
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][4:] < lines[j][4:] })
+	return lines
+}
+
+func subjectDigests(stmt *Statement) map[string]DigestSet {
+	m := map[string]DigestSet{}
+	if stmt != nil {
+		for _, s := range stmt.Subject {
+			m[s.Name] = s.Digest
+		}
+	}
+	return m
+}
+
+func materialDigests(stmt *Statement) map[string]DigestSet {
+	m := map[string]DigestSet{}
+	if stmt != nil {
+		for _, i := range stmt.Predicate.Materials {
+			m[i.URI] = i.Digest
+		}
+	}
+	return m
+}
+
+// watch regenerates the provenance of the single artifact path of opts at
+// --output_path whenever its files change, once they have been unchanged for
+// debounce, and reports the subjects and materials that changed. Failures are
+// reported and watching continues, so that a broken build script can be fixed
+// in place.
+func watch(opts Options, debounce time.Duration) {
+	artifacts := singleArtifactPath(opts.ArtifactPaths)
+	if opts.GitHubContext == "" || opts.RunnerContext == "" {
+		gh, runner, err := localContexts(artifacts)
+		if err != nil {
+			fmt.Printf("Failed to describe the local build: %s\n", err)
+			os.Exit(1)
+		}
+		if opts.GitHubContext == "" {
+			opts.GitHubContext = gh
+		}
+		if opts.RunnerContext == "" {
+			opts.RunnerContext = runner
+		}
+		if opts.BuilderId == "" && opts.BuilderNamespace == "" {
+			opts.BuilderId = LocalBuilderId
+		}
+	}
+	// Outside of the job, the host has nothing to say about the build.
+	opts.InspectHost = false
+	written := map[string]bool{}
+	var last *Statement
+	regenerate := func() {
+		opts.Timing = newTiming()
+		stmt, findings, err := generate(opts)
+		if err != nil {
+			findings.print(opts.Severities)
+			fmt.Printf("Failed to generate provenance: %s\n", err)
+			return
+		}
+		path, err := expandOutputPath(*outputPath, stmt, artifacts, opts)
+		if err != nil {
+			fmt.Printf("Failed to name provenance: %s\n", err)
+			return
+		}
+		// Provenance this watch wrote is its own to overwrite.
+		o := opts
+		o.Force = opts.Force || written[absPath(path)]
+		payload, err := writeStatement(stmt, path, o)
+		findings.print(opts.Severities)
+		if err != nil {
+			fmt.Printf("Failed to write provenance: %s\n", err)
+			return
+		}
+		for _, f := range outputFiles(path, payload) {
+			written[absPath(f)] = true
+		}
+		fmt.Printf("[%s] Provenance: %s (%d subjects, %d materials)\n", time.Now().Format("15:04:05"), path, len(stmt.Subject), len(stmt.Predicate.Materials))
+		changes := append(diffItems("subject", subjectDigests(last), subjectDigests(stmt)), diffItems("material", materialDigests(last), materialDigests(stmt))...)
+		if last != nil && len(changes) == 0 {
+			fmt.Println("  (no changes)")
+		}
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		last = stmt
+	}
+	root, err := filepath.Abs(artifacts)
+	if err != nil {
+		fmt.Printf("Failed to watch %s: %s\n", artifacts, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Watching %s; press Ctrl-C to stop\n", artifacts)
+	regenerate()
+	current, _ := snapshot(root, written)
+	var changedAt time.Time
+	pending := false
+	for range time.Tick(watchPollInterval) {
+		next, err := snapshot(root, written)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to watch %s: %s\n", artifacts, err)
+			continue
+		}
+		if !sameSnapshot(current, next) {
+			current, changedAt, pending = next, time.Now(), true
+			continue
+		}
+		if pending && time.Since(changedAt) >= debounce {
+			pending = false
+			regenerate()
+			// The snapshot skips the provenance, but a template may have
+			// named it anew.
+			current, _ = snapshot(root, written)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Job is a single provenance-generation request consumed in worker mode.
+type Job struct {
+	ArtifactPath        string          `json:"artifact_path"`
+	BuildxMetadataFile  string          `json:"buildx_metadata_file"`
+	ExpandImageIndex    bool            `json:"expand_image_index"`
+	ImageLayers         bool            `json:"image_layers"`
+	KoImageRefs         string          `json:"ko_image_refs"`
+	GoreleaserArtifacts string          `json:"goreleaser_artifacts"`
+	RunArtifact         string          `json:"subject_from_run_artifact"`
+	GitHubPackages      string          `json:"subject_from_github_packages"`
+	SubjectManifest     string          `json:"subject_manifest"`
+	SubjectNaming       string          `json:"subject_naming"`
+	FilePurl            string          `json:"file_purl"`
+	MaterialNaming      string          `json:"material_naming"`
+	MavenCoordinates    string          `json:"maven_coordinates"`
+	DigestAlgorithms    []string        `json:"digest_algorithms"`
+	Concurrency         int             `json:"concurrency"`
+	Include             []string        `json:"include"`
+	Exclude             []string        `json:"exclude"`
+	OutputPath          string          `json:"output_path"`
+	GitHubContext       json.RawMessage `json:"github_context"`
+	RunnerContext       json.RawMessage `json:"runner_context"`
+	JobContext          json.RawMessage `json:"job_context"`
+	// Env holds the environment variables of the run that produced the
+	// artifacts, e.g. GITHUB_ACTIONS.
+	Env map[string]string `json:"env"`
+
+	// The remaining fields mirror the generation flags of the same name.
+	// Their paths, like those above, are resolved in the worker's --root.
+
+	// Workspace defaults to the worker's root.
+	Workspace string `json:"workspace"`
+	Strict    bool   `json:"strict"`
+	// OnCollision defaults to CollisionKeep.
+	OnCollision  string `json:"on_name_collision"`
+	Reproducible bool   `json:"reproducible"`
+	Append       bool   `json:"append"`
+	MaxSubjects  int    `json:"max_subjects"`
+	// Format is FormatStatement, the default, or FormatPredicate.
+	Format string `json:"format"`
+	// PredicateVersion is PredicateV01, the default, or PredicateV1.
+	PredicateVersion string `json:"predicate_version"`
+	// Redact is empty, RedactStrip or RedactHash.
+	Redact string `json:"redact"`
+	// Envelope is empty or EnvelopeDSSE. A job can't name a key, which
+	// would let any producer on the queue sign with any key on the worker
+	// host: envelopes are signed with the key of the tenant of the run, as
+	// authenticated by IDToken, or else unsigned.
+	Envelope string `json:"envelope"`
+	// IDToken is the GitHub Actions OIDC token of the run, issued to the
+	// worker's --tenant_audience, naming the tenant whose key of
+	// --tenant_keys signs the envelope.
+	IDToken string `json:"id_token"`
+	// OutputPath may be a template, as with --output_path, and Force allows
+	// overwriting existing files.
+	Force bool `json:"force"`
+	// Patch is the path of a JSON Patch file, as with --patch.
+	Patch string `json:"patch"`
+	// CASDir, if set, is the local CAS to add the provenance to.
+	CASDir string `json:"cas_dir"`
+	// BuilderId and BuilderNamespace are validated by generate.
+	BuilderId        string `json:"builder_id"`
+	BuilderNamespace string `json:"builder_namespace"`
+	// EphemeralRunner and RunnerGroup describe self-hosted runners.
+	EphemeralRunner bool   `json:"ephemeral_runner"`
+	RunnerGroup     string `json:"runner_group"`
+	Hermetic        bool   `json:"hermetic"`
+	ContainerImage  string `json:"job_container_image"`
+	// ScrubFields defaults to the standard event key patterns.
+	ScrubFields []string `json:"scrub_fields"`
+	// Severity overrides the default severity of finding codes.
+	Severity map[string]string `json:"severity"`
+	FailOn   string            `json:"fail_on"`
+	// Attestors may only name "environment", which records Env; the git and
+	// command-run attestors must run inside the job.
+	Attestors         []string `json:"attestors"`
+	AttestationBundle string   `json:"attestation_bundle"`
+	FileMetadata      bool     `json:"file_metadata"`
+	SigningReceipts   []string `json:"signing_receipts"`
+	VerifyPublished   []string `json:"verify_published"`
+	RecordApprovals   bool     `json:"record_approvals"`
+	RecordCommit      bool     `json:"record_commit"`
+	SkipAttested      string   `json:"skip_already_attested"`
+	RestoredCaches    string   `json:"restored_caches"`
+	CommandsLog       string   `json:"commands_log"`
+	EgressReport      string   `json:"egress_report"`
+	// ValidFor is a duration, as with --valid_for.
+	ValidFor string `json:"valid_for"`
+	// MaterialURIMap is the path of a file of MaterialRules, as with
+	// --material_uri_map.
+	MaterialURIMap string `json:"material_uri_map"`
+	// SubjectAnnotations annotate every subject, and SubjectAnnotationRules
+	// is the path of a file of rules, as with --subject_annotation_rules.
+	SubjectAnnotations     map[string]string `json:"subject_annotations"`
+	SubjectAnnotationRules string            `json:"subject_annotation_rules"`
+	SubjectTimestamps      string            `json:"subject_timestamps"`
+}
+
+// JobResult reports the outcome of a Job back to its producer.
+type JobResult struct {
+	OutputPath string        `json:"output_path,omitempty"`
+	Findings   Findings      `json:"findings,omitempty"`
+	Timing     *TimingReport `json:"timing,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Delivery is a Job received from a Queue.
+type Delivery struct {
+	Body []byte
+	// Reply, when non-nil, sends the serialized JobResult to the producer.
+	Reply func(result []byte) error
+	// Ack, when non-nil, removes the job from the queue once it's handled,
+	// which redelivers it to another worker otherwise.
+	Ack func() error
+}
+
+// Queue is a source of provenance-generation jobs.
+type Queue interface {
+	// Receive blocks until the next job is available. It returns io.EOF once
+	// the queue is exhausted.
+	Receive() (*Delivery, error)
+	Close() error
+}
+
+// openQueue returns the Queue identified by rawurl.
+func openQueue(rawurl, group string) (Queue, error) {
+	if rawurl == "-" {
+		return newLineQueue(os.Stdin), nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+		if err := requireOnline("a " + u.Scheme + ":// queue"); err != nil {
+			return nil, err
+		}
+		return dialNATS(u, group)
+	case "sqs":
+		if err := requireOnline("an sqs:// queue"); err != nil {
+			return nil, err
+		}
+		return newSQSQueue(u)
+	case "pubsub":
+		if err := requireOnline("a pubsub:// queue"); err != nil {
+			return nil, err
+		}
+		return newPubSubQueue(u)
+	case "file":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return newLineQueue(f), nil
+	default:
+		return nil, fmt.Errorf("unsupported queue scheme: %q", u.Scheme)
+	}
+}
+
+// lineQueue reads newline-delimited Job documents, e.g. from a file or stdin.
+type lineQueue struct {
+	r *bufio.Reader
+	c io.Closer
+}
+
+func newLineQueue(rc io.ReadCloser) *lineQueue {
+	return &lineQueue{r: bufio.NewReader(rc), c: rc}
+}
+
+func (q *lineQueue) Receive() (*Delivery, error) {
+	for {
+		line, err := q.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		return &Delivery{Body: line}, nil
+	}
+}
+
+func (q *lineQueue) Close() error {
+	return q.c.Close()
+}
+
+// jobRoot is the directory the paths of jobs are resolved in. Producers on
+// the queue are no more trusted than a build step, so their paths must not
+// read, hash or overwrite files of the worker host outside it.
+type jobRoot workspace
+
+// path returns p, relative to the root or absolute, resolved within the
+// root: neither ".." nor symlinks take it out. Paths that don't exist yet,
+// such as outputs, globs and templates, are resolved as far as they exist.
+func (r jobRoot) path(p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	p = normalizeInputPath(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(string(r), p)
+	}
+	resolved, err := resolveExisting(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	if !workspace(r).contains(resolved) {
+		return "", fmt.Errorf("job path %s resolves to %s, outside the worker root %s", p, resolved, string(r))
+	}
+	return resolved, nil
+}
+
+// paths resolves each of paths as path does.
+func (r jobRoot) paths(paths []string) ([]string, error) {
+	var resolved []string
+	for _, p := range paths {
+		rp, err := r.path(p)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, rp)
+	}
+	return resolved, nil
+}
+
+// resolveExisting returns p with the symlinks of its longest existing prefix
+// evaluated, and the rest appended as it is.
+func resolveExisting(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// resolve resolves the paths of job in root, defaulting its workspace to the
+// root rather than the artifact path, which a job could point anywhere in it.
+func (job *Job) resolve(root jobRoot) error {
+	artifacts, err := root.paths(splitPaths(job.ArtifactPath))
+	if err != nil {
+		return err
+	}
+	job.ArtifactPath = strings.Join(artifacts, "\n")
+	if job.Workspace == "" {
+		job.Workspace = string(root)
+	}
+	for _, p := range []*string{
+		&job.BuildxMetadataFile, &job.KoImageRefs, &job.GoreleaserArtifacts, &job.SubjectManifest,
+		&job.MavenCoordinates, &job.OutputPath, &job.Workspace, &job.Patch, &job.CASDir,
+		&job.AttestationBundle, &job.SkipAttested, &job.RestoredCaches, &job.CommandsLog,
+		&job.EgressReport, &job.MaterialURIMap, &job.SubjectAnnotationRules, &job.SubjectTimestamps,
+	} {
+		if *p, err = root.path(*p); err != nil {
+			return err
+		}
+	}
+	job.SigningReceipts, err = root.paths(job.SigningReceipts)
+	return err
+}
+
+// runJob generates and writes the provenance described by a serialized Job,
+// with its paths resolved in root, signing it with the key of its tenant in
+// tenants, if any.
+func runJob(body []byte, root jobRoot, tenants *tenantKeys) JobResult {
+	job := Job{}
+	if err := json.Unmarshal(body, &job); err != nil {
+		return JobResult{Error: fmt.Sprintf("parsing job: %s", err)}
+	}
+	switch {
+	case job.ArtifactPath == "" && job.BuildxMetadataFile == "" && job.KoImageRefs == "" && job.GoreleaserArtifacts == "" && job.RunArtifact == "" && job.GitHubPackages == "" && job.SubjectManifest == "":
+		return JobResult{Error: "job is missing artifact_path"}
+	case job.OutputPath == "":
+		return JobResult{Error: "job is missing output_path"}
+	case len(job.GitHubContext) == 0:
+		return JobResult{Error: "job is missing github_context"}
+	case len(job.RunnerContext) == 0:
+		return JobResult{Error: "job is missing runner_context"}
+	}
+	if err := job.resolve(root); err != nil {
+		return JobResult{Error: err.Error()}
+	}
+	var signer Signer
+	if job.IDToken != "" {
+		var gh GitHubContext
+		switch err := json.Unmarshal(job.GitHubContext, &gh); {
+		case err != nil:
+			return JobResult{Error: fmt.Sprintf("parsing github_context: %s", err)}
+		case tenants == nil:
+			return JobResult{Error: "the job has an id_token, but the worker has no --tenant_keys to sign with"}
+		case job.Envelope != EnvelopeDSSE:
+			return JobResult{Error: "signing needs envelope: dsse"}
+		}
+		var err error
+		if signer, err = tenants.signer(job.IDToken, gh); err != nil {
+			return JobResult{Error: err.Error()}
+		}
+	}
+	var patch []PatchOperation
+	if job.Patch != "" {
+		var err error
+		if patch, err = readPatch(job.Patch); err != nil {
+			return JobResult{Error: fmt.Sprintf("reading patch: %s", err)}
+		}
+	}
+	var materialRules []MaterialRule
+	if job.MaterialURIMap != "" {
+		var err error
+		if materialRules, err = readMaterialRules(job.MaterialURIMap); err != nil {
+			return JobResult{Error: fmt.Sprintf("reading material URI map: %s", err)}
+		}
+	}
+	var annotationRules []SubjectAnnotationRule
+	if job.SubjectAnnotationRules != "" {
+		var err error
+		if annotationRules, err = readSubjectAnnotationRules(job.SubjectAnnotationRules); err != nil {
+			return JobResult{Error: fmt.Sprintf("reading subject annotation rules: %s", err)}
+		}
+	}
+	var validFor time.Duration
+	if job.ValidFor != "" {
+		var err error
+		if validFor, err = time.ParseDuration(job.ValidFor); err != nil {
+			return JobResult{Error: fmt.Sprintf("parsing valid_for: %s", err)}
+		}
+	}
+	opts := Options{
+		ArtifactPaths:       splitPaths(job.ArtifactPath),
+		BuildxMetadataFile:  job.BuildxMetadataFile,
+		ExpandImageIndex:    job.ExpandImageIndex,
+		ImageLayers:         job.ImageLayers,
+		KoImageRefs:         job.KoImageRefs,
+		GoreleaserArtifacts: job.GoreleaserArtifacts,
+		RunArtifact:         job.RunArtifact,
+		GitHubPackages:      job.GitHubPackages,
+		SubjectManifest:     job.SubjectManifest,
+		SubjectNaming:       job.SubjectNaming,
+		FilePurl:            job.FilePurl,
+		MaterialNaming:      job.MaterialNaming,
+		MavenCoordinates:    job.MavenCoordinates,
+		DigestAlgorithms:    job.DigestAlgorithms,
+		Concurrency:         job.Concurrency,
+		GitHubContext:       string(job.GitHubContext),
+		RunnerContext:       string(job.RunnerContext),
+		JobContext:          string(job.JobContext),
+		BuilderId:           job.BuilderId,
+		BuilderNamespace:    job.BuilderNamespace,
+		EphemeralRunner:     job.EphemeralRunner,
+		RunnerGroup:         job.RunnerGroup,
+		Hermetic:            job.Hermetic,
+		ContainerImage:      job.ContainerImage,
+		Workspace:           job.Workspace,
+		Include:             job.Include,
+		Exclude:             job.Exclude,
+		Outputs:             outputPaths(job.OutputPath),
+		Strict:              job.Strict,
+		OnCollision:         job.OnCollision,
+		ScrubFields:         job.ScrubFields,
+		Reproducible:        job.Reproducible,
+		MaxSubjects:         job.MaxSubjects,
+		Patch:               patch,
+		Format:              job.Format,
+		PredicateVersion:    job.PredicateVersion,
+		Envelope:            job.Envelope,
+		Signer:              signer,
+		Redact:              job.Redact,
+		Force:               job.Force || job.Append,
+		CASDir:              job.CASDir,
+		Severities:          job.Severity,
+		FailOn:              job.FailOn,
+		Attestors:           job.Attestors,
+		FileMetadata:        job.FileMetadata,
+		SigningReceipts:     job.SigningReceipts,
+		VerifyPublished:     job.VerifyPublished,
+		RecordApprovals:     job.RecordApprovals,
+		RecordCommit:        job.RecordCommit,
+		SkipAttested:        job.SkipAttested,
+		RestoredCaches:      job.RestoredCaches,
+		CommandsLog:         job.CommandsLog,
+		EgressReport:        job.EgressReport,
+		ValidFor:            validFor,
+		MaterialRules:       materialRules,
+		SubjectAnnotations:  job.SubjectAnnotations,
+		AnnotationRules:     annotationRules,
+		SubjectTimestamps:   job.SubjectTimestamps,
+		Getenv:              func(key string) string { return job.Env[key] },
+		Environ:             func() []string { return environFromMap(job.Env) },
+		Timing:              newTiming(),
+	}
+	stmt, findings, err := generate(opts)
+	findings.print(opts.Severities)
+	findings = findings.resolve(opts.Severities)
+	if err != nil {
+		return JobResult{Findings: findings, Error: err.Error()}
+	}
+	path, err := expandOutputPath(job.OutputPath, stmt, singleArtifactPath(opts.ArtifactPaths), opts)
+	if err == nil {
+		// Templates are expanded with the names of subjects.
+		path, err = root.path(path)
+	}
+	if err != nil {
+		return JobResult{Findings: findings, Error: err.Error()}
+	}
+	unlock := func() error { return nil }
+	if job.Append {
+		if job.Format == FormatPredicate {
+			return JobResult{Findings: findings, Error: "a predicate can't be appended to"}
+		}
+		if job.Envelope != "" {
+			return JobResult{Findings: findings, Error: "an envelope can't be appended to"}
+		}
+		if unlock, err = lockFile(path); err != nil {
+			return JobResult{Findings: findings, Error: err.Error()}
+		}
+		defer unlock()
+		if stmt, err = appendStatement(path, stmt); err != nil {
+			return JobResult{Findings: findings, Error: err.Error()}
+		}
+		if opts.Reproducible {
+			sortStatement(stmt)
+		}
+	}
+	_, err = writeStatement(stmt, path, opts)
+	if uerr := unlock(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return JobResult{Findings: findings, Error: fmt.Sprintf("writing provenance: %s", err)}
+	}
+	bundle, err := bundleStatements(stmt, opts)
+	if err != nil {
+		return JobResult{Findings: findings, Error: err.Error()}
+	}
+	if bundle != nil {
+		bundleFile := job.AttestationBundle
+		if bundleFile == "" {
+			bundleFile = path + ".bundle.jsonl"
+		}
+		if bundleFile, err = root.path(bundleFile); err != nil {
+			return JobResult{Findings: findings, Error: err.Error()}
+		}
+		err := writeBundle(bundleFile, opts.Force, bundle...)
+		if err != nil {
+			return JobResult{Findings: findings, Error: fmt.Sprintf("writing attestation bundle: %s", err)}
+		}
+	}
+	return JobResult{OutputPath: path, Findings: findings, Timing: opts.Timing.report()}
+}
+
+// workerMain consumes jobs from a queue until it is exhausted, so provenance
+// generation can be scaled horizontally by running several workers.
+func workerMain(args []string) {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	queueURL := flags.String("queue", "", "The job queue to consume: nats://host:port/subject, tls://[user:pass@]host:port/subject[?tls_ca=ca.pem], sqs://sqs.<region>.amazonaws.com/<account>/<queue>, pubsub://<project>/<subscription>, file:///path/to/jobs.jsonl, or - for stdin.")
+	group := flags.String("queue_group", "create_provenance", "The NATS queue group shared by all workers consuming the same subject.")
+	storeURL := flags.String("store", "", "Where to also store the provenance of each job, indexed by subject digest and repository: a directory, file:///path/to/dir or postgres://user@host/database.")
+	tenantKeysPath := flags.String("tenant_keys", "", "A JSON file mapping owners and owner/repo repositories to the PEM private keys of their tenants, e.g. {\"octo-org\": \"octo-org.pem\"}. Jobs with an id_token are signed with the key of its repository.")
+	tenantAudience := flags.String("tenant_audience", "create_provenance", "The audience the id_token of jobs must be issued for.")
+	oidcIssuer := flags.String("oidc_issuer", DefaultOIDCIssuer, "The issuer of the id_token of jobs, e.g. that of GitHub Enterprise Server.")
+	rootDir := flags.String("root", "", "The directory the paths of jobs are resolved in and must stay within, the artifacts, outputs and inputs alike (required).")
+	addOfflineFlag(flags)
+	flags.Parse(args)
+	if *queueURL == "" {
+		fmt.Println("No value found for required flag: --queue")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *rootDir == "" {
+		fmt.Println("No value found for required flag: --root")
+		flags.Usage()
+		os.Exit(1)
+	}
+	ws, err := newWorkspace(normalizeInputPath(*rootDir), false)
+	if err != nil {
+		fmt.Printf("Failed to resolve --root: %s\n", err)
+		os.Exit(1)
+	}
+	root := jobRoot(ws)
+	var tenants *tenantKeys
+	if *tenantKeysPath != "" {
+		if tenants, err = readTenantKeys(*tenantKeysPath, *oidcIssuer, *tenantAudience); err != nil {
+			fmt.Printf("Failed to read --tenant_keys: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	q, err := openQueue(*queueURL, *group)
+	if err != nil {
+		fmt.Printf("Failed to open queue: %s\n", err)
+		os.Exit(1)
+	}
+	defer q.Close()
+	var store Store
+	if *storeURL != "" {
+		if store, err = openStore(*storeURL); err != nil {
+			fmt.Printf("Failed to open store: %s\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+	}
+	for {
+		d, err := q.Receive()
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			fmt.Printf("Failed to receive job: %s\n", err)
+			os.Exit(1)
+		}
+		result := runJob(d.Body, root, tenants)
+		if result.Error == "" && store != nil {
+			if err := storeOutput(store, result.OutputPath); err != nil {
+				result.Error = fmt.Sprintf("storing provenance: %s", err)
+			}
+		}
+		if result.Error != "" {
+			fmt.Printf("Job failed: %s\n", result.Error)
+		} else {
+			fmt.Printf("Wrote provenance: %s\n", result.OutputPath)
+		}
+		if d.Reply != nil {
+			payload, _ := json.Marshal(result)
+			if err := d.Reply(payload); err != nil {
+				fmt.Printf("Failed to reply to job: %s\n", err)
+			}
+		}
+		if d.Ack != nil {
+			if err := d.Ack(); err != nil {
+				fmt.Printf("Failed to acknowledge job: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobRootPath(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	for _, d := range []string{"root/dist", "root/out"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "root/escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "root/dist"), filepath.Join(dir, "root/inside")); err != nil {
+		t.Fatal(err)
+	}
+	ws, err := newWorkspace(filepath.Join(dir, "root"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := jobRoot(ws)
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"dist/app", "dist/app", false},
+		{filepath.Join(string(ws), "out/app.provenance"), "out/app.provenance", false},
+		{"inside/app", "dist/app", false},
+		{"new/dir/app.provenance", "new/dir/app.provenance", false},
+		{"dist/*.tar.gz", "dist/*.tar.gz", false},
+		{"../app", "", true},
+		{"dist/../../app", "", true},
+		{"/etc/passwd", "", true},
+		{"escape/app", "", true},
+		{"escape/new/app.provenance", "", true},
+	}
+	for _, tt := range tests {
+		got, err := root.path(tt.path)
+		switch {
+		case tt.wantErr:
+			if err == nil {
+				t.Errorf("path(%q) = %q, want an error", tt.path, got)
+			}
+		case err != nil:
+			t.Errorf("path(%q) = %v", tt.path, err)
+		case got != filepath.Join(string(ws), tt.want):
+			t.Errorf("path(%q) = %q, want %q", tt.path, got, filepath.Join(string(ws), tt.want))
+		}
+	}
+}
+
+func TestJobResolve(t *testing.T) {
+	ws, err := newWorkspace(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := jobRoot(ws)
+	job := Job{ArtifactPath: "dist/a\ndist/b", OutputPath: "out/app.provenance"}
+	if err := job.resolve(root); err != nil {
+		t.Fatal(err)
+	}
+	if job.Workspace != string(ws) {
+		t.Errorf("Workspace = %q, want the root %q", job.Workspace, ws)
+	}
+	if want := filepath.Join(string(ws), "dist/a") + "\n" + filepath.Join(string(ws), "dist/b"); job.ArtifactPath != want {
+		t.Errorf("ArtifactPath = %q, want %q", job.ArtifactPath, want)
+	}
+	for _, job := range []Job{
+		{ArtifactPath: "dist/a\n../b", OutputPath: "out/app.provenance"},
+		{ArtifactPath: "dist/a", OutputPath: "out/app.provenance", Workspace: "/"},
+		{ArtifactPath: "dist/a", OutputPath: "out/app.provenance", CASDir: "/var/lib/cas"},
+		{ArtifactPath: "dist/a", OutputPath: "out/app.provenance", SigningReceipts: []string{"../receipt.json"}},
+	} {
+		if err := job.resolve(root); err == nil {
+			t.Errorf("resolve() of %+v succeeded, want an error", job)
+		}
+	}
+}
+
+func TestNATSRefusesPlaintextCredentials(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(`INFO {"auth_required":true}` + "\r\n"))
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+	u, _ := url.Parse("nats://user:secret@" + l.Addr().String() + "/jobs")
+	if _, err := dialNATS(u, "g"); err == nil || !strings.Contains(err.Error(), "plaintext") {
+		t.Errorf("dialNATS() = %v, want a refusal to send credentials in plaintext", err)
+	}
+	if got := <-received; strings.Contains(got, "secret") {
+		t.Errorf("the server received the password: %q", got)
+	}
+}
+
+// fakeSQS serves the SQS actions a worker uses on one queue holding body,
+// recording the actions.
+type fakeSQS struct {
+	body    string
+	actions []string
+	sent    map[string]string
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&in)
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+	f.actions = append(f.actions, action)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.sqs#MissingAuthenticationToken","message":"no signature"}`))
+		return
+	}
+	switch action {
+	case "ReceiveMessage":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Messages": []interface{}{map[string]interface{}{
+			"ReceiptHandle":     "receipt-1",
+			"Body":              f.body,
+			"MessageAttributes": map[string]interface{}{"reply_to": map[string]string{"DataType": "String", "StringValue": "https://sqs.us-east-1.amazonaws.com/1/replies"}},
+		}}})
+	case "SendMessage":
+		f.sent[in["QueueUrl"].(string)] = in["MessageBody"].(string)
+		w.Write([]byte(`{}`))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+func TestSQSQueue(t *testing.T) {
+	f := &fakeSQS{body: `{"artifact_path":"a"}`, sent: map[string]string{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	u, _ := url.Parse("sqs://sqs.eu-west-1.amazonaws.com/123456789012/jobs")
+	q, err := newSQSQueue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.region != "eu-west-1" || q.queueURL != "https://sqs.eu-west-1.amazonaws.com/123456789012/jobs" {
+		t.Errorf("newSQSQueue() = region %q, queue %q", q.region, q.queueURL)
+	}
+	q.endpoint = srv.URL
+	q.getenv = func(k string) string {
+		return map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"}[k]
+	}
+	d, err := q.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Body) != f.body {
+		t.Errorf("Receive() = %q, want %q", d.Body, f.body)
+	}
+	if err := d.Reply([]byte(`{"output_path":"a.provenance"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.actions, ","); got != "ReceiveMessage,SendMessage,DeleteMessage" {
+		t.Errorf("actions = %s", got)
+	}
+	if got := f.sent["https://sqs.us-east-1.amazonaws.com/1/replies"]; got != `{"output_path":"a.provenance"}` {
+		t.Errorf("reply = %q", got)
+	}
+	q.getenv = func(string) string { return "" }
+	if _, err := q.Receive(); err == nil || !strings.Contains(err.Error(), "no AWS credentials") {
+		t.Errorf("Receive() without credentials = %v", err)
+	}
+}
+
+func TestPubSubQueue(t *testing.T) {
+	var calls []string
+	published := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":pull"):
+			json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": []interface{}{map[string]interface{}{
+				"ackId": "ack-1",
+				"message": map[string]interface{}{
+					"data":       base64.StdEncoding.EncodeToString([]byte(`{"artifact_path":"a"}`)),
+					"attributes": map[string]string{"reply_to": "projects/p/topics/results"},
+				},
+			}}})
+		case strings.HasSuffix(r.URL.Path, ":publish"):
+			var in struct {
+				Messages []struct {
+					Data []byte `json:"data"`
+				} `json:"messages"`
+			}
+			json.NewDecoder(r.Body).Decode(&in)
+			published[r.URL.Path] = string(in.Messages[0].Data)
+			w.Write([]byte(`{}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+	for _, bad := range []string{"pubsub://p", "pubsub://p/a/b", "pubsub://p/sub%3Fx"} {
+		u, _ := url.Parse(bad)
+		if _, err := newPubSubQueue(u); err == nil {
+			t.Errorf("newPubSubQueue(%s) succeeded, want an error", bad)
+		}
+	}
+	u, _ := url.Parse("pubsub://p/jobs")
+	q, err := newPubSubQueue(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.endpoint, q.emulator = srv.URL, true
+	d, err := q.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Body) != `{"artifact_path":"a"}` {
+		t.Errorf("Receive() = %q", d.Body)
+	}
+	if err := d.Reply([]byte(`{"output_path":"a.provenance"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/v1/projects/p/subscriptions/jobs:pull", "/v1/projects/p/subscriptions/jobs:modifyAckDeadline", "/v1/projects/p/topics/results:publish", "/v1/projects/p/subscriptions/jobs:acknowledge"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if got := published["/v1/projects/p/topics/results:publish"]; got != `{"output_path":"a.provenance"}` {
+		t.Errorf("reply = %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// EscapeError refuses to generate provenance when a subject escapes the workspace.
+	EscapeError = "error"
+	// EscapeWarn keeps subjects that escape the workspace, reporting a
+	// CodeWorkspaceEscape finding instead.
+	EscapeWarn = "warn"
+)
+
+// workspace is the fully resolved directory that subjects must stay within.
+// It protects against build steps that plant symlinks (or pass paths like
+// "../..") so that provenance is generated over arbitrary runner files.
+type workspace string
+
+// newWorkspace returns the workspace dir resolves to or, if base is set, the
+// one of dir itself in the directory its parent resolves to, so that a dir
+// that is a symlink doesn't take the workspace to its target.
+func newWorkspace(dir string, base bool) (workspace, error) {
+	if base {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", fmt.Errorf("resolving workspace: %w", err)
+		}
+		parent, err := resolvePath(filepath.Dir(abs))
+		if err != nil {
+			return "", fmt.Errorf("resolving workspace: %w", err)
+		}
+		return workspace(filepath.Join(parent, filepath.Base(abs))), nil
+	}
+	resolved, err := resolvePath(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolving workspace: %w", err)
+	}
+	return workspace(resolved), nil
+}
+
+// resolvePath returns the absolute path of p with all symlinks evaluated.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// contains reports whether the resolved path p is inside w.
+func (w workspace) contains(p string) bool {
+	rel, err := filepath.Rel(string(w), p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// check resolves path and applies the onEscape policy if it lies outside w.
+func (w workspace) check(path, onEscape string, findings *Findings) error {
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	if w.contains(resolved) {
+		return nil
+	}
+	if onEscape == EscapeWarn {
+		findings.add(CodeWorkspaceEscape, "subject %s resolves to %s, outside the workspace %s", path, resolved, w)
+		return nil
+	}
+	return fmt.Errorf("subject %s resolves to %s, outside the workspace %s", path, resolved, w)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files of names, with forward slashes, under dir,
+// each holding its name.
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// symlink links name under dir to target.
+func symlink(t *testing.T, target, dir, name string) {
+	t.Helper()
+	if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+		t.Skipf("creating symlinks: %s", err)
+	}
+}
+
+func TestWorkspaceCheck(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, dir, "ws/dist/app", "ws-other/app")
+	writeFiles(t, outside, "secret")
+	ws := filepath.Join(dir, "ws")
+	symlink(t, filepath.Join(outside, "secret"), ws, "dist/secret-file")
+	symlink(t, outside, ws, "dist/secret-dir")
+	symlink(t, filepath.Join(ws, "dist/app"), ws, "dist/inside")
+	w, err := newWorkspace(ws, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		escape bool
+	}{
+		{"dist/app", false},
+		{"dist/inside", false},
+		{"dist/../dist/app", false},
+		{"../ws-other/app", true},
+		{"dist/../../ws-other/app", true},
+		{"dist/secret-file", true},
+		{"dist/secret-dir/secret", true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(ws, filepath.FromSlash(tt.path))
+		var findings Findings
+		err := w.check(path, EscapeError, &findings)
+		if (err != nil) != tt.escape {
+			t.Errorf("check(%s, %s) = %v, want an escape %v", tt.path, EscapeError, err, tt.escape)
+		}
+		if err != nil && !strings.Contains(err.Error(), "outside the workspace") {
+			t.Errorf("check(%s, %s) = %v, want an escape", tt.path, EscapeError, err)
+		}
+		findings = nil
+		if err := w.check(path, EscapeWarn, &findings); err != nil {
+			t.Errorf("check(%s, %s) = %v", tt.path, EscapeWarn, err)
+		}
+		if escaped := len(findings) == 1 && findings[0].Code == CodeWorkspaceEscape; escaped != tt.escape || len(findings) > 1 {
+			t.Errorf("check(%s, %s) found %v, want an escape %v", tt.path, EscapeWarn, findings, tt.escape)
+		}
+	}
+	if err := w.check(filepath.Join(ws, "missing"), EscapeError, nil); err == nil {
+		t.Error("check() of a missing file succeeded")
+	}
+}
+
+func TestWorkspaceContains(t *testing.T) {
+	w := workspace(filepath.FromSlash("/w/ws"))
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/w/ws", true},
+		{"/w/ws/dist/app", true},
+		{"/w/ws/..app", true},
+		{"/w/ws-other/app", false},
+		{"/w", false},
+		{"/w/ws/../app", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := w.contains(filepath.Clean(filepath.FromSlash(tt.path))); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewWorkspaceOfSymlink(t *testing.T) {
+	// The artifact path given as the workspace is itself a link out of the
+	// runner's workspace: with base, the link doesn't take the workspace
+	// to its target.
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, outside, "secret")
+	symlink(t, outside, dir, "dist")
+	resolvedDir, err := resolvePath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvedOutside, err := resolvePath(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		base   bool
+		want   string
+		escape bool
+	}{
+		{false, resolvedOutside, false},
+		{true, filepath.Join(resolvedDir, "dist"), true},
+	} {
+		w, err := newWorkspace(filepath.Join(dir, "dist"), tt.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(w) != tt.want {
+			t.Errorf("newWorkspace(dist, %v) = %s, want %s", tt.base, w, tt.want)
+		}
+		err = w.check(filepath.Join(dir, "dist", "secret"), EscapeError, nil)
+		if (err != nil) != tt.escape {
+			t.Errorf("check() in newWorkspace(dist, %v) = %v, want an escape %v", tt.base, err, tt.escape)
+		}
+	}
+}
+
+func TestSubjectsRefuseEscapes(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeFiles(t, dir, "dist/app", "dist/lib/app.so")
+	writeFiles(t, outside, "secret")
+	tests := []struct {
+		name    string
+		link    string
+		target  string
+		paths   []string
+		wantErr bool
+	}{
+		{"inside", "", "", []string{"dist"}, false},
+		{"symlinked file", "dist/secret", filepath.Join(outside, "secret"), []string{"dist"}, true},
+		{"artifact path outside", "", "", []string{filepath.Join(outside, "secret")}, true},
+		{"dot-dot artifact path", "", "", []string{filepath.Join(dir, "dist", "..", "..", filepath.Base(outside), "secret")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.link != "" {
+				symlink(t, tt.target, dir, tt.link)
+				defer os.Remove(filepath.Join(dir, tt.link))
+			}
+			var paths []string
+			for _, p := range tt.paths {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(dir, p)
+				}
+				paths = append(paths, p)
+			}
+			roots, err := expandArtifactPaths(paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var findings Findings
+			_, err = subjects(roots, Options{Workspace: dir, OnEscape: EscapeError}, &findings)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("subjects() = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}